@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/jc-lab/docker-cache-server/pkg/bench"
+	"github.com/spf13/pflag"
+)
+
+// benchCommand returns the flags of the bench command and its function: it
+// runs a synthetic workload of blob pulls and pushes against a running
+// server and reports the throughput and latency percentiles of each kind of
+// operation
+func benchCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("bench", pflag.ExitOnError)
+	registry := flags.String("registry", "http://localhost:5000", "URL of the server")
+	username := flags.String("username", "", "Username to authenticate to the server")
+	password := flags.String("password", "", "Password to authenticate to the server")
+	repo := flags.String("repo", "bench/load", "Repository the blobs are pushed into and pulled from")
+	blobSizes := flags.StringSlice("blob-size", []string{"1MiB"}, "Sizes of the blobs, picked at random per blob, e.g. 64KiB,16MiB")
+	blobs := flags.Int("blobs", 32, "Number of blobs pushed before the run, pulled by the hits")
+	concurrency := flags.Int("concurrency", 8, "Number of operations in progress at once")
+	duration := flags.Duration("duration", 30*time.Second, "How long operations are started for")
+	hitRatio := flags.Float64("hit-ratio", 0.9, "Share of the pulls of a blob pushed, the others pull a blob never pushed")
+	pushRatio := flags.Float64("push-ratio", 0.1, "Share of the operations pushing a new blob")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	return flags, func(args []string) error {
+		name, err := reference.WithName(*repo)
+		if err != nil {
+			return fmt.Errorf("--repo: %w", err)
+		}
+		var sizes []int64
+		for _, s := range *blobSizes {
+			size, err := parseSize(s)
+			if err != nil {
+				return fmt.Errorf("--blob-size: %w", err)
+			}
+			sizes = append(sizes, size)
+		}
+		client, err := registryclient.New(*registry, nil)
+		if err != nil {
+			return err
+		}
+		client.Auth = &registryclient.Auth{Username: *username, Password: *password}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		fmt.Fprintf(os.Stderr, "pushing %d blobs, then running for %v\n", *blobs, *duration)
+		result, err := bench.Run(ctx, client, bench.Workload{
+			Repository:  name,
+			BlobSizes:   sizes,
+			Blobs:       *blobs,
+			Concurrency: *concurrency,
+			Duration:    *duration,
+			HitRatio:    *hitRatio,
+			PushRatio:   *pushRatio,
+		})
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(result)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "OPERATION\tCOUNT\tERRORS\tOPS/S\tTHROUGHPUT\tP50\tP90\tP99\tMAX")
+		for _, s := range result.Operations {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s/s\t%v\t%v\t%v\t%v\n",
+				s.Operation, s.Count, s.Errors, s.OpsPerSecond, formatSize(int64(s.BytesPerSecond)),
+				s.P50.Round(time.Microsecond), s.P90.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		for _, s := range result.Operations {
+			if s.FirstError != "" {
+				fmt.Fprintf(os.Stderr, "first %s error: %s\n", s.Operation, s.FirstError)
+			}
+		}
+		return nil
+	}
+}
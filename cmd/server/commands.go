@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// filenameAnnotation marks the flags taking a file name, completed with the
+// files of the shell
+const filenameAnnotation = "filename"
+
+// command is a subcommand of docker-cache-server
+type command struct {
+	name    string
+	summary string
+
+	// args are the values accepted as positional argument, for usage and
+	// completion, if any
+	args []string
+
+	// new returns the flags of the command and the function running it with
+	// the positional arguments once they are parsed
+	new func() (*pflag.FlagSet, func(args []string) error)
+}
+
+// commands returns the subcommands
+func commands() []command {
+	return []command{
+		{name: "prune", summary: "Delete old tags, manifests and blobs of matching repositories", new: pruneCommand},
+		{name: "seed", summary: "Pull a list of images through the cache", new: seedCommand},
+		{name: "tui", summary: "Browse, delete and pin cached repositories and blobs interactively", new: tuiCommand},
+		{name: "simulate", summary: "Replay blob reads against hypothetical TTL, size and eviction settings", new: simulateCommand},
+		{name: "meta", summary: "Export or import the blob metadata to migrate it between stores", args: metaActions, new: metaCommand},
+		{name: "bench", summary: "Measure the throughput and latency of a synthetic pull and push workload", new: benchCommand},
+		{name: "completion", summary: "Print a shell completion script", args: shells, new: completionCommand},
+		{name: "gen-docs", summary: "Generate man pages or markdown documentation", new: genDocsCommand},
+	}
+}
+
+// serverFlags returns the flags of the server itself, run without a
+// subcommand
+func serverFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("docker-cache-server", pflag.ExitOnError)
+	flags.String("config", "", "Path to config file")
+	flags.SetAnnotation("config", filenameAnnotation, nil)
+	flags.Bool("version", false, "Print version and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: docker-cache-server [flags]\n       docker-cache-server <command> [flags]\n\nCommands:\n")
+		for _, cmd := range commands() {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n%s", flags.FlagUsages())
+	}
+	return flags
+}
+
+// runCommand runs the subcommand named by args[0], if any, and reports
+// whether there was one
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for _, cmd := range commands() {
+		if cmd.name != args[0] {
+			continue
+		}
+		flags, run := cmd.new()
+		flags.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: docker-cache-server %s [flags]%s\n\n%s\n\nFlags:\n%s",
+				cmd.name, argsUsage(cmd.args), cmd.summary, flags.FlagUsages())
+		}
+		if err := flags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing flags: %v\n", err)
+			os.Exit(1)
+		}
+		if err := run(flags.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	return false
+}
+
+// argsUsage formats the values accepted as positional argument for usage
+func argsUsage(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return " " + strings.Join(args, "|")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// shells are the shells completion scripts are generated for
+var shells = []string{"bash", "zsh", "fish"}
+
+// completionCommand returns the flags of the completion command and its
+// function: it prints the completion script of a shell, generated from the
+// flags of the server and of the subcommands
+func completionCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("completion", pflag.ExitOnError)
+	return flags, func(args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one shell of %s", strings.Join(shells, ", "))
+		}
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		case "fish":
+			writeFishCompletion(os.Stdout)
+		default:
+			return fmt.Errorf("unsupported shell %q, expected one of %s", args[0], strings.Join(shells, ", "))
+		}
+		return nil
+	}
+}
+
+// completedFlag is a flag as completion scripts see it
+type completedFlag struct {
+	name     string
+	usage    string
+	hasValue bool
+	filename bool
+}
+
+// completedFlags returns the flags of flags in order
+func completedFlags(flags *pflag.FlagSet) []completedFlag {
+	var completed []completedFlag
+	flags.VisitAll(func(f *pflag.Flag) {
+		_, filename := f.Annotations[filenameAnnotation]
+		completed = append(completed, completedFlag{
+			name:     f.Name,
+			usage:    f.Usage,
+			hasValue: f.Value.Type() != "bool",
+			filename: filename,
+		})
+	})
+	return completed
+}
+
+// writeBashCompletion writes the bash completion script, enabled with
+// source <(docker-cache-server completion bash)
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion for docker-cache-server")
+	fmt.Fprintln(w, "_docker_cache_server() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(w, `	local cmd="" flags="" files="" args=""`)
+	fmt.Fprintln(w, `	[[ ${COMP_CWORD} -gt 1 ]] && cmd="${COMP_WORDS[1]}"`)
+	fmt.Fprintln(w, `	case "${cmd}" in`)
+	for _, cmd := range commands() {
+		flags, _ := cmd.new()
+		fmt.Fprintf(w, "\t%s)\n", cmd.name)
+		writeBashFlags(w, completedFlags(flags))
+		fmt.Fprintf(w, "\t\targs=%q\n", strings.Join(cmd.args, " "))
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	var names []string
+	for _, cmd := range commands() {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintln(w, "\t*)")
+	writeBashFlags(w, completedFlags(serverFlags()))
+	fmt.Fprintf(w, "\t\t[[ ${COMP_CWORD} -eq 1 ]] && args=%q\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, `	if [[ " ${files} " == *" ${prev} "* ]]; then`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -f -- "${cur}"))`)
+	fmt.Fprintln(w, `	elif [[ "${cur}" == -* ]]; then`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -W "${flags}" -- "${cur}"))`)
+	fmt.Fprintln(w, `	else`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -W "${args}" -- "${cur}"))`)
+	fmt.Fprintln(w, `	fi`)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _docker_cache_server docker-cache-server")
+}
+
+// writeBashFlags sets the flags and the flags taking a file name of a case
+// of the bash completion script
+func writeBashFlags(w io.Writer, flags []completedFlag) {
+	var names, files []string
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+		if f.filename {
+			files = append(files, "--"+f.name)
+		}
+	}
+	fmt.Fprintf(w, "\t\tflags=%q\n", strings.Join(names, " "))
+	fmt.Fprintf(w, "\t\tfiles=%q\n", strings.Join(files, " "))
+}
+
+// writeZshCompletion writes the zsh completion script, to be saved as
+// _docker-cache-server in a directory of $fpath
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef docker-cache-server")
+	fmt.Fprintln(w, "_docker_cache_server() {")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, cmd := range commands() {
+		flags, _ := cmd.new()
+		fmt.Fprintf(w, "\t%s)\n", cmd.name)
+		fmt.Fprintln(w, "\t\tshift words; (( CURRENT-- ))")
+		fmt.Fprint(w, "\t\t_arguments -s")
+		writeZshFlags(w, completedFlags(flags))
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(w, " '1:%s:(%s)'", cmd.name, strings.Join(cmd.args, " "))
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "\t\treturn")
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprint(w, "\t_arguments -s")
+	writeZshFlags(w, completedFlags(serverFlags()))
+	fmt.Fprint(w, " '1:command:((")
+	for i, cmd := range commands() {
+		if i > 0 {
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprintf(w, `%s\:"%s"`, cmd.name, zshQuote(cmd.summary))
+	}
+	fmt.Fprintln(w, "))'")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, `_docker_cache_server "$@"`)
+}
+
+// writeZshFlags writes the _arguments specs of flags
+func writeZshFlags(w io.Writer, flags []completedFlag) {
+	for _, f := range flags {
+		spec := "--" + f.name
+		if f.hasValue {
+			spec += "="
+		}
+		spec += "[" + zshQuote(f.usage) + "]"
+		switch {
+		case f.filename:
+			spec += ":file:_files"
+		case f.hasValue:
+			spec += ":" + f.name + ":"
+		}
+		fmt.Fprintf(w, " '%s'", spec)
+	}
+}
+
+// zshQuote escapes s for an _arguments spec within single quotes
+func zshQuote(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`, `"`, `\"`).Replace(s)
+}
+
+// writeFishCompletion writes the fish completion script, to be saved as
+// docker-cache-server.fish in ~/.config/fish/completions
+func writeFishCompletion(w io.Writer) {
+	const prog = "docker-cache-server"
+	fmt.Fprintf(w, "complete -c %s -f\n", prog)
+	for _, f := range completedFlags(serverFlags()) {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand%s\n", prog, fishFlag(f))
+	}
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", prog, cmd.name, fishQuote(cmd.summary))
+		condition := fishQuote("__fish_seen_subcommand_from " + cmd.name)
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", prog, condition, fishQuote(strings.Join(cmd.args, " ")))
+		}
+		flags, _ := cmd.new()
+		for _, f := range completedFlags(flags) {
+			fmt.Fprintf(w, "complete -c %s -n %s%s\n", prog, condition, fishFlag(f))
+		}
+	}
+}
+
+// fishFlag returns the options of the complete command for a flag
+func fishFlag(f completedFlag) string {
+	opts := " -l " + f.name + " -d " + fishQuote(f.usage)
+	switch {
+	case f.filename:
+		opts += " -r -F"
+	case f.hasValue:
+		opts += " -r"
+	}
+	return opts
+}
+
+// fishQuote quotes s for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
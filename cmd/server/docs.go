@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// genDocsCommand returns the flags of the gen-docs command and its function:
+// it writes man pages, or markdown, for the server and each subcommand,
+// generated from their flags
+func genDocsCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("gen-docs", pflag.ExitOnError)
+	dir := flags.String("dir", ".", "Directory to write the documentation to")
+	format := flags.String("format", "man", "Format of the documentation: man or markdown")
+	return flags, func(args []string) error {
+		if err := os.MkdirAll(*dir, 0o755); err != nil {
+			return err
+		}
+		var write func(name, summary, args string, flags *pflag.FlagSet) (string, []byte)
+		switch *format {
+		case "man":
+			write = manPage
+		case "markdown":
+			write = markdownPage
+		default:
+			return fmt.Errorf("unsupported format %q, expected man or markdown", *format)
+		}
+
+		pages := [][2]string{}
+		file, content := write("docker-cache-server", "Docker registry cache server", "", serverFlags())
+		pages = append(pages, [2]string{file, string(content)})
+		for _, cmd := range commands() {
+			flags, _ := cmd.new()
+			file, content := write("docker-cache-server-"+cmd.name, cmd.summary, argsUsage(cmd.args), flags)
+			pages = append(pages, [2]string{file, string(content)})
+		}
+		for _, page := range pages {
+			path := filepath.Join(*dir, page[0])
+			if err := os.WriteFile(path, []byte(page[1]), 0o644); err != nil {
+				return err
+			}
+			fmt.Println(path)
+		}
+		return nil
+	}
+}
+
+// commandLine returns the command line of the page name, e.g.
+// "docker-cache-server prune" for docker-cache-server-prune
+func commandLine(name string) string {
+	if cmd, ok := strings.CutPrefix(name, "docker-cache-server-"); ok {
+		return "docker-cache-server " + cmd
+	}
+	return name
+}
+
+// manPage returns the file name and the content of the man page of a
+// command
+func manPage(name, summary, args string, flags *pflag.FlagSet) (string, []byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, ".TH %s 1 %q docker-cache-server\n", strings.ToUpper(name), time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&b, ".SH NAME\n%s \\- %s\n", roffEscape(name), roffEscape(summary))
+	fmt.Fprintf(&b, ".SH SYNOPSIS\n.B %s\n[flags]%s\n", roffEscape(commandLine(name)), roffEscape(args))
+	fmt.Fprintf(&b, ".SH DESCRIPTION\n%s\n", roffEscape(summary))
+	fmt.Fprintf(&b, ".SH OPTIONS\n")
+	flags.VisitAll(func(f *pflag.Flag) {
+		fmt.Fprintf(&b, ".TP\n\\fB%s\\fR", roffEscape("--"+f.Name))
+		if f.Value.Type() != "bool" {
+			fmt.Fprintf(&b, " \\fI%s\\fR", roffEscape(f.Value.Type()))
+		}
+		fmt.Fprintf(&b, "\n%s\n", roffEscape(flagUsage(f)))
+	})
+	if name == "docker-cache-server" {
+		fmt.Fprintf(&b, ".SH SEE ALSO\n")
+		for i, cmd := range commands() {
+			if i > 0 {
+				fmt.Fprintf(&b, ",\n")
+			}
+			fmt.Fprintf(&b, ".BR %s (1)", roffEscape("docker-cache-server-"+cmd.name))
+		}
+		fmt.Fprintln(&b)
+	} else {
+		fmt.Fprintf(&b, ".SH SEE ALSO\n.BR docker\\-cache\\-server (1)\n")
+	}
+	return name + ".1", b.Bytes()
+}
+
+// roffEscape escapes s for roff text
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// markdownPage returns the file name and the content of the markdown page
+// of a command
+func markdownPage(name, summary, args string, flags *pflag.FlagSet) (string, []byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n%s\n\n", commandLine(name), summary)
+	fmt.Fprintf(&b, "```\n%s [flags]%s\n```\n\n", commandLine(name), args)
+	if flags.HasFlags() {
+		fmt.Fprintf(&b, "| Flag | Description |\n| --- | --- |\n")
+	}
+	flags.VisitAll(func(f *pflag.Flag) {
+		flag := "`--" + f.Name
+		if f.Value.Type() != "bool" {
+			flag += " " + f.Value.Type()
+		}
+		flag += "`"
+		fmt.Fprintf(&b, "| %s | %s |\n", flag, strings.ReplaceAll(flagUsage(f), "|", `\|`))
+	})
+	if name == "docker-cache-server" {
+		fmt.Fprintf(&b, "\n## Commands\n\n")
+		for _, cmd := range commands() {
+			fmt.Fprintf(&b, "- [docker-cache-server %s](docker-cache-server-%s.md): %s\n", cmd.name, cmd.name, cmd.summary)
+		}
+	}
+	return name + ".md", b.Bytes()
+}
+
+// flagUsage returns the usage of a flag with its default value, if any
+func flagUsage(f *pflag.Flag) string {
+	switch f.DefValue {
+	case "", "false", "0", "0s", "[]":
+		return f.Usage
+	}
+	return fmt.Sprintf("%s (default %s)", f.Usage, f.DefValue)
+}
@@ -5,31 +5,35 @@ import (
 	"os"
 
 	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/jc-lab/docker-cache-server/pkg/logging"
 	"github.com/jc-lab/docker-cache-server/pkg/server"
 
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/pflag"
 )
 
 func main() {
-	// Setup flags
-	flags := pflag.NewFlagSet("docker-cache-server", pflag.ExitOnError)
-	configFile := flags.String("config", "", "Path to config file")
-	version := flags.Bool("version", false, "Print version and exit")
+	// Subcommands
+	if runCommand(os.Args[1:]) {
+		return
+	}
 
+	// Setup flags
+	flags := serverFlags()
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing flags: %v\n", err)
 		os.Exit(1)
 	}
+	configFile, _ := flags.GetString("config")
+	version, _ := flags.GetBool("version")
 
 	// Print version
-	if *version {
+	if version {
 		fmt.Println("docker-cache-server v1.0.0")
 		os.Exit(0)
 	}
 
 	// Load configuration
-	cfg, err := config.Load(*configFile, flags)
+	cfg, err := config.Load(configFile, flags)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
 		os.Exit(1)
@@ -37,11 +41,16 @@ func main() {
 
 	// Setup logger
 	logger := logrus.New()
-	logger.SetOutput(os.Stdout)
 	logger.SetLevel(logrus.InfoLevel)
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
+	logOutput, err := logging.Setup(logger, cfg.Log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %v\n", err)
+		os.Exit(1)
+	}
+	defer logOutput.Close()
 
 	// Create and start server
 	srv, err := server.New(&server.Options{
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/jc-lab/docker-cache-server/pkg/server"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// metaActions are the actions of the meta command
+var metaActions = []string{"export", "import"}
+
+// metaCommand returns the flags of the meta command and its function: it
+// exports the blob metadata of the store configured to a JSON lines file, or
+// imports such a file into it, so that the access history survives a change
+// of cache.metadata.type
+func metaCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("meta", pflag.ExitOnError)
+	configFile := flags.String("config", "", "Path to the config file of the server owning the metadata")
+	flags.SetAnnotation("config", filenameAnnotation, nil)
+	file := flags.StringP("file", "f", "-", "File to export to or import from, - for stdout or stdin")
+	flags.SetAnnotation("file", filenameAnnotation, nil)
+	return flags, func(args []string) error {
+		if len(args) != 1 || !slices.Contains(metaActions, args[0]) {
+			return fmt.Errorf("expected one action of %s", strings.Join(metaActions, ", "))
+		}
+		cfg, err := config.Load(*configFile, nil)
+		if err != nil {
+			return fmt.Errorf("loading configuration: %w", err)
+		}
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		store, err := server.OpenMetaStore(cfg, logger)
+		if err != nil {
+			return err
+		}
+		if _, ok := store.(cache.MemoryMetaStore); ok {
+			return fmt.Errorf("the memory metadata store persists nothing")
+		}
+
+		ctx := context.Background()
+		if args[0] == "export" {
+			out := os.Stdout
+			if *file != "-" {
+				if out, err = os.Create(*file); err != nil {
+					return err
+				}
+			}
+			n, err := cache.ExportMeta(ctx, store, out)
+			if err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "exported %d entries\n", n)
+			return nil
+		}
+
+		in := os.Stdin
+		if *file != "-" {
+			if in, err = os.Open(*file); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		n, err := cache.ImportMeta(ctx, store, in)
+		fmt.Fprintf(os.Stderr, "imported %d entries\n", n)
+		return err
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// pruneJob is the part of an admin job the prune command reads
+type pruneJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Error  string `json:"error"`
+	Result *struct {
+		DryRun       bool `json:"dry_run"`
+		Repositories []struct {
+			Repository string   `json:"repository"`
+			Tags       []string `json:"tags"`
+			Manifests  []string `json:"manifests"`
+			Blobs      []string `json:"blobs"`
+			Orphans    []string `json:"orphans"`
+		} `json:"repositories"`
+		Evicted int `json:"evicted"`
+	} `json:"result"`
+}
+
+// pruneCommand returns the flags of the prune command and its function: it
+// starts a prune job on the admin endpoint of a running server and waits for
+// it to finish
+func pruneCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("prune", pflag.ExitOnError)
+	repo := flags.String("repo", "", "Glob matching the repositories to prune, e.g. 'ci-*'")
+	olderThan := flags.Duration("older-than", 0, "Prune tags, manifests and blobs not used for this long, e.g. 72h")
+	dryRun := flags.Bool("dry-run", false, "Only list what would be pruned")
+	admin := adminFlags(flags)
+	return flags, func(args []string) error {
+		if *repo == "" {
+			return fmt.Errorf("--repo is required")
+		}
+		if *olderThan <= 0 {
+			return fmt.Errorf("--older-than must be positive")
+		}
+
+		query := url.Values{
+			"repo":       {*repo},
+			"older_than": {olderThan.String()},
+			"dry_run":    {fmt.Sprint(*dryRun)},
+		}
+		var j pruneJob
+		if err := admin.request(http.MethodPost, "/admin/prune?"+query.Encode(), &j); err != nil {
+			return err
+		}
+		for j.Status == "running" {
+			time.Sleep(time.Second)
+			if err := admin.request(http.MethodGet, "/admin/jobs/"+j.ID, &j); err != nil {
+				return err
+			}
+			if j.Total > 0 {
+				fmt.Fprintf(os.Stderr, "\r%d/%d repositories", j.Done, j.Total)
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+
+		if j.Result != nil {
+			for _, r := range j.Result.Repositories {
+				fmt.Printf("%s: %d tags, %d manifests, %d blobs, %d exclusive\n",
+					r.Repository, len(r.Tags), len(r.Manifests), len(r.Blobs), len(r.Orphans))
+				if j.Result.DryRun {
+					for _, tag := range r.Tags {
+						fmt.Printf("  tag %s\n", tag)
+					}
+					for _, dgst := range r.Manifests {
+						fmt.Printf("  manifest %s\n", dgst)
+					}
+					for _, dgst := range r.Blobs {
+						fmt.Printf("  blob %s\n", dgst)
+					}
+				}
+			}
+			if !j.Result.DryRun {
+				fmt.Printf("evicted %d blobs\n", j.Result.Evicted)
+			}
+		}
+		if j.Status != "succeeded" {
+			return fmt.Errorf("prune job %s %s: %s", j.ID, j.Status, j.Error)
+		}
+		return nil
+	}
+}
+
+// adminTokenEnv is the environment variable the admin token is taken from
+// by default, the one setting http.debug.admin.token on the server
+const adminTokenEnv = "DCS_HTTP_DEBUG_ADMIN_TOKEN"
+
+// adminClient sends requests to the admin endpoint of a running server
+type adminClient struct {
+	base  string
+	token string
+}
+
+// adminFlags adds the flags locating the admin endpoint to flags and returns
+// the client using them once parsed
+func adminFlags(flags *pflag.FlagSet) *adminClient {
+	c := &adminClient{}
+	flags.StringVar(&c.base, "admin", "http://127.0.0.1:5001", "URL of the admin endpoint (http.debug.addr)")
+	flags.StringVar(&c.token, "admin-token", "", "Token of the admin endpoint (http.debug.admin.token), $"+adminTokenEnv+" by default")
+	return c
+}
+
+// url returns the URL of path on the admin endpoint
+func (c *adminClient) url(path string) string {
+	return strings.TrimSuffix(c.base, "/") + path
+}
+
+// request sends a request for path to the admin endpoint and decodes the
+// JSON response into v, unless v is nil
+func (c *adminClient) request(method, path string, v any) error {
+	u := c.url(path)
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	token := c.token
+	if token == "" {
+		token = os.Getenv(adminTokenEnv)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
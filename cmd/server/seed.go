@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/pflag"
+)
+
+// seeder pulls images through a cache so that they are cached
+type seeder struct {
+	client    *registryclient.Client
+	platforms []string
+
+	// seen holds the blobs already pulled, so that layers shared by images
+	// are pulled once
+	seen sync.Map
+}
+
+// seedCommand returns the flags of the seed command and its function: it
+// pulls every image listed in a file through a running cache, e.g. to
+// pre-provision a new site
+func seedCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("seed", pflag.ExitOnError)
+	file := flags.String("file", "", "File listing the images to pull, one reference per line")
+	flags.SetAnnotation("file", filenameAnnotation, nil)
+	registry := flags.String("registry", "http://localhost:5000", "URL of the cache")
+	username := flags.String("username", "", "Username to authenticate to the cache")
+	password := flags.String("password", "", "Password to authenticate to the cache")
+	concurrency := flags.Int("concurrency", 4, "Number of images pulled at once")
+	platforms := flags.StringSlice("platform", nil, "Platforms to pull from manifest lists (os/arch[/variant]), all if unset")
+	return flags, func(args []string) error {
+		if *file == "" {
+			return fmt.Errorf("--file is required")
+		}
+		if *concurrency < 1 {
+			return fmt.Errorf("--concurrency must be at least 1")
+		}
+
+		refs, err := readImageList(*file)
+		if err != nil {
+			return err
+		}
+		client, err := registryclient.New(*registry, nil)
+		if err != nil {
+			return err
+		}
+		client.Auth = &registryclient.Auth{Username: *username, Password: *password}
+		s := &seeder{client: client, platforms: *platforms}
+
+		ctx := context.Background()
+		queue := make(chan string)
+		var done, failed atomic.Int32
+		var wg sync.WaitGroup
+		for range *concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ref := range queue {
+					blobs, size, err := s.seed(ctx, ref)
+					n := done.Add(1)
+					if err != nil {
+						failed.Add(1)
+						fmt.Fprintf(os.Stderr, "[%d/%d] %s: %v\n", n, len(refs), ref, err)
+						continue
+					}
+					fmt.Printf("[%d/%d] %s: %d blobs, %d bytes pulled\n", n, len(refs), ref, blobs, size)
+				}
+			}()
+		}
+		for _, ref := range refs {
+			queue <- ref
+		}
+		close(queue)
+		wg.Wait()
+
+		if n := failed.Load(); n > 0 {
+			return fmt.Errorf("failed to pull %d of %d images", n, len(refs))
+		}
+		return nil
+	}
+}
+
+// readImageList reads the references listed in path, skipping blank lines
+// and # comments
+func readImageList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var refs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		refs = append(refs, line)
+	}
+	return refs, scanner.Err()
+}
+
+// seed pulls the image ref through the cache and returns the number and the
+// size of the blobs pulled. The registry of ref, if any, is dropped: the
+// cache pulls from its own upstream.
+func (s *seeder) seed(ctx context.Context, ref string) (int, int64, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Docker Hub official images keep their short name, which the cache
+	// maps to library/<name> itself
+	path := reference.Path(named)
+	if reference.Domain(named) == "docker.io" {
+		path = reference.FamiliarName(named)
+	}
+	name, err := reference.WithName(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tagOrDigest := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tagOrDigest = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		tagOrDigest = digested.Digest().String()
+	}
+	return s.pullManifest(ctx, name, tagOrDigest)
+}
+
+// pullManifest pulls a manifest with the blobs it references, or the
+// manifests of a manifest list or index
+func (s *seeder) pullManifest(ctx context.Context, name reference.Named, tagOrDigest string) (int, int64, error) {
+	_, payload, err := s.client.GetManifest(ctx, name, tagOrDigest)
+	if err != nil {
+		return 0, 0, err
+	}
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config"`
+		Layers    []v1.Descriptor `json:"layers"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return 0, 0, fmt.Errorf("parsing manifest %s: %w", tagOrDigest, err)
+	}
+
+	blobs, size := 0, int64(0)
+	for _, desc := range manifest.Manifests {
+		if !s.wantPlatform(desc.Platform) {
+			continue
+		}
+		n, m, err := s.pullManifest(ctx, name, desc.Digest.String())
+		if err != nil {
+			return blobs, size, err
+		}
+		blobs, size = blobs+n, size+m
+	}
+	layers := manifest.Layers
+	if manifest.Config != nil {
+		layers = append(layers, *manifest.Config)
+	}
+	for _, desc := range layers {
+		if _, seen := s.seen.LoadOrStore(desc.Digest, true); seen {
+			continue
+		}
+		n, err := s.pullBlob(ctx, name, desc.Digest)
+		if err != nil {
+			s.seen.Delete(desc.Digest)
+			return blobs, size, err
+		}
+		blobs, size = blobs+1, size+n
+	}
+	return blobs, size, nil
+}
+
+// pullBlob reads a blob to its end, so that the cache stores all of it, and
+// returns its size
+func (s *seeder) pullBlob(ctx context.Context, name reference.Named, dgst digest.Digest) (int64, error) {
+	blobURL, err := s.client.BlobURL(name, dgst)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("getting blob %s: unexpected status %s", dgst, resp.Status)
+	}
+	verifier := dgst.Verifier()
+	n, err := io.Copy(verifier, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("getting blob %s: %w", dgst, err)
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("getting blob %s: %w", dgst, registryclient.DigestMismatchError{Digest: dgst})
+	}
+	return n, nil
+}
+
+// wantPlatform reports whether the images of platform are pulled from
+// manifest lists
+func (s *seeder) wantPlatform(platform *v1.Platform) bool {
+	if len(s.platforms) == 0 || platform == nil {
+		return true
+	}
+	name := platform.OS + "/" + platform.Architecture
+	for _, want := range s.platforms {
+		if want == name || (platform.Variant != "" && want == name+"/"+platform.Variant) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// blobURIPattern matches the path of the blob requests of the registry API,
+// after the optional http.prefix
+var blobURIPattern = regexp.MustCompile(`/v2/.+/blobs/([a-z0-9]+:[a-f0-9]+)(?:\?|$)`)
+
+// simulateCommand returns the flags of the simulate command and its
+// function: it replays the blob reads of the server log, or those recorded
+// in the blob metadata, against hypothetical cache settings and reports the
+// resulting hit rate and disk usage of each combination
+func simulateCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("simulate", pflag.ExitOnError)
+	logFile := flags.String("log", "", "Server log to replay the blob reads of, '-' for stdin (text or JSON)")
+	flags.SetAnnotation("log", filenameAnnotation, nil)
+	metadata := flags.String("metadata", "", "Blob metadata directory to replay the daily reads of, e.g. <storage.directory>/meta/cache")
+	flags.SetAnnotation("metadata", filenameAnnotation, nil)
+	ttls := flags.DurationSlice("ttl", []time.Duration{7 * 24 * time.Hour}, "TTLs to simulate, 0 for none")
+	maxSizes := flags.StringSlice("max-size", []string{"0"}, "Maximum sizes to simulate, e.g. 500GiB, 0 for unlimited")
+	evictions := flags.StringSlice("eviction", []string{cache.EvictLRU}, "Eviction orders to simulate: lru (the server's), lfu or fifo")
+	cleanupInterval := flags.Duration("cleanup-interval", time.Hour, "Time between two evictions of the expired blobs (cache.cleanup_interval)")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	return flags, func(args []string) error {
+		if (*logFile == "") == (*metadata == "") {
+			return fmt.Errorf("either --log or --metadata is required")
+		}
+		var sizes []int64
+		for _, s := range *maxSizes {
+			size, err := parseSize(s)
+			if err != nil {
+				return fmt.Errorf("--max-size: %w", err)
+			}
+			sizes = append(sizes, size)
+		}
+
+		var accesses []cache.SimulatedAccess
+		var err error
+		if *logFile != "" {
+			accesses, err = readLogAccesses(*logFile)
+		} else {
+			accesses, err = readMetadataAccesses(*metadata)
+		}
+		if err != nil {
+			return err
+		}
+		if len(accesses) == 0 {
+			return fmt.Errorf("no blob reads found")
+		}
+		fmt.Fprintf(os.Stderr, "replaying %d blob reads from %s to %s\n", len(accesses),
+			accesses[0].Time.Format(time.RFC3339), accesses[len(accesses)-1].Time.Format(time.RFC3339))
+
+		var results []cache.SimulationResult
+		for _, eviction := range *evictions {
+			for _, ttl := range *ttls {
+				for _, size := range sizes {
+					result, err := cache.Simulate(accesses, cache.SimulationPolicy{
+						TTL:             ttl,
+						MaxSize:         size,
+						Eviction:        eviction,
+						CleanupInterval: *cleanupInterval,
+					})
+					if err != nil {
+						return err
+					}
+					results = append(results, result)
+				}
+			}
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(results)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "EVICTION\tTTL\tMAX SIZE\tHIT RATE\tBYTE HIT RATE\tUPSTREAM\tPEAK SIZE\tAVERAGE SIZE\tEVICTIONS")
+		for _, r := range results {
+			ttl, maxSize := "none", "unlimited"
+			if r.Policy.TTL > 0 {
+				ttl = r.Policy.TTL.String()
+			}
+			if r.Policy.MaxSize > 0 {
+				maxSize = formatSize(r.Policy.MaxSize)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%.1f%%\t%s\t%s\t%s\t%d\n",
+				r.Policy.Eviction, ttl, maxSize, 100*r.HitRate, 100*r.ByteHitRate,
+				formatSize(r.UpstreamBytes), formatSize(r.PeakSize), formatSize(r.AverageSize), r.Evictions)
+		}
+		return w.Flush()
+	}
+}
+
+// readLogAccesses returns the blob reads of a server log, the successful
+// GET requests of blobs, sorted by time. A blob is given the largest size
+// written for it, redirects to the storage writing none.
+func readLogAccesses(path string) ([]cache.SimulatedAccess, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var accesses []cache.SimulatedAccess
+	sizes := make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := parseLogLine(scanner.Text())
+		if fields["msg"] != "response completed" || fields["http.request.method"] != "GET" {
+			continue
+		}
+		if status := fields["http.response.status"]; status != "200" && status != "307" {
+			continue
+		}
+		match := blobURIPattern.FindStringSubmatch(fields["http.request.uri"])
+		if match == nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields["time"])
+		if err != nil {
+			continue
+		}
+		written, _ := strconv.ParseInt(fields["http.response.written"], 10, 64)
+		sizes[match[1]] = max(sizes[match[1]], written)
+		accesses = append(accesses, cache.SimulatedAccess{Time: t, Digest: match[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading log: %w", err)
+	}
+	for i := range accesses {
+		accesses[i].Size = sizes[accesses[i].Digest]
+	}
+	slices.SortStableFunc(accesses, func(a, b cache.SimulatedAccess) int { return a.Time.Compare(b.Time) })
+	return accesses, nil
+}
+
+// parseLogLine returns the fields of a log line of the text formatter of
+// logrus, key=value with quoted values, or of its JSON formatter
+func parseLogLine(line string) map[string]string {
+	fields := make(map[string]string)
+	if strings.HasPrefix(line, "{") {
+		var values map[string]any
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return fields
+		}
+		for key, value := range values {
+			if s, ok := value.(string); ok {
+				fields[key] = s
+			} else {
+				fields[key] = fmt.Sprint(value)
+			}
+		}
+		return fields
+	}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok || strings.Contains(key, " ") {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				break
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		fields[key] = value
+		line = rest
+	}
+	return fields
+}
+
+// readMetadataAccesses returns the reads recorded per day in the blob
+// metadata, spread evenly over each day, and the write of the blobs written
+// in the days recorded, sorted by time
+func readMetadataAccesses(dir string) ([]cache.SimulatedAccess, error) {
+	// the store creates a missing directory
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store, err := cache.NewFileMetaStore(dir, logger)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := store.Load(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("loading metadata: %w", err)
+	}
+
+	const day = 24 * time.Hour
+	var accesses []cache.SimulatedAccess
+	for _, meta := range metas {
+		if _, err := digest.Parse(meta.Digest); err != nil {
+			continue
+		}
+		first := time.Unix((meta.ReadDay-int64(len(meta.ReadDays))+1)*int64(day/time.Second), 0).UTC()
+		if len(meta.ReadDays) > 0 && !meta.CreatedAt.Before(first) {
+			accesses = append(accesses, cache.SimulatedAccess{Time: meta.CreatedAt, Digest: meta.Digest, Size: meta.Size})
+		}
+		for i, reads := range meta.ReadDays {
+			start := time.Unix((meta.ReadDay-int64(i))*int64(day/time.Second), 0).UTC()
+			for n := range reads {
+				t := start.Add(time.Duration(2*n+1) * day / time.Duration(2*reads))
+				accesses = append(accesses, cache.SimulatedAccess{Time: t, Digest: meta.Digest, Size: meta.Size})
+			}
+		}
+	}
+	slices.SortStableFunc(accesses, func(a, b cache.SimulatedAccess) int { return a.Time.Compare(b.Time) })
+	return accesses, nil
+}
+
+// sizeUnits are the suffixes of sizes, longest first
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseSize parses a number of bytes with an optional unit, e.g. "500GiB"
+func parseSize(s string) (int64, error) {
+	for _, unit := range sizeUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return int64(n * float64(unit.bytes)), nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+// formatSize formats a number of bytes with a binary unit
+func formatSize(n int64) string {
+	binary := sizeUnits[:4]
+	for i := len(binary) - 1; i >= 0; i-- {
+		if unit := binary[i]; n >= unit.bytes {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(unit.bytes), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/spf13/pflag"
+)
+
+// tuiSorts are the orders the entries are sorted by, in turn: largest,
+// least recently used or name first
+var tuiSorts = []string{"size", "age", "name"}
+
+// tuiChrome is the number of screen lines not listing entries: the title,
+// the column titles, the status and the keys
+const tuiChrome = 4
+
+// tuiEntry is a line of the tui command: a repository, or a tag or blob of
+// the repository browsed
+type tuiEntry struct {
+	kind   string
+	name   string
+	digest string
+	size   int64
+	time   time.Time
+	pinned bool
+
+	// blobs and pins count the blobs of a repository and those pinned
+	blobs, pins int
+}
+
+// tuiBlob is the part of the LRU metadata of a blob the tui command reads
+type tuiBlob struct {
+	Digest       string    `json:"digest"`
+	Size         int64     `json:"size"`
+	LastAccessed time.Time `json:"last_accessed"`
+	Pinned       bool      `json:"pinned"`
+}
+
+// tuiLoaded carries the entries of the view of repository repo, none for
+// the list of repositories, or the error listing them
+type tuiLoaded struct {
+	repo    string
+	entries []tuiEntry
+	err     error
+}
+
+// tuiDone reports the end of an action changing the entries, which are
+// listed again
+type tuiDone struct {
+	status string
+	err    error
+}
+
+// tuiModel is the state of the tui command
+type tuiModel struct {
+	admin *adminClient
+
+	// repo is the repository browsed, none for the list of repositories
+	repo    string
+	entries []tuiEntry
+	sort    int
+	cursor  int
+	top     int
+
+	// repoCursor is the cursor in the list of repositories, restored when
+	// going back to it
+	repoCursor int
+
+	width, height int
+
+	status string
+	// confirm is the action waiting for the user to confirm it, if any
+	confirm tea.Cmd
+}
+
+// tuiCommand returns the flags of the tui command and its function: it
+// browses the repositories, tags and blobs of a running server through its
+// admin endpoint in the terminal, and deletes or pins them
+func tuiCommand() (*pflag.FlagSet, func(args []string) error) {
+	flags := pflag.NewFlagSet("tui", pflag.ExitOnError)
+	admin := adminFlags(flags)
+	return flags, func(args []string) error {
+		m := newTuiModel(admin)
+		// an unreachable server is reported before taking over the terminal
+		loaded := m.load("")().(tuiLoaded)
+		if loaded.err != nil {
+			return loaded.err
+		}
+		m.Update(loaded)
+		_, err := tea.NewProgram(m, tea.WithAltScreen()).Run()
+		return err
+	}
+}
+
+func newTuiModel(admin *adminClient) *tuiModel {
+	return &tuiModel{admin: admin, width: 80, height: 24}
+}
+
+// Init implements tea.Model, the entries are loaded already
+func (m *tuiModel) Init() tea.Cmd {
+	return nil
+}
+
+// load lists the entries of the view of repository repo from the admin
+// endpoint, or the repositories if repo is empty
+func (m *tuiModel) load(repo string) tea.Cmd {
+	admin := m.admin
+	return func() tea.Msg {
+		var entries []tuiEntry
+		if repo == "" {
+			var repos []struct {
+				Name         string    `json:"name"`
+				Blobs        int       `json:"blobs"`
+				Pinned       int       `json:"pinned"`
+				Size         int64     `json:"size"`
+				LastAccessed time.Time `json:"last_accessed"`
+			}
+			if err := admin.request(http.MethodGet, "/admin/repositories", &repos); err != nil {
+				return tuiLoaded{repo: repo, err: err}
+			}
+			for _, r := range repos {
+				entries = append(entries, tuiEntry{kind: "repository", name: r.Name, size: r.Size, time: r.LastAccessed, blobs: r.Blobs, pins: r.Pinned})
+			}
+			return tuiLoaded{repo: repo, entries: entries}
+		}
+
+		query := "?" + url.Values{"repo": {repo}}.Encode()
+		var blobs []tuiBlob
+		if err := admin.request(http.MethodGet, "/admin/blobs"+query, &blobs); err != nil {
+			return tuiLoaded{repo: repo, err: err}
+		}
+		var tags []struct {
+			Name     string    `json:"name"`
+			Digest   string    `json:"digest"`
+			LastUsed time.Time `json:"last_used"`
+		}
+		if err := admin.request(http.MethodGet, "/admin/tags"+query, &tags); err != nil {
+			return tuiLoaded{repo: repo, err: err}
+		}
+		// a tag takes up the size of its manifest
+		sizes := make(map[string]int64, len(blobs))
+		for _, meta := range blobs {
+			sizes[meta.Digest] = meta.Size
+			entries = append(entries, tuiEntry{kind: "blob", name: meta.Digest, digest: meta.Digest, size: meta.Size, time: meta.LastAccessed, pinned: meta.Pinned})
+		}
+		for _, tag := range tags {
+			entries = append(entries, tuiEntry{kind: "tag", name: tag.Name, digest: tag.Digest, size: sizes[tag.Digest], time: tag.LastUsed})
+		}
+		return tuiLoaded{repo: repo, entries: entries}
+	}
+}
+
+// sortEntries sorts the entries in the current order, tags before blobs
+func (m *tuiModel) sortEntries() {
+	slices.SortStableFunc(m.entries, func(x, y tuiEntry) int {
+		if x.kind != y.kind {
+			// tags first, the reverse of the order of the kinds
+			return -strings.Compare(x.kind, y.kind)
+		}
+		switch tuiSorts[m.sort] {
+		case "size":
+			return cmp.Compare(y.size, x.size)
+		case "age":
+			return x.time.Compare(y.time)
+		default:
+			return strings.Compare(x.name, y.name)
+		}
+	})
+}
+
+// selected returns the entry under the cursor, if any
+func (m *tuiModel) selected() (tuiEntry, bool) {
+	if m.cursor >= len(m.entries) {
+		return tuiEntry{}, false
+	}
+	return m.entries[m.cursor], true
+}
+
+// Update implements tea.Model
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tuiLoaded:
+		if msg.repo != m.repo {
+			// the user moved on meanwhile
+			break
+		}
+		if msg.err != nil {
+			m.status = msg.err.Error()
+			break
+		}
+		m.entries = msg.entries
+		m.sortEntries()
+	case tuiDone:
+		m.status = msg.status
+		if msg.err != nil {
+			m.status = msg.err.Error()
+		}
+		return m, m.load(m.repo)
+	case tea.KeyMsg:
+		return m, m.handle(msg.String())
+	}
+	m.cursor = max(min(m.cursor, len(m.entries)-1), 0)
+	return m, nil
+}
+
+// handle handles a key pressed and returns the command it starts, if any
+func (m *tuiModel) handle(key string) tea.Cmd {
+	if m.confirm != nil {
+		confirm := m.confirm
+		m.confirm, m.status = nil, ""
+		if key == "y" || key == "Y" {
+			return confirm
+		}
+		return nil
+	}
+	m.status = ""
+
+	var cmd tea.Cmd
+	page := max(m.height-tuiChrome, 1)
+	switch key {
+	case "q", "ctrl+c":
+		return tea.Quit
+	case "k", "up":
+		m.cursor--
+	case "j", "down":
+		m.cursor++
+	case "pgup":
+		m.cursor -= page
+	case "pgdown", " ":
+		m.cursor += page
+	case "g", "home":
+		m.cursor = 0
+	case "G", "end":
+		m.cursor = len(m.entries)
+	case "enter", "l", "right":
+		if e, ok := m.selected(); ok && e.kind == "repository" {
+			m.repoCursor = m.cursor
+			m.repo, m.entries, m.cursor, m.top = e.name, nil, 0, 0
+			cmd = m.load(m.repo)
+		}
+	case "backspace", "h", "left":
+		if m.repo != "" {
+			m.repo, m.entries, m.cursor, m.top = "", nil, m.repoCursor, 0
+			cmd = m.load(m.repo)
+		}
+	case "s":
+		m.sort = (m.sort + 1) % len(tuiSorts)
+		m.sortEntries()
+	case "r":
+		cmd = m.load(m.repo)
+	case "d":
+		m.askDelete()
+	case "p":
+		cmd = m.togglePin()
+	}
+	if m.entries != nil || cmd == nil {
+		m.cursor = max(min(m.cursor, len(m.entries)-1), 0)
+	}
+	return cmd
+}
+
+// askDelete asks to confirm deleting the entry under the cursor
+func (m *tuiModel) askDelete() {
+	e, ok := m.selected()
+	if !ok {
+		return
+	}
+	admin := m.admin
+	switch e.kind {
+	case "repository":
+		m.status = fmt.Sprintf("Delete repository %s and its blobs used nowhere else? [y/N]", e.name)
+		m.confirm = func() tea.Msg {
+			var j struct {
+				ID string `json:"id"`
+			}
+			if err := admin.request(http.MethodDelete, "/admin/repositories/"+e.name, &j); err != nil {
+				return tuiDone{err: err}
+			}
+			return tuiDone{status: fmt.Sprintf("Deleting the blobs of %s in job %s", e.name, j.ID)}
+		}
+	case "blob":
+		if e.pinned {
+			m.status = "Unpin the blob to delete it"
+			return
+		}
+		m.status = fmt.Sprintf("Delete blob %s? [y/N]", e.digest)
+		m.confirm = func() tea.Msg {
+			return tuiDone{err: admin.request(http.MethodDelete, "/admin/blobs/"+e.digest, nil)}
+		}
+	default:
+		m.status = "Tags are deleted along with their repository, or pruned"
+	}
+}
+
+// togglePin returns the command pinning the blob under the cursor, or all
+// the blobs of the repository under it, or unpinning them if they are pinned
+// already
+func (m *tuiModel) togglePin() tea.Cmd {
+	e, ok := m.selected()
+	if !ok {
+		return nil
+	}
+	if e.kind == "tag" {
+		m.status = "Pin the blobs of the tag, or its repository"
+		return nil
+	}
+	admin := m.admin
+	return func() tea.Msg {
+		dgsts := []string{e.digest}
+		pin := !e.pinned
+		if e.kind == "repository" {
+			var blobs []tuiBlob
+			if err := admin.request(http.MethodGet, "/admin/blobs?"+url.Values{"repo": {e.name}}.Encode(), &blobs); err != nil {
+				return tuiDone{err: err}
+			}
+			dgsts = dgsts[:0]
+			for _, meta := range blobs {
+				dgsts = append(dgsts, meta.Digest)
+			}
+			pin = e.pins < e.blobs
+		}
+
+		method := http.MethodPut
+		if !pin {
+			method = http.MethodDelete
+		}
+		for _, dgst := range dgsts {
+			if err := admin.request(method, "/admin/blobs/"+dgst+"/pin", nil); err != nil {
+				return tuiDone{err: err}
+			}
+		}
+		return tuiDone{}
+	}
+}
+
+// View implements tea.Model
+func (m *tuiModel) View() string {
+	var screen strings.Builder
+	fit := func(s string) string {
+		if runes := []rune(s); len(runes) > m.width {
+			return string(runes[:m.width])
+		}
+		return s
+	}
+	line := func(s string) {
+		screen.WriteString(fit(s) + "\n")
+	}
+
+	view := "repositories"
+	if m.repo != "" {
+		view = m.repo
+	}
+	line(fmt.Sprintf("%s - %s: %d entries by %s", m.admin.url(""), view, len(m.entries), tuiSorts[m.sort]))
+	nameWidth := max(m.width-40, 20)
+	if m.repo == "" {
+		line(fmt.Sprintf("%-*s %6s %10s %10s %s", nameWidth, "REPOSITORY", "BLOBS", "SIZE", "ACCESSED", "PINNED"))
+	} else {
+		line(fmt.Sprintf("%-4s %-*s %10s %10s %s", "", nameWidth-5, "NAME", "SIZE", "USED", "PINNED"))
+	}
+
+	rows := max(m.height-tuiChrome, 1)
+	if m.cursor < m.top {
+		m.top = m.cursor
+	} else if m.cursor >= m.top+rows {
+		m.top = m.cursor - rows + 1
+	}
+	now := time.Now()
+	shown := 0
+	for i := m.top; i < min(len(m.entries), m.top+rows); i++ {
+		e := m.entries[i]
+		var s string
+		if e.kind == "repository" {
+			pins := ""
+			if e.pins > 0 {
+				pins = fmt.Sprint(e.pins)
+			}
+			s = fmt.Sprintf("%-*s %6d %10s %10s %s", nameWidth, e.name, e.blobs, formatSize(e.size), formatAge(now, e.time), pins)
+		} else {
+			pin := ""
+			if e.pinned {
+				pin = "yes"
+			}
+			s = fmt.Sprintf("%-4s %-*s %10s %10s %s", e.kind, nameWidth-5, e.name, formatSize(e.size), formatAge(now, e.time), pin)
+		}
+		if i == m.cursor {
+			// reverse video over the whole width
+			s = fmt.Sprintf("\x1b[7m%-*s\x1b[0m", m.width, fit(s))
+		}
+		line(s)
+		shown++
+	}
+
+	// the status and the keys at the bottom
+	screen.WriteString(strings.Repeat("\n", rows-shown))
+	line(m.status)
+	screen.WriteString(fit("j/k move  enter open  h back  s sort  p pin  d delete  r refresh  q quit"))
+	return screen.String()
+}
+
+// formatAge formats the time elapsed since t
+func formatAge(now, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	switch d := now.Sub(t); {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// fakeAdmin is an admin endpoint serving a repository with two blobs, one
+// pinned, and a tag. It records the requests it receives.
+type fakeAdmin struct {
+	mu       sync.Mutex
+	requests []string
+	pinned   map[string]bool
+	// token is required as Bearer token if set
+	token string
+}
+
+func newFakeAdmin(t *testing.T) (*fakeAdmin, *httptest.Server) {
+	f := &fakeAdmin{pinned: map[string]bool{"sha256:a": true, "sha256:b": false}}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeAdmin) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+
+	reply := func(v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodGet && path == "/admin/repositories":
+		pins := 0
+		for _, pinned := range f.pinned {
+			if pinned {
+				pins++
+			}
+		}
+		reply([]map[string]any{{"name": "library/alpine", "blobs": len(f.pinned), "pinned": pins, "size": 300}})
+	case r.Method == http.MethodGet && path == "/admin/blobs":
+		var blobs []map[string]any
+		for _, dgst := range []string{"sha256:a", "sha256:b"} {
+			if pinned, ok := f.pinned[dgst]; ok {
+				blobs = append(blobs, map[string]any{"digest": dgst, "size": 100 + 100*len(blobs), "pinned": pinned})
+			}
+		}
+		reply(blobs)
+	case r.Method == http.MethodGet && path == "/admin/tags":
+		reply([]map[string]any{{"name": "latest", "digest": "sha256:a"}})
+	case r.Method == http.MethodDelete && path == "/admin/repositories/library/alpine":
+		f.pinned = map[string]bool{}
+		w.WriteHeader(http.StatusAccepted)
+		reply(map[string]any{"id": "job-1"})
+	case strings.HasSuffix(path, "/pin"):
+		dgst := strings.TrimSuffix(strings.TrimPrefix(path, "/admin/blobs/"), "/pin")
+		f.pinned[dgst] = r.Method == http.MethodPut
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/admin/blobs/"):
+		delete(f.pinned, strings.TrimPrefix(path, "/admin/blobs/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// take returns the requests received since the last call
+func (f *fakeAdmin) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+// press sends keys to the model, running the commands they start until none
+// is left as the program would
+func press(t *testing.T, m *tuiModel, keys ...tea.KeyMsg) {
+	t.Helper()
+	for _, key := range keys {
+		_, cmd := m.Update(key)
+		for cmd != nil {
+			_, cmd = m.Update(cmd())
+		}
+	}
+}
+
+func runes(s string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)}
+}
+
+func expectRequests(t *testing.T, f *fakeAdmin, expected ...string) {
+	t.Helper()
+	if requests := f.take(); !slices.Equal(requests, expected) {
+		t.Fatalf("unexpected requests: %q != %q", requests, expected)
+	}
+}
+
+func TestTuiBrowse(t *testing.T) {
+	f, server := newFakeAdmin(t)
+	m := newTuiModel(&adminClient{base: server.URL + "/"})
+	press(t, m, runes("r"))
+	expectRequests(t, f, "GET /admin/repositories")
+	if len(m.entries) != 1 || m.entries[0].name != "library/alpine" || m.entries[0].pins != 1 {
+		t.Fatalf("unexpected repositories: %+v", m.entries)
+	}
+
+	press(t, m, tea.KeyMsg{Type: tea.KeyEnter})
+	expectRequests(t, f, "GET /admin/blobs?repo=library%2Falpine", "GET /admin/tags?repo=library%2Falpine")
+	// the tag first, then the blobs largest first
+	var names []string
+	for _, e := range m.entries {
+		names = append(names, e.kind+" "+e.name)
+	}
+	if expected := []string{"tag latest", "blob sha256:b", "blob sha256:a"}; !slices.Equal(names, expected) {
+		t.Fatalf("unexpected entries: %q != %q", names, expected)
+	}
+	if m.entries[0].size != 100 {
+		t.Fatalf("expected the tag to take up the size of its manifest: %d", m.entries[0].size)
+	}
+	if view := m.View(); !strings.Contains(view, "library/alpine: 3 entries by size") {
+		t.Fatalf("unexpected view:\n%s", view)
+	}
+
+	press(t, m, runes("s"), runes("s"))
+	if m.entries[1].name != "sha256:a" {
+		t.Fatalf("expected the blobs sorted by name: %+v", m.entries)
+	}
+	press(t, m, tea.KeyMsg{Type: tea.KeyBackspace})
+	expectRequests(t, f, "GET /admin/repositories")
+	if m.repo != "" || len(m.entries) != 1 {
+		t.Fatalf("expected the repositories back: %q %+v", m.repo, m.entries)
+	}
+}
+
+func TestTuiPin(t *testing.T) {
+	f, server := newFakeAdmin(t)
+	m := newTuiModel(&adminClient{base: server.URL})
+	press(t, m, runes("r"), runes("l"), runes("j"))
+	f.take()
+
+	// sha256:b, not pinned yet
+	press(t, m, runes("p"))
+	expectRequests(t, f, "PUT /admin/blobs/sha256:b/pin", "GET /admin/blobs?repo=library%2Falpine", "GET /admin/tags?repo=library%2Falpine")
+	if e, _ := m.selected(); e.name != "sha256:b" || !e.pinned {
+		t.Fatalf("expected the blob pinned: %+v", e)
+	}
+	// pinned blobs are not deleted
+	press(t, m, runes("d"))
+	if m.confirm != nil || !strings.HasPrefix(m.status, "Unpin") {
+		t.Fatalf("unexpected status: %q", m.status)
+	}
+
+	// the repository is all pinned, pinning it unpins its blobs
+	press(t, m, runes("h"), runes("p"))
+	expectRequests(t, f,
+		"GET /admin/repositories",
+		"GET /admin/blobs?repo=library%2Falpine",
+		"DELETE /admin/blobs/sha256:a/pin",
+		"DELETE /admin/blobs/sha256:b/pin",
+		"GET /admin/repositories",
+	)
+	if m.entries[0].pins != 0 {
+		t.Fatalf("expected the blobs unpinned: %+v", m.entries[0])
+	}
+}
+
+func TestTuiDelete(t *testing.T) {
+	f, server := newFakeAdmin(t)
+	m := newTuiModel(&adminClient{base: server.URL})
+	press(t, m, runes("r"), runes("l"), runes("j"))
+	f.take()
+
+	// declined
+	press(t, m, runes("d"), runes("n"))
+	expectRequests(t, f)
+
+	press(t, m, runes("d"), runes("y"))
+	expectRequests(t, f, "DELETE /admin/blobs/sha256:b", "GET /admin/blobs?repo=library%2Falpine", "GET /admin/tags?repo=library%2Falpine")
+	if len(m.entries) != 2 {
+		t.Fatalf("expected the blob deleted: %+v", m.entries)
+	}
+
+	press(t, m, runes("h"), runes("d"), runes("y"))
+	expectRequests(t, f, "GET /admin/repositories", "DELETE /admin/repositories/library/alpine", "GET /admin/repositories")
+	if m.status != "Deleting the blobs of library/alpine in job job-1" {
+		t.Fatalf("unexpected status: %q", m.status)
+	}
+}
+
+func TestTuiAdminToken(t *testing.T) {
+	f, server := newFakeAdmin(t)
+	f.token = "secret"
+	m := newTuiModel(&adminClient{base: server.URL})
+	press(t, m, runes("r"))
+	if !strings.Contains(m.status, "401") || len(m.entries) != 0 {
+		t.Fatalf("expected the request rejected without token: %q %+v", m.status, m.entries)
+	}
+
+	m = newTuiModel(&adminClient{base: server.URL, token: "secret"})
+	press(t, m, runes("r"))
+	if len(m.entries) != 1 {
+		t.Fatalf("expected the repositories with the token: %q", m.status)
+	}
+
+	t.Setenv(adminTokenEnv, "secret")
+	m = newTuiModel(&adminClient{base: server.URL})
+	press(t, m, runes("r"))
+	if len(m.entries) != 1 {
+		t.Fatalf("expected the repositories with the token of %s: %q", adminTokenEnv, m.status)
+	}
+}
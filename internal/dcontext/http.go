@@ -89,6 +89,7 @@ func WithVars(ctx context.Context, r *http.Request) context.Context {
 // GetRequestLogger returns a logger that contains fields from the request in
 // the current context. If the request is not available in the context, no
 // fields will display. Request loggers can safely be pushed onto the context.
+// The span of the request is included if it was traced by the client.
 func GetRequestLogger(ctx context.Context) Logger {
 	return GetLogger(ctx,
 		"http.request.id",
@@ -98,7 +99,10 @@ func GetRequestLogger(ctx context.Context) Logger {
 		"http.request.referer",
 		"http.request.useragent",
 		"http.request.remoteaddr",
-		"http.request.contenttype")
+		"http.request.contenttype",
+		"trace.trace_id",
+		"trace.span_id",
+		"trace.parent_span_id")
 }
 
 // GetResponseLogger reads the current response stats and builds a logger.
@@ -0,0 +1,115 @@
+package dcontext
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TraceContext identifies a span of a distributed trace, as carried by the
+// traceparent and tracestate headers of the W3C Trace Context.
+type TraceContext struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+	Flags   string // 2 lowercase hex digits, "01" if sampled
+	State   string // vendor specific tracestate, passed on unchanged
+}
+
+// ParseTraceContext returns the trace context of the traceparent and
+// tracestate headers. It returns false if traceparent is missing or invalid,
+// in which case tracestate is ignored as well.
+func ParseTraceContext(header http.Header) (TraceContext, bool) {
+	parent := strings.TrimSpace(header.Get("traceparent"))
+	// later versions may append fields after the ones of version 00
+	if len(parent) < 55 || (len(parent) > 55 && parent[55] != '-') {
+		return TraceContext{}, false
+	}
+	version, traceID, spanID, flags := parent[0:2], parent[3:35], parent[36:52], parent[53:55]
+	if parent[2] != '-' || parent[35] != '-' || parent[52] != '-' ||
+		!isHex(version) || version == "ff" || (version == "00" && len(parent) != 55) ||
+		!isHex(traceID) || isZero(traceID) || !isHex(spanID) || isZero(spanID) || !isHex(flags) {
+		return TraceContext{}, false
+	}
+	return TraceContext{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Flags:   flags,
+		State:   strings.Join(header.Values("tracestate"), ","),
+	}, true
+}
+
+// isHex reports whether s only has lowercase hex digits
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isZero reports whether s only has zeros, which is an invalid id
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// Child returns the trace context of a new span of the same trace
+func (tc TraceContext) Child() TraceContext {
+	var id [8]byte
+	rand.Read(id[:])
+	tc.SpanID = hex.EncodeToString(id[:])
+	return tc
+}
+
+// SetHeaders sets the traceparent and tracestate headers of the span
+func (tc TraceContext) SetHeaders(header http.Header) {
+	header.Set("traceparent", "00-"+tc.TraceID+"-"+tc.SpanID+"-"+tc.Flags)
+	if tc.State != "" {
+		header.Set("tracestate", tc.State)
+	} else {
+		header.Del("tracestate")
+	}
+}
+
+// WithTraceContext starts a span of the trace of the caller on the context,
+// as a child of the span of the caller. The trace id, the span id and the
+// span id of the caller are available at "trace.trace_id", "trace.span_id"
+// and "trace.parent_span_id", unlike "trace.id" which identifies the timing
+// spans of WithTrace.
+func WithTraceContext(ctx context.Context, caller TraceContext) context.Context {
+	return &spanContext{
+		Context: ctx,
+		span:    caller.Child(),
+		parent:  caller.SpanID,
+	}
+}
+
+// GetTraceContext returns the span started on the context by
+// WithTraceContext, false if none.
+func GetTraceContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value("trace.context").(TraceContext)
+	return tc, ok
+}
+
+// spanContext carries a span of a distributed trace
+type spanContext struct {
+	context.Context
+	span   TraceContext
+	parent string
+}
+
+func (ctx *spanContext) Value(key interface{}) interface{} {
+	switch key {
+	case "trace.context":
+		return ctx.span
+	case "trace.trace_id":
+		return ctx.span.TraceID
+	case "trace.span_id":
+		return ctx.span.SpanID
+	case "trace.parent_span_id":
+		return ctx.parent
+	}
+	return ctx.Context.Value(key)
+}
@@ -0,0 +1,62 @@
+package dcontext
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceContext(t *testing.T) {
+	for _, tc := range []struct {
+		traceparent string
+		valid       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01", false},
+	} {
+		header := http.Header{}
+		header.Set("traceparent", tc.traceparent)
+		header.Add("tracestate", "a=1")
+		header.Add("tracestate", "b=2")
+		parsed, ok := ParseTraceContext(header)
+		if ok != tc.valid {
+			t.Errorf("ParseTraceContext(%q) valid = %v, expected %v", tc.traceparent, ok, tc.valid)
+			continue
+		}
+		if ok && (parsed.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parsed.SpanID != "00f067aa0ba902b7" ||
+			parsed.Flags != "01" || parsed.State != "a=1,b=2") {
+			t.Errorf("unexpected trace context of %q: %+v", tc.traceparent, parsed)
+		}
+	}
+}
+
+func TestWithTraceContext(t *testing.T) {
+	caller := TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: "01"}
+	ctx := WithTraceContext(context.Background(), caller)
+	span, ok := GetTraceContext(ctx)
+	if !ok {
+		t.Fatal("no trace context on the context")
+	}
+	if span.TraceID != caller.TraceID || span.SpanID == caller.SpanID || len(span.SpanID) != 16 {
+		t.Fatalf("unexpected span %+v of caller %+v", span, caller)
+	}
+	if parent := GetStringValue(ctx, "trace.parent_span_id"); parent != caller.SpanID {
+		t.Fatalf("unexpected parent span id %q", parent)
+	}
+
+	header := http.Header{}
+	span.SetHeaders(header)
+	if parsed, ok := ParseTraceContext(header); !ok || parsed != span {
+		t.Fatalf("span %+v not round tripped through headers: %+v", span, parsed)
+	}
+	if _, ok := GetTraceContext(context.Background()); ok {
+		t.Fatal("unexpected trace context on a context without one")
+	}
+}
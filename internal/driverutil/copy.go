@@ -0,0 +1,33 @@
+// Package driverutil holds helpers shared by the storage drivers wrapping
+// other drivers.
+package driverutil
+
+import (
+	"context"
+	"io"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// CopyFile copies the file at sourcePath on source to destPath on dest
+func CopyFile(ctx context.Context, source, dest driver.StorageDriver, sourcePath, destPath string) error {
+	reader, err := source.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := dest.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Cancel(ctx)
+		return err
+	}
+	if err := writer.Commit(ctx); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+)
+
+// activityEntries is the number of recent operations kept in memory
+const activityEntries = 1000
+
+// Kinds of the recent operations
+const (
+	ActivityPull   = "pull"
+	ActivityPush   = "push"
+	ActivityDelete = "delete"
+	ActivityEvict  = "evict"
+)
+
+// Activity is a recent operation of the registry: a manifest pulled, pushed
+// or deleted, or a blob evicted from the cache
+type Activity struct {
+	Time       time.Time     `json:"time"`
+	Kind       string        `json:"kind"`
+	Repository string        `json:"repository,omitempty"`
+	Reference  string        `json:"reference,omitempty"` // tag, if any
+	Digest     digest.Digest `json:"digest,omitempty"`
+	User       string        `json:"user,omitempty"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Cache      string        `json:"cache,omitempty"` // HIT or MISS of a pull in pull-through mode
+}
+
+// activityLog is a ring of the recent operations, the oldest overwritten
+type activityLog struct {
+	mu      sync.Mutex
+	entries []Activity
+	next    int // index of the next entry in a full ring
+}
+
+// add records an operation
+func (l *activityLog) add(entry Activity) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < activityEntries {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % activityEntries
+}
+
+// recent returns up to limit operations of the kind, all if empty, most
+// recent first
+func (l *activityLog) recent(limit int, kind string) []Activity {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []Activity{}
+	for i := range l.entries {
+		if len(entries) >= limit {
+			break
+		}
+		// from the newest entry backwards
+		entry := l.entries[(l.next-1-i+2*len(l.entries))%len(l.entries)]
+		if kind == "" || entry.Kind == kind {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// recordActivity records an operation of a request
+func (app *App) recordActivity(ctx *Context, r *http.Request, entry Activity) {
+	entry.User = getUserName(ctx, r)
+	entry.RemoteAddr = dcontext.GetStringValue(ctx, "http.request.remoteaddr")
+	app.activity.add(entry)
+}
+
+// RecordActivity records an operation not made by a request, e.g. a blob
+// evicted by the cleanup.
+func (app *App) RecordActivity(entry Activity) {
+	app.activity.add(entry)
+}
+
+// Activity returns up to limit recent operations of the kind, all if empty,
+// most recent first. Only the last activityEntries operations are kept.
+func (app *App) Activity(limit int, kind string) []Activity {
+	return app.activity.recent(limit, kind)
+}
@@ -3,21 +3,33 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
 	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
@@ -27,10 +39,14 @@ import (
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/lru_driver"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -564,6 +580,7 @@ func TestTagsAPI(t *testing.T) {
 			queryParams:        url.Values{"last": []string{"does-not-exist"}, "n": []string{"3"}},
 			expectedStatusCode: http.StatusOK,
 			expectedBody: tagsAPIResponse{Name: imageName.Name(), Tags: []string{
+				"jyi7b",
 				"kb0j5",
 				"sb71y",
 			}},
@@ -608,6 +625,74 @@ func TestTagsAPI(t *testing.T) {
 	}
 }
 
+// TestTagsAPIPageSize checks the configured default and maximum page sizes
+// of the tags list.
+func TestTagsAPIPageSize(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{
+		Driver:             inmemory.New(),
+		TagsDefaultEntries: 2,
+		TagsMaxEntries:     3,
+	})
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("test")
+	for _, tag := range []string{"a", "b", "c", "d", "e"} {
+		createRepository(env, t, imageName.Name(), tag)
+	}
+
+	tt := []struct {
+		name         string
+		queryParams  url.Values
+		expectedTags []string
+		expectedLink string
+	}{
+		{
+			name:         "default page size",
+			expectedTags: []string{"a", "b"},
+			expectedLink: `</v2/test/tags/list?last=b&n=2>; rel="next"`,
+		},
+		{
+			name:         "requested page size",
+			queryParams:  url.Values{"n": []string{"1"}},
+			expectedTags: []string{"a"},
+			expectedLink: `</v2/test/tags/list?last=a&n=1>; rel="next"`,
+		},
+		{
+			name:         "page size above the maximum",
+			queryParams:  url.Values{"n": []string{"10"}},
+			expectedTags: []string{"a", "b", "c"},
+			expectedLink: `</v2/test/tags/list?last=c&n=3>; rel="next"`,
+		},
+		{
+			name:         "last page",
+			queryParams:  url.Values{"last": []string{"c"}},
+			expectedTags: []string{"d", "e"},
+		},
+	}
+
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			tagsURL, err := env.builder.BuildTagsURL(imageName, test.queryParams)
+			checkErr(t, err, "building tags url")
+			resp, err := http.Get(tagsURL)
+			checkErr(t, err, "listing tags")
+			defer resp.Body.Close()
+			checkResponse(t, "listing tags", resp, http.StatusOK)
+
+			var body tagsAPIResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("unexpected error decoding response body: %v", err)
+			}
+			if !reflect.DeepEqual(body.Tags, test.expectedTags) {
+				t.Fatalf("expected tags %v, got %v", test.expectedTags, body.Tags)
+			}
+			if link := resp.Header.Get("Link"); link != test.expectedLink {
+				t.Fatalf("expected Link header %q, got %q", test.expectedLink, link)
+			}
+		})
+	}
+}
+
 func checkLink(t *testing.T, urlStr string, numEntries int, last string) url.Values {
 	re := regexp.MustCompile("<(/v2/_catalog.*)>; rel=\"next\"")
 	matches := re.FindStringSubmatch(urlStr)
@@ -1854,6 +1939,38 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 	defer resp.Body.Close()
 
 	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	// Get by name with a list of weak and strong etags, gives 304
+	req, err = http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", fmt.Sprintf(`"sha256:0000", W/%s`, etag))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching manifest by name with etag list", resp, http.StatusNotModified)
+
+	// Get by name with a stale etag, gives the manifest
+	req, err = http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", `"sha256:0000"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching manifest by name with stale etag", resp, http.StatusOK)
 
 	// Ensure that the tag is listed.
 	resp, err = http.Get(tagsURL)
@@ -2256,7 +2373,9 @@ func newTestEnv(t *testing.T, deleteEnabled bool) *testEnv {
 func newTestEnvWithConfig(t *testing.T, config *configuration.Configuration) *testEnv {
 	ctx := context.Background()
 
-	app, err := NewApp(ctx, &Config{})
+	app, err := NewApp(ctx, &Config{
+		CatalogMaxEntries: config.Catalog.MaxEntries,
+	})
 	if err != nil {
 		t.Fatalf("error creating app: %v", err)
 	}
@@ -2859,3 +2978,1421 @@ func TestProxyManifestGetByTag(t *testing.T) {
 		"Docker-Content-Digest": []string{newDigest.String()},
 	})
 }
+
+const (
+	helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// recordingTracker is a BlobTracker which records touched digests.
+type recordingTracker struct {
+	mu      sync.Mutex
+	touched map[digest.Digest]int
+	ttls    map[digest.Digest]time.Duration
+}
+
+func (rt *recordingTracker) Touch(ctx context.Context, dgst digest.Digest) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if cache.AccessModeFromContext(ctx) == cache.AccessSkip {
+		return true
+	}
+	if rt.touched == nil {
+		rt.touched = make(map[digest.Digest]int)
+	}
+	rt.touched[dgst]++
+	return true
+}
+
+func (rt *recordingTracker) ExtendTTL(dgst digest.Digest, ttl time.Duration) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.ttls == nil {
+		rt.ttls = make(map[digest.Digest]time.Duration)
+	}
+	if ttl > rt.ttls[dgst] {
+		rt.ttls[dgst] = ttl
+	}
+	return true
+}
+
+func (rt *recordingTracker) ttl(dgst digest.Digest) time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.ttls[dgst]
+}
+
+func (rt *recordingTracker) count(dgst digest.Digest) int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.touched[dgst]
+}
+
+func newTestEnvWithTracker(t *testing.T, tracker BlobTracker) *testEnv {
+	return newTestEnvWithAppConfig(t, &Config{
+		Driver:  inmemory.New(),
+		Tracker: tracker,
+	})
+}
+
+func newTestEnvWithAppConfig(t *testing.T, config *Config) *testEnv {
+	ctx := context.Background()
+
+	if config.HttpHeaders == nil {
+		config.HttpHeaders = headerConfig
+	}
+	app, err := NewApp(ctx, config)
+	if err != nil {
+		t.Fatalf("error creating app: %v", err)
+	}
+	server := httptest.NewServer(app)
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating url builder: %v", err)
+	}
+
+	return &testEnv{
+		ctx:     ctx,
+		app:     app,
+		server:  server,
+		builder: builder,
+	}
+}
+
+// filesystemDriver returns a storage driver in a temporary directory, for the
+// tests depending on the size and content of uploads in progress, which the
+// inmemory driver does not report until they are committed.
+func filesystemDriver(t *testing.T) storagedriver.StorageDriver {
+	return filesystem.New(filesystem.DriverParameters{
+		RootDirectory: t.TempDir(),
+		MaxThreads:    100,
+	})
+}
+
+// pushBlobContent uploads content as a blob of the named repository and
+// returns its digest.
+func pushBlobContent(t *testing.T, env *testEnv, name reference.Named, content []byte) digest.Digest {
+	dgst := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	return dgst
+}
+
+// TestHelmChartPull pushes a helm chart as an OCI artifact and pulls it back
+// the way `helm pull` does, ensuring that non-image media types round trip
+// and that the config blob is retained together with the chart layer.
+func TestHelmChartPull(t *testing.T) {
+	tracker := &recordingTracker{}
+	env := newTestEnvWithTracker(t, tracker)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("charts/mychart")
+
+	chartConfig := []byte(`{"name":"mychart","version":"0.1.0","apiVersion":"v2"}`)
+	chartConfigDigest := digest.FromBytes(chartConfig)
+	chartContent := []byte("not really a tarball, but the registry does not care")
+	chartContentDigest := digest.FromBytes(chartContent)
+
+	pushBlobContent(t, env, imageName, chartConfig)
+	pushBlobContent(t, env, imageName, chartContent)
+
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: helmConfigMediaType,
+			Digest:    chartConfigDigest,
+			Size:      int64(len(chartConfig)),
+		},
+		Layers: []v1.Descriptor{
+			{
+				MediaType: helmChartMediaType,
+				Digest:    chartContentDigest,
+				Size:      int64(len(chartContent)),
+			},
+		},
+	}
+
+	tagRef, _ := reference.WithTag(imageName, "0.1.0")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp := putManifest(t, "putting helm chart manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting helm chart manifest", resp, http.StatusCreated)
+	manifestDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("error constructing request: %s", err)
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching helm chart manifest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching helm chart manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Type":          []string{v1.MediaTypeImageManifest},
+		"Docker-Content-Digest": []string{manifestDigest.String()},
+	})
+
+	var fetched v1.Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+	if fetched.Config.MediaType != helmConfigMediaType {
+		t.Fatalf("unexpected config media type: %q != %q", fetched.Config.MediaType, helmConfigMediaType)
+	}
+	if len(fetched.Layers) != 1 || fetched.Layers[0].MediaType != helmChartMediaType {
+		t.Fatalf("unexpected layers in fetched manifest: %v", fetched.Layers)
+	}
+
+	for _, dgst := range []digest.Digest{chartConfigDigest, chartContentDigest} {
+		if tracker.count(dgst) == 0 {
+			t.Fatalf("expected %s to be touched when pulling the manifest", dgst)
+		}
+	}
+
+	for dgst, expected := range map[digest.Digest][]byte{
+		chartConfigDigest:  chartConfig,
+		chartContentDigest: chartContent,
+	} {
+		ref, _ := reference.WithDigest(imageName, dgst)
+		blobURL, err := env.builder.BuildBlobURL(ref)
+		if err != nil {
+			t.Fatalf("error building blob url: %v", err)
+		}
+		resp, err := http.Get(blobURL)
+		if err != nil {
+			t.Fatalf("unexpected error fetching blob %s: %v", dgst, err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, "fetching helm chart blob", resp, http.StatusOK)
+		p, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading blob %s: %v", dgst, err)
+		}
+		if !bytes.Equal(p, expected) {
+			t.Fatalf("unexpected content for blob %s", dgst)
+		}
+	}
+}
+
+// TestZstdLayerManifest pushes an OCI image with zstd compressed layers and
+// checks that it negotiates like any other OCI manifest.
+func TestZstdLayerManifest(t *testing.T) {
+	tracker := &recordingTracker{}
+	env := newTestEnvWithTracker(t, tracker)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/zstd")
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := pushBlobContent(t, env, imageName, config)
+	// zstd frame magic number followed by arbitrary payload
+	layer := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, []byte("zstd layer payload")...)
+	layerDigest := pushBlobContent(t, env, imageName, layer)
+
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []v1.Descriptor{
+			{
+				MediaType: v1.MediaTypeImageLayerZstd,
+				Digest:    layerDigest,
+				Size:      int64(len(layer)),
+			},
+		},
+	}
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp := putManifest(t, "putting zstd manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting zstd manifest", resp, http.StatusCreated)
+
+	for _, testcase := range []struct {
+		method         string
+		accept         []string
+		expectedStatus int
+	}{
+		{http.MethodGet, []string{v1.MediaTypeImageManifest}, http.StatusOK},
+		{http.MethodHead, []string{v1.MediaTypeImageManifest}, http.StatusOK},
+		{http.MethodGet, []string{schema2.MediaTypeManifest + ", " + v1.MediaTypeImageManifest + ";q=0.9"}, http.StatusOK},
+		{http.MethodGet, []string{schema2.MediaTypeManifest, v1.MediaTypeImageIndex, v1.MediaTypeImageManifest}, http.StatusOK},
+		{http.MethodGet, []string{schema2.MediaTypeManifest}, http.StatusNotFound},
+		{http.MethodGet, nil, http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(testcase.method, manifestURL, nil)
+		if err != nil {
+			t.Fatalf("error constructing request: %s", err)
+		}
+		for _, accept := range testcase.accept {
+			req.Header.Add("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error fetching manifest: %v", err)
+		}
+		defer resp.Body.Close()
+
+		msg := fmt.Sprintf("%s zstd manifest with Accept %q", testcase.method, testcase.accept)
+		checkResponse(t, msg, resp, testcase.expectedStatus)
+		if testcase.expectedStatus != http.StatusOK {
+			if testcase.method == http.MethodGet {
+				// nolint:errcheck
+				checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestUnknown)
+			}
+			continue
+		}
+		checkHeaders(t, resp, http.Header{
+			"Content-Type": []string{v1.MediaTypeImageManifest},
+		})
+	}
+
+	if tracker.count(layerDigest) == 0 {
+		t.Fatalf("expected zstd layer %s to be touched when pulling the manifest", layerDigest)
+	}
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building blob url: %v", err)
+	}
+	resp, err = http.Get(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching zstd layer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching zstd layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(len(layer))},
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+}
+
+// TestManifestTTLAnnotation checks that the TTL annotation on a pushed
+// manifest is applied to the manifest and all of its blobs.
+func TestManifestTTLAnnotation(t *testing.T) {
+	tracker := &recordingTracker{}
+	env := newTestEnvWithTracker(t, tracker)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/golden")
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := pushBlobContent(t, env, imageName, config)
+	layer := []byte("golden layer")
+	layerDigest := pushBlobContent(t, env, imageName, layer)
+
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []v1.Descriptor{
+			{
+				MediaType: v1.MediaTypeImageLayerGzip,
+				Digest:    layerDigest,
+				Size:      int64(len(layer)),
+			},
+		},
+		Annotations: map[string]string{
+			ttlAnnotation: "not-a-duration",
+		},
+	}
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp := putManifest(t, "putting manifest with invalid ttl", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with invalid ttl", resp, http.StatusBadRequest)
+	// nolint:errcheck
+	checkBodyHasErrorCodes(t, "putting manifest with invalid ttl", resp, errcode.ErrorCodeManifestInvalid)
+
+	manifest.Annotations[ttlAnnotation] = "720h"
+	resp = putManifest(t, "putting manifest with ttl", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with ttl", resp, http.StatusCreated)
+	manifestDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+
+	for _, dgst := range []digest.Digest{manifestDigest, configDigest, layerDigest} {
+		if ttl := tracker.ttl(dgst); ttl != 720*time.Hour {
+			t.Fatalf("unexpected ttl for %s: %v != %v", dgst, ttl, 720*time.Hour)
+		}
+	}
+}
+
+// TestHeadAccessMode checks that HEAD probes leave blob access times alone
+// when configured to skip them, while GET requests still refresh them.
+func TestHeadAccessMode(t *testing.T) {
+	tracker := &recordingTracker{}
+	env := newTestEnvWithAppConfig(t, &Config{
+		Driver:         inmemory.New(),
+		Tracker:        tracker,
+		HeadAccessMode: cache.AccessSkip,
+	})
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/probed")
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := pushBlobContent(t, env, imageName, config)
+
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []v1.Descriptor{},
+	}
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp := putManifest(t, "putting manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest", resp, http.StatusCreated)
+
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error checking manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "checking manifest", resp, http.StatusOK)
+
+	if count := tracker.count(configDigest); count != 0 {
+		t.Fatalf("unexpected touches after HEAD: %d != 0", count)
+	}
+
+	req.Method = http.MethodGet
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest", resp, http.StatusOK)
+
+	if count := tracker.count(configDigest); count != 1 {
+		t.Fatalf("unexpected touches after GET: %d != 1", count)
+	}
+}
+
+// staticRouter is a BlobRouter assigning every blob to one node.
+type staticRouter string
+
+func (r staticRouter) Owner(dgst digest.Digest) string {
+	return string(r)
+}
+
+// TestShardedBlobs checks that blobs pushed to a node are handed off to the
+// owning node and that reads are forwarded to it.
+func TestShardedBlobs(t *testing.T) {
+	owner := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	defer owner.Shutdown()
+	front := newTestEnvWithAppConfig(t, &Config{
+		Driver:     inmemory.New(),
+		BlobRouter: staticRouter(owner.server.URL),
+	})
+	defer front.Shutdown()
+
+	imageName, _ := reference.WithName("foo/sharded")
+	content := []byte("sharded layer")
+	dgst := pushBlobContent(t, front, imageName, content)
+
+	ref, _ := reference.WithDigest(imageName, dgst)
+	ownerURL, err := owner.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+
+	// the hand off runs in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Head(ownerURL)
+		if err != nil {
+			t.Fatalf("unexpected error checking blob on owner: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blob was not handed off to owner: %s", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	frontURL, err := front.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+	resp, err := http.Get(frontURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching blob: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching sharded blob", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("unexpected blob content: %q != %q", body, content)
+	}
+}
+
+// waitForBlob waits for a pulled blob to be committed, which happens after
+// the response is complete.
+func waitForBlob(t *testing.T, env *testEnv, dgst digest.Digest) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := env.app.registry.BlobStatter().Stat(env.ctx, dgst); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blob %s was not cached", dgst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPullThroughCache pulls a manifest and a blob missing from the cache
+// from the upstream and serves them from the cache once the upstream is
+// gone.
+func TestPullThroughCache(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	imageName, _ := reference.WithName("foo/pulled")
+	content := []byte("pulled layer")
+	blobDigest := pushBlobContent(t, upstream, imageName, content)
+	manifestDigest := createRepository(upstream, t, imageName.Name(), "latest")
+
+	client, err := registryclient.New(upstream.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	client.Auth = &registryclient.Auth{}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:   inmemory.New(),
+		Upstream: client,
+	})
+	defer cache.Shutdown()
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := cache.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	blobRef, _ := reference.WithDigest(imageName, blobDigest)
+	blobURL, err := cache.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	unknownRef, _ := reference.WithTag(imageName, "unknown")
+	unknownURL, err := cache.builder.BuildManifestURL(unknownRef)
+	checkErr(t, err, "building manifest url")
+
+	resp, err := http.Get(unknownURL)
+	checkErr(t, err, "fetching unknown manifest")
+	resp.Body.Close()
+	checkResponse(t, "fetching unknown manifest", resp, http.StatusNotFound)
+
+	fetch := func(msg string, cacheStatus string) {
+		req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+		req.Header.Set("Accept", schema2.MediaTypeManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, msg)
+		resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Docker-Content-Digest": []string{manifestDigest.String()},
+			"X-Cache":               []string{cacheStatus},
+		})
+
+		resp, err = http.Get(blobURL)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"X-Cache": []string{cacheStatus},
+		})
+		if cacheStatus == cacheMiss && resp.Header.Get("X-Cache-Upstream") != client.Host() {
+			t.Fatalf("%s: unexpected X-Cache-Upstream: %q", msg, resp.Header.Get("X-Cache-Upstream"))
+		}
+		body, err := io.ReadAll(resp.Body)
+		checkErr(t, err, msg)
+		if !bytes.Equal(body, content) {
+			t.Fatalf("%s: unexpected blob content: %q != %q", msg, body, content)
+		}
+	}
+	fetch("pulling from upstream", cacheMiss)
+
+	waitForBlob(t, cache, blobDigest)
+
+	upstream.Shutdown()
+	fetch("serving from cache", cacheHit)
+}
+
+// TestPullThroughCacheResume interrupts the pull of a blob and ensures that
+// the next request resumes it where it stopped.
+func TestPullThroughCacheResume(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	defer upstream.Shutdown()
+	imageName, _ := reference.WithName("foo/resumed")
+	content := bytes.Repeat([]byte("resumed layer "), 10000)
+	dgst := pushBlobContent(t, upstream, imageName, content)
+
+	var mu sync.Mutex
+	var ranges []string
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			first := len(ranges) == 1
+			mu.Unlock()
+			if first {
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+		}
+		upstream.app.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	client, err := registryclient.New(flaky.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:   filesystemDriver(t),
+		Upstream: client,
+	})
+	defer cache.Shutdown()
+
+	ref, _ := reference.WithDigest(imageName, dgst)
+	blobURL, err := cache.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching interrupted blob")
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("expected interrupted blob download to fail")
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching resumed blob")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching resumed blob", resp, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading resumed blob")
+	if !bytes.Equal(body, content) {
+		t.Fatalf("unexpected resumed blob content, %d of %d bytes", len(body), len(content))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Fatalf("unexpected upstream ranges: %q != %q", ranges, expected)
+	}
+	waitForBlob(t, cache, dgst)
+}
+
+// TestTagRefresh moves a pulled tag to the manifest it points to upstream
+// when popular tags are refreshed.
+func TestTagRefresh(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	imageName, _ := reference.WithName("foo/refreshed")
+	createRepository(upstream, t, imageName.Name(), "latest")
+
+	client, err := registryclient.New(upstream.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:   inmemory.New(),
+		Upstream: client,
+	})
+	defer cache.Shutdown()
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := cache.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	fetch := func(msg string) string {
+		req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+		req.Header.Set("Accept", schema2.MediaTypeManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, msg)
+		resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusOK)
+		return resp.Header.Get("Docker-Content-Digest")
+	}
+	fetch("pulling tag")
+
+	newDigest := createRepository(upstream, t, imageName.Name(), "latest")
+	cache.app.refreshTags(10)
+	upstream.Shutdown()
+
+	if dgst := fetch("fetching refreshed tag"); dgst != newDigest.String() {
+		t.Fatalf("expected refreshed tag to point to %s, got %s", newDigest, dgst)
+	}
+}
+
+func TestTagPullsTop(t *testing.T) {
+	var tp tagPulls
+	for i := 0; i < 3; i++ {
+		tp.record("foo", "latest")
+	}
+	tp.record("foo", "old")
+	tp.record("bar", "latest")
+	tp.record("bar", "latest")
+
+	top := tp.top(2)
+	expected := []tagKey{{"foo", "latest"}, {"bar", "latest"}}
+	if !reflect.DeepEqual(top, expected) {
+		t.Fatalf("unexpected top tags: %v != %v", top, expected)
+	}
+
+	// counts are halved, single pulls are forgotten
+	if top := tp.top(10); len(top) != 2 {
+		t.Fatalf("expected tags pulled once to be forgotten, got %v", top)
+	}
+}
+
+// TestPrefetch pulls a manifest through the cache and ensures that its blobs
+// are cached without being requested.
+func TestPrefetch(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	imageName, _ := reference.WithName("foo/prefetched")
+	manifestDigest := createRepository(upstream, t, imageName.Name(), "latest")
+
+	repository, err := upstream.app.registry.Repository(upstream.ctx, imageName)
+	checkErr(t, err, "getting upstream repository")
+	manifests, err := repository.Manifests(upstream.ctx)
+	checkErr(t, err, "getting upstream manifests")
+	manifest, err := manifests.Get(upstream.ctx, manifestDigest)
+	checkErr(t, err, "getting upstream manifest")
+
+	client, err := registryclient.New(upstream.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:          filesystemDriver(t),
+		Upstream:        client,
+		PrefetchWorkers: 2,
+	})
+	defer cache.Shutdown()
+	defer upstream.Shutdown()
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := cache.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "pulling manifest")
+	resp.Body.Close()
+	checkResponse(t, "pulling manifest", resp, http.StatusOK)
+
+	for _, desc := range manifest.References() {
+		waitForBlob(t, cache, desc.Digest)
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	platforms := []string{"linux/amd64", "linux/arm/v7"}
+	for _, tc := range []struct {
+		platform *v1.Platform
+		expected bool
+	}{
+		{&v1.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{&v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, true},
+		{&v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{&v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{&v1.Platform{OS: "linux", Architecture: "s390x"}, false},
+		{nil, true},
+	} {
+		if got := matchPlatform(platforms, tc.platform); got != tc.expected {
+			t.Errorf("matchPlatform(%v) = %v, expected %v", tc.platform, got, tc.expected)
+		}
+	}
+	if !matchPlatform(nil, &v1.Platform{OS: "linux", Architecture: "s390x"}) {
+		t.Error("expected any platform to match an empty list")
+	}
+}
+
+// TestPullThroughCacheDenied ensures that repositories not allowed to be
+// pulled from the upstream are denied.
+func TestPullThroughCacheDenied(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	defer upstream.Shutdown()
+	allowedName, _ := reference.WithName("library/allowed")
+	createRepository(upstream, t, allowedName.Name(), "latest")
+	deniedName, _ := reference.WithName("library/bitcoin-miner")
+	createRepository(upstream, t, deniedName.Name(), "latest")
+	otherName, _ := reference.WithName("other/image")
+	createRepository(upstream, t, otherName.Name(), "latest")
+
+	client, err := registryclient.New(upstream.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:        inmemory.New(),
+		Upstream:      client,
+		UpstreamAllow: []string{"library/*"},
+		UpstreamDeny:  []string{"*/bitcoin-miner*"},
+	})
+	defer cache.Shutdown()
+
+	for _, tc := range []struct {
+		name     reference.Named
+		expected int
+	}{
+		{allowedName, http.StatusOK},
+		{deniedName, http.StatusForbidden},
+		{otherName, http.StatusForbidden},
+	} {
+		tagRef, _ := reference.WithTag(tc.name, "latest")
+		manifestURL, err := cache.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+		req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+		req.Header.Set("Accept", schema2.MediaTypeManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "pulling manifest")
+		resp.Body.Close()
+		checkResponse(t, "pulling "+tc.name.Name(), resp, tc.expected)
+	}
+}
+
+// TestPullSignatures ensures that the cosign signature of a pulled manifest
+// is pulled along with its blobs.
+func TestPullSignatures(t *testing.T) {
+	upstream := newTestEnvWithAppConfig(t, &Config{
+		Driver: inmemory.New(),
+	})
+	defer upstream.Shutdown()
+	imageName, _ := reference.WithName("foo/signed")
+	manifestDigest := createRepository(upstream, t, imageName.Name(), "latest")
+	signatureTag := "sha256-" + manifestDigest.Encoded() + ".sig"
+	signatureDigest := createRepository(upstream, t, imageName.Name(), signatureTag)
+
+	client, err := registryclient.New(upstream.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating upstream client: %v", err)
+	}
+	cache := newTestEnvWithAppConfig(t, &Config{
+		Driver:             filesystemDriver(t),
+		Upstream:           client,
+		UpstreamSignatures: true,
+	})
+	defer cache.Shutdown()
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := cache.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "pulling manifest")
+	resp.Body.Close()
+	checkResponse(t, "pulling manifest", resp, http.StatusOK)
+
+	repository, err := cache.app.registry.Repository(cache.ctx, imageName)
+	checkErr(t, err, "getting cache repository")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		desc, err := repository.Tags(cache.ctx).Get(cache.ctx, signatureTag)
+		if err == nil {
+			if desc.Digest != signatureDigest {
+				t.Fatalf("unexpected signature digest %s, expected %s", desc.Digest, signatureDigest)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("signature was not pulled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	manifests, err := repository.Manifests(cache.ctx)
+	checkErr(t, err, "getting cache manifests")
+	signature, err := manifests.Get(cache.ctx, signatureDigest)
+	checkErr(t, err, "getting signature manifest")
+	for _, desc := range signature.References() {
+		waitForBlob(t, cache, desc.Digest)
+	}
+}
+
+func TestTrustPolicyVerifyPayload(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err, "generating key")
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	checkErr(t, err, "marshaling public key")
+	tp, err := NewTrustPolicy([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})})
+	checkErr(t, err, "creating trust policy")
+
+	dgst := digest.FromString("manifest")
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"foo"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, dgst))
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	checkErr(t, err, "signing payload")
+
+	if !tp.verifyPayload(payload, signature, dgst) {
+		t.Fatal("expected signature to be valid")
+	}
+	if tp.verifyPayload(payload, signature, digest.FromString("other")) {
+		t.Fatal("expected signature of another manifest to be rejected")
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err, "generating key")
+	otherSignature, err := ecdsa.SignASN1(rand.Reader, otherKey, hash[:])
+	checkErr(t, err, "signing payload")
+	if tp.verifyPayload(payload, otherSignature, dgst) {
+		t.Fatal("expected signature of an untrusted key to be rejected")
+	}
+}
+
+func TestVerifyingWriter(t *testing.T) {
+	content := []byte("blob content")
+	for _, tc := range []struct {
+		dgst     digest.Digest
+		verified bool
+	}{
+		{digest.FromBytes(content), true},
+		{digest.FromString("other"), false},
+	} {
+		var buf bytes.Buffer
+		vw := newVerifyingWriter(&buf, tc.dgst)
+		vw.Write(content[:5])
+		vw.Write(content[5:])
+		if verified := vw.finish(); verified != tc.verified {
+			t.Fatalf("expected verified to be %v", tc.verified)
+		}
+		if tc.verified && !bytes.Equal(buf.Bytes(), content) {
+			t.Fatalf("unexpected content %q", buf.Bytes())
+		}
+		if !tc.verified && buf.Len() == len(content) {
+			t.Fatal("expected the end of mismatching content to be held back")
+		}
+	}
+}
+
+// pushImageContent pushes an image of the named repository tagged latest,
+// made of a config and a single layer. Repositories are enumerated by their
+// manifests, blobs pushed alone are not seen by a storage walk.
+func pushImageContent(t *testing.T, env *testEnv, name reference.Named, config, layer []byte) {
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    pushBlobContent(t, env, name, config),
+			Size:      int64(len(config)),
+		},
+		Layers: []v1.Descriptor{
+			{
+				MediaType: v1.MediaTypeImageLayer,
+				Digest:    pushBlobContent(t, env, name, layer),
+				Size:      int64(len(layer)),
+			},
+		},
+	}
+	tagRef, _ := reference.WithTag(name, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp := putManifest(t, "putting manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest", resp, http.StatusCreated)
+}
+
+func TestPushQuota(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{Driver: filesystemDriver(t)})
+	defer env.Shutdown()
+	// set up by hand rather than through the config so that no refresh runs
+	// concurrently with the test
+	env.app.quotas = &quotas{limits: map[string]int64{"team-a": 10}}
+
+	appName, _ := reference.WithName("team-a/app")
+	otherName, _ := reference.WithName("team-a/other")
+	pushImageContent(t, env, appName, []byte("1234"), []byte("5678"))
+
+	content := []byte("abcdefgh")
+	uploadURLBase, _ := startPushLayer(t, env, otherName)
+	resp, err := doPushLayer(t, env.builder, otherName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	checkErr(t, err, "pushing layer over quota")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing layer over quota", resp, http.StatusRequestEntityTooLarge)
+
+	// usage computed from the storage, blobs of other namespaces not counted
+	bName, _ := reference.WithName("team-b/app")
+	pushImageContent(t, env, bName, []byte("abcd"), []byte("efgh"))
+	checkErr(t, env.app.refreshQuotas(env.ctx), "refreshing quotas")
+	usages := env.app.Quotas()
+	expected := []QuotaUsage{
+		{Namespace: "team-a", Usage: 8, Limit: 10},
+		{Namespace: "team-b", Usage: 8},
+	}
+	if !reflect.DeepEqual(usages, expected) {
+		t.Fatalf("unexpected quota usage %+v", usages)
+	}
+}
+
+func TestQuotaRefreshSkipsAccess(t *testing.T) {
+	// the layer expires unless the refresh accesses it
+	tracker, err := cache.NewLRUTrackerWithStore(cache.MemoryMetaStore{}, 100*time.Millisecond, nil)
+	checkErr(t, err, "creating tracker")
+	env := newTestEnvWithAppConfig(t, &Config{Driver: lru_driver.New(filesystemDriver(t), tracker, nil)})
+	defer env.Shutdown()
+	env.app.quotas = &quotas{}
+
+	name, _ := reference.WithName("team-a/app")
+	layer := []byte("layer")
+	pushImageContent(t, env, name, []byte("config"), layer)
+	time.Sleep(200 * time.Millisecond)
+
+	// the walk reads the layer links, which must not refresh the blobs
+	checkErr(t, env.app.refreshQuotas(env.ctx), "refreshing quotas")
+	if usages := env.app.Quotas(); len(usages) != 1 || usages[0].Usage == 0 {
+		t.Fatalf("unexpected quota usage %+v", usages)
+	}
+	if expired := tracker.GetExpiredBlobs(env.ctx); !slices.Contains(expired, digest.FromBytes(layer)) {
+		t.Fatalf("quota refresh accessed the layer, expired blobs %v", expired)
+	}
+}
+
+func TestBlobRange(t *testing.T) {
+	tracker, err := cache.NewLRUTrackerWithStore(cache.MemoryMetaStore{}, time.Hour, nil)
+	checkErr(t, err, "creating tracker")
+	<-tracker.Loaded()
+	env := newTestEnvWithAppConfig(t, &Config{Driver: lru_driver.New(inmemory.New(), tracker, nil)})
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/ranged")
+	content := []byte("0123456789abcdef")
+	dgst := pushBlobContent(t, env, name, content)
+	ref, _ := reference.WithDigest(name, dgst)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+
+	get := func(rangeHeader string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+		checkErr(t, err, "building request")
+		req.Header.Set("Range", rangeHeader)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching blob range")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		checkErr(t, err, "reading blob range")
+		return resp, body
+	}
+
+	before, _ := tracker.Blob(dgst)
+
+	resp, body := get("bytes=4-9")
+	checkResponse(t, "fetching blob range", resp, http.StatusPartialContent)
+	checkHeaders(t, resp, http.Header{
+		"Content-Range":  []string{fmt.Sprintf("bytes 4-9/%d", len(content))},
+		"Content-Length": []string{"6"},
+	})
+	if string(body) != "456789" {
+		t.Fatalf("unexpected range content %q", body)
+	}
+
+	resp, body = get("bytes=-3")
+	checkResponse(t, "fetching blob suffix", resp, http.StatusPartialContent)
+	if string(body) != "def" {
+		t.Fatalf("unexpected suffix content %q", body)
+	}
+
+	// each range is read from its own offset within the same request
+	resp, body = get("bytes=0-1,8-9")
+	checkResponse(t, "fetching blob ranges", resp, http.StatusPartialContent)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") ||
+		!bytes.Contains(body, []byte("01")) || !bytes.Contains(body, []byte("89")) {
+		t.Fatalf("unexpected multi-range response %q: %q", resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, _ = get(fmt.Sprintf("bytes=%d-", len(content)))
+	checkResponse(t, "fetching blob range past its end", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkHeaders(t, resp, http.Header{"Content-Range": []string{fmt.Sprintf("bytes */%d", len(content))}})
+
+	// partial reads refresh the blob without counting as reads
+	after, _ := tracker.Blob(dgst)
+	if !after.LastAccessed.After(before.LastAccessed) {
+		t.Fatalf("range requests did not refresh the last access: %v", after.LastAccessed)
+	}
+	if after.Reads != before.Reads {
+		t.Fatalf("range requests counted as %d reads", after.Reads-before.Reads)
+	}
+
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	checkErr(t, err, "reading blob")
+	if !bytes.Equal(body, content) {
+		t.Fatalf("unexpected blob content %q", body)
+	}
+	if meta, _ := tracker.Blob(dgst); meta.Reads != before.Reads+1 {
+		t.Fatalf("expected the full read to count once, got %d reads", meta.Reads-before.Reads)
+	}
+}
+
+func TestMaxUploadsPerClient(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{Driver: inmemory.New(), MaxUploadsPerClient: 2})
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/bar")
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	startPushLayer(t, env, name)
+
+	uploadURL, err := env.builder.BuildBlobUploadURL(name)
+	checkErr(t, err, "building upload url")
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload over the limit")
+	resp.Body.Close()
+	checkResponse(t, "starting upload over the limit", resp, http.StatusTooManyRequests)
+
+	// completing an upload frees its session
+	content := []byte("layer content")
+	pushLayer(t, env.builder, name, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	startPushLayer(t, env, name)
+}
+
+func TestUploadSessionInProgress(t *testing.T) {
+	sessions := &uploadSessions{limit: 1}
+	reservation, err := sessions.reserve("ip:127.0.0.1")
+	checkErr(t, err, "reserving upload")
+	sessions.bind(reservation, "upload")
+
+	// a request outlasting the idle timeout, e.g. a large PATCH, keeps its
+	// session counted
+	done := sessions.begin("upload")
+	sessions.expire(time.Now().Add(2 * uploadIdleTimeout))
+	if len(sessions.sessions) != 1 {
+		t.Fatal("session expired while a request was in progress")
+	}
+	done()
+	sessions.expire(time.Now().Add(2 * uploadIdleTimeout))
+	if len(sessions.sessions) != 0 {
+		t.Fatal("idle session did not expire")
+	}
+}
+
+func TestAbortedUpload(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{Driver: inmemory.New()})
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/aborted")
+	uploadURLBase, uploadUUID := startPushLayer(t, env, name)
+	active := func() int {
+		env.app.uploads.mu.Lock()
+		defer env.app.uploads.mu.Unlock()
+		return env.app.uploads.sessions[uploadUUID].active
+	}
+	waitActive := func(want int) {
+		for deadline := time.Now().Add(5 * time.Second); active() != want; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("upload requests in progress = %d, want %d", active(), want)
+			}
+		}
+	}
+
+	// the client goes away in the middle of the body
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, uploadURLBase, body)
+	checkErr(t, err, "building request")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	_, err = bodyWriter.Write([]byte("partial layer"))
+	checkErr(t, err, "writing body")
+	waitActive(1)
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("expected the aborted upload to fail")
+	}
+
+	// the server gives up the request rather than waiting for the rest
+	waitActive(0)
+	if _, _, err := getUploadStatus(uploadURLBase); err != nil {
+		t.Fatalf("upload unusable after an aborted request: %v", err)
+	}
+}
+
+func TestLimitExemptions(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{
+		Driver:              inmemory.New(),
+		MaxUploadsPerClient: 1,
+		LimitExemptPrefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	})
+	defer env.Shutdown()
+	env.app.quotas = &quotas{limits: map[string]int64{"team-a": 1}}
+
+	// the test server is reached from the loopback address
+	name, _ := reference.WithName("team-a/app")
+	startPushLayer(t, env, name)
+	pushBlobContent(t, env, name, []byte("over the quota and the upload limit"))
+
+	if env.app.exemptions.exempt(&Context{App: env.app, Context: env.ctx}, &http.Request{RemoteAddr: "10.0.0.1:1234"}) {
+		t.Fatal("expected other addresses not to be exempt")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	env := newTestEnvWithAppConfig(t, &Config{Driver: inmemory.New(), MaxBlobSize: 10, MaxImageSize: 15})
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/bar")
+	pushBlobContent(t, env, name, []byte("0123456789"))
+
+	content := []byte("0123456789a")
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	resp, err := doPushLayer(t, env.builder, name, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	checkErr(t, err, "pushing blob over the limit")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing blob over the limit", resp, http.StatusRequestEntityTooLarge)
+
+	manifest := &schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config: v1.Descriptor{
+			Digest:    digest.FromString("config"),
+			Size:      8,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []v1.Descriptor{
+			{
+				Digest:    digest.FromString("layer"),
+				Size:      8,
+				MediaType: schema2.MediaTypeLayer,
+			},
+		},
+	}
+	tagRef, _ := reference.WithTag(name, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting image over the limit", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting image over the limit", resp, http.StatusRequestEntityTooLarge)
+}
+
+// patternReader produces a deterministic, incompressible enough stream of n
+// bytes without holding it in memory
+type patternReader struct {
+	n   int64
+	pos uint64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		r.pos++
+		p[i] = byte(r.pos ^ r.pos>>8 ^ r.pos>>19)
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+// TestLargeBlobStreaming pushes and pulls a multi-GB blob, ensuring that
+// neither path buffers the blob in memory.
+func TestLargeBlobStreaming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("pushes and pulls a multi-GB blob")
+	}
+	const size = 3 << 30
+	const ceiling = 256 << 20
+
+	env := newTestEnvWithAppConfig(t, &Config{
+		Driver: filesystem.New(filesystem.DriverParameters{
+			RootDirectory: t.TempDir(),
+			MaxThreads:    100,
+		}),
+	})
+	defer env.Shutdown()
+
+	digester := digest.Canonical.Digester()
+	_, err := io.Copy(digester.Hash(), &patternReader{n: size})
+	checkErr(t, err, "computing digest")
+	dgst := digester.Digest()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak.Load() {
+					peak.Store(stats.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	name, _ := reference.WithName("foo/large")
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, &patternReader{n: size})
+
+	ref, _ := reference.WithDigest(name, dgst)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "pulling blob")
+	defer resp.Body.Close()
+	checkResponse(t, "pulling blob", resp, http.StatusOK)
+	pulled := digest.Canonical.Digester()
+	n, err := io.Copy(pulled.Hash(), resp.Body)
+	checkErr(t, err, "reading blob")
+	if n != size || pulled.Digest() != dgst {
+		t.Fatalf("pulled %d bytes with digest %s, expected %d bytes with digest %s", n, pulled.Digest(), int64(size), dgst)
+	}
+
+	close(stop)
+	<-sampled
+	if grown := int64(peak.Load()) - int64(before.HeapInuse); grown > ceiling {
+		t.Fatalf("heap grew by %d bytes while transferring a %d bytes blob", grown, int64(size))
+	}
+}
+
+func TestRequestHooks(t *testing.T) {
+	requests := make(chan RequestEvent, 16)
+	responses := make(chan RequestEvent, 16)
+	env := newTestEnvWithAppConfig(t, &Config{
+		Driver:     inmemory.New(),
+		OnRequest:  func(event RequestEvent) { requests <- event },
+		OnResponse: func(event RequestEvent) { responses <- event },
+	})
+	defer env.Shutdown()
+
+	// the hooks may run after the client read the response
+	next := func(events chan RequestEvent) RequestEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return RequestEvent{}
+		}
+	}
+
+	name, _ := reference.WithName("foo/hooks")
+	content := []byte("accounted content")
+	dgst := pushBlobContent(t, env, name, content)
+	upload := map[string]RequestEvent{}
+	for range 2 {
+		event := next(responses)
+		upload[event.Route] = event
+	}
+	if start := upload["blob_upload"]; start.Method != http.MethodPost || start.Status != http.StatusAccepted {
+		t.Fatalf("unexpected upload start event %+v", start)
+	}
+	put := upload["blob_upload_chunk"]
+	if put.Method != http.MethodPut || put.Repository != name.Name() || put.Digest != dgst ||
+		put.Status != http.StatusCreated || put.BytesRead != int64(len(content)) {
+		t.Fatalf("unexpected upload event %+v", put)
+	}
+	next(requests)
+	next(requests)
+
+	ref, _ := reference.WithDigest(name, dgst)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if request := next(requests); request.Route != "blob" || request.Digest != dgst || request.Status != 0 {
+		t.Fatalf("unexpected request event %+v", request)
+	}
+	get := next(responses)
+	if get.Route != "blob" || get.Method != http.MethodGet || get.Repository != name.Name() || get.Digest != dgst ||
+		get.Status != http.StatusOK || get.BytesWritten != int64(len(content)) || get.Duration <= 0 {
+		t.Fatalf("unexpected blob event %+v", get)
+	}
+
+	tagRef, _ := reference.WithTag(name, "missing")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Get(manifestURL)
+	checkErr(t, err, "fetching manifest")
+	resp.Body.Close()
+	next(requests)
+	if manifest := next(responses); manifest.Route != "manifest" || manifest.Tag != "missing" || manifest.Digest != "" || manifest.Status != http.StatusNotFound {
+		t.Fatalf("unexpected manifest event %+v", manifest)
+	}
+}
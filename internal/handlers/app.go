@@ -4,11 +4,14 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/distribution/distribution/v3"
@@ -24,6 +27,10 @@ import (
 	"github.com/docker/go-metrics"
 	"github.com/gorilla/mux"
 	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 )
@@ -39,6 +46,7 @@ type Config struct {
 	HttpHost         string
 	HttpRelativeURLs bool
 	HttpSecret       string
+	HttpHeaders      http.Header // added to every response
 
 	HttpPrefix string
 	Router     *mux.Router // main application router, configured with dispatchers
@@ -48,6 +56,81 @@ type Config struct {
 	AccessController auth.AccessController          // main access controller for application
 
 	PrometheusEnabled bool
+
+	CatalogMaxEntries     int // maximum number of repositories returned by a catalog request
+	CatalogDefaultEntries int // repositories returned by a catalog request without n
+	TagsMaxEntries        int // maximum number of tags returned by a tags list request, zero if unlimited
+	TagsDefaultEntries    int // tags returned by a tags list request without n, all if zero
+
+	Tracker BlobTracker // optional, informed about blobs referenced by served manifests
+
+	HeadAccessMode cache.AccessMode // how HEAD requests update blob access times
+
+	BlobRedirect bool // redirect blob downloads to URLs of the storage driver, e.g. pre-signed S3 URLs
+
+	BlobRouter BlobRouter // optional, partitions blobs between the nodes of a sharded deployment
+
+	ManifestListener ManifestListener // optional, informed about pushed manifests
+	BlobQuarantine   BlobQuarantine   // optional, keeps upstream content not matching its digest
+
+	Upstream      *registryclient.Client // optional, registry pulled from on cache misses
+	UpstreamAllow []string               // path.Match patterns of the repositories pulled, all if empty
+	UpstreamDeny  []string               // path.Match patterns of the repositories never pulled
+
+	UpstreamSegments       int   // parallel range requests large blobs are pulled with, one disables
+	UpstreamSegmentMinSize int64 // size from which blobs are pulled in segments
+	UpstreamSignatures     bool  // pulls the cosign signatures and referrers of pulled manifests
+
+	TrustPolicy *TrustPolicy // optional, only manifests it verifies are served and cached
+
+	TagRefreshInterval time.Duration // refreshes the most pulled tags from the upstream, zero disables
+	TagRefreshCount    int           // number of most pulled tags refreshed
+
+	PrefetchWorkers   int      // prefetches the blobs of manifests pulled through the upstream, zero disables
+	PrefetchPlatforms []string // os/arch[/variant] of the manifest list entries prefetched, all if empty
+
+	Quotas               map[string]int64 // storage quotas in bytes of namespaces, the first component of repository names
+	QuotaDefault         int64            // storage quota in bytes of the namespaces not in Quotas, zero if unlimited
+	QuotaRefreshInterval time.Duration    // recomputes the storage used per namespace, quotas are disabled if zero
+
+	MaxUploadsPerClient int   // blob upload sessions in progress per user or IP, zero if unlimited
+	MaxBlobSize         int64 // size in bytes of the largest blob pushed or pulled, zero if unlimited
+	MaxImageSize        int64 // size in bytes of the blobs of the largest image pushed or pulled, zero if unlimited
+
+	LimitExemptPrefixes []netip.Prefix // client addresses exempt from MaxUploadsPerClient and the quotas
+	LimitExemptUsers    []string       // users exempt from MaxUploadsPerClient and the quotas
+
+	ReadOnly bool // only serves GET and HEAD requests, e.g. on a replica of the storage of another instance
+
+	OnRequest  func(RequestEvent) // optional, called once a request of the registry API is authorized
+	OnResponse func(RequestEvent) // optional, called once a request of the registry API is served, authorized or not
+}
+
+// BlobTracker receives blob usage observed at the API level, complementing
+// the access tracking done by the storage driver.
+type BlobTracker interface {
+	// Touch refreshes the access time of a tracked blob and reports whether
+	// the blob was tracked.
+	Touch(ctx context.Context, dgst digest.Digest) bool
+
+	// ExtendTTL raises the TTL of a tracked blob to at least ttl and reports
+	// whether the blob was tracked.
+	ExtendTTL(dgst digest.Digest, ttl time.Duration) bool
+}
+
+// ManifestListener is informed about manifests pushed through the API.
+type ManifestListener interface {
+	// ManifestPushed is called after a manifest was stored and, if pushed by
+	// tag, tagged. It must not block.
+	ManifestPushed(name reference.Named, tag string, dgst digest.Digest)
+}
+
+// BlobQuarantine keeps content of blobs failing digest verification out of
+// the cache for inspection.
+type BlobQuarantine interface {
+	// QuarantineContent keeps the content received for the blob dgst, which
+	// is not served nor stored until released.
+	QuarantineContent(ctx context.Context, dgst digest.Digest, content io.Reader, source, reason string) error
 }
 
 // App is a global registry application object. Shared resources can be placed
@@ -67,9 +150,49 @@ type App struct {
 	httpHost         url.URL
 	httpRelativeURLs bool
 	httpSecret       string
+	httpHeaders      http.Header
 
 	prometheusEnabled bool
 
+	catalogMaxEntries     int
+	catalogDefaultEntries int
+	tagsMaxEntries        int
+	tagsDefaultEntries    int
+
+	tracker        BlobTracker
+	headAccessMode cache.AccessMode
+
+	blobRouter       BlobRouter
+	manifestListener ManifestListener
+	blobQuarantine   BlobQuarantine
+	onRequest        func(RequestEvent)
+	onResponse       func(RequestEvent)
+	shardHTTPClient  *http.Client
+
+	upstream       *registryclient.Client
+	upstreamAllow  []string
+	upstreamDeny   []string
+	segments       int
+	segmentMin     int64
+	pullSignatures bool
+	trust          *TrustPolicy
+	pulling        sync.Map // digests of blobs being cached from the upstream
+	partialsMu     sync.Mutex
+	partials       map[digest.Digest]partialBlob // interrupted pulls to resume
+	quarantine     quarantine                    // upstream content not matching its digest
+	tagPulls       tagPulls
+	activity       activityLog // recent pulls, pushes and evictions
+
+	prefetchQueue     chan prefetchJob // manifests whose blobs are prefetched, nil if disabled
+	prefetchPlatforms []string
+
+	quotas     *quotas         // storage quotas of namespaces, nil if disabled
+	uploads    *uploadSessions // upload sessions in progress per client
+	exemptions limitExemptions // clients the uploads and quotas do not limit
+
+	maxBlobSize  int64
+	maxImageSize int64
+
 	// readOnly is true if the registry is in a read-only maintenance mode
 	readOnly bool
 }
@@ -87,13 +210,49 @@ func NewApp(ctx context.Context, config *Config) (*App, error) {
 		repoRemover:      config.RepoRemover,
 		accessController: config.AccessController,
 
-		httpSecret:        config.HttpSecret,
-		httpRelativeURLs:  config.HttpRelativeURLs,
-		prometheusEnabled: config.PrometheusEnabled,
+		httpSecret:            config.HttpSecret,
+		httpHeaders:           config.HttpHeaders,
+		httpRelativeURLs:      config.HttpRelativeURLs,
+		prometheusEnabled:     config.PrometheusEnabled,
+		catalogMaxEntries:     config.CatalogMaxEntries,
+		catalogDefaultEntries: config.CatalogDefaultEntries,
+		tagsMaxEntries:        config.TagsMaxEntries,
+		tagsDefaultEntries:    config.TagsDefaultEntries,
+		tracker:               config.Tracker,
+		headAccessMode:        config.HeadAccessMode,
+		blobRouter:            config.BlobRouter,
+		manifestListener:      config.ManifestListener,
+		blobQuarantine:        config.BlobQuarantine,
+		onRequest:             config.OnRequest,
+		onResponse:            config.OnResponse,
+		upstream:              config.Upstream,
+		upstreamAllow:         config.UpstreamAllow,
+		upstreamDeny:          config.UpstreamDeny,
+		segments:              config.UpstreamSegments,
+		segmentMin:            config.UpstreamSegmentMinSize,
+		pullSignatures:        config.UpstreamSignatures,
+		trust:                 config.TrustPolicy,
+		maxBlobSize:           config.MaxBlobSize,
+		maxImageSize:          config.MaxImageSize,
+		readOnly:              config.ReadOnly,
 	}
 	if app.router == nil {
 		app.router = v2.RouterWithPrefix(config.HttpPrefix)
 	}
+	if app.catalogMaxEntries <= 0 {
+		app.catalogMaxEntries = defaultCatalogMaxEntries
+	}
+	if app.catalogDefaultEntries <= 0 {
+		app.catalogDefaultEntries = defaultReturnedEntries
+	}
+	if app.blobRouter != nil {
+		app.shardHTTPClient = &http.Client{
+			// redirects, e.g. to storage backends, are passed to the client
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
 
 	// Register the handler dispatchers.
 	app.register(v2.RouteNameBase, func(ctx *Context, r *http.Request) http.Handler {
@@ -106,10 +265,28 @@ func NewApp(ctx context.Context, config *Config) (*App, error) {
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
 
-	purgeConfig := uploadPurgeDefaultConfig()
-	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	if app.upstream != nil && config.TagRefreshInterval > 0 && config.TagRefreshCount > 0 {
+		app.startTagRefresh(config.TagRefreshInterval, config.TagRefreshCount)
+	}
+	if app.upstream != nil && config.PrefetchWorkers > 0 {
+		app.prefetchPlatforms = config.PrefetchPlatforms
+		app.startPrefetch(config.PrefetchWorkers)
+	}
+	app.uploads = &uploadSessions{limit: config.MaxUploadsPerClient}
+	app.exemptions = limitExemptions{prefixes: config.LimitExemptPrefixes, users: config.LimitExemptUsers}
+	if config.QuotaRefreshInterval > 0 {
+		app.quotas = &quotas{limits: config.Quotas, defaultLimit: config.QuotaDefault}
+	}
+
+	if !app.readOnly {
+		purgeConfig := uploadPurgeDefaultConfig()
+		startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	}
 
 	options := registrymiddleware.GetRegistryOptions()
+	if config.BlobRedirect {
+		options = append(options, storage.EnableRedirect)
+	}
 
 	if config.HttpHost != "" {
 		if parsedHost, err := url.Parse(config.HttpHost); err != nil {
@@ -154,9 +331,19 @@ func NewApp(ctx context.Context, config *Config) (*App, error) {
 		dcontext.GetLogger(app).Warnf("Registry does not implement RepositoryRemover. Will not be able to delete repos and tags")
 	}
 
+	// usage is computed by walking the registry, which must exist by then
+	if app.quotas != nil {
+		app.startQuotaRefresh(config.QuotaRefreshInterval)
+	}
+
 	return app, nil
 }
 
+// Registry returns the registry backend of the app.
+func (app *App) Registry() distribution.Namespace {
+	return app.registry
+}
+
 // Shutdown close the underlying registry
 func (app *App) Shutdown() error {
 	if r, ok := app.registry.(proxy.Closer); ok {
@@ -169,7 +356,7 @@ func (app *App) Shutdown() error {
 // passed through the application filters and context will be constructed at
 // request time.
 func (app *App) register(routeName string, dispatch dispatchFunc) {
-	handler := app.dispatcher(dispatch)
+	handler := instrumentRoute(routeName, app.dispatcher(routeName, dispatch))
 
 	// Chain the handler with prometheus instrumented handler
 	if app.prometheusEnabled {
@@ -200,12 +387,21 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Prepare the context with our own little decorations.
 	ctx := r.Context()
 	ctx = dcontext.WithRequest(ctx, r)
+	if caller, ok := dcontext.ParseTraceContext(r.Header); ok {
+		// passed on to the upstream by the registry client
+		ctx = dcontext.WithTraceContext(ctx, caller)
+	}
 	ctx, w = dcontext.WithResponseWriter(ctx, w)
 	ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLogger(ctx))
 	r = r.WithContext(ctx)
 
 	// Set a header with the Docker Distribution API Version for all responses.
 	w.Header().Add("Docker-Distribution-API-Version", "registry/2.0")
+	for name, values := range app.httpHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
 	app.router.ServeHTTP(w, r)
 }
 
@@ -220,15 +416,23 @@ type dispatchFunc func(ctx *Context, r *http.Request) http.Handler
 
 // dispatcher returns a handler that constructs a request specific context and
 // handler, using the dispatch factory function.
-func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
+func (app *App) dispatcher(routeName string, dispatch dispatchFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//for headerName, headerValues := range app.Config.HTTP.Headers {
-		//	for _, value := range headerValues {
-		//		w.Header().Add(headerName, value)
-		//	}
-		//}
-
+		start := time.Now()
+		var body *countingBody
+		if app.onResponse != nil && r.Body != nil {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
 		context := app.context(w, r)
+		// a blob read in several parts, e.g. the ranges of a multi-range
+		// request, is accessed once
+		context.Context = cache.WithRequestAccess(context.Context, r.Header.Get("Range") != "")
+		if r.Method == http.MethodHead {
+			// existence probes, e.g. from buildkit, are frequent enough that
+			// persisting every access can be configured away
+			context.Context = cache.WithAccessMode(context.Context, app.headAccessMode)
+		}
 
 		defer func() {
 			// Automated error response handling here. Handlers may return their
@@ -240,6 +444,21 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			} else if status, ok := context.Value("http.response.status").(int); ok && status >= 200 && status <= 399 {
 				dcontext.GetResponseLogger(context).Infof("response completed")
 			}
+
+			if app.onResponse != nil {
+				event := requestEvent(routeName, context, r)
+				event.Status, _ = context.Value("http.response.status").(int)
+				if event.Status == 0 {
+					// nothing written, or only the body, which implies 200
+					event.Status = http.StatusOK
+				}
+				event.BytesWritten, _ = context.Value("http.response.written").(int64)
+				if body != nil {
+					event.BytesRead = body.n
+				}
+				event.Duration = time.Since(start)
+				app.onResponse(event)
+			}
 		}()
 
 		if err := app.authorized(w, r, context); err != nil {
@@ -289,6 +508,9 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			context.RepositoryRemover = context.App.repoRemover
 		}
 
+		if app.onRequest != nil {
+			app.onRequest(requestEvent(routeName, context, r))
+		}
 		dispatch(context, r).ServeHTTP(w, r)
 	})
 }
@@ -403,7 +625,13 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			// Add the appropriate WWW-Auth header
 			err.SetHeaders(r, w)
 
-			if err := errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(accessRecords)); err != nil {
+			// An authenticated user denied the access gets no use out of
+			// authenticating again
+			code := errcode.ErrorCodeUnauthorized
+			if errors.Is(err, dcsauth.ErrAccessDenied) {
+				code = errcode.ErrorCodeDenied
+			}
+			if err := errcode.ServeJSON(w, code.WithDetail(accessRecords)); err != nil {
 				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
 		default:
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -201,6 +202,65 @@ func TestNewApp(t *testing.T) {
 }
 
 // Test the access record accumulator
+// TestHttpHeaders checks that the configured headers are added to every
+// response, including errors.
+func TestHttpHeaders(t *testing.T) {
+	app, err := NewApp(dcontext.Background(), &Config{
+		Driver:           inmemory.New(),
+		AccessController: silly.MustNew("realm-test", "service-test"),
+		HttpHeaders: http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"Via":                    {"1.1 cache-a", "1.1 cache-b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating app: %v", err)
+	}
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("unexpected error during GET: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %v", resp.StatusCode)
+	}
+	if v := resp.Header.Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf("unexpected X-Content-Type-Options header: %q", v)
+	}
+	if v := resp.Header.Values("Via"); len(v) != 2 || v[0] != "1.1 cache-a" || v[1] != "1.1 cache-b" {
+		t.Errorf("unexpected Via headers: %q", v)
+	}
+}
+
+// TestStatusClass checks that the status class of route metrics is read from
+// the response writer instrumented in the request context.
+func TestStatusClass(t *testing.T) {
+	for _, tc := range []struct {
+		write    func(w http.ResponseWriter)
+		expected string
+	}{
+		{func(w http.ResponseWriter) {}, "2xx"},
+		{func(w http.ResponseWriter) { w.Write([]byte("body")) }, "2xx"},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusTemporaryRedirect) }, "3xx"},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, "4xx"},
+		{func(w http.ResponseWriter) { w.WriteHeader(499) }, "4xx"},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, "5xx"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		ctx, w := dcontext.WithResponseWriter(r.Context(), httptest.NewRecorder())
+		r = r.WithContext(ctx)
+		tc.write(w)
+		if class := statusClass(r); class != tc.expected {
+			t.Errorf("unexpected status class %q, expected %q", class, tc.expected)
+		}
+	}
+}
+
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
 
@@ -264,3 +324,30 @@ func TestAppendAccessRecords(t *testing.T) {
 		t.Fatal("Actual access record differs from expected")
 	}
 }
+
+func TestActivityLog(t *testing.T) {
+	var l activityLog
+	if entries := l.recent(10, ""); len(entries) != 0 {
+		t.Fatalf("unexpected activity %+v", entries)
+	}
+	for i := range activityEntries + 5 {
+		kind := ActivityPull
+		if i%2 == 1 {
+			kind = ActivityEvict
+		}
+		l.add(Activity{Kind: kind, Repository: fmt.Sprint(i)})
+	}
+
+	entries := l.recent(activityEntries+10, "")
+	if len(entries) != activityEntries {
+		t.Fatalf("got %d entries, want %d", len(entries), activityEntries)
+	}
+	if first, last := entries[0].Repository, entries[len(entries)-1].Repository; first != fmt.Sprint(activityEntries+4) || last != "5" {
+		t.Fatalf("got entries %s to %s, want %d to 5", first, last, activityEntries+4)
+	}
+
+	entries = l.recent(2, ActivityPull)
+	if len(entries) != 2 || entries[0].Repository != fmt.Sprint(activityEntries+4) || entries[1].Repository != fmt.Sprint(activityEntries+2) {
+		t.Fatalf("unexpected pulls %+v", entries)
+	}
+}
@@ -54,8 +54,14 @@ type blobHandler struct {
 // response.
 func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(bh).Debug("GetBlob")
+	if owner := bh.shardOwner(r, bh.Digest); owner != "" && bh.forwardBlob(w, r, owner) {
+		return
+	}
 	blobs := bh.Repository.Blobs(bh)
 	desc, err := blobs.Stat(bh, bh.Digest)
+	if err == distribution.ErrBlobUnknown && bh.App.upstream != nil && bh.pullBlob(w, r) {
+		return
+	}
 	if err != nil {
 		if err == distribution.ErrBlobUnknown {
 			bh.Errors = append(bh.Errors, errcode.ErrorCodeBlobUnknown.WithDetail(bh.Digest))
@@ -65,6 +71,10 @@ func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	bh.App.setCacheStatus(w, cacheHit)
+	if r.Method != http.MethodHead {
+		defer trackTransfer(transferDownload, desc.Size)()
+	}
 	if err := blobs.ServeBlob(bh, w, r, desc.Digest); err != nil {
 		dcontext.GetLogger(bh).Debugf("unexpected error getting blob HTTP handler: %v", err)
 		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
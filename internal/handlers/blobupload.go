@@ -70,6 +70,30 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 	fromRepo := r.FormValue("from")
 	mountDigest := r.FormValue("mount")
 
+	exempt := buh.exemptions.exempt(buh.Context, r)
+	if buh.quotas != nil && !exempt {
+		if err := buh.quotas.check(buh.Repository.Named().Name(), 0); err != nil {
+			buh.Errors = append(buh.Errors, err)
+			return
+		}
+	}
+
+	if buh.uploads != nil && !exempt {
+		reservation, err := buh.uploads.reserve(uploadClient(buh.Context, r))
+		if err != nil {
+			buh.Errors = append(buh.Errors, err)
+			return
+		}
+		defer func() {
+			// mounted blobs complete without an upload session
+			if buh.Upload != nil {
+				buh.uploads.bind(reservation, buh.Upload.ID())
+			} else {
+				buh.uploads.end(reservation)
+			}
+		}()
+	}
+
 	if mountDigest != "" && fromRepo != "" {
 		opt, err := buh.createBlobMountOption(fromRepo, mountDigest)
 		if opt != nil && err == nil {
@@ -134,6 +158,9 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadUnknown)
 		return
 	}
+	if buh.uploads != nil {
+		defer buh.uploads.begin(buh.UUID)()
+	}
 
 	ct := r.Header.Get("Content-Type")
 	if ct != "" && ct != "application/octet-stream" {
@@ -166,8 +193,7 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+	if !buh.copyBlobData(w, r, "blob PATCH") {
 		return
 	}
 
@@ -190,6 +216,10 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 	defer buh.Upload.Close()
+	if buh.uploads != nil {
+		defer buh.uploads.end(buh.UUID)
+		defer buh.uploads.begin(buh.UUID)()
+	}
 
 	dgstStr := r.FormValue("digest") // TODO(stevvooe): Support multiple digest parameters!
 
@@ -206,11 +236,20 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+	if !buh.copyBlobData(w, r, "blob PUT") {
 		return
 	}
 
+	if buh.quotas != nil && !buh.exemptions.exempt(buh.Context, r) {
+		if err := buh.quotas.check(buh.Repository.Named().Name(), buh.Upload.Size()); err != nil {
+			buh.Errors = append(buh.Errors, err)
+			if err := buh.Upload.Cancel(buh); err != nil {
+				dcontext.GetLogger(buh).Errorf("error canceling upload after error: %v", err)
+			}
+			return
+		}
+	}
+
 	desc, err := buh.Upload.Commit(buh, v1.Descriptor{
 		Digest: dgst,
 
@@ -247,6 +286,18 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 
 		return
 	}
+	if buh.quotas != nil {
+		buh.quotas.add(buh.Repository.Named().Name(), desc.Size)
+	}
+	if owner := buh.shardOwner(r, desc.Digest); owner != "" {
+		name := buh.Repository.Named()
+		authorization := r.Header.Get("Authorization")
+		go func() {
+			if err := buh.App.handOffBlob(buh.App, owner, name, desc, authorization); err != nil {
+				dcontext.GetLogger(buh.App).Errorf("failed to hand off blob %s to %s: %v", desc.Digest, owner, err)
+			}
+		}()
+	}
 	if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -260,6 +311,9 @@ func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Re
 		return
 	}
 	defer buh.Upload.Close()
+	if buh.uploads != nil {
+		defer buh.uploads.end(buh.UUID)
+	}
 
 	w.Header().Set("Docker-Upload-UUID", buh.UUID)
 	if err := buh.Upload.Cancel(buh); err != nil {
@@ -9,12 +9,20 @@ import (
 	"strconv"
 
 	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
 )
 
+// defaultReturnedEntries is the number of catalog entries returned by a
+// request without n when not configured otherwise.
 const defaultReturnedEntries = 100
 
+// defaultCatalogMaxEntries is the maximum number of catalog entries returned
+// by a single request when not configured otherwise.
+const defaultCatalogMaxEntries = 1000
+
 func catalogDispatcher(ctx *Context, r *http.Request) http.Handler {
 	catalogHandler := &catalogHandler{
 		Context: ctx,
@@ -39,8 +47,8 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	lastEntry := q.Get("last")
 
-	entries := defaultReturnedEntries
-	maximumConfiguredEntries := 100 // ch.App.Config.Catalog.MaxEntries // FIXME
+	entries := ch.App.catalogDefaultEntries
+	maximumConfiguredEntries := ch.App.catalogMaxEntries
 
 	// parse n, if n is negative abort with an error
 	if n := q.Get("n"); n != "" {
@@ -71,17 +79,39 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	if entries == 0 {
 		moreEntries = false
 	} else {
-		returnedRepositories, err := ch.App.registry.Repositories(ch.Context, repos, lastEntry)
-		if err != nil {
-			_, pathNotFound := err.(driver.PathNotFoundError)
-			if err != io.EOF && !pathNotFound {
-				ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-				return
+		// Repositories the user may not pull are skipped, so keep reading
+		// until the page is full or the registry runs out of entries.
+		last := lastEntry
+		for filled < entries {
+			batch := make([]string, entries-filled)
+			returnedRepositories, err := ch.App.registry.Repositories(ch.Context, batch, last)
+			for _, repo := range batch[:returnedRepositories] {
+				if ch.canPull(r, repo) {
+					repos[filled] = repo
+					filled++
+				}
+			}
+			if returnedRepositories > 0 {
+				last = batch[returnedRepositories-1]
 			}
-			// err is either io.EOF or not PathNotFoundError
+			if err != nil {
+				_, pathNotFound := err.(driver.PathNotFoundError)
+				if err != io.EOF && !pathNotFound {
+					ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+					return
+				}
+				// err is either io.EOF or not PathNotFoundError
+				moreEntries = false
+				break
+			}
+			if returnedRepositories == 0 {
+				moreEntries = false
+				break
+			}
+		}
+		if filled == 0 {
 			moreEntries = false
 		}
-		filled = returnedRepositories
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -106,6 +136,29 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// canPull reports whether the requesting user is allowed to pull from the
+// named repository, so that the catalog only lists visible repositories.
+// The permissions of the user authorized for the catalog are checked
+// directly when the access controller supports it, rather than authorizing
+// the request again for every repository.
+func (ch *catalogHandler) canPull(r *http.Request, name string) bool {
+	if ch.App.accessController == nil {
+		return true
+	}
+	access := auth.Access{
+		Resource: auth.Resource{
+			Type: "repository",
+			Name: name,
+		},
+		Action: "pull",
+	}
+	if authorizer, ok := ch.App.accessController.(dcsauth.Authorizer); ok {
+		return authorizer.Allows(r.WithContext(ch.Context), getUserName(ch.Context, r), access)
+	}
+	_, err := ch.App.accessController.Authorized(r.WithContext(ch.Context), access)
+	return err == nil
+}
+
 // Use the original URL from the request to create a new URL for
 // the link header
 func createLinkEntry(origURL string, maxEntries int, lastEntry string) (string, error) {
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+// DedupStats describes how much storage is saved by sharing blobs between
+// repositories.
+type DedupStats struct {
+	// Repositories is the number of repositories inspected.
+	Repositories int `json:"repositories"`
+
+	// UniqueBlobs is the number of blobs physically present in storage.
+	UniqueBlobs int `json:"unique_blobs"`
+
+	// References is the number of repository to blob links.
+	References int `json:"references"`
+
+	// LogicalSize is the sum of the sizes of all blobs referenced by each
+	// repository, counting shared blobs once per repository.
+	LogicalSize int64 `json:"logical_size"`
+
+	// PhysicalSize is the sum of the sizes of all unique blobs.
+	PhysicalSize int64 `json:"physical_size"`
+
+	// Ratio is LogicalSize divided by PhysicalSize.
+	Ratio float64 `json:"ratio"`
+
+	// TopShared lists the blobs referenced by the most repositories.
+	TopShared []SharedBlob `json:"top_shared"`
+}
+
+// SharedBlob describes a blob referenced from multiple repositories.
+type SharedBlob struct {
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+	Repositories []string      `json:"repositories"`
+}
+
+// DedupStats walks every repository and computes deduplication statistics,
+// returning at most top entries in TopShared. Reading the layer links does
+// not count as an access of the blobs.
+func (app *App) DedupStats(ctx context.Context, top int) (*DedupStats, error) {
+	ctx = cache.WithAccessMode(ctx, cache.AccessSkip)
+	repositoryEnumerator, ok := app.registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("registry does not support repository enumeration")
+	}
+
+	statter := app.registry.BlobStatter()
+	sizes := make(map[digest.Digest]int64)
+	sizeOf := func(dgst digest.Digest) (int64, error) {
+		if size, ok := sizes[dgst]; ok {
+			return size, nil
+		}
+		desc, err := statter.Stat(ctx, dgst)
+		if err != nil {
+			return 0, err
+		}
+		sizes[dgst] = desc.Size
+		return desc.Size, nil
+	}
+
+	stats := &DedupStats{}
+	referrers := make(map[digest.Digest][]string)
+
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		stats.Repositories++
+
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := app.registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		blobEnumerator, ok := repository.Blobs(ctx).(distribution.BlobEnumerator)
+		if !ok {
+			return fmt.Errorf("blob store of %s does not support enumeration", repoName)
+		}
+
+		err = blobEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			size, err := sizeOf(dgst)
+			if err != nil {
+				if err == distribution.ErrBlobUnknown {
+					return nil
+				}
+				return err
+			}
+			stats.References++
+			stats.LogicalSize += size
+			referrers[dgst] = append(referrers[dgst], repoName)
+			return nil
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// repositories without any layer links
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.registry.Blobs().Enumerate(ctx, func(dgst digest.Digest) error {
+		size, err := sizeOf(dgst)
+		if err != nil {
+			if err == distribution.ErrBlobUnknown {
+				return nil
+			}
+			return err
+		}
+		stats.UniqueBlobs++
+		stats.PhysicalSize += size
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
+	if stats.PhysicalSize > 0 {
+		stats.Ratio = float64(stats.LogicalSize) / float64(stats.PhysicalSize)
+	}
+
+	for dgst, repos := range referrers {
+		if len(repos) < 2 {
+			continue
+		}
+		stats.TopShared = append(stats.TopShared, SharedBlob{
+			Digest:       dgst,
+			Size:         sizes[dgst],
+			Repositories: repos,
+		})
+	}
+	// Rank by the space saved through sharing, i.e. size times extra references.
+	sort.Slice(stats.TopShared, func(i, j int) bool {
+		si := stats.TopShared[i].Size * int64(len(stats.TopShared[i].Repositories)-1)
+		sj := stats.TopShared[j].Size * int64(len(stats.TopShared[j].Repositories)-1)
+		if si != sj {
+			return si > sj
+		}
+		return stats.TopShared[i].Digest < stats.TopShared[j].Digest
+	})
+	if top >= 0 && len(stats.TopShared) > top {
+		stats.TopShared = stats.TopShared[:top]
+	}
+
+	return stats, nil
+}
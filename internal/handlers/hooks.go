@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/internal/requestutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// RequestEvent describes a request of the registry API to the OnRequest and
+// OnResponse hooks
+type RequestEvent struct {
+	// Route is the name of the route as labeled in the request metrics,
+	// e.g. "manifest", "blob", "blob_upload" or "blob_upload_chunk"
+	Route  string
+	Method string
+
+	// Repository is the name of the repository, empty for the base and
+	// catalog routes
+	Repository string
+	// Digest is the digest of the blob or manifest, or of the blob an upload
+	// completes. Tag is the tag of a manifest requested by tag instead.
+	Digest digest.Digest
+	Tag    string
+
+	// User is the authenticated user, empty until the request is authorized
+	// and for anonymous requests
+	User       string
+	RemoteAddr string
+
+	// Status, the bytes of the request and response bodies and the time
+	// serving the request took are only set for OnResponse
+	Status       int
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+}
+
+// requestEvent returns the event describing the request r of the route
+// routeName, served with ctx
+func requestEvent(routeName string, ctx *Context, r *http.Request) RequestEvent {
+	event := RequestEvent{
+		Route:      strings.ReplaceAll(routeName, "-", "_"),
+		Method:     r.Method,
+		Repository: getName(ctx),
+		User:       dcontext.GetStringValue(ctx, userNameKey),
+		RemoteAddr: requestutil.RemoteIP(r),
+	}
+	if dgst, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.digest")); err == nil {
+		event.Digest = dgst
+	} else if ref := getReference(ctx); ref != "" {
+		if dgst, err := digest.Parse(ref); err == nil {
+			event.Digest = dgst
+		} else {
+			event.Tag = ref
+		}
+	} else if dgst, err := digest.Parse(r.URL.Query().Get("digest")); err == nil {
+		// completing an upload
+		event.Digest = dgst
+	}
+	return event
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
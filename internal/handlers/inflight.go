@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+)
+
+// Directions of blob transfers
+const (
+	transferDownload = "download"
+	transferUpload   = "upload"
+)
+
+var (
+	inflightNamespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "inflight", nil)
+
+	inflightUploadSessions = inflightNamespace.NewGauge("upload_sessions", "The blob upload sessions started and neither completed, canceled nor idle", "")
+	inflightTransfers      = inflightNamespace.NewLabeledGauge("transfers", "The blob bodies being sent to or received from clients", "", "direction")
+	inflightTransferSize   = inflightNamespace.NewLabeledGauge("transfer", "The size of the blob bodies being sent to or received from clients, when known", metrics.Bytes, "direction")
+)
+
+func init() {
+	metrics.Register(inflightNamespace)
+}
+
+// trackTransfer counts a blob body of size bytes, negative if unknown, being
+// transferred in direction until the returned function is called
+func trackTransfer(direction string, size int64) func() {
+	if size < 0 {
+		size = 0
+	}
+	transfers := inflightTransfers.WithValues(direction)
+	bytes := inflightTransferSize.WithValues(direction)
+	transfers.Inc()
+	bytes.Add(float64(size))
+	return func() {
+		transfers.Dec()
+		bytes.Add(-float64(size))
+	}
+}
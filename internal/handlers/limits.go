@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+)
+
+// errorCodeSizeExceeded is returned for blobs and images larger than the
+// configured limits
+var errorCodeSizeExceeded = errcode.Register("docker-cache-server", errcode.ErrorDescriptor{
+	Value:          "SIZE_EXCEEDED",
+	Message:        "content exceeds the size limit",
+	Description:    "The blob or image is larger than the size limit of the registry.",
+	HTTPStatusCode: http.StatusRequestEntityTooLarge,
+})
+
+// checkBlobSize returns an error if a blob of size bytes exceeds the maximum
+// blob size
+func (app *App) checkBlobSize(dgst digest.Digest, size int64) error {
+	if app.maxBlobSize <= 0 || size <= app.maxBlobSize {
+		return nil
+	}
+	blob := "blob"
+	if dgst != "" {
+		blob += " " + dgst.String()
+	}
+	return errorCodeSizeExceeded.WithMessage(fmt.Sprintf(
+		"%s of %d bytes exceeds the maximum blob size of %d bytes", blob, size, app.maxBlobSize))
+}
+
+// checkImageSize returns an error if a blob referenced by manifest exceeds
+// the maximum blob size, or all of them together the maximum image size.
+// The manifests of an index are checked on their own.
+func (app *App) checkImageSize(dgst digest.Digest, manifest distribution.Manifest) error {
+	if isIndex(manifest) || (app.maxBlobSize <= 0 && app.maxImageSize <= 0) {
+		return nil
+	}
+	var size int64
+	for _, desc := range manifest.References() {
+		if err := app.checkBlobSize(desc.Digest, desc.Size); err != nil {
+			return err
+		}
+		size += desc.Size
+	}
+	if app.maxImageSize > 0 && size > app.maxImageSize {
+		return errorCodeSizeExceeded.WithMessage(fmt.Sprintf(
+			"image %s of %d bytes exceeds the maximum image size of %d bytes", dgst, size, app.maxImageSize))
+	}
+	return nil
+}
+
+// uploadLimit returns the number of bytes the upload may still receive, -1
+// if unlimited, or an error if the request announces more.
+func (buh *blobUploadHandler) uploadLimit(r *http.Request) (int64, error) {
+	if buh.maxBlobSize <= 0 {
+		return -1, nil
+	}
+	size := buh.Upload.Size()
+	if r.ContentLength > 0 {
+		if err := buh.checkBlobSize("", size+r.ContentLength); err != nil {
+			return 0, err
+		}
+	}
+	// copyFullPayload does not limit a request to zero bytes, the size of the
+	// upload is checked once more after the copy
+	return max(buh.maxBlobSize-size, 1), nil
+}
+
+// copyBlobData copies the payload of a blob upload request into the upload,
+// enforcing the maximum blob size. An upload exceeding it is canceled.
+func (buh *blobUploadHandler) copyBlobData(w http.ResponseWriter, r *http.Request, action string) bool {
+	limit, err := buh.uploadLimit(r)
+	if err == nil {
+		done := trackTransfer(transferUpload, r.ContentLength)
+		err = copyFullPayload(buh, w, r, buh.Upload, limit, action)
+		done()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = errorCodeSizeExceeded.WithMessage(fmt.Sprintf(
+				"blob exceeds the maximum blob size of %d bytes", buh.maxBlobSize))
+		} else if err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+			return false
+		} else if limit > 0 {
+			err = buh.checkBlobSize("", buh.Upload.Size())
+		}
+	}
+	if err != nil {
+		buh.Errors = append(buh.Errors, err)
+		if err := buh.Upload.Cancel(buh); err != nil {
+			dcontext.GetLogger(buh).Errorf("error canceling upload after error: %v", err)
+		}
+		if buh.uploads != nil {
+			buh.uploads.end(buh.UUID)
+		}
+		return false
+	}
+	return true
+}
+
+// limitExemptions are the clients the limit of upload sessions per client
+// and the namespace quotas do not apply to, e.g. the CI
+type limitExemptions struct {
+	prefixes []netip.Prefix
+	users    []string
+}
+
+// exempt reports whether the client of r is exempt from the limits. The
+// address is the one of the connection, not of proxy headers clients could
+// forge, and the user must have been authenticated.
+func (e limitExemptions) exempt(ctx *Context, r *http.Request) bool {
+	if username := dcontext.GetStringValue(ctx, userNameKey); username != "" && slices.Contains(e.users, username) {
+		return true
+	}
+	if len(e.prefixes) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(e.prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
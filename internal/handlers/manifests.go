@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
@@ -18,6 +20,7 @@ import (
 	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
 	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
@@ -28,6 +31,10 @@ const (
 	defaultOS           = "linux"
 	maxManifestBodySize = 4 * 1024 * 1024
 	imageClass          = "image"
+
+	// ttlAnnotation on a pushed manifest extends the cache TTL of the image,
+	// e.g. "io.dcs.cache.ttl": "720h".
+	ttlAnnotation = "io.dcs.cache.ttl"
 )
 
 type storageType int
@@ -115,21 +122,44 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	cacheStatus := cacheHit
 	if imh.Tag != "" {
 		tags := imh.Repository.Tags(imh)
 		desc, err := tags.Get(imh, imh.Tag)
+		if _, ok := err.(distribution.ErrTagUnknown); ok && imh.App.upstream != nil {
+			if !imh.App.upstreamAllowed(imh.Repository.Named()) {
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied)
+				return
+			}
+			desc, err = imh.pullManifest(imh.Tag)
+			cacheStatus = cacheMiss
+			if errors.Is(err, registryclient.ErrNotFound) {
+				err = distribution.ErrTagUnknown{Tag: imh.Tag}
+			}
+		}
 		if err != nil {
 			if _, ok := err.(distribution.ErrTagUnknown); ok {
 				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+			} else if trustErr, ok := trustError(err); ok {
+				imh.Errors = append(imh.Errors, trustErr)
+			} else if ecErr, ok := err.(errcode.Error); ok {
+				imh.Errors = append(imh.Errors, ecErr)
 			} else {
 				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			}
 			return
 		}
 		imh.Digest = desc.Digest
+		if imh.App.upstream != nil {
+			imh.App.tagPulls.record(imh.Repository.Named().Name(), imh.Tag)
+		}
 	}
 
 	if etagMatch(r, imh.Digest.String()) {
+		// a 304 carries the validators so pollers can keep their cached copy
+		imh.App.setCacheStatus(w, cacheStatus)
+		w.Header().Set("Docker-Content-Digest", imh.Digest.String())
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, imh.Digest))
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -139,9 +169,28 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		options = append(options, distribution.WithTag(imh.Tag))
 	}
 	manifest, err := manifests.Get(imh, imh.Digest, options...)
+	if _, ok := err.(distribution.ErrManifestUnknownRevision); ok && imh.App.upstream != nil && imh.Tag == "" {
+		if !imh.App.upstreamAllowed(imh.Repository.Named()) {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied)
+			return
+		}
+		if _, pullErr := imh.pullManifest(imh.Digest.String()); pullErr == nil {
+			cacheStatus = cacheMiss
+			manifest, err = manifests.Get(imh, imh.Digest)
+		} else if !errors.Is(pullErr, registryclient.ErrNotFound) {
+			err = pullErr
+		}
+	}
+	if err == nil && imh.App.trust != nil && !isSignatureTag(imh.Tag) {
+		err = imh.App.trust.verify(imh, imh.Repository, imh.Digest, manifest)
+	}
 	if err != nil {
 		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+		} else if trustErr, ok := trustError(err); ok {
+			imh.Errors = append(imh.Errors, trustErr)
+		} else if ecErr, ok := err.(errcode.Error); ok {
+			imh.Errors = append(imh.Errors, ecErr)
 		} else {
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		}
@@ -211,6 +260,12 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	imh.touchReferences(manifest)
+	if imh.App.prefetchQueue != nil && r.Method == http.MethodGet {
+		imh.App.enqueuePrefetch(imh, imh.Repository.Named(), manifest)
+	}
+
+	imh.App.setCacheStatus(w, cacheStatus)
 	w.Header().Set("Content-Type", ct)
 	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
@@ -220,15 +275,104 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	activity := Activity{Kind: ActivityPull, Repository: imh.Repository.Named().Name(), Reference: imh.Tag, Digest: imh.Digest}
+	if imh.App.upstream != nil {
+		activity.Cache = cacheStatus
+	}
+	imh.App.recordActivity(imh.Context, r, activity)
+
 	if _, err := w.Write(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// touchReferences refreshes the access time of the blobs referenced by the
+// manifest. Clients skip blobs they already hold, so without this a config
+// blob or artifact layer could expire while the manifest pointing to it is
+// still being pulled.
+func (imh *manifestHandler) touchReferences(manifest distribution.Manifest) {
+	if imh.App.tracker == nil {
+		return
+	}
+	if isIndex(manifest) {
+		// child manifests are tracked when they are pulled themselves
+		return
+	}
+	for _, desc := range manifest.References() {
+		imh.App.tracker.Touch(imh, desc.Digest)
+	}
+}
+
+// isIndex reports whether the manifest is a manifest list or OCI image index.
+func isIndex(manifest distribution.Manifest) bool {
+	switch manifest.(type) {
+	case *manifestlist.DeserializedManifestList, *ocischema.DeserializedImageIndex:
+		return true
+	}
+	return false
+}
+
+// parseTTLAnnotation returns the TTL requested through ttlAnnotation, or zero
+// if the annotation is absent.
+func parseTTLAnnotation(annotations map[string]string) (time.Duration, error) {
+	value, ok := annotations[ttlAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q: %w", ttlAnnotation, value, err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be positive", ttlAnnotation, value)
+	}
+	return ttl, nil
+}
+
+// extendTTL applies ttl to the manifest and every blob it references. For an
+// index the child manifests and their blobs are included as well.
+func (imh *manifestHandler) extendTTL(manifests distribution.ManifestService, manifest distribution.Manifest, dgst digest.Digest, ttl time.Duration) {
+	tracker := imh.App.tracker
+	if tracker == nil {
+		return
+	}
+	tracker.ExtendTTL(dgst, ttl)
+
+	if !isIndex(manifest) {
+		for _, desc := range manifest.References() {
+			tracker.ExtendTTL(desc.Digest, ttl)
+		}
+		return
+	}
+
+	for _, child := range manifest.References() {
+		tracker.ExtendTTL(child.Digest, ttl)
+		childManifest, err := manifests.Get(imh, child.Digest)
+		if err != nil {
+			dcontext.GetLogger(imh).Warnf("unable to extend TTL of child manifest %s: %v", child.Digest, err)
+			continue
+		}
+		for _, desc := range childManifest.References() {
+			tracker.ExtendTTL(desc.Digest, ttl)
+		}
+	}
+}
+
+// etagMatch reports whether any entity tag listed in the If-None-Match
+// headers of the request matches etag. Tags may be quoted or unquoted, weak
+// or strong, and "*" matches any existing manifest.
 func etagMatch(r *http.Request, etag string) bool {
 	for _, headerVal := range r.Header["If-None-Match"] {
-		if headerVal == etag || headerVal == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
-			return true
+		for _, candidate := range strings.Split(headerVal, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" {
+				return true
+			}
+			// weak comparison is sufficient for GET and HEAD
+			candidate = strings.TrimPrefix(candidate, "W/")
+			if candidate == etag || candidate == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
+				return true
+			}
 		}
 	}
 	return false
@@ -270,6 +414,17 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	ttl, err := parseTTLAnnotation(desc.Annotations)
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if err := imh.App.checkImageSize(desc.Digest, manifest); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	isAnOCIManifest := mediaType == v1.MediaTypeImageManifest || mediaType == v1.MediaTypeImageIndex
 
 	if isAnOCIManifest {
@@ -332,6 +487,15 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 
 	}
 
+	if ttl > 0 {
+		dcontext.GetLogger(imh).Infof("extending TTL of %s to %s", imh.Digest, ttl)
+		imh.extendTTL(manifests, manifest, imh.Digest, ttl)
+	}
+
+	if imh.App.manifestListener != nil {
+		imh.App.manifestListener.ManifestPushed(imh.Repository.Named(), imh.Tag, imh.Digest)
+	}
+
 	// Construct a canonical url for the uploaded manifest.
 	ref, err := reference.WithDigest(imh.Repository.Named(), imh.Digest)
 	if err != nil {
@@ -347,6 +511,8 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		dcontext.GetLogger(imh).Errorf("error building manifest url from digest: %v", err)
 	}
 
+	imh.App.recordActivity(imh.Context, r, Activity{Kind: ActivityPush, Repository: imh.Repository.Named().Name(), Reference: imh.Tag, Digest: imh.Digest})
+
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
 	w.WriteHeader(http.StatusCreated)
@@ -370,6 +536,7 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 			}
 			return
 		}
+		imh.App.recordActivity(imh.Context, r, Activity{Kind: ActivityDelete, Repository: imh.Repository.Named().Name(), Reference: imh.Tag})
 		w.WriteHeader(http.StatusAccepted)
 		return
 	}
@@ -427,5 +594,6 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 	_ = g.Wait() // imh will record all errors, so ignore the error of Wait()
 	imh.Errors = errs
 
+	imh.App.recordActivity(imh.Context, r, Activity{Kind: ActivityDelete, Repository: imh.Repository.Named().Name(), Digest: imh.Digest})
 	w.WriteHeader(http.StatusAccepted)
 }
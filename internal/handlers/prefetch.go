@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// prefetchQueueSize is the number of pulled manifests waiting for their
+// blobs to be prefetched before new ones are dropped
+const prefetchQueueSize = 100
+
+// prefetchJob is a manifest pulled by a client whose blobs are prefetched
+type prefetchJob struct {
+	name     reference.Named
+	manifest distribution.Manifest
+}
+
+// startPrefetch starts workers pulling the blobs of manifests pulled by
+// clients from the upstream, so that the following blob requests are cache
+// hits. The workers stop when the app context is done.
+func (app *App) startPrefetch(workers int) {
+	app.prefetchQueue = make(chan prefetchJob, prefetchQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-app.Done():
+					return
+				case job := <-app.prefetchQueue:
+					app.prefetch(app, job.name, job.manifest)
+				}
+			}
+		}()
+	}
+}
+
+// enqueuePrefetch queues the blobs of a pulled manifest to be prefetched
+func (app *App) enqueuePrefetch(ctx context.Context, name reference.Named, manifest distribution.Manifest) {
+	select {
+	case app.prefetchQueue <- prefetchJob{name: name, manifest: manifest}:
+	default:
+		dcontext.GetLogger(ctx).Warnf("prefetch queue full, not prefetching blobs of %s", name.Name())
+	}
+}
+
+// prefetch pulls the blobs referenced by manifest into the named repository.
+// The child manifests of an index are pulled together with their blobs,
+// unless their platform is not one of the prefetched platforms.
+func (app *App) prefetch(ctx context.Context, name reference.Named, manifest distribution.Manifest) {
+	log := dcontext.GetLogger(ctx)
+	repository, err := app.registry.Repository(ctx, name)
+	if err != nil {
+		log.Warnf("failed to prefetch blobs of %s: %v", name.Name(), err)
+		return
+	}
+
+	for _, desc := range manifest.References() {
+		if !isIndex(manifest) {
+			if err := app.prefetchBlob(ctx, repository, desc.Digest); err != nil {
+				log.Warnf("failed to prefetch blob %s of %s: %v", desc.Digest, name.Name(), err)
+			}
+			continue
+		}
+		if !matchPlatform(app.prefetchPlatforms, desc.Platform) {
+			continue
+		}
+
+		child, err := app.getOrPullManifest(ctx, repository, desc.Digest)
+		if err != nil {
+			log.Warnf("failed to prefetch manifest %s of %s: %v", desc.Digest, name.Name(), err)
+			continue
+		}
+		app.prefetch(ctx, name, child)
+	}
+}
+
+// getOrPullManifest returns a manifest of repository, pulling it from the
+// upstream when it is missing.
+func (app *App) getOrPullManifest(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (distribution.Manifest, error) {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := manifests.Get(ctx, dgst)
+	if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+		if _, err := app.pullManifest(ctx, repository, dgst.String(), ""); err != nil {
+			return nil, err
+		}
+		manifest, err = manifests.Get(ctx, dgst)
+	}
+	return manifest, err
+}
+
+// prefetchBlob pulls a blob missing from the cache from the upstream,
+// unless it is already being pulled.
+func (app *App) prefetchBlob(ctx context.Context, repository distribution.Repository, dgst digest.Digest) error {
+	if _, err := repository.Blobs(ctx).Stat(ctx, dgst); err == nil {
+		return nil
+	}
+	if app.quarantine.contains(dgst) {
+		return fmt.Errorf("blob %s is quarantined after not matching its digest", dgst)
+	}
+	if _, pulling := app.pulling.LoadOrStore(dgst, struct{}{}); pulling {
+		return nil
+	}
+	defer app.pulling.Delete(dgst)
+
+	var offset int64
+	bw := app.resumePartialBlob(ctx, repository, dgst)
+	if bw != nil {
+		offset = bw.Size()
+	}
+	blobURL, err := app.upstream.BlobURL(repository.Named(), dgst)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := app.upstream.Do(req)
+	if err != nil {
+		if bw != nil {
+			app.keepPartialBlob(ctx, repository, dgst, bw)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if bw != nil && !resumes(resp, offset) {
+		bw.Cancel(ctx)
+		bw = nil
+	}
+	if bw == nil && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getting blob %s: unexpected status %s", dgst, resp.Status)
+	}
+	size := resp.ContentLength
+	if bw != nil {
+		size += offset
+	}
+	if err := app.checkBlobSize(dgst, size); err != nil {
+		if bw != nil {
+			bw.Cancel(ctx)
+		}
+		return err
+	}
+	return app.cacheBlob(ctx, repository, dgst, resp, bw, nil)
+}
+
+// matchPlatform reports whether platform is one of platforms, given as
+// os/arch or os/arch/variant. Any platform matches an empty list, as does a
+// manifest without platform.
+func matchPlatform(platforms []string, platform *v1.Platform) bool {
+	if len(platforms) == 0 || platform == nil {
+		return true
+	}
+	for _, p := range platforms {
+		parts := strings.Split(p, "/")
+		if len(parts) < 2 || parts[0] != platform.OS || parts[1] != platform.Architecture {
+			continue
+		}
+		if len(parts) == 2 || parts[2] == platform.Variant {
+			return true
+		}
+	}
+	return false
+}
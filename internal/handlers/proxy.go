@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pullManifest pulls the manifest with the given tag or digest from the
+// upstream registry into the cache. Pulled tags are stored like pushed
+// ones. The referenced blobs are pulled when they are requested.
+func (imh *manifestHandler) pullManifest(tagOrDigest string) (v1.Descriptor, error) {
+	return imh.App.pullManifest(imh, imh.Repository, tagOrDigest, imh.Tag)
+}
+
+// pullManifest pulls a manifest from the upstream registry into repository,
+// tagging it with tag if set. A tag already pointing to the pulled manifest
+// is left as it is. With a trust policy, manifests without a valid signature
+// are not pulled.
+func (app *App) pullManifest(ctx context.Context, repository distribution.Repository, tagOrDigest string, tag string) (v1.Descriptor, error) {
+	if dgst, err := digest.Parse(tagOrDigest); err == nil && app.quarantine.contains(dgst) {
+		return v1.Descriptor{}, fmt.Errorf("manifest %s is quarantined after not matching its digest", dgst)
+	}
+	mediaType, payload, err := app.upstream.GetManifest(ctx, repository.Named(), tagOrDigest)
+	var mismatch registryclient.DigestMismatchError
+	if errors.As(err, &mismatch) {
+		dcontext.GetLogger(ctx).Errorf("manifest %s of %s from upstream does not match its digest", tagOrDigest, repository.Named().Name())
+		app.quarantine.add(QuarantineEntry{
+			Kind:       "manifest",
+			Repository: repository.Named().Name(),
+			Digest:     mismatch.Digest,
+			Reason:     err.Error(),
+		})
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	manifest, desc, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("parsing upstream manifest: %w", err)
+	}
+	if err := app.checkImageSize(desc.Digest, manifest); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	tags := repository.Tags(ctx)
+	if tag != "" {
+		if current, err := tags.Get(ctx, tag); err == nil && current.Digest == desc.Digest {
+			return desc, nil
+		}
+	}
+	if app.trust != nil && !isSignatureTag(tag) {
+		if err := app.pullSignature(ctx, repository, desc.Digest, manifest); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	manifests, err := repository.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if _, err := manifests.Put(ctx, manifest); err != nil {
+		return v1.Descriptor{}, err
+	}
+	if tag != "" {
+		if err := tags.Tag(ctx, tag, desc); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+	dcontext.GetLogger(ctx).Infof("pulled manifest %s of %s from upstream", desc.Digest, repository.Named().Name())
+	if app.pullSignatures && !isSignatureTag(tag) {
+		go app.pullSignatureTags(context.WithoutCancel(ctx), repository, desc.Digest)
+	}
+	return desc, nil
+}
+
+// signatureTagSuffixes are appended to the digest tag of a manifest to name
+// the tags cosign stores its signatures, attestations and SBOMs under. The
+// digest tag itself holds the index of referrers of registries without the
+// referrers API.
+var signatureTagSuffixes = []string{".sig", ".att", ".sbom", ""}
+
+// isSignatureTag reports whether tag is the digest tag of another manifest
+func isSignatureTag(tag string) bool {
+	return strings.HasPrefix(tag, string(digest.SHA256)+"-")
+}
+
+// pullSignatureTags pulls the signatures, attestations and referrers of the
+// manifest dgst of repository together with their blobs, so that they can
+// be verified against the cache while the upstream is unreachable.
+func (app *App) pullSignatureTags(ctx context.Context, repository distribution.Repository, dgst digest.Digest) {
+	log := dcontext.GetLogger(ctx)
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		log.Warnf("failed to pull signatures of %s: %v", dgst, err)
+		return
+	}
+	for _, suffix := range signatureTagSuffixes {
+		tag := string(dgst.Algorithm()) + "-" + dgst.Encoded() + suffix
+		desc, err := app.pullManifest(ctx, repository, tag, tag)
+		if errors.Is(err, registryclient.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("failed to pull %s:%s from upstream: %v", repository.Named().Name(), tag, err)
+			continue
+		}
+		manifest, err := manifests.Get(ctx, desc.Digest)
+		if err != nil {
+			log.Warnf("failed to pull %s:%s from upstream: %v", repository.Named().Name(), tag, err)
+			continue
+		}
+		app.prefetch(ctx, repository.Named(), manifest)
+	}
+}
+
+// upstreamError converts an error pulling from the upstream registry into
+// the response error
+func upstreamError(err error) error {
+	return errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("upstream: %v", err))
+}
+
+// Values of the X-Cache header telling whether a response in pull-through
+// mode was served from the cache or pulled from the upstream
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+)
+
+// setCacheStatus sets the X-Cache header of a response in pull-through mode,
+// naming the upstream in X-Cache-Upstream on a miss.
+func (app *App) setCacheStatus(w http.ResponseWriter, status string) {
+	if app.upstream == nil {
+		return
+	}
+	w.Header().Set("X-Cache", status)
+	if status == cacheMiss {
+		w.Header().Set("X-Cache-Upstream", app.upstream.Host())
+	}
+}
+
+// upstreamAllowed reports whether the named repository may be pulled from the
+// upstream registry. The patterns match the name on the upstream. Deny
+// patterns take precedence over allow patterns, all repositories not denied
+// are allowed when there are no allow patterns.
+func (app *App) upstreamAllowed(named reference.Named) bool {
+	name := app.upstream.RemoteName(named).Name()
+	for _, pattern := range app.upstreamDeny {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(app.upstreamAllow) == 0 {
+		return true
+	}
+	for _, pattern := range app.upstreamAllow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pullBlob serves a blob missing from the cache from the upstream registry.
+// It reports whether a response was written; blobs the upstream does not
+// hold are left to be reported as unknown, repositories not allowed to be
+// pulled are denied.
+//
+// Whole blob GET requests are streamed to the client and into the cache at
+// the same time, so the client does not wait for the download to complete.
+// An interrupted download is kept and resumed with a range request by the
+// next miss. HEAD and range requests, as well as requests for a blob already
+// being pulled, are passed through without caching.
+func (bh *blobHandler) pullBlob(w http.ResponseWriter, r *http.Request) bool {
+	if !bh.App.upstreamAllowed(bh.Repository.Named()) {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeDenied)
+		return true
+	}
+	if bh.App.quarantine.contains(bh.Digest) {
+		bh.Errors = append(bh.Errors, upstreamError(fmt.Errorf("blob %s is quarantined after not matching its digest", bh.Digest)))
+		return true
+	}
+
+	cache := r.Method == http.MethodGet && r.Header.Get("Range") == ""
+	if cache {
+		if _, pulling := bh.App.pulling.LoadOrStore(bh.Digest, struct{}{}); pulling {
+			cache = false
+		} else {
+			defer bh.App.pulling.Delete(bh.Digest)
+		}
+	}
+
+	var ctx context.Context = bh
+	var bw distribution.BlobWriter
+	var offset int64
+	if cache {
+		// finish caching the blob when the client goes away
+		ctx = context.WithoutCancel(ctx)
+		if bw = bh.App.resumePartialBlob(ctx, bh.Repository, bh.Digest); bw != nil {
+			offset = bw.Size()
+		}
+	}
+	blobURL, err := bh.App.upstream.BlobURL(bh.Repository.Named(), bh.Digest)
+	if err != nil {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return true
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, blobURL, nil)
+	if err != nil {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return true
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := bh.App.upstream.Do(req)
+	if err != nil {
+		if bw != nil {
+			bh.App.keepPartialBlob(ctx, bh.Repository, bh.Digest, bw)
+		}
+		dcontext.GetLogger(bh).Warnf("failed to pull blob %s from upstream: %v", bh.Digest, err)
+		bh.Errors = append(bh.Errors, upstreamError(err))
+		return true
+	}
+	defer resp.Body.Close()
+
+	if bw != nil && !resumes(resp, offset) {
+		// the upstream does not continue where the download stopped
+		bw.Cancel(ctx)
+		bw, offset = nil, 0
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		return false
+	default:
+		err := fmt.Errorf("getting blob %s: unexpected status %s", bh.Digest, resp.Status)
+		dcontext.GetLogger(bh).Warnf("failed to pull blob from upstream: %v", err)
+		bh.Errors = append(bh.Errors, upstreamError(err))
+		return true
+	}
+	if resp.StatusCode == http.StatusOK || bw != nil {
+		if err := bh.App.checkBlobSize(bh.Digest, offset+resp.ContentLength); err != nil {
+			if bw != nil {
+				bw.Cancel(ctx)
+			}
+			bh.Errors = append(bh.Errors, err)
+			return true
+		}
+	}
+
+	bh.App.setCacheStatus(w, cacheMiss)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", bh.Digest.String())
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, bh.Digest))
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(offset+resp.ContentLength))
+	}
+	if bw != nil {
+		// the client gets the whole blob, starting with the kept part
+		w.WriteHeader(http.StatusOK)
+	} else {
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+			w.Header().Set("Content-Range", contentRange)
+		}
+		w.WriteHeader(resp.StatusCode)
+	}
+	if r.Method == http.MethodHead {
+		return true
+	}
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size = offset + resp.ContentLength
+	}
+	defer trackTransfer(transferDownload, size)()
+
+	if !cache || (bw == nil && resp.StatusCode != http.StatusOK) {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			dcontext.GetLogger(bh).Warnf("failed to copy blob %s from upstream: %v", bh.Digest, err)
+		}
+		return true
+	}
+
+	if err := bh.App.cacheBlob(ctx, bh.Repository, bh.Digest, resp, bw, w); err != nil {
+		dcontext.GetLogger(bh).Errorf("failed to cache blob %s from upstream: %v", bh.Digest, err)
+	}
+	return true
+}
+
+// resumes reports whether resp continues a download at offset
+func resumes(resp *http.Response, offset int64) bool {
+	return resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset))
+}
+
+// cacheBlob writes the upstream response into the cache while streaming it
+// to the client w, if any. When bw is set, the response continues the
+// download kept in it, which is sent to the client first. Otherwise large
+// blobs are downloaded in parallel segments if enabled. The end of the blob
+// is only sent to the client once the blob matches its digest, blobs not
+// matching it are quarantined. An interrupted
+// download is kept to be resumed, a download not matching the digest is
+// removed.
+func (app *App) cacheBlob(ctx context.Context, repository distribution.Repository, dgst digest.Digest, resp *http.Response, bw distribution.BlobWriter, w io.Writer) error {
+	var client *verifyingWriter
+	var out io.Writer = io.Discard
+	if w != nil {
+		client = newVerifyingWriter(&clientWriter{w: w}, dgst)
+		out = client
+	}
+	if bw == nil && app.segments > 1 && resp.ContentLength >= app.segmentMin {
+		body := app.upstream.SegmentedBody(resp, app.segments)
+		defer body.Close()
+		resp.Body = body
+	}
+	if bw == nil {
+		var err error
+		if bw, err = repository.Blobs(ctx).Create(ctx); err != nil {
+			// the client is still served
+			io.Copy(out, resp.Body)
+			if client != nil && !client.finish() {
+				app.quarantineBlob(repository, dgst, "content does not match the digest")
+			}
+			return err
+		}
+	} else if w != nil {
+		if err := replayBlob(bw, out); err != nil {
+			app.keepPartialBlob(ctx, repository, dgst, bw)
+			return err
+		}
+	}
+
+	size, err := io.Copy(io.MultiWriter(bw, out), resp.Body)
+	if err == nil && resp.ContentLength >= 0 && size != resp.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", size, resp.ContentLength)
+	}
+	if err != nil {
+		app.keepPartialBlob(ctx, repository, dgst, bw)
+		return err
+	}
+	if client != nil && !client.finish() {
+		app.quarantineBlob(repository, dgst, "content does not match the digest")
+		app.keepQuarantined(ctx, bw, dgst, "content does not match the digest")
+		bw.Cancel(ctx)
+		return fmt.Errorf("blob %s: %w", dgst, registryclient.ErrDigestMismatch)
+	}
+
+	size = bw.Size()
+	if _, err := bw.Commit(ctx, v1.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dgst,
+		Size:      size,
+	}); err != nil {
+		if invalid, ok := err.(distribution.ErrBlobInvalidDigest); ok {
+			app.quarantineBlob(repository, dgst, invalid.Reason.Error())
+			app.keepQuarantined(ctx, bw, dgst, invalid.Reason.Error())
+		}
+		bw.Cancel(ctx)
+		return err
+	}
+	dcontext.GetLogger(ctx).Infof("pulled blob %s from upstream, %d bytes", dgst, size)
+	return nil
+}
+
+// quarantineBlob keeps a blob not matching its digest from being pulled
+// again for a while
+func (app *App) quarantineBlob(repository distribution.Repository, dgst digest.Digest, reason string) {
+	dcontext.GetLogger(app).Errorf("blob %s of %s from upstream does not match its digest: %s", dgst, repository.Named().Name(), reason)
+	app.quarantine.add(QuarantineEntry{
+		Kind:       "blob",
+		Repository: repository.Named().Name(),
+		Digest:     dgst,
+		Reason:     reason,
+	})
+}
+
+// keepQuarantined hands the content of bw, pulled for the blob dgst and not
+// matching it, to the blob quarantine if any, before the upload is canceled
+func (app *App) keepQuarantined(ctx context.Context, bw distribution.BlobWriter, dgst digest.Digest, reason string) {
+	if app.blobQuarantine == nil {
+		return
+	}
+	readable, ok := bw.(interface {
+		Reader() (io.ReadCloser, error)
+	})
+	if !ok {
+		return
+	}
+	reader, err := readable.Reader()
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to read blob %s to quarantine: %v", dgst, err)
+		return
+	}
+	defer reader.Close()
+	if err := app.blobQuarantine.QuarantineContent(ctx, dgst, reader, "upstream", reason); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to quarantine blob %s: %v", dgst, err)
+	}
+}
+
+// replayBlob writes the content already written to bw to w
+func replayBlob(bw distribution.BlobWriter, w io.Writer) error {
+	readable, ok := bw.(interface {
+		Reader() (io.ReadCloser, error)
+	})
+	if !ok {
+		return fmt.Errorf("cannot read upload %s", bw.ID())
+	}
+	reader, err := readable.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.CopyN(w, reader, bw.Size())
+	return err
+}
+
+// partialBlob is an interrupted pull of a blob
+type partialBlob struct {
+	repository string
+	uploadID   string
+}
+
+// keepPartialBlob closes the upload of an interrupted pull so that the next
+// miss of the blob in the same repository resumes it. Empty uploads are
+// removed.
+func (app *App) keepPartialBlob(ctx context.Context, repository distribution.Repository, dgst digest.Digest, bw distribution.BlobWriter) {
+	if bw.Size() == 0 {
+		bw.Cancel(ctx)
+		return
+	}
+	if err := bw.Close(); err != nil {
+		dcontext.GetLogger(ctx).Warnf("failed to keep partial blob %s: %v", dgst, err)
+		bw.Cancel(ctx)
+		return
+	}
+
+	app.partialsMu.Lock()
+	defer app.partialsMu.Unlock()
+	if app.partials == nil {
+		app.partials = make(map[digest.Digest]partialBlob)
+	}
+	app.partials[dgst] = partialBlob{
+		repository: repository.Named().Name(),
+		uploadID:   bw.ID(),
+	}
+	dcontext.GetLogger(ctx).Infof("kept %d bytes of blob %s to resume the pull", bw.Size(), dgst)
+}
+
+// resumePartialBlob reopens the upload of an interrupted pull of the blob
+// into repository, if any.
+func (app *App) resumePartialBlob(ctx context.Context, repository distribution.Repository, dgst digest.Digest) distribution.BlobWriter {
+	app.partialsMu.Lock()
+	partial, ok := app.partials[dgst]
+	if ok && partial.repository == repository.Named().Name() {
+		delete(app.partials, dgst)
+	} else {
+		ok = false
+	}
+	app.partialsMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	bw, err := repository.Blobs(ctx).Resume(ctx, partial.uploadID)
+	if err != nil {
+		// e.g. purged in the meantime
+		dcontext.GetLogger(ctx).Debugf("cannot resume pull of blob %s: %v", dgst, err)
+		return nil
+	}
+	return bw
+}
+
+// clientWriter writes to the client until that fails, e.g. because the
+// client went away, and then discards the rest so that caching goes on.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/opencontainers/go-digest"
+)
+
+// quarantineDuration is how long content that did not match its digest is
+// not pulled again from the upstream
+const quarantineDuration = time.Hour
+
+var (
+	upstreamNamespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "upstream", nil)
+
+	digestMismatches = upstreamNamespace.NewLabeledCounter("digest_mismatches", "The number of upstream responses not matching their digest", "kind")
+)
+
+func init() {
+	metrics.Register(upstreamNamespace)
+}
+
+// QuarantineEntry is content of the upstream that did not match its digest
+type QuarantineEntry struct {
+	Kind       string        `json:"kind"` // blob or manifest
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Reason     string        `json:"reason"`
+	Time       time.Time     `json:"time"`
+}
+
+// quarantine holds the digests not pulled again after a mismatch
+type quarantine struct {
+	mu      sync.Mutex
+	entries map[digest.Digest]QuarantineEntry
+}
+
+// add quarantines a digest
+func (q *quarantine) add(entry QuarantineEntry) {
+	digestMismatches.WithValues(entry.Kind).Inc(1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.entries == nil {
+		q.entries = make(map[digest.Digest]QuarantineEntry)
+	}
+	entry.Time = time.Now()
+	q.entries[entry.Digest] = entry
+}
+
+// contains reports whether dgst is quarantined
+func (q *quarantine) contains(dgst digest.Digest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[dgst]
+	if ok && time.Since(entry.Time) > quarantineDuration {
+		delete(q.entries, dgst)
+		return false
+	}
+	return ok
+}
+
+// Quarantine returns the content of the upstream currently quarantined after
+// not matching its digest, most recent first.
+func (app *App) Quarantine() []QuarantineEntry {
+	q := &app.quarantine
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]QuarantineEntry, 0, len(q.entries))
+	for dgst, entry := range q.entries {
+		if time.Since(entry.Time) > quarantineDuration {
+			delete(q.entries, dgst)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries
+}
+
+// verifyingWriter passes content to w, holding back the last write until the
+// content is verified against its digest, so that a client never receives
+// the whole of a blob not matching its digest.
+type verifyingWriter struct {
+	w        io.Writer
+	verifier digest.Verifier
+	held     []byte
+}
+
+func newVerifyingWriter(w io.Writer, dgst digest.Digest) *verifyingWriter {
+	return &verifyingWriter{w: w, verifier: dgst.Verifier()}
+}
+
+func (vw *verifyingWriter) Write(p []byte) (int, error) {
+	vw.verifier.Write(p)
+	if len(vw.held) > 0 {
+		if _, err := vw.w.Write(vw.held); err != nil {
+			return 0, err
+		}
+	}
+	vw.held = append(vw.held[:0], p...)
+	return len(p), nil
+}
+
+// finish writes the held back content if the content matches the digest,
+// reporting whether it does.
+func (vw *verifyingWriter) finish() bool {
+	if !vw.verifier.Verified() {
+		return false
+	}
+	if len(vw.held) > 0 {
+		vw.w.Write(vw.held)
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/opencontainers/go-digest"
+)
+
+// errorCodeQuotaExceeded is returned for pushes into a namespace using its
+// whole storage quota
+var errorCodeQuotaExceeded = errcode.Register("docker-cache-server", errcode.ErrorDescriptor{
+	Value:          "QUOTA_EXCEEDED",
+	Message:        "storage quota exceeded",
+	Description:    "The namespace of the repository uses its whole storage quota.",
+	HTTPStatusCode: http.StatusRequestEntityTooLarge,
+})
+
+var (
+	quotaNamespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "quota", nil)
+
+	quotaUsage      = quotaNamespace.NewLabeledGauge("usage", "The storage used by the repositories of a namespace", metrics.Bytes, "namespace")
+	quotaRejections = quotaNamespace.NewLabeledCounter("rejections", "The number of pushes rejected for exceeding the quota of a namespace", "namespace")
+)
+
+func init() {
+	metrics.Register(quotaNamespace)
+}
+
+// QuotaUsage is the storage used by the repositories of a namespace
+type QuotaUsage struct {
+	Namespace string `json:"namespace"`
+	Usage     int64  `json:"usage"`
+	Limit     int64  `json:"limit"` // zero if unlimited
+}
+
+// quotas tracks the storage used per namespace, the first component of
+// repository names. Usage counts the blobs linked into every repository of
+// the namespace, it is computed by walking the storage periodically and
+// raised by the uploads completed in between.
+type quotas struct {
+	limits       map[string]int64
+	defaultLimit int64
+
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// namespaceOf returns the namespace of a repository name
+func namespaceOf(name string) string {
+	namespace, _, _ := strings.Cut(name, "/")
+	return namespace
+}
+
+// limit returns the quota of a namespace, zero if unlimited
+func (q *quotas) limit(namespace string) int64 {
+	if limit, ok := q.limits[namespace]; ok {
+		return limit
+	}
+	return q.defaultLimit
+}
+
+// check returns an error if storing size more bytes in the repository name
+// exceeds the quota of its namespace
+func (q *quotas) check(name string, size int64) error {
+	namespace := namespaceOf(name)
+	limit := q.limit(namespace)
+	if limit <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	usage := q.usage[namespace]
+	q.mu.Unlock()
+	if usage+size <= limit {
+		return nil
+	}
+	quotaRejections.WithValues(namespace).Inc(1)
+	return errorCodeQuotaExceeded.WithMessage(fmt.Sprintf(
+		"storage quota of namespace %s exceeded: %d bytes used, %d bytes pushed, quota of %d bytes",
+		namespace, usage, size, limit))
+}
+
+// add records size bytes stored in the repository name
+func (q *quotas) add(name string, size int64) {
+	namespace := namespaceOf(name)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		q.usage = make(map[string]int64)
+	}
+	q.usage[namespace] += size
+	quotaUsage.WithValues(namespace).Set(float64(q.usage[namespace]))
+}
+
+// Quotas returns the storage used per namespace with its quota, sorted by
+// namespace.
+func (app *App) Quotas() []QuotaUsage {
+	q := app.quotas
+	if q == nil {
+		return []QuotaUsage{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usages := make([]QuotaUsage, 0, len(q.usage))
+	for namespace, usage := range q.usage {
+		usages = append(usages, QuotaUsage{Namespace: namespace, Usage: usage, Limit: q.limit(namespace)})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Namespace < usages[j].Namespace
+	})
+	return usages
+}
+
+// startQuotaRefresh computes the storage used per namespace now and at every
+// interval
+func (app *App) startQuotaRefresh(interval time.Duration) {
+	go func() {
+		for {
+			if err := app.refreshQuotas(app); err != nil {
+				dcontext.GetLogger(app).Errorf("failed to compute quota usage: %v", err)
+			}
+			select {
+			case <-time.After(interval):
+			case <-app.Done():
+				return
+			}
+		}
+	}()
+}
+
+// refreshQuotas walks every repository and replaces the usage of the quotas.
+// The walk reads every layer link, which must not count as accesses of the
+// blobs, or no blob would ever expire.
+func (app *App) refreshQuotas(ctx context.Context) error {
+	ctx = cache.WithAccessMode(ctx, cache.AccessSkip)
+	repositoryEnumerator, ok := app.registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return fmt.Errorf("registry does not support repository enumeration")
+	}
+
+	statter := app.registry.BlobStatter()
+	usage := make(map[string]int64)
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := app.registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		blobEnumerator, ok := repository.Blobs(ctx).(distribution.BlobEnumerator)
+		if !ok {
+			return fmt.Errorf("blob store of %s does not support enumeration", repoName)
+		}
+
+		namespace := namespaceOf(repoName)
+		if _, ok := usage[namespace]; !ok {
+			usage[namespace] = 0
+		}
+		err = blobEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			desc, err := statter.Stat(ctx, dgst)
+			if err != nil {
+				if err == distribution.ErrBlobUnknown {
+					return nil
+				}
+				return err
+			}
+			usage[namespace] += desc.Size
+			return nil
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// repositories without any layer links
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	q := app.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for namespace := range q.usage {
+		if _, ok := usage[namespace]; !ok {
+			quotaUsage.WithValues(namespace).Set(0)
+		}
+	}
+	for namespace, size := range usage {
+		quotaUsage.WithValues(namespace).Set(float64(size))
+	}
+	q.usage = usage
+	return nil
+}
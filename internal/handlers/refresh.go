@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+)
+
+// tagKey identifies a tag of a repository
+type tagKey struct {
+	repository string
+	tag        string
+}
+
+// tagPulls counts the pulls of tags served in pull-through mode, so that the
+// most popular ones can be refreshed from the upstream before clients ask.
+type tagPulls struct {
+	mu     sync.Mutex
+	counts map[tagKey]int
+}
+
+// record counts a pull of the tag
+func (tp *tagPulls) record(repository, tag string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.counts == nil {
+		tp.counts = make(map[tagKey]int)
+	}
+	tp.counts[tagKey{repository: repository, tag: tag}]++
+}
+
+// top returns the n most pulled tags and halves all counts, so that the
+// popularity follows recent pulls and tags no longer pulled are forgotten.
+func (tp *tagPulls) top(n int) []tagKey {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	keys := make([]tagKey, 0, len(tp.counts))
+	for key := range tp.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return tp.counts[keys[i]] > tp.counts[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	for key, count := range tp.counts {
+		if count /= 2; count == 0 {
+			delete(tp.counts, key)
+		} else {
+			tp.counts[key] = count
+		}
+	}
+	return keys
+}
+
+// startTagRefresh periodically pulls the count most pulled tags from the
+// upstream until the app context is done.
+func (app *App) startTagRefresh(interval time.Duration, count int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.Done():
+				return
+			case <-ticker.C:
+			}
+			app.refreshTags(count)
+		}
+	}()
+}
+
+// refreshTags pulls the count most pulled tags from the upstream, moving
+// those changed upstream to the new manifest.
+func (app *App) refreshTags(count int) {
+	log := dcontext.GetLogger(app)
+	keys := app.tagPulls.top(count)
+	log.Debugf("refreshing %d tags from upstream", len(keys))
+
+	for _, key := range keys {
+		name, err := reference.WithName(key.repository)
+		if err != nil || !app.upstreamAllowed(name) {
+			continue
+		}
+		repository, err := app.registry.Repository(app, name)
+		if err != nil {
+			log.Warnf("failed to refresh %s:%s from upstream: %v", key.repository, key.tag, err)
+			continue
+		}
+		if _, err := app.pullManifest(app, repository, key.tag, key.tag); err != nil {
+			log.Warnf("failed to refresh %s:%s from upstream: %v", key.repository, key.tag, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+)
+
+var (
+	routeNamespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "http", nil)
+
+	routeRequestDuration = routeNamespace.NewLabeledTimer("request_duration", "The time to serve requests by route, method and status class", "route", "method", "status")
+)
+
+func init() {
+	metrics.Register(routeNamespace)
+}
+
+// routeMethods are the methods labeled as such, the others are counted as
+// "other" so that clients cannot grow the number of series
+var routeMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// instrumentRoute observes the duration of the requests of the route
+// routeName served by handler, labeled with the class of their status
+func instrumentRoute(routeName string, handler http.Handler) http.Handler {
+	route := strings.ReplaceAll(routeName, "-", "_")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+
+		method := r.Method
+		if !routeMethods[method] {
+			method = "other"
+		}
+		routeRequestDuration.WithValues(route, method, statusClass(r)).UpdateSince(start)
+	})
+}
+
+// statusClass returns the class of the status of the response to r, such as
+// "2xx", from the response writer instrumented in its context
+func statusClass(r *http.Request) string {
+	status, _ := r.Context().Value("http.response.status").(int)
+	if status == 0 {
+		// nothing written, or only the body, which implies 200
+		status = http.StatusOK
+	}
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
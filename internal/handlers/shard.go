@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// shardForwardedHeader marks requests forwarded between the nodes of a
+// sharded deployment, so that the receiving node serves them itself.
+const shardForwardedHeader = "X-Dcs-Shard-Forwarded"
+
+// forwardedRequestHeaders are copied from the client request when it is
+// forwarded to the owning node.
+var forwardedRequestHeaders = []string{
+	"Accept",
+	"Authorization",
+	"If-None-Match",
+	"Range",
+}
+
+// BlobRouter assigns blobs to the nodes of a sharded deployment.
+type BlobRouter interface {
+	// Owner returns the base URL of the node owning dgst, or an empty string
+	// when this node owns it.
+	Owner(dgst digest.Digest) string
+}
+
+// shardOwner returns the base URL of the node owning dgst, or an empty string
+// when the request must be served locally.
+func (ctx *Context) shardOwner(r *http.Request, dgst digest.Digest) string {
+	if ctx.App.blobRouter == nil || r.Header.Get(shardForwardedHeader) != "" {
+		return ""
+	}
+	return ctx.App.blobRouter.Owner(dgst)
+}
+
+// shardClient returns a client for the node with the given base URL which
+// marks its requests as forwarded and passes on the client credentials.
+func (app *App) shardClient(owner string, authorization string) (*registryclient.Client, error) {
+	client, err := registryclient.New(owner, app.shardHTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	client.Prepare = func(req *http.Request) {
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		req.Header.Set(shardForwardedHeader, "1")
+	}
+	return client, nil
+}
+
+// forwardBlob serves a blob request from the owning node. It reports whether
+// a response was written; blobs the owner does not have, e.g. because a
+// hand off failed, are left to be served locally.
+func (bh *blobHandler) forwardBlob(w http.ResponseWriter, r *http.Request, owner string) bool {
+	client, err := bh.App.shardClient(owner, "")
+	if err != nil {
+		dcontext.GetLogger(bh).Errorf("failed to create shard client for %s: %v", owner, err)
+		return false
+	}
+	blobURL, err := client.BlobURL(bh.Repository.Named(), bh.Digest)
+	if err != nil {
+		dcontext.GetLogger(bh).Errorf("failed to build shard url for %s: %v", owner, err)
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(bh, r.Method, blobURL, nil)
+	if err != nil {
+		dcontext.GetLogger(bh).Errorf("failed to create shard request: %v", err)
+		return false
+	}
+	for _, name := range forwardedRequestHeaders {
+		if values, ok := r.Header[name]; ok {
+			req.Header[name] = values
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		dcontext.GetLogger(bh).Warnf("failed to forward blob request to %s: %v", owner, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		dcontext.GetLogger(bh).Debugf("blob %s not found on %s, serving locally", bh.Digest, owner)
+		return false
+	}
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		dcontext.GetLogger(bh).Warnf("failed to copy blob from %s: %v", owner, err)
+	}
+	return true
+}
+
+// handOffBlob uploads a committed blob to the owning node under the same
+// repository. The local copy stays in place and is evicted by the LRU
+// cleanup once reads are served by the owner.
+func (app *App) handOffBlob(ctx context.Context, owner string, name reference.Named, desc v1.Descriptor, authorization string) error {
+	client, err := app.shardClient(owner, authorization)
+	if err != nil {
+		return err
+	}
+
+	// the owner may already have it from another repository or node
+	exists, err := client.BlobExists(ctx, name, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	repository, err := app.registry.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+	blob, err := repository.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	return client.PushBlob(ctx, name, desc, blob)
+}
@@ -48,49 +48,45 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// do pagination if requested
+	// paginate in lexical order, as clients pass the last tag of a page to
+	// get the next one
+	sort.Strings(tags)
 	q := r.URL.Query()
-	// get entries after latest, if any specified
+	// get entries after last, whether or not it is still a tag
 	if lastEntry := q.Get("last"); lastEntry != "" {
-		lastEntryIndex := sort.SearchStrings(tags, lastEntry)
-
-		// as`sort.SearchStrings` can return len(tags), if the
-		// specified `lastEntry` is not found, we need to
-		// ensure it does not panic when slicing.
-		if lastEntryIndex == len(tags) {
-			tags = []string{}
-		} else {
-			tags = tags[lastEntryIndex+1:]
+		i := sort.SearchStrings(tags, lastEntry)
+		if i < len(tags) && tags[i] == lastEntry {
+			i++
 		}
+		tags = tags[i:]
 	}
 
-	// if no error, means that the user requested `n` entries
+	// the page size is the requested n, else the configured default, capped
+	// to the configured maximum
+	entries, paginate := th.App.tagsDefaultEntries, th.App.tagsDefaultEntries > 0
 	if n := q.Get("n"); n != "" {
-		maxEntries, err := strconv.Atoi(n)
-		if err != nil || maxEntries < 0 {
+		parsed, err := strconv.Atoi(n)
+		if err != nil || parsed < 0 {
 			th.Errors = append(th.Errors, errcode.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": n}))
 			return
 		}
+		entries, paginate = parsed, true
+	}
+	if maxEntries := th.App.tagsMaxEntries; maxEntries > 0 && (!paginate || entries > maxEntries) {
+		entries, paginate = maxEntries, true
+	}
 
-		// if there is requested more than or
-		// equal to the amount of tags we have,
-		// then set the request to equal `len(tags)`.
-		// the reason for the `=`, is so the else
-		// clause will only activate if there
-		// are tags left the user needs.
-		if maxEntries >= len(tags) {
-			maxEntries = len(tags)
-		} else if maxEntries > 0 {
+	if paginate && entries < len(tags) {
+		if entries > 0 {
 			// defined in `catalog.go`
-			urlStr, err := createLinkEntry(r.URL.String(), maxEntries, tags[maxEntries-1])
+			urlStr, err := createLinkEntry(r.URL.String(), entries, tags[entries-1])
 			if err != nil {
 				th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 				return
 			}
 			w.Header().Set("Link", urlStr)
 		}
-
-		tags = tags[:maxEntries]
+		tags = tags[:entries]
 	}
 
 	w.Header().Set("Content-Type", "application/json")
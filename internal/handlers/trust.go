@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+)
+
+// cosignSignatureAnnotation holds the signature of a cosign simple signing
+// payload on the layer of a signature manifest
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// maxSignaturePayloadSize bounds the simple signing payloads read into
+// memory, which are a few hundred bytes, as their size is declared by the
+// upstream
+const maxSignaturePayloadSize = 64 * 1024
+
+// errUntrusted is returned for manifests without a signature valid for any
+// of the trusted keys
+type errUntrusted struct {
+	digest digest.Digest
+	reason string
+}
+
+func (e errUntrusted) Error() string {
+	return fmt.Sprintf("manifest %s is not signed by a trusted key: %s", e.digest, e.reason)
+}
+
+// trustError converts an error into a denied response error if it is caused
+// by a manifest failing the trust policy
+func trustError(err error) (errcode.Error, bool) {
+	var untrusted errUntrusted
+	if !errors.As(err, &untrusted) {
+		return errcode.Error{}, false
+	}
+	return errcode.ErrorCodeDenied.WithMessage(untrusted.Error()), true
+}
+
+// TrustPolicy only lets manifests signed with cosign by one of its keys be
+// served and cached. Signatures are read from the sha256-<digest>.sig tag of
+// the repository, the manifests of a verified index are trusted as well.
+type TrustPolicy struct {
+	keys []crypto.PublicKey
+
+	verified sync.Map // digest.Digest of trusted manifests
+}
+
+// NewTrustPolicy returns a policy trusting the signatures of the given PEM
+// encoded public keys.
+func NewTrustPolicy(pemKeys [][]byte) (*TrustPolicy, error) {
+	if len(pemKeys) == 0 {
+		return nil, errors.New("no trusted keys")
+	}
+	tp := &TrustPolicy{}
+	for _, data := range pemKeys {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM public key found")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+		tp.keys = append(tp.keys, key)
+	}
+	return tp, nil
+}
+
+// verify checks the signatures of the manifest dgst stored in repository
+func (tp *TrustPolicy) verify(ctx context.Context, repository distribution.Repository, dgst digest.Digest, manifest distribution.Manifest) error {
+	if _, ok := tp.verified.Load(dgst); ok {
+		return nil
+	}
+
+	signatureTag := string(dgst.Algorithm()) + "-" + dgst.Encoded() + ".sig"
+	desc, err := repository.Tags(ctx).Get(ctx, signatureTag)
+	if err != nil {
+		return errUntrusted{digest: dgst, reason: "no signature"}
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	signatures, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	blobs := repository.Blobs(ctx)
+	for _, layer := range signatures.References() {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		// the stored size, the one of the manifest is not verified
+		stat, err := blobs.Stat(ctx, layer.Digest)
+		if err != nil {
+			return err
+		}
+		if stat.Size > maxSignaturePayloadSize {
+			continue
+		}
+		payload, err := blobs.Get(ctx, layer.Digest)
+		if err != nil {
+			return err
+		}
+		if tp.verifyPayload(payload, signature, dgst) {
+			tp.trust(dgst, manifest)
+			return nil
+		}
+	}
+	return errUntrusted{digest: dgst, reason: "no valid signature"}
+}
+
+// trust records a verified manifest and the manifests of a verified index
+func (tp *TrustPolicy) trust(dgst digest.Digest, manifest distribution.Manifest) {
+	tp.verified.Store(dgst, struct{}{})
+	if isIndex(manifest) {
+		for _, desc := range manifest.References() {
+			tp.verified.Store(desc.Digest, struct{}{})
+		}
+	}
+}
+
+// verifyPayload reports whether signature is a valid signature of a simple
+// signing payload for the manifest dgst by one of the keys
+func (tp *TrustPolicy) verifyPayload(payload, signature []byte, dgst digest.Digest) bool {
+	var simpleSigning struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil ||
+		simpleSigning.Critical.Image.DockerManifestDigest != dgst.String() {
+		return false
+	}
+
+	hash := sha256.Sum256(payload)
+	for _, key := range tp.keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, hash[:], signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, payload, signature) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pullSignature pulls the cosign signature of the manifest dgst from the
+// upstream registry into repository and verifies it, so that unsigned
+// manifests are not cached.
+func (app *App) pullSignature(ctx context.Context, repository distribution.Repository, dgst digest.Digest, manifest distribution.Manifest) error {
+	if _, ok := app.trust.verified.Load(dgst); ok {
+		return nil
+	}
+	signatureTag := string(dgst.Algorithm()) + "-" + dgst.Encoded() + ".sig"
+	desc, err := app.pullManifest(ctx, repository, signatureTag, signatureTag)
+	if errors.Is(err, registryclient.ErrNotFound) {
+		return errUntrusted{digest: dgst, reason: "no signature"}
+	}
+	if err != nil {
+		return err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	signatures, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	for _, layer := range signatures.References() {
+		if layer.Size > maxSignaturePayloadSize {
+			continue
+		}
+		if err := app.prefetchBlob(ctx, repository, layer.Digest); err != nil {
+			return err
+		}
+	}
+	return app.trust.verify(ctx, repository, dgst, manifest)
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/jc-lab/docker-cache-server/internal/requestutil"
+)
+
+// uploadIdleTimeout is how long an upload session without any request keeps
+// counting against the limit of its client, so that abandoned uploads do
+// not block the client forever. Sessions never expire while one of their
+// requests is in progress, however long it takes.
+const uploadIdleTimeout = 10 * time.Minute
+
+// uploadSession is a blob upload in progress
+type uploadSession struct {
+	client string
+	last   time.Time // the last request of the upload ended
+	active int       // requests of the upload in progress
+}
+
+// uploadSessions tracks the blob upload sessions in progress, from the
+// request starting an upload until the one completing or canceling it, and
+// limits them per client. Sessions are counted by the upload_sessions gauge.
+type uploadSessions struct {
+	limit int // per client, zero for unlimited
+
+	mu       sync.Mutex
+	sessions map[string]uploadSession // by upload UUID or reservation
+	next     int                      // of the next reservation
+}
+
+// uploadClient identifies the client of a request by its user name, or its
+// IP address for anonymous requests
+func uploadClient(ctx *Context, r *http.Request) string {
+	if username := getUserName(ctx, r); username != "" {
+		return "user:" + username
+	}
+	return "ip:" + requestutil.RemoteIP(r)
+}
+
+// reserve reserves an upload session for client if it has less than the
+// limit in progress, returning the reservation to bind to the upload.
+func (s *uploadSessions) reserve(client string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]uploadSession)
+	}
+	now := time.Now()
+	s.expire(now)
+	count := 0
+	for _, session := range s.sessions {
+		if session.client == client {
+			count++
+		}
+	}
+	if s.limit > 0 && count >= s.limit {
+		return "", errcode.ErrorCodeTooManyRequests.WithMessage(fmt.Sprintf(
+			"too many concurrent uploads: %d uploads in progress, limit of %d", count, s.limit))
+	}
+	s.next++
+	reservation := fmt.Sprintf("reservation-%d", s.next)
+	s.sessions[reservation] = uploadSession{client: client, last: now}
+	inflightUploadSessions.Inc()
+	return reservation, nil
+}
+
+// expire forgets the sessions idle for longer than uploadIdleTimeout
+func (s *uploadSessions) expire(now time.Time) {
+	for id, session := range s.sessions {
+		if session.active == 0 && now.Sub(session.last) > uploadIdleTimeout {
+			delete(s.sessions, id)
+			inflightUploadSessions.Dec()
+		}
+	}
+}
+
+// bind turns a reservation into the session of the upload uuid
+func (s *uploadSessions) bind(reservation, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[reservation]; ok {
+		delete(s.sessions, reservation)
+		s.sessions[uuid] = session
+	}
+}
+
+// begin records a request of the upload uuid in progress, keeping its
+// session from expiring until the returned function is called at the end of
+// the request
+func (s *uploadSessions) begin(uuid string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	session, ok := s.sessions[uuid]
+	if !ok {
+		return func() {}
+	}
+	session.active++
+	s.sessions[uuid] = session
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if session, ok := s.sessions[uuid]; ok {
+			session.active--
+			session.last = time.Now()
+			s.sessions[uuid] = session
+		}
+	}
+}
+
+// end releases the session of an upload or a reservation
+func (s *uploadSessions) end(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; ok {
+		delete(s.sessions, id)
+		inflightUploadSessions.Dec()
+	}
+	s.expire(time.Now())
+}
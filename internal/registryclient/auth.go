@@ -0,0 +1,224 @@
+package registryclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenLifetime is the lifetime of tokens issued without expires_in,
+// as specified by the token authentication specification
+const defaultTokenLifetime = 60 * time.Second
+
+// tokenExpiryMargin is subtracted from the lifetime of cached tokens, so that
+// they are not used while expiring
+const tokenExpiryMargin = 5 * time.Second
+
+// Auth answers the authentication challenges of a registry. Bearer tokens
+// are requested from the token service named in the challenge, anonymously
+// unless credentials are set, and cached per scope until they expire, so
+// that following requests for the same repository skip the challenge.
+type Auth struct {
+	Username string
+	Password string
+
+	// Credentials, if set, is called for the credentials instead of using
+	// Username and Password, e.g. to ask a credential helper.
+	Credentials func(ctx context.Context) (username, password string, err error)
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken // by scope
+}
+
+// cachedToken is a bearer token issued for a scope
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// challenge is a parsed WWW-Authenticate header
+type challenge struct {
+	scheme     string
+	parameters map[string]string
+}
+
+// authorize returns the Authorization header answering the challenge of
+// resp, or an empty string when it cannot be answered.
+func (a *Auth) authorize(ctx context.Context, httpClient *http.Client, resp *http.Response) (string, error) {
+	c, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return "", nil
+	}
+
+	switch c.scheme {
+	case "basic":
+		username, password, err := a.credentials(ctx)
+		if err != nil || username == "" {
+			return "", err
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, lifetime, err := a.fetchToken(ctx, httpClient, c.parameters)
+		if err != nil {
+			return "", err
+		}
+		if scope := c.parameters["scope"]; scope != "" && lifetime > tokenExpiryMargin {
+			a.mu.Lock()
+			if a.tokens == nil {
+				a.tokens = make(map[string]cachedToken)
+			}
+			a.tokens[scope] = cachedToken{
+				token:   token,
+				expires: time.Now().Add(lifetime - tokenExpiryMargin),
+			}
+			a.mu.Unlock()
+		}
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+// credentials returns the credentials to authenticate with, empty for
+// anonymous access
+func (a *Auth) credentials(ctx context.Context) (string, string, error) {
+	if a.Credentials != nil {
+		return a.Credentials(ctx)
+	}
+	return a.Username, a.Password, nil
+}
+
+// cached returns the Authorization header of a cached token for the scope
+// of req, or an empty string when there is none. Only pulls have a scope.
+func (a *Auth) cached(req *http.Request) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	name, ok := repositoryName(req.URL.Path)
+	if !ok {
+		return ""
+	}
+	scope := "repository:" + name + ":pull"
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cached, ok := a.tokens[scope]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(cached.expires) {
+		delete(a.tokens, scope)
+		return ""
+	}
+	return "Bearer " + cached.token
+}
+
+// repositoryName returns the repository of a manifest or blob URL path
+func repositoryName(urlPath string) (string, bool) {
+	_, rest, ok := strings.Cut(urlPath, "/v2/")
+	if !ok {
+		return "", false
+	}
+	for _, kind := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(rest, kind); i > 0 {
+			return rest[:i], true
+		}
+	}
+	return "", false
+}
+
+// fetchToken requests a bearer token from the realm of a challenge,
+// returning it with its lifetime
+func (a *Auth) fetchToken(ctx context.Context, httpClient *http.Client, parameters map[string]string) (string, time.Duration, error) {
+	realm, err := url.Parse(parameters["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", 0, fmt.Errorf("invalid token realm %q", parameters["realm"])
+	}
+	query := realm.Query()
+	if service := parameters["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := parameters["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	username, password, err := a.credentials(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("fetching token from %s: unexpected status %s", realm.Host, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("decoding token from %s: %w", realm.Host, err)
+	}
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if body.Token != "" {
+		return body.Token, lifetime, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, lifetime, nil
+	}
+	return "", 0, fmt.Errorf("no token in response from %s", realm.Host)
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(header string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+	c := challenge{
+		scheme:     strings.ToLower(scheme),
+		parameters: make(map[string]string),
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return challenge{}, false
+			}
+			c.parameters[name] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			c.parameters[name] = strings.TrimSpace(value)
+		}
+	}
+	return c, true
+}
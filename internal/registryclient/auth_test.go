@@ -0,0 +1,73 @@
+package registryclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTokenCachedPerScope(t *testing.T) {
+	var tokenRequests atomic.Int32
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+		fmt.Fprintf(w, `{"token": %q, "expires_in": 300}`, r.URL.Query().Get("scope"))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		name, _ := repositoryName(r.URL.Path)
+		scope := "repository:" + name + ":pull"
+		if r.Header.Get("Authorization") != "Bearer "+scope {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="%s"`, server.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Auth = &Auth{}
+	get := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: unexpected status %s", path, resp.Status)
+		}
+	}
+
+	get("/v2/library/foo/manifests/latest")
+	get("/v2/library/foo/blobs/sha256:abcd")
+	if n := tokenRequests.Load(); n != 1 {
+		t.Fatalf("expected the token to be reused within its scope, got %d token requests", n)
+	}
+	get("/v2/library/bar/manifests/latest")
+	if n := tokenRequests.Load(); n != 2 {
+		t.Fatalf("expected a token to be requested for another scope, got %d token requests", n)
+	}
+}
+
+func TestRepositoryName(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/v2/library/foo/manifests/latest":    "library/foo",
+		"/mirror/v2/foo/blobs/sha256:abcd":    "foo",
+		"/v2/foo/blobs/uploads/1234":          "foo",
+		"/v2/manifests/manifests/latest":      "manifests",
+		"/v2/_catalog":                        "",
+		"/other/library/foo/manifests/latest": "",
+	} {
+		if name, _ := repositoryName(path); name != expected {
+			t.Errorf("repositoryName(%q) = %q, expected %q", path, name, expected)
+		}
+	}
+}
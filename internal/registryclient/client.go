@@ -0,0 +1,365 @@
+// Package registryclient implements the small subset of the registry API
+// needed to copy content to another registry and to pull content from an
+// upstream registry.
+package registryclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxManifestSize limits the size of pulled manifests
+const maxManifestSize = 4 * 1024 * 1024
+
+// ErrNotFound is returned for content the registry does not hold.
+var ErrNotFound = errors.New("not found")
+
+// ErrDigestMismatch is matched by errors about content not matching its
+// digest.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// DigestMismatchError is returned for content not matching its digest.
+type DigestMismatchError struct {
+	Digest digest.Digest
+}
+
+func (e DigestMismatchError) Error() string {
+	return fmt.Sprintf("content does not match digest %s", e.Digest)
+}
+
+func (e DigestMismatchError) Is(target error) bool {
+	return target == ErrDigestMismatch
+}
+
+// manifestMediaTypes are accepted when pulling manifests
+var manifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+}
+
+// Client talks to the registry at a base URL.
+type Client struct {
+	ub         *v2.URLBuilder
+	httpClient *http.Client
+	stats      *stats
+
+	// Prepare, if set, is called on every request before it is sent, e.g.
+	// to add credentials.
+	Prepare func(req *http.Request)
+
+	// Auth, if set, answers the authentication challenges of the registry.
+	// Only requests without a body, or with GetBody set, are retried.
+	Auth *Auth
+
+	// Limiter, if set, limits the rate at which response bodies are read.
+	Limiter *Limiter
+
+	// DefaultNamespace, if set, is prefixed to repository names without a
+	// namespace, e.g. "library" for the official images of Docker Hub.
+	DefaultNamespace string
+}
+
+// New returns a client for the registry at baseURL. A nil httpClient selects
+// http.DefaultClient.
+func New(baseURL string, httpClient *http.Client) (*Client, error) {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	ub, err := v2.NewURLBuilderFromString(baseURL, false)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		ub:         ub,
+		httpClient: httpClient,
+		stats:      newStats(baseURL),
+	}, nil
+}
+
+// Host returns the host of the registry, e.g. "registry-1.docker.io".
+func (c *Client) Host() string {
+	return c.stats.host
+}
+
+// RemoteName returns the name of a repository on the registry, applying
+// DefaultNamespace.
+func (c *Client) RemoteName(name reference.Named) reference.Named {
+	if c.DefaultNamespace == "" || strings.Contains(name.Name(), "/") {
+		return name
+	}
+	remote, err := reference.WithName(c.DefaultNamespace + "/" + name.Name())
+	if err != nil {
+		return name
+	}
+	return remote
+}
+
+// BlobURL returns the URL of a blob.
+func (c *Client) BlobURL(name reference.Named, dgst digest.Digest) (string, error) {
+	name = c.RemoteName(name)
+	ref, err := reference.WithDigest(name, dgst)
+	if err != nil {
+		return "", err
+	}
+	return c.ub.BuildBlobURL(ref)
+}
+
+// Do sends a request, applying Prepare first. Requests rejected with an
+// authentication challenge are retried once with Auth answering it. Pulls
+// carry a token cached by Auth for their repository, if any. Response bodies
+// are read at the rate of Limiter, if set. Requests sent while serving a
+// traced request carry the trace context of a new span of its trace, which is
+// logged.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	var span dcontext.TraceContext
+	parent, traced := dcontext.GetTraceContext(req.Context())
+	if traced && req.Header.Get("traceparent") == "" {
+		span = parent.Child()
+		span.SetHeaders(req.Header)
+	}
+	start := time.Now()
+	resp, err := c.send(req)
+	elapsed := time.Since(start)
+	c.stats.record(req, resp, err, elapsed)
+	if span.SpanID != "" {
+		logSpan(req, span, resp, err, elapsed)
+	}
+	if err == nil && c.Limiter != nil {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, ctx: req.Context(), limiter: c.Limiter}
+	}
+	return resp, err
+}
+
+// send sends a request for Do
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.Prepare != nil {
+		c.Prepare(req)
+	}
+	if c.Auth != nil && req.Header.Get("Authorization") == "" {
+		if authorization := c.Auth.cached(req); authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.Auth == nil {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	authorization, err := c.Auth.authorize(req.Context(), c.httpClient, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if authorization == "" {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", authorization)
+	return c.httpClient.Do(retry)
+}
+
+// logSpan logs the span of a traced request to the registry, with the
+// trace, the span of the request it was sent for and the outcome
+func logSpan(req *http.Request, span dcontext.TraceContext, resp *http.Response, err error, elapsed time.Duration) {
+	fields := map[interface{}]interface{}{
+		"trace.upstream.span_id":  span.SpanID,
+		"trace.upstream.method":   req.Method,
+		"trace.upstream.url":      req.URL.Redacted(),
+		"trace.upstream.duration": elapsed.String(),
+	}
+	if err != nil {
+		fields["trace.upstream.error"] = err.Error()
+	} else {
+		fields["trace.upstream.status"] = resp.StatusCode
+	}
+	dcontext.GetLoggerWithFields(req.Context(), fields, "trace.trace_id", "trace.span_id").Info("upstream request")
+}
+
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return c.Do(req)
+}
+
+// GetManifest pulls the manifest with the given tag or digest, returning its
+// media type and payload. The payload is verified against the digest asked
+// for or, for tags, the Docker-Content-Digest header.
+func (c *Client) GetManifest(ctx context.Context, name reference.Named, tagOrDigest string) (string, []byte, error) {
+	name = c.RemoteName(name)
+	var ref reference.Named
+	var err error
+	if dgst, parseErr := digest.Parse(tagOrDigest); parseErr == nil {
+		ref, err = reference.WithDigest(name, dgst)
+	} else {
+		ref, err = reference.WithTag(name, tagOrDigest)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	manifestURL, err := c.ub.BuildManifestURL(ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, manifestURL, nil, http.Header{
+		"Accept": []string{strings.Join(manifestMediaTypes, ", ")},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil, ErrNotFound
+	default:
+		return "", nil, fmt.Errorf("getting manifest %s: unexpected status %s", ref, resp.Status)
+	}
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(payload) > maxManifestSize {
+		return "", nil, fmt.Errorf("getting manifest %s: manifest exceeds %d bytes", ref, maxManifestSize)
+	}
+
+	// the digest asked for, or else the one the registry claims
+	expected, err := digest.Parse(tagOrDigest)
+	if err != nil {
+		expected, err = digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	}
+	if err == nil && expected.Algorithm().FromBytes(payload) != expected {
+		return "", nil, fmt.Errorf("getting manifest %s: %w", ref, DigestMismatchError{Digest: expected})
+	}
+	return resp.Header.Get("Content-Type"), payload, nil
+}
+
+// BlobExists reports whether the repository holds the blob.
+func (c *Client) BlobExists(ctx context.Context, name reference.Named, dgst digest.Digest) (bool, error) {
+	name = c.RemoteName(name)
+	blobURL, err := c.BlobURL(name, dgst)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, http.MethodHead, blobURL, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("checking blob %s: unexpected status %s", dgst, resp.Status)
+}
+
+// PushBlob uploads the blob described by desc, read from r, in a single
+// request.
+func (c *Client) PushBlob(ctx context.Context, name reference.Named, desc v1.Descriptor, r io.Reader) error {
+	name = c.RemoteName(name)
+	uploadURL, err := c.ub.BuildBlobUploadURL(name)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, uploadURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting upload of %s: unexpected status %s", desc.Digest, resp.Status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("starting upload of %s: %v", desc.Digest, err)
+	}
+	values := location.Query()
+	values.Set("digest", desc.Digest.String())
+	location.RawQuery = values.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("completing upload of %s: unexpected status %s", desc.Digest, resp.Status)
+	}
+	return nil
+}
+
+// PushManifest stores a manifest under tag, or under its digest when tag is
+// empty.
+func (c *Client) PushManifest(ctx context.Context, name reference.Named, tag string, mediaType string, payload []byte) error {
+	name = c.RemoteName(name)
+	var ref reference.Named
+	var err error
+	if tag != "" {
+		ref, err = reference.WithTag(name, tag)
+	} else {
+		ref, err = reference.WithDigest(name, digest.FromBytes(payload))
+	}
+	if err != nil {
+		return err
+	}
+	manifestURL, err := c.ub.BuildManifestURL(ref)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, manifestURL, bytes.NewReader(payload), http.Header{
+		"Content-Type": []string{mediaType},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("putting manifest %s: unexpected status %s", ref, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package registryclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRemoteName(t *testing.T) {
+	client, err := New("https://registry-1.docker.io", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DefaultNamespace = "library"
+	for name, expected := range map[string]string{
+		"ubuntu":         "library/ubuntu",
+		"library/ubuntu": "library/ubuntu",
+		"grafana/loki":   "grafana/loki",
+	} {
+		if remote := client.RemoteName(mustName(t, name)).Name(); remote != expected {
+			t.Errorf("RemoteName(%q) = %q, expected %q", name, remote, expected)
+		}
+	}
+
+	dgst := digest.FromString("layer")
+	url, err := client.BlobURL(mustName(t, "ubuntu"), dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://registry-1.docker.io/v2/library/ubuntu/blobs/" + dgst.String(); url != expected {
+		t.Errorf("unexpected blob url %q, expected %q", url, expected)
+	}
+}
+
+func mustName(t *testing.T, name string) reference.Named {
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return named
+}
+
+func TestStats(t *testing.T) {
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/foo/manifests/latest", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	get()
+	fail = false
+	get()
+
+	stats := client.Stats()
+	if stats.Requests != 2 || stats.Errors != 1 || stats.ErrorRate != 0.5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.LastError != "GET /v2/foo/manifests/latest: 503 Service Unavailable" || stats.LastErrorTime == nil {
+		t.Fatalf("unexpected last error: %+v", stats)
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ctx context.Context) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v2/foo/manifests/latest", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get(context.Background())
+	if v := header.Get("traceparent"); v != "" {
+		t.Fatalf("unexpected traceparent of an untraced request: %q", v)
+	}
+
+	caller := dcontext.TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: "01", State: "vendor=value"}
+	ctx := dcontext.WithTraceContext(context.Background(), caller)
+	get(ctx)
+	span, ok := dcontext.ParseTraceContext(header)
+	if !ok {
+		t.Fatalf("invalid trace context sent: %v", header)
+	}
+	own, _ := dcontext.GetTraceContext(ctx)
+	if span.TraceID != caller.TraceID || span.State != caller.State || span.Flags != caller.Flags ||
+		span.SpanID == caller.SpanID || span.SpanID == own.SpanID {
+		t.Fatalf("unexpected span %+v sent for caller %+v", span, caller)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 20*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Limiter = NewLimiter(100 * 1024)
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/foo/blobs/sha256:abcd", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("unexpected content")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("expected reading 20KiB at 100KiB/s to take about 200ms, took %v", elapsed)
+	}
+}
+
+func TestSegmentedBody(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	var ranges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/foo/blobs/sha256:abcd", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := client.SegmentedBody(resp, 3)
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	if !bytes.Equal(got, content) {
+		t.Fatal("unexpected content")
+	}
+	if n := ranges.Load(); n != 2 {
+		t.Fatalf("expected 2 range requests, got %d", n)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+		t.Fatalf("expected segment files to be removed, got %d", len(entries))
+	}
+}
+
+func TestGetManifestDigestMismatch(t *testing.T) {
+	payload := []byte(`{"schemaVersion":2}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest.FromString("other").String())
+		w.Write(payload)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mismatch DigestMismatchError
+	_, _, err = client.GetManifest(context.Background(), mustName(t, "foo"), "latest")
+	if !errors.As(err, &mismatch) || mismatch.Digest != digest.FromString("other") {
+		t.Fatalf("expected a digest mismatch for the claimed digest, got %v", err)
+	}
+	_, _, err = client.GetManifest(context.Background(), mustName(t, "foo"), digest.FromString("asked").String())
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected a digest mismatch for the digest asked for, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package registryclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialHelperTTL is how long the credentials of a credential helper are
+// used before it is asked again, so that short-lived credentials such as
+// ECR login tokens are refreshed before they expire
+const credentialHelperTTL = 5 * time.Minute
+
+// CredentialHelper returns a function for Auth.Credentials asking the
+// docker-credential-<helper> binary for the credentials of serverURL,
+// following the docker credential helper protocol.
+func CredentialHelper(helper, serverURL string) func(ctx context.Context) (string, string, error) {
+	var mu sync.Mutex
+	var username, password string
+	var expires time.Time
+	return func(ctx context.Context) (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().Before(expires) {
+			return username, password, nil
+		}
+
+		cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+		cmd.Stdin = strings.NewReader(serverURL)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", "", fmt.Errorf("credential helper %s: %w", helper, err)
+		}
+		var creds struct {
+			Username string
+			Secret   string
+		}
+		if err := json.Unmarshal(output, &creds); err != nil {
+			return "", "", fmt.Errorf("credential helper %s: %w", helper, err)
+		}
+		username, password = creds.Username, creds.Secret
+		expires = time.Now().Add(credentialHelperTTL)
+		return username, password, nil
+	}
+}
+
+// dockerConfig is the part of a docker config.json file holding credentials
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DockerConfigCredentials returns a function for Auth.Credentials with the
+// credentials of the registry host found in the docker config.json file at
+// path: those of the credential helper configured for host, those stored in
+// the file, or those of the default credentials store, in this order.
+func DockerConfigCredentials(path, host string) (func(ctx context.Context) (string, string, error), error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if helper, ok := config.CredHelpers[host]; ok {
+		return CredentialHelper(helper, host), nil
+	}
+	serverURL := host
+	for key, entry := range config.Auths {
+		if configHost(key) != host {
+			continue
+		}
+		serverURL = key
+		username, password := entry.Username, entry.Password
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: invalid auth for %s: %w", path, key, err)
+			}
+			username, password, _ = strings.Cut(string(decoded), ":")
+		}
+		if username != "" {
+			return func(context.Context) (string, string, error) {
+				return username, password, nil
+			}, nil
+		}
+	}
+	if config.CredsStore != "" {
+		return CredentialHelper(config.CredsStore, serverURL), nil
+	}
+	return func(context.Context) (string, string, error) {
+		return "", "", nil
+	}, nil
+}
+
+// configHost returns the host of a key of the auths of a docker config file,
+// which are either hosts or URLs such as "https://index.docker.io/v1/"
+func configHost(key string) string {
+	if _, rest, ok := strings.Cut(key, "://"); ok {
+		key = rest
+	}
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
@@ -0,0 +1,55 @@
+package registryclient
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDockerConfigCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helper script requires a unix shell")
+	}
+	dir := t.TempDir()
+	helper := "#!/bin/sh\nread server\necho \"{\\\"Username\\\": \\\"AWS\\\", \\\"Secret\\\": \\\"token-for-$server\\\"}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	configPath := filepath.Join(dir, "config.json")
+	config := `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ="},
+			"quay.io": {}
+		},
+		"credHelpers": {"ecr.example.com": "test"}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host     string
+		username string
+		password string
+	}{
+		{"index.docker.io", "user", "secret"},
+		{"ecr.example.com", "AWS", "token-for-ecr.example.com"},
+		{"quay.io", "", ""},
+	} {
+		credentials, err := DockerConfigCredentials(configPath, tc.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		username, password, err := credentials(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.host, err)
+		}
+		if username != tc.username || password != tc.password {
+			t.Errorf("%s: unexpected credentials %q:%q, expected %q:%q", tc.host, username, password, tc.username, tc.password)
+		}
+	}
+}
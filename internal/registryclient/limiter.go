@@ -0,0 +1,72 @@
+package registryclient
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate at which response bodies are read, shared by all
+// the responses it wraps.
+type Limiter struct {
+	rate int64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the bytes reserved so far have been read at rate
+}
+
+// NewLimiter returns a limiter allowing bytesPerSecond.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{rate: bytesPerSecond}
+}
+
+// chunk returns the largest read waited for at once, a tenth of a second of
+// transfer, so that concurrent readers share the rate evenly
+func (l *Limiter) chunk() int {
+	return int(max(l.rate/10, 1))
+}
+
+// wait blocks until n more bytes may be read
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedBody is a response body read at the rate of a limiter
+type limitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if chunk := b.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := b.limiter.wait(b.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,139 @@
+package registryclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SegmentedBody replaces the body of resp, a whole blob response of known
+// size, with one downloading the blob in segments over parallel range
+// requests. The first segment is read from resp as it arrives, the others
+// are downloaded into temporary files and read once complete. Responses of
+// servers not accepting ranges are returned as they are.
+func (c *Client) SegmentedBody(resp *http.Response, segments int) io.ReadCloser {
+	size := resp.ContentLength
+	if segments < 2 || size < int64(segments) || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Accept-Ranges") != "bytes" || resp.Request == nil {
+		return resp.Body
+	}
+
+	ctx, cancel := context.WithCancel(resp.Request.Context())
+	segmentSize := (size + int64(segments) - 1) / int64(segments)
+	b := &segmentedBody{
+		first:  resp.Body,
+		cancel: cancel,
+		parts:  make([]*segment, 0, segments-1),
+	}
+	b.current = io.LimitReader(resp.Body, segmentSize)
+	for start := segmentSize; start < size; start += segmentSize {
+		s := &segment{done: make(chan struct{})}
+		b.parts = append(b.parts, s)
+		end := min(start+segmentSize, size) - 1
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer close(s.done)
+			s.file, s.err = c.fetchSegment(ctx, resp.Request, start, end)
+		}()
+	}
+	return b
+}
+
+// fetchSegment downloads the bytes start to end of the response to req into
+// a temporary file
+func (c *Client) fetchSegment(ctx context.Context, req *http.Request, start, end int64) (*os.File, error) {
+	req = req.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return nil, fmt.Errorf("getting bytes %d-%d: unexpected response %s", start, end, resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "segment-")
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err == nil && n != end-start+1 {
+		err = fmt.Errorf("getting bytes %d-%d: received %d bytes", start, end, n)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSegment(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// segment is a part of a blob downloaded by a range request
+type segment struct {
+	done chan struct{}
+	file *os.File
+	err  error
+}
+
+// segmentedBody reads the segments of a blob in order
+type segmentedBody struct {
+	first   io.ReadCloser
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	parts   []*segment
+	next    int // index of the part read after current
+	current io.Reader
+}
+
+func (b *segmentedBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if b.next == 0 {
+			// stop the transfer of the rest of the blob
+			b.first.Close()
+		}
+		if b.next == len(b.parts) {
+			return 0, io.EOF
+		}
+		s := b.parts[b.next]
+		b.next++
+		<-s.done
+		if s.err != nil {
+			return 0, s.err
+		}
+		b.current = s.file
+	}
+}
+
+// Close stops the downloads and removes the temporary files.
+func (b *segmentedBody) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	for _, s := range b.parts {
+		if s.file != nil {
+			removeSegment(s.file)
+		}
+	}
+	return b.first.Close()
+}
+
+// removeSegment closes and removes the temporary file of a segment
+func removeSegment(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,124 @@
+package registryclient
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "registry_client", nil)
+
+	requestsTotal  = namespace.NewLabeledCounter("requests", "The number of requests sent to remote registries", "registry", "result")
+	requestLatency = namespace.NewLabeledTimer("request_latency", "The time until remote registries respond", "registry")
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// Stats summarizes the requests sent to a registry, so that failing pulls
+// can be attributed to the registry rather than to the cache.
+type Stats struct {
+	URL            string     `json:"url"`
+	Requests       uint64     `json:"requests"`
+	Errors         uint64     `json:"errors"`
+	ErrorRate      float64    `json:"error_rate"`
+	AverageLatency string     `json:"average_latency"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorTime  *time.Time `json:"last_error_time,omitempty"`
+	// FailingSince is the time of the first error since the last successful
+	// request, nil if that succeeded
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+}
+
+// stats records the requests sent by a client
+type stats struct {
+	url  string
+	host string
+
+	mu            sync.Mutex
+	requests      uint64
+	errors        uint64
+	latency       time.Duration // total
+	lastError     string
+	lastErrorTime time.Time
+	failingSince  time.Time
+}
+
+func newStats(baseURL string) *stats {
+	s := &stats{url: baseURL}
+	if u, err := url.Parse(baseURL); err == nil {
+		s.host = u.Host
+	}
+	return s
+}
+
+// record records the outcome of a request. Transport errors, server errors
+// and rate limiting count as errors, requests canceled by the caller are
+// not recorded.
+func (s *stats) record(req *http.Request, resp *http.Response, err error, latency time.Duration) {
+	if err != nil && req.Context().Err() != nil {
+		return
+	}
+	var failure string
+	switch {
+	case err != nil:
+		failure = err.Error()
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		failure = req.Method + " " + req.URL.Path + ": " + resp.Status
+	}
+
+	result := "success"
+	if failure != "" {
+		result = "error"
+	}
+	requestsTotal.WithValues(s.host, result).Inc(1)
+	requestLatency.WithValues(s.host).Update(latency)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.latency += latency
+	if failure == "" {
+		s.failingSince = time.Time{}
+		return
+	}
+	s.errors++
+	s.lastError = failure
+	s.lastErrorTime = time.Now()
+	if s.failingSince.IsZero() {
+		s.failingSince = s.lastErrorTime
+	}
+}
+
+// Stats returns a summary of the requests sent by the client.
+func (c *Client) Stats() Stats {
+	s := c.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{
+		URL:       s.url,
+		Requests:  s.requests,
+		Errors:    s.errors,
+		LastError: s.lastError,
+	}
+	if s.requests > 0 {
+		stats.ErrorRate = float64(s.errors) / float64(s.requests)
+		stats.AverageLatency = (s.latency / time.Duration(s.requests)).String()
+	}
+	if !s.lastErrorTime.IsZero() {
+		lastErrorTime := s.lastErrorTime
+		stats.LastErrorTime = &lastErrorTime
+	}
+	if !s.failingSince.IsZero() {
+		failingSince := s.failingSince
+		stats.FailingSince = &failingSince
+	}
+	return stats
+}
@@ -0,0 +1,287 @@
+// Package alert evaluates conditions of the cache needing attention at a
+// fixed interval and posts alerts to webhooks when they start and stop, as
+// lightweight alerting for teams without a monitoring stack.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "alert", nil)
+
+	notifications = namespace.NewLabeledCounter("notifications", "The number of alerts posted to webhooks", "alert", "result")
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// Names of the alerts
+const (
+	DiskUsage       = "disk_usage"
+	EvictionBacklog = "eviction_backlog"
+	UpstreamFailing = "upstream_failing"
+)
+
+// Statuses of the alerts
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// Formats of the webhook bodies
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+// sendTimeout limits the time a webhook is given to accept an alert
+const sendTimeout = 10 * time.Second
+
+// Alert is the body of the webhooks of the json format
+type Alert struct {
+	Name     string    `json:"alert"`
+	Status   string    `json:"status"`
+	Message  string    `json:"message"`
+	Instance string    `json:"instance,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// text formats the alert for chat webhooks
+func (a Alert) text() string {
+	prefix := ":rotating_light: [FIRING]"
+	if a.Status == Resolved {
+		prefix = ":white_check_mark: [RESOLVED]"
+	}
+	if a.Instance != "" {
+		prefix += " " + a.Instance
+	}
+	return fmt.Sprintf("%s %s: %s", prefix, a.Name, a.Message)
+}
+
+// Webhook is an URL alerts are posted to
+type Webhook struct {
+	URL    string
+	Format string // FormatJSON if empty
+}
+
+// Probes read the state the conditions are evaluated on. A nil probe
+// disables its alert.
+type Probes struct {
+	// Usage returns the bytes used and available in total
+	Usage func(ctx context.Context) (used, total int64, err error)
+	// Backlog returns the number of evictable blobs the cleanup left behind
+	Backlog func() int64
+	// UpstreamFailingSince returns the time the upstream started failing,
+	// zero if it does not
+	UpstreamFailingSince func() time.Time
+}
+
+// Config selects the conditions alerting
+type Config struct {
+	Webhooks []Webhook
+	Interval time.Duration
+	// Instance names the server in the alerts, e.g. its host name
+	Instance string
+
+	// DiskUsage are the percentages of use alerting when crossed
+	DiskUsage []float64
+	// EvictionBacklog and UpstreamFailing are how long the condition must
+	// hold before alerting, zero disables the alert
+	EvictionBacklog time.Duration
+	UpstreamFailing time.Duration
+}
+
+// Monitor evaluates the conditions every interval and posts an alert when
+// one starts to hold, and another when it stops
+type Monitor struct {
+	config Config
+	probes Probes
+	client *http.Client
+	logger *logrus.Logger
+
+	// diskLevel is the number of disk usage thresholds crossed
+	diskLevel    int
+	backlogSince time.Time
+	firing       map[string]bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMonitor creates a monitor of the conditions of config read by probes.
+func NewMonitor(config Config, probes Probes, logger *logrus.Logger) (*Monitor, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("alert interval must be positive")
+	}
+	for _, webhook := range config.Webhooks {
+		switch webhook.Format {
+		case "", FormatJSON, FormatSlack:
+		default:
+			return nil, fmt.Errorf("webhook %s: unknown format %q, want %s or %s", webhook.URL, webhook.Format, FormatJSON, FormatSlack)
+		}
+	}
+	for _, threshold := range config.DiskUsage {
+		if threshold <= 0 || threshold > 100 {
+			return nil, fmt.Errorf("disk usage threshold %v is not a percentage", threshold)
+		}
+	}
+	config.DiskUsage = slices.Clone(config.DiskUsage)
+	slices.Sort(config.DiskUsage)
+	return &Monitor{
+		config: config,
+		probes: probes,
+		client: &http.Client{Timeout: sendTimeout},
+		logger: logger,
+		firing: make(map[string]bool),
+	}, nil
+}
+
+// Start evaluates the conditions every interval until ctx is done or Stop is
+// called.
+func (m *Monitor) Start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, alert := range m.evaluate(ctx, now) {
+					m.send(ctx, alert)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops evaluating the conditions and waits for the alerts being sent.
+func (m *Monitor) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// evaluate returns the alerts of the conditions which started or stopped
+// holding since the previous evaluation
+func (m *Monitor) evaluate(ctx context.Context, now time.Time) []Alert {
+	var alerts []Alert
+	add := func(name string, firing bool, message string) {
+		if m.firing[name] == firing {
+			return
+		}
+		m.firing[name] = firing
+		status := Resolved
+		if firing {
+			status = Firing
+		}
+		alerts = append(alerts, Alert{Name: name, Status: status, Message: message, Instance: m.config.Instance, Time: now})
+	}
+
+	if m.probes.Usage != nil && len(m.config.DiskUsage) > 0 {
+		used, total, err := m.probes.Usage(ctx)
+		switch {
+		case err != nil:
+			m.logger.Warnf("error reading disk usage for alerts: %v", err)
+		case total > 0:
+			percent := 100 * float64(used) / float64(total)
+			level := 0
+			for level < len(m.config.DiskUsage) && percent >= m.config.DiskUsage[level] {
+				level++
+			}
+			if level > m.diskLevel {
+				// a higher threshold crossed alerts again
+				m.firing[DiskUsage] = false
+				add(DiskUsage, true, fmt.Sprintf("%.1f%% used (%d of %d bytes), above %v%%", percent, used, total, m.config.DiskUsage[level-1]))
+			} else if level == 0 {
+				add(DiskUsage, false, fmt.Sprintf("%.1f%% used (%d of %d bytes), below %v%%", percent, used, total, m.config.DiskUsage[0]))
+			}
+			m.diskLevel = level
+		}
+	}
+
+	if m.probes.Backlog != nil && m.config.EvictionBacklog > 0 {
+		backlog := m.probes.Backlog()
+		if backlog == 0 {
+			m.backlogSince = time.Time{}
+			add(EvictionBacklog, false, "the cleanup caught up with the evictable blobs")
+		} else {
+			if m.backlogSince.IsZero() {
+				m.backlogSince = now
+			}
+			if now.Sub(m.backlogSince) >= m.config.EvictionBacklog {
+				add(EvictionBacklog, true, fmt.Sprintf("%d evictable blobs left behind by the cleanup for %v", backlog, now.Sub(m.backlogSince).Round(time.Second)))
+			}
+		}
+	}
+
+	if m.probes.UpstreamFailingSince != nil && m.config.UpstreamFailing > 0 {
+		since := m.probes.UpstreamFailingSince()
+		if since.IsZero() {
+			add(UpstreamFailing, false, "the upstream answers again")
+		} else if failing := now.Sub(since); failing >= m.config.UpstreamFailing {
+			add(UpstreamFailing, true, fmt.Sprintf("every upstream request failed for %v", failing.Round(time.Second)))
+		}
+	}
+	return alerts
+}
+
+// send posts an alert to every webhook, logging failures
+func (m *Monitor) send(ctx context.Context, alert Alert) {
+	m.logger.Warnf("alert %s %s: %s", alert.Name, alert.Status, alert.Message)
+	for _, webhook := range m.config.Webhooks {
+		result := "success"
+		if err := m.post(ctx, webhook, alert); err != nil {
+			result = "error"
+			m.logger.Errorf("error sending alert %s to %s: %v", alert.Name, webhook.URL, err)
+		}
+		notifications.WithValues(alert.Name, result).Inc(1)
+	}
+}
+
+func (m *Monitor) post(ctx context.Context, webhook Webhook, alert Alert) error {
+	var body any = alert
+	if webhook.Format == FormatSlack {
+		body = map[string]string{"text": alert.text()}
+	}
+	p, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func names(alerts []Alert) []string {
+	var s []string
+	for _, a := range alerts {
+		s = append(s, a.Name+" "+a.Status)
+	}
+	return s
+}
+
+func TestEvaluate(t *testing.T) {
+	var used int64
+	var backlog int64
+	var failingSince time.Time
+	m, err := NewMonitor(Config{
+		Interval:        time.Minute,
+		DiskUsage:       []float64{90, 80},
+		EvictionBacklog: 10 * time.Minute,
+		UpstreamFailing: 5 * time.Minute,
+	}, Probes{
+		Usage:                func(context.Context) (int64, int64, error) { return used, 100, nil },
+		Backlog:              func() int64 { return backlog },
+		UpstreamFailingSince: func() time.Time { return failingSince },
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating monitor: %v", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		used, backlog int64
+		failing       time.Duration // since the upstream fails, 0 if it does not
+		want          string
+	}{
+		{used: 50},
+		{used: 85, backlog: 3, failing: time.Minute, want: "disk_usage firing"},
+		// staying above the same threshold does not alert again
+		{used: 88, backlog: 3, failing: 6 * time.Minute, want: "upstream_failing firing"},
+		// the backlog holds since the second step
+		{used: 95, backlog: 3, failing: 7 * time.Minute, want: "disk_usage firing,eviction_backlog firing"},
+		{used: 85, backlog: 3, failing: 8 * time.Minute},
+		{used: 50, backlog: 3, want: "disk_usage resolved,upstream_failing resolved"},
+		{used: 50, want: "eviction_backlog resolved"},
+		{used: 50},
+	}
+	for i, step := range steps {
+		now := start.Add(time.Duration(i) * 5 * time.Minute)
+		used, backlog = step.used, step.backlog
+		failingSince = time.Time{}
+		if step.failing > 0 {
+			failingSince = now.Add(-step.failing)
+		}
+		if got := strings.Join(names(m.evaluate(context.Background(), now)), ","); got != step.want {
+			t.Errorf("step %d: got alerts %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	bodies := make(chan map[string]any, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("unexpected error decoding body: %v", err)
+		}
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	m, err := NewMonitor(Config{
+		Interval: time.Minute,
+		Instance: "cache-1",
+		Webhooks: []Webhook{{URL: srv.URL}, {URL: srv.URL, Format: FormatSlack}},
+	}, Probes{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating monitor: %v", err)
+	}
+	m.send(context.Background(), Alert{Name: DiskUsage, Status: Firing, Message: "91.0% used", Instance: "cache-1", Time: time.Now()})
+
+	body := <-bodies
+	if body["alert"] != DiskUsage || body["status"] != Firing || body["instance"] != "cache-1" {
+		t.Errorf("unexpected json body %v", body)
+	}
+	body = <-bodies
+	if text, _ := body["text"].(string); !strings.Contains(text, "[FIRING] cache-1 disk_usage: 91.0% used") {
+		t.Errorf("unexpected slack body %v", body)
+	}
+}
+
+func TestNewMonitorErrors(t *testing.T) {
+	for _, config := range []Config{
+		{},
+		{Interval: time.Minute, Webhooks: []Webhook{{URL: "http://example.com", Format: "xml"}}},
+		{Interval: time.Minute, DiskUsage: []float64{120}},
+	} {
+		if _, err := NewMonitor(config, Probes{}, nil); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
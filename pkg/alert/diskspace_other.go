@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+package alert
+
+import (
+	"context"
+	"errors"
+)
+
+func FileSystem(dir string) func(ctx context.Context) (int64, int64, error) {
+	return func(ctx context.Context) (int64, int64, error) {
+		return 0, 0, errors.New("disk usage alerts are not supported on this platform")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package alert
+
+import (
+	"context"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileSystem returns a usage probe of the file system holding dir. As df
+// does, the blocks reserved for the superuser are not counted in the total.
+func FileSystem(dir string) func(ctx context.Context) (int64, int64, error) {
+	return func(ctx context.Context) (int64, int64, error) {
+		var stat unix.Statfs_t
+		if err := unix.Statfs(dir, &stat); err != nil {
+			return 0, 0, err
+		}
+		used := (uint64(stat.Blocks) - uint64(stat.Bfree)) * uint64(stat.Bsize)
+		return int64(used), int64(used + uint64(stat.Bavail)*uint64(stat.Bsize)), nil
+	}
+}
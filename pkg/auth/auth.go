@@ -0,0 +1,66 @@
+// Package auth holds the registry of the auth types selected by auth.type in
+// the configuration. Access controllers register their type from the init
+// function of their package, so that importing a package, even from another
+// module, makes its type available:
+//
+//	import _ "example.com/registry-auth/ldap"
+//
+// The built-in types are "userpass", "pat" and "kubernetes".
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+// Factory creates the access controller of an auth type from the
+// configuration. realm is the realm of the challenges of the access
+// controller. Types outside of this module read their settings from
+// cfg.Auth.Parameters.
+type Factory func(realm string, cfg *config.Config) (registryauth.AccessController, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes the auth type name available, created by factory. It fails
+// if name is already registered.
+func Register(name string, factory Factory) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := factories[name]; exists {
+		return fmt.Errorf("auth type %q already registered", name)
+	}
+	factories[name] = factory
+	return nil
+}
+
+// New creates the access controller of the auth type name
+func New(name string, realm string, cfg *config.Config) (registryauth.AccessController, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown auth type %q, registered types are %v", name, Types())
+	}
+	return factory(realm, cfg)
+}
+
+// Types returns the registered auth types, sorted
+func Types() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+type staticController struct {
+	user string
+}
+
+func (ac *staticController) Authorized(req *http.Request, accessRecords ...registryauth.Access) (*registryauth.Grant, error) {
+	return &registryauth.Grant{User: registryauth.UserInfo{Name: ac.user}}, nil
+}
+
+func TestRegister(t *testing.T) {
+	factory := func(realm string, cfg *config.Config) (registryauth.AccessController, error) {
+		user, _ := cfg.Auth.Parameters["user"].(string)
+		return &staticController{user: user}, nil
+	}
+	if err := Register("test-static", factory); err != nil {
+		t.Fatalf("unexpected error registering: %v", err)
+	}
+	if err := Register("test-static", factory); err == nil {
+		t.Fatal("expected error registering a type twice")
+	}
+	if !slices.Contains(Types(), "test-static") {
+		t.Fatalf("expected registered type in %v", Types())
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Auth.Parameters = map[string]any{"user": "static"}
+	ac, err := New("test-static", "test-realm", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+	grant, err := ac.Authorized(&http.Request{})
+	if err != nil || grant.User.Name != "static" {
+		t.Fatalf("unexpected grant %v, %v", grant, err)
+	}
+
+	if _, err := New("test-unknown", "test-realm", cfg); err == nil {
+		t.Fatal("expected error for an unknown type")
+	}
+}
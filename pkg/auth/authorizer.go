@@ -0,0 +1,17 @@
+package auth
+
+import (
+	"net/http"
+
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+)
+
+// Authorizer is implemented by access controllers able to decide further
+// accesses of a request they already authorized, without authenticating it
+// again nor logging or counting denials. The catalog lists only the
+// repositories the user may pull with it.
+type Authorizer interface {
+	// Allows reports whether user, the user of the grant of req, may
+	// access.
+	Allows(req *http.Request, user string, access registryauth.Access) bool
+}
@@ -0,0 +1,411 @@
+// Package kubernetes provides an access controller that authenticates
+// Kubernetes service accounts by their token given as password, validated
+// with a TokenReview against the cluster API, and grants access by their
+// namespace and name.
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrAccessDenied is returned when no rule grants the service account the
+// requested access to a repository.
+var ErrAccessDenied = dcsauth.ErrAccessDenied
+
+// serviceAccountDir holds the credentials of the service account of the pod
+// the cache server runs in
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// serviceAccountPrefix prefixes the usernames of service accounts
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// maxCachedTokens bounds the reviewed tokens kept, so that trying random
+// tokens cannot grow the cache without limit
+const maxCachedTokens = 10000
+
+// requestTimeout bounds a TokenReview
+const requestTimeout = 30 * time.Second
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "auth_kubernetes", nil)
+
+	reviews = namespace.NewLabeledCounter("token_reviews", "The number of tokens reviewed by the cluster API", "result")
+)
+
+func init() {
+	metrics.Register(namespace)
+
+	err := dcsauth.Register("kubernetes", func(realm string, cfg *config.Config) (auth.AccessController, error) {
+		ac, err := New(realm, cfg.Auth.Kubernetes)
+		if err != nil {
+			return nil, fmt.Errorf("auth.kubernetes: %w", err)
+		}
+		return ac, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type rule struct {
+	namespace      string
+	serviceAccount string
+	push           bool
+	repositories   []string
+}
+
+// serviceAccount is the service account a token belongs to
+type serviceAccount struct {
+	namespace string
+	name      string
+}
+
+// cached is the result of reviewing a token
+type cached struct {
+	sa      serviceAccount
+	valid   bool
+	expires time.Time
+}
+
+type accessController struct {
+	realm     string
+	client    *http.Client
+	server    string
+	tokenFile string
+	audiences []string
+	rules     []rule
+	ttl       time.Duration
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[string]cached // by hash of the token
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ dcsauth.Authorizer    = &accessController{}
+)
+
+// New returns an access controller reviewing tokens with the cluster API of
+// cfg, by default the one of the cluster the cache server runs in
+func New(realm string, cfg config.KubernetesAuthConfig) (auth.AccessController, error) {
+	if cfg.CacheTTL <= 0 {
+		return nil, fmt.Errorf("cache_ttl must be positive")
+	}
+
+	server := cfg.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("api_server must be set outside of a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+	caFile := cfg.CAFile
+	if caFile == "" {
+		caFile = path.Join(serviceAccountDir, "ca.crt")
+	}
+	tokenFile := cfg.TokenFile
+	if tokenFile == "" {
+		tokenFile = path.Join(serviceAccountDir, "token")
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading ca_file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in ca_file %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	ac := &accessController{
+		realm:     realm,
+		client:    &http.Client{Transport: transport, Timeout: requestTimeout},
+		server:    strings.TrimRight(server, "/"),
+		tokenFile: tokenFile,
+		audiences: cfg.Audiences,
+		ttl:       cfg.CacheTTL,
+		cache:     make(map[string]cached),
+	}
+	for i, r := range cfg.Rules {
+		if r.Namespace == "" {
+			return nil, fmt.Errorf("rules[%d]: namespace must be set", i)
+		}
+		if r.Access != "pull" && r.Access != "push" {
+			return nil, fmt.Errorf("rules[%d]: unknown access %q", i, r.Access)
+		}
+		for _, pattern := range r.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rules[%d]: invalid repository pattern %q: %w", i, pattern, err)
+			}
+		}
+		ac.rules = append(ac.rules, rule{
+			namespace:      r.Namespace,
+			serviceAccount: r.ServiceAccount,
+			push:           r.Access == "push",
+			repositories:   r.Repositories,
+		})
+	}
+	return ac, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	// the username is whatever clients require, the token tells the user
+	_, token, ok := req.BasicAuth()
+	if !ok || token == "" {
+		return nil, ac.challenge(auth.ErrInvalidCredential)
+	}
+
+	sa, valid, err := ac.identify(req.Context(), token)
+	if err != nil {
+		dcontext.GetLogger(req.Context()).Errorf("error reviewing service account token: %v", err)
+		return nil, ac.challenge(err)
+	} else if !valid {
+		dcontext.GetLogger(req.Context()).Errorf("cluster API rejected service account token")
+		return nil, ac.challenge(auth.ErrAuthenticationFailure)
+	}
+
+	username := serviceAccountPrefix + sa.namespace + ":" + sa.name
+	var resources []auth.Resource
+	for _, access := range accessRecords {
+		if access.Type == "repository" && !ac.allowed(sa, access) {
+			dcontext.GetLogger(req.Context()).Warnf("user %q denied %s access to %q", username, access.Action, access.Name)
+			return nil, ac.challenge(ErrAccessDenied)
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{User: auth.UserInfo{Name: username}, Resources: resources}, nil
+}
+
+// Allows implements dcsauth.Authorizer
+func (ac *accessController) Allows(req *http.Request, user string, access auth.Access) bool {
+	if access.Type != "repository" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(user, serviceAccountPrefix)
+	if !ok {
+		return false
+	}
+	namespace, name, ok := strings.Cut(rest, ":")
+	if !ok {
+		return false
+	}
+	return ac.allowed(serviceAccount{namespace: namespace, name: name}, access)
+}
+
+// identify returns the service account of token, false if the cluster API
+// rejected it. Results are cached for the cache TTL, errors are not.
+func (ac *accessController) identify(ctx context.Context, token string) (serviceAccount, bool, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	ac.mu.Lock()
+	entry, ok := ac.cache[key]
+	ac.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.sa, entry.valid, nil
+	}
+
+	// concurrent requests of a client, such as layer pulls, share the review
+	v, err, _ := ac.group.Do(key, func() (any, error) {
+		sa, valid, err := ac.review(context.WithoutCancel(ctx), token)
+		switch {
+		case err != nil:
+			reviews.WithValues("error").Inc(1)
+			return nil, err
+		case valid:
+			reviews.WithValues("valid").Inc(1)
+		default:
+			reviews.WithValues("invalid").Inc(1)
+		}
+		entry := cached{sa: sa, valid: valid, expires: time.Now().Add(ac.ttl)}
+		ac.store(key, entry)
+		return entry, nil
+	})
+	if err != nil {
+		return serviceAccount{}, false, err
+	}
+	entry = v.(cached)
+	return entry.sa, entry.valid, nil
+}
+
+// store caches entry, dropping the expired entries or else an arbitrary one
+// when the cache is full
+func (ac *accessController) store(key string, entry cached) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if len(ac.cache) >= maxCachedTokens {
+		now := time.Now()
+		for k, e := range ac.cache {
+			if now.After(e.expires) {
+				delete(ac.cache, k)
+			}
+		}
+		for k := range ac.cache {
+			if len(ac.cache) < maxCachedTokens {
+				break
+			}
+			delete(ac.cache, k)
+		}
+	}
+	ac.cache[key] = entry
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Error string `json:"error"`
+}
+
+// review asks the cluster API whether token is valid for the audiences and
+// belongs to a service account. The cache server authenticates with the
+// token of its own service account, which needs the system:auth-delegator
+// cluster role.
+func (ac *accessController) review(ctx context.Context, token string) (serviceAccount, bool, error) {
+	reviewerToken, err := os.ReadFile(ac.tokenFile)
+	if err != nil {
+		return serviceAccount{}, false, fmt.Errorf("reading token_file: %w", err)
+	}
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: ac.audiences},
+	})
+	if err != nil {
+		return serviceAccount{}, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ac.server+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return serviceAccount{}, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(reviewerToken)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return serviceAccount{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return serviceAccount{}, false, fmt.Errorf("creating TokenReview: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return serviceAccount{}, false, fmt.Errorf("decoding TokenReview: %w", err)
+	}
+	if !result.Status.Authenticated {
+		return serviceAccount{}, false, nil
+	}
+	// only service accounts, not users the cluster authenticates otherwise
+	name, ok := strings.CutPrefix(result.Status.User.Username, serviceAccountPrefix)
+	if !ok {
+		return serviceAccount{}, false, nil
+	}
+	ns, name, ok := strings.Cut(name, ":")
+	if !ok {
+		return serviceAccount{}, false, nil
+	}
+	return serviceAccount{namespace: ns, name: name}, true, nil
+}
+
+// allowed reports whether a rule grants sa the access
+func (ac *accessController) allowed(sa serviceAccount, access auth.Access) bool {
+	push := access.Action != "pull"
+	for _, r := range ac.rules {
+		if push && !r.push {
+			continue
+		}
+		if r.namespace != "*" && r.namespace != sa.namespace {
+			continue
+		}
+		if r.serviceAccount != "" && r.serviceAccount != "*" && r.serviceAccount != sa.name {
+			continue
+		}
+		if len(r.repositories) == 0 {
+			return true
+		}
+		for _, pattern := range r.repositories {
+			if matched, _ := path.Match(expand(pattern, sa), access.Name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expand replaces $namespace and $serviceaccount in a repository pattern by
+// the ones of sa, so that one rule can give each namespace its own
+// repositories
+func expand(pattern string, sa serviceAccount) string {
+	return strings.NewReplacer("$namespace", sa.namespace, "$serviceaccount", sa.name).Replace(pattern)
+}
+
+func (ac *accessController) challenge(err error) error {
+	return &challenge{realm: ac.realm, err: err}
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+// Unwrap returns the error of the challenge
+func (ch challenge) Unwrap() error {
+	return ch.err
+}
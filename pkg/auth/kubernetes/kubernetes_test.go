@@ -0,0 +1,152 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+func access(action, name string) auth.Access {
+	return auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: name},
+		Action:   action,
+	}
+}
+
+// newCluster returns the configuration of a fake cluster API which
+// authenticates tokens named after the username they belong to
+func newCluster(t *testing.T, reviews *atomic.Int32) config.KubernetesAuthConfig {
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer reviewer" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reviews.Add(1)
+		var review tokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(review.Spec.Audiences) != 1 || review.Spec.Audiences[0] != "docker-cache-server" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if review.Spec.Token != "invalid" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = review.Spec.Token
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	t.Cleanup(api.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("reviewer\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.KubernetesAuthConfig{
+		APIServer: api.URL,
+		CAFile:    caFile,
+		TokenFile: tokenFile,
+		Audiences: []string{"docker-cache-server"},
+		CacheTTL:  time.Hour,
+	}
+}
+
+func TestTokenReview(t *testing.T) {
+	var reviews atomic.Int32
+	cfg := newCluster(t, &reviews)
+	cfg.Rules = []config.KubernetesRule{
+		{Namespace: "*", Access: "pull", Repositories: []string{"library/*", "$namespace/*"}},
+		{Namespace: "ci", ServiceAccount: "builder", Access: "push", Repositories: []string{"$namespace/*"}},
+	}
+	ac, err := New("test-realm", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	for _, testcase := range []struct {
+		token   string
+		access  auth.Access
+		allowed bool
+	}{
+		{"system:serviceaccount:ci:builder", access("pull", "library/ubuntu"), true},
+		{"system:serviceaccount:ci:builder", access("push", "ci/app"), true},
+		{"system:serviceaccount:ci:builder", access("push", "other/app"), false},
+		{"system:serviceaccount:ci:default", access("pull", "ci/app"), true},
+		{"system:serviceaccount:ci:default", access("push", "ci/app"), false},
+		{"system:serviceaccount:web:default", access("pull", "web/app"), true},
+		{"system:serviceaccount:web:default", access("pull", "ci/app"), false},
+		// users other than service accounts are rejected
+		{"admin", access("pull", "library/ubuntu"), false},
+		{"invalid", access("pull", "library/ubuntu"), false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		req.SetBasicAuth("unused", testcase.token)
+		grant, err := ac.Authorized(req, testcase.access)
+		if testcase.allowed {
+			if err != nil {
+				t.Fatalf("expected %q %s access to %q: %v", testcase.token, testcase.access.Action, testcase.access.Name, err)
+			}
+			if grant.User.Name != testcase.token {
+				t.Fatalf("unexpected user name: %q != %q", grant.User.Name, testcase.token)
+			}
+			continue
+		}
+		if _, ok := err.(auth.Challenge); !ok {
+			t.Fatalf("expected challenge for %q %s access to %q, got %v", testcase.token, testcase.access.Action, testcase.access.Name, err)
+		}
+	}
+	// one review per token, the others come from the cache
+	if n := reviews.Load(); n != 5 {
+		t.Fatalf("unexpected number of token reviews: %d != 5", n)
+	}
+}
+
+func TestTokenReviewError(t *testing.T) {
+	var reviews atomic.Int32
+	cfg := newCluster(t, &reviews)
+	cfg.Rules = []config.KubernetesRule{{Namespace: "*", Access: "pull"}}
+	// a reviewer without the permission to create TokenReviews
+	if err := os.WriteFile(cfg.TokenFile, []byte("unauthorized"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ac, err := New("test-realm", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+	req.SetBasicAuth("unused", "system:serviceaccount:ci:default")
+	if _, err := ac.Authorized(req, access("pull", "ci/app")); err == nil {
+		t.Fatal("expected error while the reviewer is forbidden")
+	}
+
+	// errors are not cached, and the token file is read again as the
+	// kubelet rotates it
+	if err := os.WriteFile(cfg.TokenFile, []byte("reviewer"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.Authorized(req, access("pull", "ci/app")); err != nil {
+		t.Fatalf("unexpected error authorizing: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Package pat provides an access controller that authenticates users by a
+// GitHub or GitLab personal access token given as password, and grants
+// access by their organization or group memberships.
+package pat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrAccessDenied is returned when no rule grants the organizations of the
+// user the requested access to a repository.
+var ErrAccessDenied = dcsauth.ErrAccessDenied
+
+// maxCachedTokens bounds the validated tokens kept, so that trying random
+// tokens cannot grow the cache without limit
+const maxCachedTokens = 10000
+
+// requestTimeout bounds the validation of a token against the provider
+const requestTimeout = 30 * time.Second
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "auth_pat", nil)
+
+	validations = namespace.NewLabeledCounter("validations", "The number of tokens validated against the provider", "provider", "result")
+)
+
+func init() {
+	metrics.Register(namespace)
+
+	err := dcsauth.Register("pat", func(realm string, cfg *config.Config) (auth.AccessController, error) {
+		ac, err := New(realm, cfg.Auth.PAT)
+		if err != nil {
+			return nil, fmt.Errorf("auth.pat: %w", err)
+		}
+		return ac, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type rule struct {
+	org          string
+	push         bool
+	repositories []string
+}
+
+// cached is the result of validating a token
+type cached struct {
+	id      identity
+	valid   bool
+	expires time.Time
+}
+
+type accessController struct {
+	realm    string
+	name     string // of the provider
+	provider provider
+	rules    []rule
+	ttl      time.Duration
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[string]cached // by hash of the token
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ dcsauth.Authorizer    = &accessController{}
+)
+
+// New returns an access controller validating tokens with the provider of
+// cfg
+func New(realm string, cfg config.PATConfig) (auth.AccessController, error) {
+	if cfg.CacheTTL <= 0 {
+		return nil, fmt.Errorf("cache_ttl must be positive")
+	}
+
+	ac := &accessController{
+		realm: realm,
+		name:  cfg.Provider,
+		ttl:   cfg.CacheTTL,
+		cache: make(map[string]cached),
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	switch cfg.Provider {
+	case "github":
+		ac.provider = &github{client: client, url: apiURL(cfg.URL, "https://api.github.com")}
+	case "gitlab":
+		ac.provider = &gitlab{client: client, url: apiURL(cfg.URL, "https://gitlab.com")}
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Org == "" {
+			return nil, fmt.Errorf("rules[%d]: org must be set", i)
+		}
+		if r.Access != "pull" && r.Access != "push" {
+			return nil, fmt.Errorf("rules[%d]: unknown access %q", i, r.Access)
+		}
+		for _, pattern := range r.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rules[%d]: invalid repository pattern %q: %w", i, pattern, err)
+			}
+		}
+		ac.rules = append(ac.rules, rule{org: r.Org, push: r.Access == "push", repositories: r.Repositories})
+	}
+	return ac, nil
+}
+
+func apiURL(url, fallback string) string {
+	if url == "" {
+		return fallback
+	}
+	return strings.TrimRight(url, "/")
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	// the username is whatever clients require, the token tells the user
+	_, token, ok := req.BasicAuth()
+	if !ok || token == "" {
+		return nil, ac.challenge(auth.ErrInvalidCredential)
+	}
+
+	id, valid, err := ac.identify(req.Context(), token)
+	if err != nil {
+		dcontext.GetLogger(req.Context()).Errorf("error validating %s token: %v", ac.name, err)
+		return nil, ac.challenge(err)
+	} else if !valid {
+		dcontext.GetLogger(req.Context()).Errorf("%s rejected token", ac.name)
+		return nil, ac.challenge(auth.ErrAuthenticationFailure)
+	}
+
+	var resources []auth.Resource
+	for _, access := range accessRecords {
+		if access.Type == "repository" && !ac.allowed(id, access) {
+			dcontext.GetLogger(req.Context()).Warnf("user %q denied %s access to %q", id.login, access.Action, access.Name)
+			return nil, ac.challenge(ErrAccessDenied)
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{User: auth.UserInfo{Name: id.login}, Resources: resources}, nil
+}
+
+// Allows implements dcsauth.Authorizer. The identity of the token of req is
+// cached since the request was authorized.
+func (ac *accessController) Allows(req *http.Request, user string, access auth.Access) bool {
+	if access.Type != "repository" {
+		return true
+	}
+	_, token, ok := req.BasicAuth()
+	if !ok || token == "" {
+		return false
+	}
+	id, valid, err := ac.identify(req.Context(), token)
+	return err == nil && valid && id.login == user && ac.allowed(id, access)
+}
+
+// identify returns the identity of token, false if the provider rejected it.
+// Results are cached for the cache TTL, errors are not.
+func (ac *accessController) identify(ctx context.Context, token string) (identity, bool, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	ac.mu.Lock()
+	entry, ok := ac.cache[key]
+	ac.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.id, entry.valid, nil
+	}
+
+	// concurrent requests of a client, such as layer pulls, share the
+	// validation
+	v, err, _ := ac.group.Do(key, func() (any, error) {
+		ctx := context.WithoutCancel(ctx)
+		id, err := ac.provider.identify(ctx, token)
+		entry := cached{id: id, valid: err == nil, expires: time.Now().Add(ac.ttl)}
+		switch {
+		case err == nil:
+			validations.WithValues(ac.name, "valid").Inc(1)
+		case errors.Is(err, errInvalidToken):
+			validations.WithValues(ac.name, "invalid").Inc(1)
+		default:
+			validations.WithValues(ac.name, "error").Inc(1)
+			return nil, err
+		}
+		ac.store(key, entry)
+		return entry, nil
+	})
+	if err != nil {
+		return identity{}, false, err
+	}
+	entry = v.(cached)
+	return entry.id, entry.valid, nil
+}
+
+// store caches entry, dropping the expired entries or else an arbitrary one
+// when the cache is full
+func (ac *accessController) store(key string, entry cached) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if len(ac.cache) >= maxCachedTokens {
+		now := time.Now()
+		for k, e := range ac.cache {
+			if now.After(e.expires) {
+				delete(ac.cache, k)
+			}
+		}
+		for k := range ac.cache {
+			if len(ac.cache) < maxCachedTokens {
+				break
+			}
+			delete(ac.cache, k)
+		}
+	}
+	ac.cache[key] = entry
+}
+
+// allowed reports whether a rule grants id the access
+func (ac *accessController) allowed(id identity, access auth.Access) bool {
+	push := access.Action != "pull"
+	for _, r := range ac.rules {
+		if (push && !r.push) || !id.member(r.org) {
+			continue
+		}
+		if len(r.repositories) == 0 {
+			return true
+		}
+		for _, pattern := range r.repositories {
+			if matched, _ := path.Match(pattern, access.Name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// member reports whether id is a member of org, which is case insensitive
+func (id identity) member(org string) bool {
+	if org == "*" {
+		return true
+	}
+	for _, o := range id.orgs {
+		if strings.EqualFold(o, org) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ac *accessController) challenge(err error) error {
+	return &challenge{realm: ac.realm, err: err}
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+// Unwrap returns the error of the challenge
+func (ch challenge) Unwrap() error {
+	return ch.err
+}
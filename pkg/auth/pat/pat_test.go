@@ -0,0 +1,170 @@
+package pat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+func access(action, name string) auth.Access {
+	return auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: name},
+		Action:   action,
+	}
+}
+
+func TestGitHub(t *testing.T) {
+	var requests atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/user":
+			json.NewEncoder(w).Encode(map[string]string{"login": "octocat"})
+		case r.URL.Path == "/user/orgs" && r.URL.Query().Get("page") == "":
+			w.Header().Set("Link", `</user/orgs?per_page=100&page=2>; rel="next", </user/orgs?per_page=100&page=2>; rel="last"`)
+			json.NewEncoder(w).Encode([]map[string]string{{"login": "Readers"}})
+		case r.URL.Path == "/user/orgs":
+			json.NewEncoder(w).Encode([]map[string]string{{"login": "writers"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	ac, err := New("test-realm", config.PATConfig{
+		Provider: "github",
+		URL:      api.URL,
+		CacheTTL: time.Hour,
+		Rules: []config.PATRule{
+			{Org: "readers", Access: "pull"},
+			{Org: "writers", Access: "push", Repositories: []string{"writers/*"}},
+			{Org: "others", Access: "push"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	authorize := func(token string, accessRecords ...auth.Access) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		req.SetBasicAuth("anything", token)
+		return ac.Authorized(req, accessRecords...)
+	}
+
+	for _, testcase := range []struct {
+		access  auth.Access
+		allowed bool
+	}{
+		{access("pull", "library/ubuntu"), true},
+		{access("push", "library/ubuntu"), false},
+		{access("pull", "writers/app"), true},
+		{access("push", "writers/app"), true},
+		{access("delete", "writers/app"), true},
+	} {
+		grant, err := authorize("good", testcase.access)
+		if testcase.allowed {
+			if err != nil {
+				t.Fatalf("expected %s access to %q: %v", testcase.access.Action, testcase.access.Name, err)
+			}
+			if grant.User.Name != "octocat" {
+				t.Fatalf("unexpected user name: %q", grant.User.Name)
+			}
+			continue
+		}
+		if ch, ok := err.(*challenge); !ok || ch.err != ErrAccessDenied {
+			t.Fatalf("expected access denied for %s access to %q, got %v", testcase.access.Action, testcase.access.Name, err)
+		}
+	}
+	// the user and its two pages of organizations, then the cache
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("unexpected number of requests to the provider: %d != 3", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := authorize("bad", access("pull", "library/ubuntu")); err == nil {
+			t.Fatal("expected rejected token to be denied")
+		} else if _, ok := err.(auth.Challenge); !ok {
+			t.Fatalf("expected challenge for rejected token, got %v", err)
+		}
+	}
+	if n := requests.Load(); n != 4 {
+		t.Fatalf("expected rejected token to be cached, %d requests to the provider", n)
+	}
+}
+
+func TestGitLab(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.Header.Get("PRIVATE-TOKEN") != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v4/user":
+			json.NewEncoder(w).Encode(map[string]string{"username": "tanuki"})
+		case "/api/v4/groups":
+			json.NewEncoder(w).Encode([]map[string]string{{"full_path": "platform/build"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	ac, err := New("test-realm", config.PATConfig{
+		Provider: "gitlab",
+		URL:      api.URL + "/",
+		CacheTTL: time.Hour,
+		Rules:    []config.PATRule{{Org: "platform/build", Access: "push", Repositories: []string{"build/*"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+	req.SetBasicAuth("tanuki", "good")
+	if _, err := ac.Authorized(req, access("push", "build/app")); err == nil {
+		t.Fatal("expected error while the provider is failing")
+	}
+
+	// errors are not cached
+	failing.Store(false)
+	grant, err := ac.Authorized(req, access("push", "build/app"))
+	if err != nil {
+		t.Fatalf("unexpected error authorizing: %v", err)
+	}
+	if grant.User.Name != "tanuki" {
+		t.Fatalf("unexpected user name: %q", grant.User.Name)
+	}
+	if _, err := ac.Authorized(req, access("pull", "other/app")); err == nil {
+		t.Fatal("expected access denied outside of the repositories of the rule")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []config.PATConfig{
+		{Provider: "bitbucket", CacheTTL: time.Minute},
+		{Provider: "github"},
+		{Provider: "github", CacheTTL: time.Minute, Rules: []config.PATRule{{Org: "org", Access: "admin"}}},
+		{Provider: "github", CacheTTL: time.Minute, Rules: []config.PATRule{{Access: "pull"}}},
+		{Provider: "github", CacheTTL: time.Minute, Rules: []config.PATRule{{Org: "org", Access: "pull", Repositories: []string{"org/["}}}},
+	} {
+		if _, err := New("test-realm", cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
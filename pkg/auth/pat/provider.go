@@ -0,0 +1,156 @@
+package pat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errInvalidToken is returned by providers for a token they reject
+var errInvalidToken = errors.New("token rejected by provider")
+
+// maxPages bounds the pages of organizations or groups read per token
+const maxPages = 10
+
+// identity is the user a token belongs to and the organizations or groups it
+// is a member of
+type identity struct {
+	login string
+	orgs  []string
+}
+
+// provider validates tokens against the API of a code hosting service
+type provider interface {
+	identify(ctx context.Context, token string) (identity, error)
+}
+
+// github validates personal access tokens against the GitHub REST API.
+// Listing organizations needs the read:org scope, or the members permission
+// of the organization for fine-grained tokens.
+type github struct {
+	client *http.Client
+	url    string
+}
+
+func (p *github) identify(ctx context.Context, token string) (identity, error) {
+	setAuth := func(header http.Header) {
+		header.Set("Authorization", "Bearer "+token)
+		header.Set("Accept", "application/vnd.github+json")
+		header.Set("X-GitHub-Api-Version", "2022-11-28")
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if _, err := getJSON(ctx, p.client, p.url+"/user", setAuth, &user); err != nil {
+		return identity{}, err
+	}
+	id := identity{login: user.Login}
+
+	next := p.url + "/user/orgs?per_page=100"
+	for page := 0; next != "" && page < maxPages; page++ {
+		var orgs []struct {
+			Login string `json:"login"`
+		}
+		var err error
+		if next, err = getJSON(ctx, p.client, next, setAuth, &orgs); err != nil {
+			return identity{}, err
+		}
+		for _, org := range orgs {
+			id.orgs = append(id.orgs, org.Login)
+		}
+	}
+	return id, nil
+}
+
+// gitlab validates personal access tokens against the GitLab REST API,
+// which needs the read_api or read_user scope
+type gitlab struct {
+	client *http.Client
+	url    string
+}
+
+func (p *gitlab) identify(ctx context.Context, token string) (identity, error) {
+	setAuth := func(header http.Header) {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+
+	var user struct {
+		Username string `json:"username"`
+	}
+	if _, err := getJSON(ctx, p.client, p.url+"/api/v4/user", setAuth, &user); err != nil {
+		return identity{}, err
+	}
+	id := identity{login: user.Username}
+
+	// every group the user is a member of, at least as guest
+	next := p.url + "/api/v4/groups?min_access_level=10&per_page=100"
+	for page := 0; next != "" && page < maxPages; page++ {
+		var groups []struct {
+			FullPath string `json:"full_path"`
+		}
+		var err error
+		if next, err = getJSON(ctx, p.client, next, setAuth, &groups); err != nil {
+			return identity{}, err
+		}
+		for _, group := range groups {
+			id.orgs = append(id.orgs, group.FullPath)
+		}
+	}
+	return id, nil
+}
+
+// getJSON decodes the response to a GET of rawURL into v and returns the URL
+// of the next page, if any. Unauthorized and forbidden responses are
+// errInvalidToken.
+func getJSON(ctx context.Context, client *http.Client, rawURL string, setAuth func(http.Header), v any) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	setAuth(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", errInvalidToken
+	case resp.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("GET %s: unexpected status %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("GET %s: %w", req.URL.Path, err)
+	}
+	return nextPage(req.URL, resp.Header.Get("Link")), nil
+}
+
+// nextPage returns the URL of the "next" relation of the Link header, as
+// used for pagination by both GitHub and GitLab, resolved against base. It
+// returns nothing for a URL on another host, which the token is not sent to.
+func nextPage(base *url.URL, link string) string {
+	for _, part := range strings.Split(link, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(part), ";")
+		if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+				next, err := base.Parse(target[1 : len(target)-1])
+				if err != nil || next.Scheme != base.Scheme || next.Host != base.Host {
+					return ""
+				}
+				return next.String()
+			}
+		}
+	}
+	return ""
+}
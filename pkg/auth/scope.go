@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+// ErrAccessDenied is returned, wrapped in a challenge, by access controllers
+// when an authenticated user requests an access it is not allowed. The
+// registry API answers it with 403 DENIED rather than a challenge to
+// authenticate again.
+var ErrAccessDenied = errors.New("access denied")
+
+// repositoryActions are the actions of the access records of repositories
+var repositoryActions = []string{"pull", "push", "delete"}
+
+type permission struct {
+	repositories []string
+	actions      []string
+
+	// namespace, if set, limits the permission to the repositories whose
+	// name starts with this component instead of repositories
+	namespace string
+}
+
+// Permissions are the actions a user may take per repository. Nil
+// permissions allow every action on every repository.
+type Permissions []permission
+
+// NewPermissions returns the permissions of rules, validating their
+// repository patterns and actions
+func NewPermissions(rules []config.AccessRule) (Permissions, error) {
+	permissions := make(Permissions, 0, len(rules))
+	for i, rule := range rules {
+		for _, pattern := range rule.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("access[%d]: invalid repository pattern %q: %w", i, pattern, err)
+			}
+		}
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("access[%d]: actions must be set", i)
+		}
+		var actions []string
+		for _, action := range rule.Actions {
+			switch {
+			case action == "*":
+				actions = append(actions, repositoryActions...)
+			case slices.Contains(repositoryActions, action):
+				actions = append(actions, action)
+			default:
+				return nil, fmt.Errorf("access[%d]: unknown action %q", i, action)
+			}
+		}
+		permissions = append(permissions, permission{repositories: rule.Repositories, actions: actions})
+	}
+	return permissions, nil
+}
+
+// NamespacePermissions returns the permissions of every action on the
+// repositories of namespace, the first component of their name, and on no
+// other.
+func NamespacePermissions(namespace string) Permissions {
+	return Permissions{{actions: repositoryActions, namespace: namespace}}
+}
+
+// Allows reports whether the permissions allow access. Accesses to other
+// resources than repositories, such as the catalog, are allowed: the catalog
+// only lists the repositories the user may pull.
+func (p Permissions) Allows(access registryauth.Access) bool {
+	if p == nil || access.Type != "repository" {
+		return true
+	}
+	for _, permission := range p {
+		if !slices.Contains(permission.actions, access.Action) {
+			continue
+		}
+		if permission.namespace != "" {
+			if namespace, _, _ := strings.Cut(access.Name, "/"); namespace == permission.namespace {
+				return true
+			}
+			continue
+		}
+		if len(permission.repositories) == 0 {
+			return true
+		}
+		for _, pattern := range permission.repositories {
+			if matched, _ := path.Match(pattern, access.Name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Scope returns the scope of the access records in the format of the token
+// authentication of the registry API, e.g. "repository:team/app:pull,push",
+// with the actions of each resource joined
+func Scope(accessRecords []registryauth.Access) string {
+	var resources []registryauth.Resource
+	actions := make(map[registryauth.Resource][]string)
+	for _, access := range accessRecords {
+		resource := access.Resource
+		if _, ok := actions[resource]; !ok {
+			resources = append(resources, resource)
+		}
+		if !slices.Contains(actions[resource], access.Action) {
+			actions[resource] = append(actions[resource], access.Action)
+		}
+	}
+
+	scopes := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		resourceType := resource.Type
+		if resource.Class != "" {
+			resourceType += "(" + resource.Class + ")"
+		}
+		scopes = append(scopes, resourceType+":"+resource.Name+":"+strings.Join(actions[resource], ","))
+	}
+	return strings.Join(scopes, " ")
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"testing"
+
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+func repositoryAccess(name string, action string) registryauth.Access {
+	return registryauth.Access{
+		Resource: registryauth.Resource{Type: "repository", Name: name},
+		Action:   action,
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	permissions, err := NewPermissions([]config.AccessRule{
+		{Repositories: []string{"team/*"}, Actions: []string{"*"}},
+		{Repositories: []string{"library/*"}, Actions: []string{"pull"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating permissions: %v", err)
+	}
+
+	for _, testcase := range []struct {
+		access  registryauth.Access
+		allowed bool
+	}{
+		{repositoryAccess("team/app", "delete"), true},
+		{repositoryAccess("library/alpine", "pull"), true},
+		{repositoryAccess("library/alpine", "push"), false},
+		{repositoryAccess("other/app", "pull"), false},
+		{registryauth.Access{Resource: registryauth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}, true},
+	} {
+		if allowed := permissions.Allows(testcase.access); allowed != testcase.allowed {
+			t.Errorf("%s access to %s %q: expected allowed %v", testcase.access.Action, testcase.access.Type, testcase.access.Name, testcase.allowed)
+		}
+	}
+
+	if !Permissions(nil).Allows(repositoryAccess("other/app", "delete")) {
+		t.Error("expected nil permissions to allow every access")
+	}
+
+	for _, rules := range [][]config.AccessRule{
+		{{Repositories: []string{"team/["}, Actions: []string{"pull"}}},
+		{{Repositories: []string{"team/*"}}},
+		{{Repositories: []string{"team/*"}, Actions: []string{"write"}}},
+	} {
+		if _, err := NewPermissions(rules); err == nil {
+			t.Errorf("expected error for rules %+v", rules)
+		}
+	}
+}
+
+func TestNamespacePermissions(t *testing.T) {
+	permissions := NamespacePermissions("team")
+	for _, testcase := range []struct {
+		access  registryauth.Access
+		allowed bool
+	}{
+		{repositoryAccess("team/app", "push"), true},
+		{repositoryAccess("team/tools/build", "delete"), true},
+		{repositoryAccess("teams/app", "pull"), false},
+		{repositoryAccess("other/team", "pull"), false},
+	} {
+		if allowed := permissions.Allows(testcase.access); allowed != testcase.allowed {
+			t.Errorf("%s access to %q: expected allowed %v", testcase.access.Action, testcase.access.Name, testcase.allowed)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	scope := Scope([]registryauth.Access{
+		repositoryAccess("team/app", "pull"),
+		repositoryAccess("team/app", "push"),
+		repositoryAccess("team/app", "pull"),
+		repositoryAccess("library/alpine", "pull"),
+	})
+	if expected := "repository:team/app:pull,push repository:library/alpine:pull"; scope != expected {
+		t.Fatalf("unexpected scope %q != %q", scope, expected)
+	}
+}
@@ -10,9 +10,9 @@ package silly
 import (
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/distribution/distribution/v3/registry/auth"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
 )
 
 // AccessController provides a simple implementation of auth.AccessController
@@ -23,18 +23,27 @@ type AccessController struct {
 	service string
 }
 
-var _ auth.AccessController = &AccessController{}
+var (
+	_ auth.AccessController = &AccessController{}
+	_ dcsauth.Authorizer    = &AccessController{}
+)
 
 func New(realm string, service string) (auth.AccessController, error) {
 	return &AccessController{realm: realm, service: service}, nil
 }
 
+// Allows implements dcsauth.Authorizer, allowing every access
+func (ac *AccessController) Allows(req *http.Request, user string, access auth.Access) bool {
+	return true
+}
+
 func MustNew(realm string, service string) auth.AccessController {
 	return &AccessController{realm: realm, service: service}
 }
 
 // Authorized simply checks for the existence of the authorization header,
-// responding with a bearer challenge if it doesn't exist.
+// responding with a bearer challenge for the scope of the access records if it
+// doesn't exist, and grants every access record otherwise.
 func (ac *AccessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
 	if req.Header.Get("Authorization") == "" {
 		challenge := challenge{
@@ -43,17 +52,18 @@ func (ac *AccessController) Authorized(req *http.Request, accessRecords ...auth.
 		}
 
 		if len(accessRecords) > 0 {
-			var scopes []string
-			for _, access := range accessRecords {
-				scopes = append(scopes, fmt.Sprintf("%s:%s:%s", access.Type, access.Resource.Name, access.Action))
-			}
-			challenge.scope = strings.Join(scopes, " ")
+			challenge.scope = dcsauth.Scope(accessRecords)
 		}
 
 		return nil, &challenge
 	}
 
-	return &auth.Grant{User: auth.UserInfo{Name: "silly"}}, nil
+	var resources []auth.Resource
+	for _, access := range accessRecords {
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{User: auth.UserInfo{Name: "silly"}, Resources: resources}, nil
 }
 
 type challenge struct {
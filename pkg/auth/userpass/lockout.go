@@ -0,0 +1,84 @@
+package userpass
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedUsers bounds the users whose failures are tracked, so that
+// guessing random usernames cannot grow the lockout state without limit.
+const maxTrackedUsers = 10000
+
+// userFailures are the failed authentications of a user since its last
+// successful one
+type userFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// lockout locks out users after maxFailures authentications in a row failed,
+// each within duration of the previous one, for duration.
+type lockout struct {
+	maxFailures int
+	duration    time.Duration
+
+	mu    sync.Mutex
+	users map[string]*userFailures
+}
+
+// locked reports whether username is locked out at now
+func (l *lockout) locked(username string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.users[username]
+	return ok && now.Before(f.lockedUntil)
+}
+
+// fail records a failed authentication of username at now and reports
+// whether it locks the user out
+func (l *lockout) fail(username string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.users == nil {
+		l.users = make(map[string]*userFailures)
+	}
+	f, ok := l.users[username]
+	if !ok {
+		if len(l.users) >= maxTrackedUsers {
+			l.expire(now)
+			if len(l.users) >= maxTrackedUsers {
+				return false
+			}
+		}
+		f = &userFailures{}
+		l.users[username] = f
+	}
+	if now.Sub(f.last) > l.duration {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	if f.count < l.maxFailures {
+		return false
+	}
+	f.count = 0
+	f.lockedUntil = now.Add(l.duration)
+	return true
+}
+
+// succeed forgets the failures of username
+func (l *lockout) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.users, username)
+}
+
+// expire forgets the users neither locked out nor failing recently
+func (l *lockout) expire(now time.Time) {
+	for username, f := range l.users {
+		if now.Sub(f.last) > l.duration && !now.Before(f.lockedUntil) {
+			delete(l.users, username)
+		}
+	}
+}
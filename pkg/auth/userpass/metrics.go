@@ -0,0 +1,39 @@
+package userpass
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+)
+
+// Reasons of challenges and authentication failures
+const (
+	reasonMissingCredentials = "missing_credentials"
+	reasonInvalidCredentials = "invalid_credentials"
+	reasonInvalidToken       = "invalid_token"
+	reasonError              = "error"
+	reasonLockedOut          = "locked_out"
+	reasonAccessDenied       = "access_denied"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "auth", nil)
+
+	challenges = namespace.NewLabeledCounter("challenges", "The number of authentication challenges issued", "realm", "reason")
+	failures   = namespace.NewLabeledCounter("failures", "The number of failed authentications", "realm", "user", "reason")
+	lockouts   = namespace.NewLabeledCounter("lockouts", "The number of users locked out after repeated authentication failures", "realm", "user")
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// userLabel identifies username in metrics by a prefix of its SHA-256, which
+// keeps usernames, and passwords mistakenly typed as usernames, out of the
+// metrics while still telling users apart
+func userLabel(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:6])
+}
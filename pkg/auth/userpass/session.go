@@ -0,0 +1,188 @@
+package userpass
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+// ErrInvalidToken is returned for a session token that is malformed, not
+// signed by the access controller or expired.
+var ErrInvalidToken = errors.New("invalid session token")
+
+// sessionHeader is the encoded JOSE header of every session token, which
+// only come in one algorithm
+var sessionHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// sessionClaims are the claims of a session token
+type sessionClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// sessions issues and verifies the session tokens of authenticated users, as
+// JWT signed with HMAC-SHA256. A token only identifies the user: its access
+// to repositories is checked on every request as for Basic authentication.
+type sessions struct {
+	issuer   string
+	secret   []byte
+	ttl      time.Duration
+	endpoint string // URL or path of the token endpoint
+}
+
+// TokenPath returns the path of the token endpoint, under the prefix of the
+// registry API
+func TokenPath(cfg config.HttpConfig) string {
+	return strings.TrimRight(cfg.Prefix, "/") + "/auth/token"
+}
+
+// WithSessionTokens issues tokens valid for ttl at the token endpoint, the
+// handler of the access controller, to users authenticating with Basic
+// authentication, and accepts them as Bearer tokens in place of a password.
+// Clients are challenged to fetch a token from endpoint, either an absolute
+// URL or a path on the host of the request. Tokens are signed with secret,
+// random if empty, in which case they do not survive a restart nor are
+// accepted by other instances.
+func WithSessionTokens(secret []byte, ttl time.Duration, endpoint string) Option {
+	return func(ac *accessController) {
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				panic(err)
+			}
+		}
+		ac.sessions = &sessions{
+			issuer:   ac.realm,
+			secret:   secret,
+			ttl:      ttl,
+			endpoint: endpoint,
+		}
+	}
+}
+
+// issue returns a token of username issued at now
+func (s *sessions) issue(username string, now time.Time) (string, error) {
+	claims, err := json.Marshal(sessionClaims{
+		Issuer:    s.issuer,
+		Subject:   username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := sessionHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + s.sign(payload), nil
+}
+
+// verify returns the username of token if it is valid at now
+func (s *sessions) verify(token string, now time.Time) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !strings.HasPrefix(token, sessionHeader+".") {
+		return "", ErrInvalidToken
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return "", ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload[len(sessionHeader)+1:])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	if claims.Issuer != s.issuer || claims.Subject == "" || now.Unix() >= claims.ExpiresAt {
+		return "", ErrInvalidToken
+	}
+	return claims.Subject, nil
+}
+
+func (s *sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// url returns the URL of the token endpoint for clients of r
+func (s *sessions) url(r *http.Request) string {
+	if strings.Contains(s.endpoint, "://") {
+		return s.endpoint
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return scheme + "://" + host + s.endpoint
+}
+
+// tokenResponse is the response of the token endpoint, in the format of the
+// token authentication of the registry API
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// ServeHTTP serves the token endpoint, issuing a session token to users
+// authenticating with Basic authentication. Scopes requested by clients are
+// ignored since access is checked on every request.
+func (ac *accessController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ac.sessions == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := ac.authenticateBasic(r)
+	if err != nil {
+		if ch, ok := err.(*challenge); ok {
+			// the token endpoint itself is only reachable with Basic
+			// authentication
+			ch.tokenURL = ""
+			ch.SetHeaders(r, w)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	token, err := ac.sessions.issue(username, now)
+	if err != nil {
+		dcontext.GetLogger(r.Context()).Errorf("error issuing session token to user %q: %v", username, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(ac.sessions.ttl / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,62 @@
+package userpass
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tenantUser is a user of a tenant, limited to the namespace of the tenant
+type tenantUser struct {
+	// password is the configured password, a bcrypt hash if hashed is set
+	password    []byte
+	hashed      bool
+	permissions dcsauth.Permissions
+}
+
+// check reports whether password is the one of the user, comparing it in
+// constant time unless it is hashed
+func (u tenantUser) check(password string) bool {
+	if u.hashed {
+		return bcrypt.CompareHashAndPassword(u.password, []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare(u.password, []byte(password)) == 1
+}
+
+// WithTenants authenticates the users of the tenants as well, allowing them
+// every action on the repositories of the namespace of their tenant and on
+// no other. Users of the tenants take precedence over the other users of
+// the same name. Their passwords are bcrypt hashes, as in the users file, or
+// plain text.
+func WithTenants(tenants []config.TenantConfig) (Option, error) {
+	users := make(map[string]tenantUser)
+	for i, tenant := range tenants {
+		namespace := tenant.NamespaceName()
+		if namespace == "" {
+			return nil, fmt.Errorf("tenants[%d]: name must be set", i)
+		}
+		for j, cred := range tenant.Users {
+			if cred.Username == "" {
+				return nil, fmt.Errorf("tenants[%d].users[%d]: username must be set", i, j)
+			}
+			if cred.Password == "" {
+				return nil, fmt.Errorf("tenants[%d].users[%d]: password must be set", i, j)
+			}
+			if _, ok := users[cred.Username]; ok {
+				return nil, fmt.Errorf("tenants[%d]: user %q already belongs to a tenant", i, cred.Username)
+			}
+			_, err := bcrypt.Cost([]byte(cred.Password))
+			users[cred.Username] = tenantUser{
+				password:    []byte(cred.Password),
+				hashed:      err == nil,
+				permissions: dcsauth.NamespacePermissions(namespace),
+			}
+		}
+	}
+	return func(ac *accessController) {
+		ac.tenantUsers = users
+	}, nil
+}
@@ -1,38 +1,137 @@
 package userpass
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
 	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrAccessDenied is returned when an authenticated user requests an action
+// on a repository outside of its permissions.
+var ErrAccessDenied = dcsauth.ErrAccessDenied
+
+// ErrLockedOut is returned while a user is locked out after repeated
+// authentication failures.
+var ErrLockedOut = errors.New("locked out after repeated authentication failures")
+
 type AuthenticateFunc func(username string, password string) (bool, error)
 
 type accessController struct {
 	realm        string
 	modtime      time.Time
 	authenticate AuthenticateFunc
+
+	// permissions maps a username to the actions it may take per
+	// repository. Users without an entry may take every action.
+	permissions map[string]dcsauth.Permissions
+
+	lockout   *lockout   // nil if disabled
+	sessions  *sessions  // nil if disabled
+	usersFile *usersFile // nil if none
+
+	// tenantUsers maps a username to a user of a tenant
+	tenantUsers map[string]tenantUser
 }
 
-var _ auth.AccessController = &accessController{}
+var (
+	_ auth.AccessController = &accessController{}
+	_ dcsauth.Authorizer    = &accessController{}
+)
+
+// Option configures an access controller
+type Option func(*accessController)
+
+// WithLockout rejects a user for duration, without checking its password,
+// once maxFailures authentications in a row failed. Zero maxFailures
+// disables the lockout.
+func WithLockout(maxFailures int, duration time.Duration) Option {
+	return func(ac *accessController) {
+		if maxFailures > 0 && duration > 0 {
+			ac.lockout = &lockout{maxFailures: maxFailures, duration: duration}
+		}
+	}
+}
+
+func init() {
+	err := dcsauth.Register("userpass", func(realm string, cfg *config.Config) (auth.AccessController, error) {
+		options, err := ConfigOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewWithCreds(realm, cfg.Auth.Users, options...)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ConfigOptions returns the options of the lockout, session tokens and users
+// file of the auth section of cfg, and of the users of its tenants
+func ConfigOptions(cfg *config.Config) ([]Option, error) {
+	options := []Option{
+		WithLockout(cfg.Auth.Lockout.MaxFailures, cfg.Auth.Lockout.Duration),
+	}
+	if tokens := cfg.Auth.Tokens; tokens.Enabled {
+		if tokens.TTL <= 0 {
+			return nil, fmt.Errorf("auth.tokens: ttl must be positive")
+		}
+		endpoint := TokenPath(cfg.Http)
+		if cfg.Http.Host != "" {
+			endpoint = strings.TrimRight(cfg.Http.Host, "/") + endpoint
+		}
+		options = append(options, WithSessionTokens([]byte(tokens.Secret), tokens.TTL, endpoint))
+	}
+	if cfg.Auth.UsersFile != "" {
+		usersFile, err := WithUsersFile(cfg.Auth.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth.users_file: %w", err)
+		}
+		options = append(options, usersFile)
+	}
+	if len(cfg.Tenants) > 0 {
+		tenants, err := WithTenants(cfg.Tenants)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tenants)
+	}
+	return options, nil
+}
 
-func NewWithCallback(realm string, authenticate AuthenticateFunc) (auth.AccessController, error) {
-	return &accessController{
+func NewWithCallback(realm string, authenticate AuthenticateFunc, options ...Option) (auth.AccessController, error) {
+	ac := &accessController{
 		realm:        realm,
 		authenticate: authenticate,
-	}, nil
+	}
+	for _, option := range options {
+		option(ac)
+	}
+	return ac, nil
 }
 
-func NewWithCreds(realm string, creds []config.UserCreds) (auth.AccessController, error) {
+func NewWithCreds(realm string, creds []config.UserCreds, options ...Option) (auth.AccessController, error) {
 	credsMap := make(map[string]config.UserCreds)
+	permissions := make(map[string]dcsauth.Permissions)
 	for _, cred := range creds {
+		userPermissions, err := permissionsOf(cred)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", cred.Username, err)
+		}
 		credsMap[cred.Username] = cred
+		if userPermissions != nil {
+			permissions[cred.Username] = userPermissions
+		}
 	}
-	return &accessController{
+	ac := &accessController{
 		realm: realm,
 		authenticate: func(username string, password string) (bool, error) {
 			user, found := credsMap[username]
@@ -41,49 +140,192 @@ func NewWithCreds(realm string, creds []config.UserCreds) (auth.AccessController
 			}
 			return false, nil
 		},
-	}, nil
+		permissions: permissions,
+	}
+	for _, option := range options {
+		option(ac)
+	}
+	return ac, nil
 }
 
 func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	var username string
+	if token, ok := bearerToken(req); ok && ac.sessions != nil {
+		var err error
+		if username, err = ac.sessions.verify(token, time.Now()); err != nil {
+			dcontext.GetLogger(req.Context()).Warnf("rejecting session token: %v", err)
+			return nil, ac.challenge(req, reasonInvalidToken, err)
+		}
+	} else {
+		var err error
+		if username, err = ac.authenticateBasic(req); err != nil {
+			return nil, err
+		}
+	}
+
+	permissions := ac.userPermissions(req.Context(), username)
+	var resources []auth.Resource
+	for _, access := range accessRecords {
+		if !permissions.Allows(access) {
+			dcontext.GetLogger(req.Context()).Warnf("user %q denied %s access to %q", username, access.Action, access.Name)
+			ch := ac.challenge(req, reasonAccessDenied, ErrAccessDenied)
+			ch.scope = dcsauth.Scope(accessRecords)
+			return nil, ch
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{User: auth.UserInfo{Name: username}, Resources: resources}, nil
+}
+
+// authenticateBasic returns the username of the Basic authentication of req,
+// or a challenge if it fails
+func (ac *accessController) authenticateBasic(req *http.Request) (string, error) {
 	username, password, ok := req.BasicAuth()
 	if !ok {
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   auth.ErrInvalidCredential,
-		}
+		return "", ac.challenge(req, reasonMissingCredentials, auth.ErrInvalidCredential)
+	}
+
+	if ac.lockout != nil && ac.lockout.locked(username, time.Now()) {
+		dcontext.GetLogger(req.Context()).Warnf("rejecting locked out user %q", username)
+		failures.WithValues(ac.realm, userLabel(username), reasonLockedOut).Inc(1)
+		return "", ac.challenge(req, reasonLockedOut, ErrLockedOut)
 	}
 
-	success, err := ac.authenticate(username, password)
+	success, err := ac.check(req.Context(), username, password)
 	if err != nil {
 		dcontext.GetLogger(req.Context()).Errorf("error authenticating user %q: %v", username, err)
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   err,
-		}
+		failures.WithValues(ac.realm, userLabel(username), reasonError).Inc(1)
+		return "", ac.challenge(req, reasonError, err)
 	} else if !success {
 		dcontext.GetLogger(req.Context()).Errorf("failure authenticating user %q", username)
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   auth.ErrAuthenticationFailure,
+		failures.WithValues(ac.realm, userLabel(username), reasonInvalidCredentials).Inc(1)
+		if ac.lockout != nil && ac.lockout.fail(username, time.Now()) {
+			dcontext.GetLogger(req.Context()).Warnf("locking out user %q for %v after %d failed authentications",
+				username, ac.lockout.duration, ac.lockout.maxFailures)
+			lockouts.WithValues(ac.realm, userLabel(username)).Inc(1)
+		}
+		return "", ac.challenge(req, reasonInvalidCredentials, auth.ErrAuthenticationFailure)
+	}
+	if ac.lockout != nil {
+		ac.lockout.succeed(username)
+	}
+	return username, nil
+}
+
+// Allows implements dcsauth.Authorizer
+func (ac *accessController) Allows(req *http.Request, user string, access auth.Access) bool {
+	return ac.userPermissions(req.Context(), user).Allows(access)
+}
+
+// bearerToken returns the Bearer token of the Authorization header of req
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// challenge counts and returns a challenge for the reason err, to fetch a
+// session token if they are enabled
+func (ac *accessController) challenge(req *http.Request, reason string, err error) *challenge {
+	challenges.WithValues(ac.realm, reason).Inc(1)
+	ch := &challenge{
+		realm: ac.realm,
+		err:   err,
+	}
+	if ac.sessions != nil {
+		ch.tokenURL = ac.sessions.url(req)
+		switch reason {
+		case reasonInvalidToken:
+			ch.tokenError = "invalid_token"
+		case reasonAccessDenied:
+			ch.tokenError = "insufficient_scope"
+		}
+	}
+	return ch
+}
+
+// check reports whether password is the one of username, in the users of the
+// tenants and the users file first
+func (ac *accessController) check(ctx context.Context, username string, password string) (bool, error) {
+	if user, ok := ac.tenantUsers[username]; ok {
+		return user.check(password), nil
+	}
+	if ac.usersFile != nil {
+		if user, ok := ac.usersFile.user(ctx, username); ok {
+			return bcrypt.CompareHashAndPassword(user.hash, []byte(password)) == nil, nil
 		}
 	}
+	return ac.authenticate(username, password)
+}
 
-	return &auth.Grant{User: auth.UserInfo{Name: username}}, nil
+// userPermissions returns the permissions of username, from the users of the
+// tenants and the users file first
+func (ac *accessController) userPermissions(ctx context.Context, username string) dcsauth.Permissions {
+	if user, ok := ac.tenantUsers[username]; ok {
+		return user.permissions
+	}
+	if ac.usersFile != nil {
+		if user, ok := ac.usersFile.user(ctx, username); ok {
+			return user.permissions
+		}
+	}
+	return ac.permissions[username]
+}
+
+// permissionsOf returns the permissions of cred: every action on its
+// repositories and those of its access rules, or nil if it has neither.
+func permissionsOf(cred config.UserCreds) (dcsauth.Permissions, error) {
+	if len(cred.Repositories) == 0 && len(cred.Access) == 0 {
+		return nil, nil
+	}
+	var rules []config.AccessRule
+	if len(cred.Repositories) > 0 {
+		rules = append(rules, config.AccessRule{Repositories: cred.Repositories, Actions: []string{"*"}})
+	}
+	return dcsauth.NewPermissions(append(rules, cred.Access...))
 }
 
 // challenge implements the auth.Challenge interface.
 type challenge struct {
 	realm string
 	err   error
+
+	// tokenURL is the token endpoint of a Bearer challenge, empty for a
+	// Basic challenge. tokenError is the error of a rejected token.
+	tokenURL   string
+	tokenError string
+
+	// scope is the scope of the denied access records, if any
+	scope string
 }
 
 var _ auth.Challenge = challenge{}
 
-// SetHeaders sets the basic challenge header on the response.
+// SetHeaders sets the basic challenge header on the response, or the bearer
+// challenge to fetch a session token from the token endpoint.
 func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+	if ch.tokenURL == "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+		return
+	}
+	header := fmt.Sprintf("Bearer realm=%q,service=%q", ch.tokenURL, ch.realm)
+	if ch.scope != "" {
+		header += fmt.Sprintf(",scope=%q", ch.scope)
+	}
+	if ch.tokenError != "" {
+		header += fmt.Sprintf(",error=%q", ch.tokenError)
+	}
+	w.Header().Set("WWW-Authenticate", header)
 }
 
 func (ch challenge) Error() string {
 	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
 }
+
+// Unwrap returns the error of the challenge
+func (ch challenge) Unwrap() error {
+	return ch.err
+}
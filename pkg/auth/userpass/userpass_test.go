@@ -0,0 +1,428 @@
+package userpass
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRepositoryRestrictions(t *testing.T) {
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "admin", Password: "admin"},
+		{Username: "team", Password: "team", Repositories: []string{"team/*"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	pull := func(name string) auth.Access {
+		return auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   "pull",
+		}
+	}
+
+	for _, testcase := range []struct {
+		username string
+		password string
+		repo     string
+		allowed  bool
+	}{
+		{"admin", "admin", "team/app", true},
+		{"admin", "admin", "other/app", true},
+		{"team", "team", "team/app", true},
+		{"team", "team", "other/app", false},
+		{"team", "wrong", "team/app", false},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating new request: %v", err)
+		}
+		req.SetBasicAuth(testcase.username, testcase.password)
+
+		grant, err := ac.Authorized(req, pull(testcase.repo))
+		if testcase.allowed {
+			if err != nil {
+				t.Fatalf("expected %q to access %q: %v", testcase.username, testcase.repo, err)
+			}
+			if grant.User.Name != testcase.username {
+				t.Fatalf("unexpected user name: %q != %q", grant.User.Name, testcase.username)
+			}
+			continue
+		}
+		if _, ok := err.(auth.Challenge); !ok {
+			t.Fatalf("expected challenge for %q accessing %q, got %v", testcase.username, testcase.repo, err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "team", Password: "team", Repositories: []string{"team/*"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+	authorizer := ac.(dcsauth.Authorizer)
+
+	// decided for the authorized user, without credentials
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/_catalog", nil)
+	pull := func(name string) auth.Access {
+		return auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   "pull",
+		}
+	}
+	if !authorizer.Allows(req, "team", pull("team/app")) {
+		t.Fatal("team is not allowed to pull team/app")
+	}
+	if authorizer.Allows(req, "team", pull("other/app")) {
+		t.Fatal("team is allowed to pull other/app")
+	}
+}
+
+func TestInvalidRepositoryPattern(t *testing.T) {
+	_, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "team", Password: "team", Repositories: []string{"team/["}},
+	})
+	if err == nil {
+		t.Fatal("expected error for malformed repository pattern")
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "ci", Password: "ci", Repositories: []string{"ci/*"}, Access: []config.AccessRule{
+			{Repositories: []string{"team/*"}, Actions: []string{"pull", "push"}},
+			{Actions: []string{"pull"}},
+		}},
+	}, WithSessionTokens([]byte("secret"), time.Hour, "/auth/token"))
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	access := func(name string, action string) auth.Access {
+		return auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		}
+	}
+
+	for _, testcase := range []struct {
+		access  auth.Access
+		allowed bool
+	}{
+		{access("ci/app", "delete"), true},
+		{access("team/app", "push"), true},
+		{access("team/app", "delete"), false},
+		{access("other/app", "pull"), true},
+		{access("other/app", "push"), false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		req.SetBasicAuth("ci", "ci")
+
+		_, err := ac.Authorized(req, testcase.access)
+		if testcase.allowed {
+			if err != nil {
+				t.Fatalf("expected %s access to %q: %v", testcase.access.Action, testcase.access.Name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, dcsauth.ErrAccessDenied) {
+			t.Fatalf("expected %s access to %q to be denied, got %v", testcase.access.Action, testcase.access.Name, err)
+		}
+
+		rec := httptest.NewRecorder()
+		err.(auth.Challenge).SetHeaders(req, rec)
+		header := rec.Header().Get("WWW-Authenticate")
+		scope := `scope="repository:` + testcase.access.Name + `:` + testcase.access.Action + `"`
+		if !strings.Contains(header, scope) || !strings.Contains(header, `error="insufficient_scope"`) {
+			t.Fatalf("unexpected challenge %q", header)
+		}
+	}
+
+	_, err = NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "ci", Password: "ci", Access: []config.AccessRule{{Actions: []string{"write"}}}},
+	})
+	if err == nil {
+		t.Fatal("expected error for an unknown action")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "admin", Password: "admin"},
+	}, WithLockout(3, time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	authorize := func(password string) error {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating new request: %v", err)
+		}
+		req.SetBasicAuth("admin", password)
+		_, err = ac.Authorized(req)
+		return err
+	}
+	lockedOut := func(err error) bool {
+		ch, ok := err.(*challenge)
+		return ok && ch.err == ErrLockedOut
+	}
+
+	// a success resets the failures
+	for _, password := range []string{"wrong", "wrong", "admin", "wrong", "wrong"} {
+		if lockedOut(authorize(password)) {
+			t.Fatalf("unexpected lockout after %q", password)
+		}
+	}
+	if err := authorize("admin"); err != nil {
+		t.Fatalf("unexpected error authenticating: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		authorize("wrong")
+	}
+	if err := authorize("admin"); !lockedOut(err) {
+		t.Fatalf("expected lockout challenge for the right password, got %v", err)
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "team", Password: "team", Repositories: []string{"team/*"}},
+	}, WithSessionTokens([]byte("secret"), time.Hour, "/auth/token"))
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	pull := func(name string) auth.Access {
+		return auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   "pull",
+		}
+	}
+	authorize := func(token string, name string) error {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := ac.Authorized(req, pull(name))
+		return err
+	}
+
+	// clients are challenged to fetch a token
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+	_, err = ac.Authorized(req)
+	ch, ok := err.(*challenge)
+	if !ok {
+		t.Fatalf("expected challenge, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	ch.SetHeaders(req, w)
+	if expected := `Bearer realm="http://localhost/auth/token",service="test-realm"`; w.Header().Get("WWW-Authenticate") != expected {
+		t.Fatalf("unexpected challenge: %q != %q", w.Header().Get("WWW-Authenticate"), expected)
+	}
+
+	// the token endpoint requires the password
+	tokenReq := httptest.NewRequest(http.MethodGet, "http://localhost/auth/token?service=test-realm", nil)
+	tokenReq.SetBasicAuth("team", "wrong")
+	w = httptest.NewRecorder()
+	ac.(http.Handler).ServeHTTP(w, tokenReq)
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Fatalf("expected basic challenge for a wrong password, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	tokenReq.SetBasicAuth("team", "team")
+	w = httptest.NewRecorder()
+	ac.(http.Handler).ServeHTTP(w, tokenReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status fetching token: %d", w.Code)
+	}
+	var resp tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("unexpected error decoding token response: %v", err)
+	}
+	if resp.Token == "" || resp.AccessToken != resp.Token || resp.ExpiresIn != 3600 {
+		t.Fatalf("unexpected token response: %+v", resp)
+	}
+
+	if err := authorize(resp.Token, "team/app"); err != nil {
+		t.Fatalf("unexpected error authorizing with token: %v", err)
+	}
+	// tokens do not widen the repositories of the user
+	if err := authorize(resp.Token, "other/app"); err == nil {
+		t.Fatal("expected token to be denied access outside of the repositories of the user")
+	}
+
+	issuer := ac.(*accessController).sessions
+	expired, err := issuer.issue("team", time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error issuing token: %v", err)
+	}
+	forged, err := (&sessions{issuer: "test-realm", secret: []byte("other"), ttl: time.Hour}).issue("team", time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error issuing token: %v", err)
+	}
+	for _, token := range []string{expired, forged, resp.Token + "x", "garbage"} {
+		err := authorize(token, "team/app")
+		if ch, ok := err.(*challenge); !ok || ch.err != ErrInvalidToken || ch.tokenError != "invalid_token" {
+			t.Fatalf("expected invalid token challenge for %q, got %v", token, err)
+		}
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("unexpected error hashing password: %v", err)
+		}
+		return string(h)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(usersFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("users:\n  - username: team\n    password: \"" + hash("team") + "\"\n    repositories: [\"team/*\"]\n")
+
+	usersFileOption, err := WithUsersFile(usersFile)
+	if err != nil {
+		t.Fatalf("unexpected error loading users file: %v", err)
+	}
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "admin", Password: "admin"},
+		{Username: "team", Password: "plain"},
+	}, usersFileOption)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	authorize := func(username, password, repo string) error {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/", nil)
+		req.SetBasicAuth(username, password)
+		_, err := ac.Authorized(req, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: repo},
+			Action:   "pull",
+		})
+		return err
+	}
+	// reloads as if the check interval passed and the file changed
+	reload := func(content string) {
+		write(content)
+		f := ac.(*accessController).usersFile
+		f.mu.Lock()
+		f.checked, f.modTime = time.Time{}, time.Time{}
+		f.mu.Unlock()
+	}
+
+	for _, testcase := range []struct {
+		username string
+		password string
+		repo     string
+		allowed  bool
+	}{
+		{"team", "team", "team/app", true},
+		// users of the file take precedence
+		{"team", "plain", "team/app", false},
+		{"team", "team", "other/app", false},
+		{"admin", "admin", "other/app", true},
+	} {
+		if err := authorize(testcase.username, testcase.password, testcase.repo); (err == nil) != testcase.allowed {
+			t.Fatalf("unexpected result for %q accessing %q: %v", testcase.username, testcase.repo, err)
+		}
+	}
+
+	// JSON, with a new password and no restriction
+	reload(`{"users": [{"username": "team", "password": "` + hash("rotated") + `"}]}`)
+	if err := authorize("team", "team", "team/app"); err == nil {
+		t.Fatal("expected the old password to be rejected after reload")
+	}
+	if err := authorize("team", "rotated", "other/app"); err != nil {
+		t.Fatalf("unexpected error after reload: %v", err)
+	}
+
+	// an invalid file keeps the users
+	reload("users:\n  - username: team\n    password: rotated\n")
+	if err := authorize("team", "rotated", "other/app"); err != nil {
+		t.Fatalf("unexpected error after invalid reload: %v", err)
+	}
+
+	if _, err := WithUsersFile(usersFile); err == nil {
+		t.Fatal("expected error loading a users file with a plain password")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error hashing password: %v", err)
+	}
+	tenants, err := WithTenants([]config.TenantConfig{
+		{Name: "team-a", Users: []config.UserCreds{{Username: "alice", Password: "alice"}}},
+		{Name: "b", Namespace: "team-b", Users: []config.UserCreds{{Username: "bob", Password: string(hash)}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating tenants option: %v", err)
+	}
+	ac, err := NewWithCreds("test-realm", []config.UserCreds{
+		{Username: "admin", Password: "admin"},
+		{Username: "alice", Password: "other"},
+	}, tenants)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	push := func(name string) auth.Access {
+		return auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   "push",
+		}
+	}
+	for _, testcase := range []struct {
+		username string
+		password string
+		repo     string
+		allowed  bool
+	}{
+		{"alice", "alice", "team-a/app", true},
+		{"alice", "alice", "team-a/tools/build", true},
+		{"alice", "alice", "team-b/app", false},
+		{"alice", "other", "team-a/app", false},
+		{"bob", "bob", "team-b/app", true},
+		{"bob", "bob", "b/app", false},
+		{"bob", string(hash), "team-b/app", false},
+		{"admin", "admin", "team-b/app", true},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "http://localhost/v2/", nil)
+		req.SetBasicAuth(testcase.username, testcase.password)
+		_, err := ac.Authorized(req, push(testcase.repo))
+		if (err == nil) != testcase.allowed {
+			t.Errorf("%q pushing to %q: expected allowed %v, got %v", testcase.username, testcase.repo, testcase.allowed, err)
+		}
+	}
+
+	if _, err := WithTenants([]config.TenantConfig{
+		{Name: "team-a", Users: []config.UserCreds{{Username: "alice", Password: "alice"}}},
+		{Name: "team-b", Users: []config.UserCreds{{Username: "alice", Password: "alice"}}},
+	}); err == nil {
+		t.Fatal("expected error for a user of two tenants")
+	}
+	if _, err := WithTenants([]config.TenantConfig{
+		{Name: "team-a", Users: []config.UserCreds{{Username: "alice"}}},
+	}); err == nil {
+		t.Fatal("expected error for a user without password")
+	}
+}
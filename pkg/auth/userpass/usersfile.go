@@ -0,0 +1,107 @@
+package userpass
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/internal/dcontext"
+	dcsauth "github.com/jc-lab/docker-cache-server/pkg/auth"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersFileCheckInterval is the minimum time between two checks of the users
+// file for changes
+const usersFileCheckInterval = time.Second
+
+// fileUser is a user of the users file
+type fileUser struct {
+	hash        []byte
+	permissions dcsauth.Permissions
+}
+
+// usersFile holds the users of a users file, reloaded on authentication when
+// the file changed, e.g. when Kubernetes remounts the secret it comes from.
+// Stat follows the symlinks such remounts swap.
+type usersFile struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]fileUser
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// WithUsersFile authenticates the users of the users file at path as well,
+// by their bcrypt hashed password. Users of the file take precedence over
+// the other users of the same name.
+func WithUsersFile(path string) (Option, error) {
+	f := &usersFile{path: path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return func(ac *accessController) {
+		ac.usersFile = f
+	}, nil
+}
+
+// load reads the users of the file, keeping the previous ones if it is
+// invalid
+func (f *usersFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("users file: %w", err)
+	}
+	creds, err := config.LoadUsers(f.path)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]fileUser, len(creds))
+	for i, cred := range creds {
+		if cred.Username == "" {
+			return fmt.Errorf("users file: users[%d]: username must be set", i)
+		}
+		if _, err := bcrypt.Cost([]byte(cred.Password)); err != nil {
+			return fmt.Errorf("users file: password of user %q is not a bcrypt hash: %w", cred.Username, err)
+		}
+		permissions, err := permissionsOf(cred)
+		if err != nil {
+			return fmt.Errorf("users file: user %q: %w", cred.Username, err)
+		}
+		users[cred.Username] = fileUser{hash: []byte(cred.Password), permissions: permissions}
+	}
+
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// user returns the user username of the file, reloading it first if it
+// changed since it was last checked more than usersFileCheckInterval ago
+func (f *usersFile) user(ctx context.Context, username string) (fileUser, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); now.Sub(f.checked) >= usersFileCheckInterval {
+		f.checked = now
+		if info, err := os.Stat(f.path); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error checking users file, keeping %d users: %v", len(f.users), err)
+		} else if !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+			if err := f.load(); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error reloading users file, keeping %d users: %v", len(f.users), err)
+				// until it changes again
+				f.modTime, f.size = info.ModTime(), info.Size()
+			} else {
+				dcontext.GetLogger(ctx).Infof("reloaded %d users from %s", len(f.users), f.path)
+			}
+		}
+	}
+
+	user, ok := f.users[username]
+	return user, ok
+}
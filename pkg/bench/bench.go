@@ -0,0 +1,322 @@
+// Package bench generates synthetic pull and push workloads against a
+// registry and measures their throughput and latency, so that performance
+// regressions of the server can be measured.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Operations of a workload
+const (
+	// OpPull pulls a blob pushed before, a hit
+	OpPull = "pull"
+	// OpMiss pulls a blob never pushed, answered with not found
+	OpMiss = "miss"
+	// OpPush pushes a new blob
+	OpPush = "push"
+)
+
+// Workload describes the operations run against the registry
+type Workload struct {
+	// Repository is the repository the blobs are pushed into and pulled from
+	Repository reference.Named
+	// BlobSizes are the sizes of the blobs, one picked at random per blob
+	BlobSizes []int64
+	// Blobs is the number of blobs pushed before the run, pulled by the hits
+	Blobs int
+	// Concurrency is the number of operations in progress at once
+	Concurrency int
+	// Duration is how long operations are started for
+	Duration time.Duration
+	// HitRatio is the share of the pulls of a blob pushed, the others pull
+	// a blob never pushed
+	HitRatio float64
+	// PushRatio is the share of the operations pushing a new blob, which
+	// the following hits may pull
+	PushRatio float64
+}
+
+// Stats measure the operations of a kind. Latencies are those of the
+// successful operations, from sending the request to reading the whole
+// response.
+type Stats struct {
+	Operation      string        `json:"operation"`
+	Count          int           `json:"count"`
+	Errors         int           `json:"errors"`
+	Bytes          int64         `json:"bytes"`
+	OpsPerSecond   float64       `json:"ops_per_second"`
+	BytesPerSecond float64       `json:"bytes_per_second"`
+	P50            time.Duration `json:"p50"`
+	P90            time.Duration `json:"p90"`
+	P99            time.Duration `json:"p99"`
+	Max            time.Duration `json:"max"`
+
+	// FirstError is the error of the first operation failing, if any
+	FirstError string `json:"first_error,omitempty"`
+
+	latencies []time.Duration
+}
+
+// Result is the outcome of a run
+type Result struct {
+	// Duration is the time from the start of the first operation to the end
+	// of the last one
+	Duration   time.Duration `json:"duration"`
+	Operations []Stats       `json:"operations"`
+}
+
+// blob is a blob of the workload, its content generated from its seed
+type blob struct {
+	seed   uint64
+	size   int64
+	digest digest.Digest
+}
+
+// content returns the content of the blob
+func (b blob) content() io.Reader {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], b.seed)
+	return io.LimitReader(rand.NewChaCha8(key), b.size)
+}
+
+// runner runs a workload
+type runner struct {
+	client   *registryclient.Client
+	workload Workload
+
+	// seeds generates the seeds of new blobs, unique to the run
+	seeds atomic.Uint64
+
+	mu    sync.Mutex
+	blobs []blob // pushed
+}
+
+// Run pushes the blobs of the workload to the registry of client, then runs
+// the workload for its duration and measures its operations
+func Run(ctx context.Context, client *registryclient.Client, workload Workload) (Result, error) {
+	switch {
+	case workload.Repository == nil:
+		return Result{}, fmt.Errorf("no repository")
+	case len(workload.BlobSizes) == 0:
+		return Result{}, fmt.Errorf("no blob sizes")
+	case workload.Concurrency < 1:
+		return Result{}, fmt.Errorf("concurrency must be at least 1")
+	case workload.Duration <= 0:
+		return Result{}, fmt.Errorf("duration must be positive")
+	case workload.HitRatio < 0 || workload.HitRatio > 1 || workload.PushRatio < 0 || workload.PushRatio > 1:
+		return Result{}, fmt.Errorf("ratios must be between 0 and 1")
+	case workload.Blobs < 1 && workload.HitRatio > 0 && workload.PushRatio < 1:
+		return Result{}, fmt.Errorf("hits need blobs pushed before the run")
+	}
+	r := &runner{client: client, workload: workload}
+	r.seeds.Store(uint64(time.Now().UnixNano()))
+
+	if err := r.prepare(ctx); err != nil {
+		return Result{}, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(workload.Duration)
+	stats := make([]map[string]*Stats, workload.Concurrency)
+	var wg sync.WaitGroup
+	for i := range stats {
+		stats[i] = make(map[string]*Stats)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewPCG(r.seeds.Load(), uint64(i)))
+			for time.Now().Before(deadline) && ctx.Err() == nil {
+				op, n, latency, err := r.operation(ctx, random)
+				s := stats[i][op]
+				if s == nil {
+					s = &Stats{Operation: op}
+					stats[i][op] = s
+				}
+				s.Count++
+				s.Bytes += n
+				if err != nil {
+					s.Errors++
+					if s.FirstError == "" {
+						s.FirstError = err.Error()
+					}
+					continue
+				}
+				s.latencies = append(s.latencies, latency)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Duration: time.Since(start)}
+	for _, op := range []string{OpPull, OpMiss, OpPush} {
+		total := Stats{Operation: op}
+		for _, worker := range stats {
+			s := worker[op]
+			if s == nil {
+				continue
+			}
+			total.Count += s.Count
+			total.Errors += s.Errors
+			total.Bytes += s.Bytes
+			total.latencies = append(total.latencies, s.latencies...)
+			if total.FirstError == "" {
+				total.FirstError = s.FirstError
+			}
+		}
+		if total.Count == 0 {
+			continue
+		}
+		seconds := result.Duration.Seconds()
+		total.OpsPerSecond = float64(total.Count) / seconds
+		total.BytesPerSecond = float64(total.Bytes) / seconds
+		slices.Sort(total.latencies)
+		total.P50 = percentile(total.latencies, 0.5)
+		total.P90 = percentile(total.latencies, 0.9)
+		total.P99 = percentile(total.latencies, 0.99)
+		total.Max = percentile(total.latencies, 1)
+		result.Operations = append(result.Operations, total)
+	}
+	return result, nil
+}
+
+// percentile returns the latency the share q of the sorted latencies is at
+// most, by nearest rank
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// prepare pushes the blobs pulled by the hits
+func (r *runner) prepare(ctx context.Context) error {
+	queue := make(chan struct{})
+	errs := make(chan error, r.workload.Concurrency)
+	var wg sync.WaitGroup
+	for i := range r.workload.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewPCG(r.seeds.Load(), uint64(i)))
+			for range queue {
+				if _, err := r.push(ctx, random); err != nil {
+					errs <- fmt.Errorf("pushing the blobs of the workload: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	var err error
+push:
+	for range r.workload.Blobs {
+		select {
+		case queue <- struct{}{}:
+		case err = <-errs:
+			break push
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// operation runs an operation picked at random and returns its kind, the
+// bytes transferred and its latency
+func (r *runner) operation(ctx context.Context, random *rand.Rand) (string, int64, time.Duration, error) {
+	start := time.Now()
+	if random.Float64() < r.workload.PushRatio {
+		n, err := r.push(ctx, random)
+		return OpPush, n, time.Since(start), err
+	}
+
+	r.mu.Lock()
+	hit := len(r.blobs) > 0 && random.Float64() < r.workload.HitRatio
+	var b blob
+	if hit {
+		b = r.blobs[random.IntN(len(r.blobs))]
+	}
+	r.mu.Unlock()
+	if !hit {
+		var missing [32]byte
+		binary.LittleEndian.PutUint64(missing[:], random.Uint64())
+		binary.LittleEndian.PutUint64(missing[8:], random.Uint64())
+		n, err := r.pull(ctx, digest.FromBytes(missing[:]), http.StatusNotFound)
+		return OpMiss, n, time.Since(start), err
+	}
+	n, err := r.pull(ctx, b.digest, http.StatusOK)
+	return OpPull, n, time.Since(start), err
+}
+
+// push pushes a new blob and returns its size
+func (r *runner) push(ctx context.Context, random *rand.Rand) (int64, error) {
+	b := blob{
+		seed: r.seeds.Add(1),
+		size: r.workload.BlobSizes[random.IntN(len(r.workload.BlobSizes))],
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), b.content()); err != nil {
+		return 0, err
+	}
+	b.digest = digester.Digest()
+
+	desc := v1.Descriptor{MediaType: "application/octet-stream", Digest: b.digest, Size: b.size}
+	if err := r.client.PushBlob(ctx, r.workload.Repository, desc, b.content()); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.blobs = append(r.blobs, b)
+	r.mu.Unlock()
+	return b.size, nil
+}
+
+// pull reads a blob to its end and returns its size, failing unless the
+// response has the status expected
+func (r *runner) pull(ctx context.Context, dgst digest.Digest, status int) (int64, error) {
+	blobURL, err := r.client.BlobURL(r.workload.Repository, dgst)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("getting blob %s: %w", dgst, err)
+	}
+	if resp.StatusCode != status {
+		return n, fmt.Errorf("getting blob %s: unexpected status %s", dgst, resp.Status)
+	}
+	return n, nil
+}
@@ -0,0 +1,118 @@
+package bench
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeRegistry stores the blobs pushed in a single request and serves them
+type fakeRegistry struct {
+	mu    sync.Mutex
+	blobs map[digest.Digest][]byte
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+		w.Header().Set("Location", "/upload")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && r.URL.Path == "/upload":
+		dgst, err := digest.Parse(r.URL.Query().Get("digest"))
+		content, _ := io.ReadAll(r.Body)
+		if err != nil || digest.FromBytes(content) != dgst {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.blobs[dgst] = content
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/"):
+		dgst := digest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		f.mu.Lock()
+		content, ok := f.blobs[dgst]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestRun(t *testing.T) {
+	registry := &fakeRegistry{blobs: make(map[digest.Digest][]byte)}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	client, err := registryclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %v", err)
+	}
+
+	name, _ := reference.WithName("bench/load")
+	result, err := Run(context.Background(), client, Workload{
+		Repository:  name,
+		BlobSizes:   []int64{1 << 10, 4 << 10},
+		Blobs:       4,
+		Concurrency: 4,
+		Duration:    200 * time.Millisecond,
+		HitRatio:    0.5,
+		PushRatio:   0.2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error running workload: %v", err)
+	}
+
+	pushed := 0
+	for _, s := range result.Operations {
+		if s.Count == 0 || s.Errors != 0 {
+			t.Fatalf("unexpected %s stats %+v", s.Operation, s)
+		}
+		if s.P50 <= 0 || s.P50 > s.P90 || s.P90 > s.P99 || s.P99 > s.Max {
+			t.Fatalf("inconsistent %s latencies %+v", s.Operation, s)
+		}
+		if s.Operation == OpPush {
+			pushed = s.Count
+		}
+		if s.Operation != OpMiss && s.Bytes < int64(s.Count)<<10 {
+			t.Fatalf("%s transferred %d bytes in %d operations", s.Operation, s.Bytes, s.Count)
+		}
+	}
+	if len(result.Operations) != 3 {
+		t.Fatalf("expected pulls, misses and pushes, got %+v", result.Operations)
+	}
+	if len(registry.blobs) != 4+pushed {
+		t.Fatalf("registry holds %d blobs, want %d", len(registry.blobs), 4+pushed)
+	}
+
+	if _, err := Run(context.Background(), client, Workload{Repository: name, BlobSizes: []int64{1}, Concurrency: 1, Duration: time.Second, HitRatio: 1}); err == nil {
+		t.Fatal("expected an error for hits without blobs")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	for q, want := range map[float64]time.Duration{0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond, 0: time.Millisecond} {
+		if got := percentile(latencies, q); got != want {
+			t.Errorf("percentile %v = %v, want %v", q, got, want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("percentile of no latencies = %v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+)
+
+// AccessMode controls how a blob access updates the tracker.
+type AccessMode int
+
+const (
+	// AccessPersist updates the last access time and persists the metadata.
+	AccessPersist AccessMode = iota
+	// AccessMemory updates the last access time in memory only. The change is
+	// persisted with the next persisted update of the same blob.
+	AccessMemory
+	// AccessSkip leaves the last access time untouched.
+	AccessSkip
+)
+
+// ParseAccessMode parses "persist", "memory" or "skip". An empty string
+// selects AccessPersist.
+func ParseAccessMode(s string) (AccessMode, error) {
+	switch s {
+	case "", "persist":
+		return AccessPersist, nil
+	case "memory":
+		return AccessMemory, nil
+	case "skip":
+		return AccessSkip, nil
+	}
+	return AccessPersist, fmt.Errorf("invalid access mode %q", s)
+}
+
+func (m AccessMode) String() string {
+	switch m {
+	case AccessPersist:
+		return "persist"
+	case AccessMemory:
+		return "memory"
+	case AccessSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("AccessMode(%d)", int(m))
+}
+
+type accessModeKey struct{}
+
+// WithAccessMode returns a context carrying the access mode to use for blob
+// accesses made on its behalf.
+func WithAccessMode(ctx context.Context, mode AccessMode) context.Context {
+	return context.WithValue(ctx, accessModeKey{}, mode)
+}
+
+// AccessModeFromContext returns the access mode carried by ctx, defaulting to
+// AccessPersist.
+func AccessModeFromContext(ctx context.Context) AccessMode {
+	if mode, ok := ctx.Value(accessModeKey{}).(AccessMode); ok {
+		return mode
+	}
+	return AccessPersist
+}
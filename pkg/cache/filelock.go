@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lockSlots is the number of locks keys are hashed to, keys sharing a slot
+// wait for each other
+const lockSlots = 1024
+
+// FileLocks are advisory locks shared by the instances using one storage,
+// such as an NFS export, taken as POSIX byte-range locks of a lock file so
+// that they are honored across hosts by the NFS lock manager. The first
+// byte marks the instances using the storage, the others are the locks of
+// the keys, e.g. blob digests, hashed into slots.
+//
+// Locks are only advisory and only supported on unix systems, elsewhere
+// they only exclude the goroutines of this process.
+type FileLocks struct {
+	file  *os.File
+	slots [lockSlots]sync.Mutex
+}
+
+// OpenFileLocks opens the lock file at path, creating it if needed, and
+// marks this instance as using the storage until closed. It fails if the
+// file system does not support locks, e.g. NFS mounted with nolock.
+func OpenFileLocks(path string, modes FileModes) (*FileLocks, error) {
+	if err := os.MkdirAll(filepath.Dir(path), modes.Dir); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, modes.File)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+	// every instance holds a shared lock of the first byte
+	if err := lockByte(f, 0, lockShared, false); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	return &FileLocks{file: f}, nil
+}
+
+// OtherInstance reports whether another process holds the lock file open,
+// and its process id if known. The id is of little use when the process
+// runs on another host.
+func (l *FileLocks) OtherInstance() (pid int, found bool, err error) {
+	return lockHolder(l.file, 0)
+}
+
+// Lock waits for the lock of key and returns the function releasing it.
+func (l *FileLocks) Lock(key string) (unlock func(), err error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	slot := h.Sum32() % lockSlots
+
+	// POSIX locks do not exclude the threads of a process
+	l.slots[slot].Lock()
+	offset := 1 + int64(slot)
+	if err := lockByte(l.file, offset, lockExclusive, true); err != nil {
+		l.slots[slot].Unlock()
+		return nil, fmt.Errorf("locking %s: %w", key, err)
+	}
+	return func() {
+		lockByte(l.file, offset, lockRelease, false)
+		l.slots[slot].Unlock()
+	}, nil
+}
+
+// Close releases the locks and the mark of this instance.
+func (l *FileLocks) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd)
+
+package cache
+
+import "os"
+
+const (
+	lockShared = iota
+	lockExclusive
+	lockRelease
+)
+
+// lockByte does nothing, file locks are not supported
+func lockByte(f *os.File, offset int64, typ int16, wait bool) error {
+	return nil
+}
+
+// lockHolder reports no other process, file locks are not supported
+func lockHolder(f *os.File, offset int64) (int, bool, error) {
+	return 0, false, nil
+}
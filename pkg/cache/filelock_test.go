@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLocks(t *testing.T) {
+	locks, err := OpenFileLocks(filepath.Join(t.TempDir(), "meta", "storage.lock"), DefaultFileModes)
+	if err != nil {
+		t.Fatalf("unexpected error opening locks: %v", err)
+	}
+	defer locks.Close()
+
+	// the locks of this process are not another instance
+	if _, found, err := locks.OtherInstance(); err != nil || found {
+		t.Errorf("unexpected other instance: %v, %v", found, err)
+	}
+
+	unlock, err := locks.Lock("sha256:abc")
+	if err != nil {
+		t.Fatalf("unexpected error locking: %v", err)
+	}
+	var mu sync.Mutex
+	released := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		unlock, err := locks.Lock("sha256:abc")
+		if err != nil {
+			t.Errorf("unexpected error locking: %v", err)
+			return
+		}
+		defer unlock()
+		mu.Lock()
+		defer mu.Unlock()
+		if !released {
+			t.Error("lock taken while held")
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	released = true
+	mu.Unlock()
+	unlock()
+	<-done
+
+	// other keys do not wait
+	unlock, err = locks.Lock("sha256:def")
+	if err != nil {
+		t.Fatalf("unexpected error locking: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd
+
+package cache
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	lockShared    = syscall.F_RDLCK
+	lockExclusive = syscall.F_WRLCK
+	lockRelease   = syscall.F_UNLCK
+)
+
+// lockByte sets the lock of the byte at offset, waiting for conflicting
+// locks if wait is set
+func lockByte(f *os.File, offset int64, typ int16, wait bool) error {
+	cmd := syscall.F_SETLK
+	if wait {
+		cmd = syscall.F_SETLKW
+	}
+	lk := syscall.Flock_t{Type: typ, Whence: io.SeekStart, Start: offset, Len: 1}
+	return syscall.FcntlFlock(f.Fd(), cmd, &lk)
+}
+
+// lockHolder returns the process holding a lock of the byte at offset
+// conflicting with an exclusive lock, if any
+func lockHolder(f *os.File, offset int64) (int, bool, error) {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart, Start: offset, Len: 1}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return 0, false, err
+	}
+	if lk.Type == syscall.F_UNLCK {
+		return 0, false, nil
+	}
+	return int(lk.Pid), true, nil
+}
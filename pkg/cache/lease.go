@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Locker elects a single instance to run the cleanup loop when several
+// instances share one storage backend.
+type Locker interface {
+	// TryLock acquires or renews the lease and reports whether this instance
+	// holds it.
+	TryLock(ctx context.Context) (bool, error)
+
+	// Unlock releases the lease if this instance holds it.
+	Unlock(ctx context.Context) error
+}
+
+// DefaultLeaseOwner returns an identifier unique to this process.
+func DefaultLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+type leaseRecord struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileLease is a Locker backed by a lease file on storage shared by all
+// instances, such as an NFS mount. The instances' clocks are expected to be
+// roughly in sync.
+type FileLease struct {
+	path     string
+	owner    string
+	duration time.Duration
+	now      func() time.Time
+	modes    FileModes
+}
+
+// NewFileLease creates a file lease at path held for duration after each
+// TryLock. An empty owner selects DefaultLeaseOwner.
+func NewFileLease(path, owner string, duration time.Duration) (*FileLease, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("lease duration must be positive")
+	}
+	if owner == "" {
+		owner = DefaultLeaseOwner()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), DefaultFileModes.Dir); err != nil {
+		return nil, fmt.Errorf("creating lease directory: %w", err)
+	}
+	return &FileLease{
+		path:     path,
+		owner:    owner,
+		duration: duration,
+		now:      time.Now,
+		modes:    DefaultFileModes,
+	}, nil
+}
+
+// SetModes sets the permissions of the lease file when created.
+func (l *FileLease) SetModes(modes FileModes) {
+	l.modes = modes
+}
+
+// TryLock implements Locker
+func (l *FileLease) TryLock(ctx context.Context) (bool, error) {
+	current, data, err := l.read()
+	if os.IsNotExist(err) {
+		return l.create()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if l.now().Before(current.ExpiresAt) {
+		if current.Owner != l.owner {
+			return false, nil
+		}
+		return true, l.renew()
+	}
+
+	// The lease expired. Move it aside under a name unique to this owner so
+	// that only one contender takes it over.
+	stale := l.path + "." + l.owner + ".stale"
+	if err := os.Rename(l.path, stale); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("moving expired lease: %w", err)
+	}
+	moved, err := os.ReadFile(stale)
+	if err == nil && !bytes.Equal(moved, data) {
+		// another contender took over in the meantime, put its lease back
+		_ = os.Link(stale, l.path)
+		_ = os.Remove(stale)
+		return false, nil
+	}
+	_ = os.Remove(stale)
+
+	return l.create()
+}
+
+// Unlock implements Locker
+func (l *FileLease) Unlock(ctx context.Context) error {
+	current, _, err := l.read()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.Owner != l.owner {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing lease: %w", err)
+	}
+	return nil
+}
+
+// read returns the current lease and its raw content. A corrupt lease reads
+// as expired.
+func (l *FileLease) read() (leaseRecord, []byte, error) {
+	var record leaseRecord
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return record, nil, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return leaseRecord{}, data, nil
+	}
+	return record, data, nil
+}
+
+func (l *FileLease) record() ([]byte, error) {
+	return json.Marshal(leaseRecord{
+		Owner:     l.owner,
+		ExpiresAt: l.now().Add(l.duration),
+	})
+}
+
+// create writes a new lease, failing if any other lease exists
+func (l *FileLease) create() (bool, error) {
+	data, err := l.record()
+	if err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, l.modes.File)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("creating lease: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		_ = os.Remove(l.path)
+		return false, fmt.Errorf("writing lease: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(l.path)
+		return false, fmt.Errorf("writing lease: %w", err)
+	}
+	return true, nil
+}
+
+// renew extends a lease held by this owner
+func (l *FileLease) renew() error {
+	data, err := l.record()
+	if err != nil {
+		return err
+	}
+	tmp := l.path + "." + l.owner + ".tmp"
+	if err := os.WriteFile(tmp, data, l.modes.File); err != nil {
+		return fmt.Errorf("writing lease: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("renewing lease: %w", err)
+	}
+	return nil
+}
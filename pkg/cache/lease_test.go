@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLease(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cleanup.lease")
+
+	first, err := NewFileLease(path, "first", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error creating lease: %v", err)
+	}
+	second, err := NewFileLease(path, "second", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error creating lease: %v", err)
+	}
+
+	tryLock := func(l *FileLease, expected bool) {
+		t.Helper()
+		held, err := l.TryLock(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error acquiring lease: %v", err)
+		}
+		if held != expected {
+			t.Fatalf("unexpected lease state for %s: %v != %v", l.owner, held, expected)
+		}
+	}
+
+	tryLock(first, true)
+	tryLock(second, false)
+	// renewal by the holder
+	tryLock(first, true)
+
+	// the holder stops renewing and the lease expires
+	second.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	tryLock(second, true)
+	tryLock(first, false)
+
+	// releasing a lease held by someone else is a no-op
+	if err := first.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+	second.now = time.Now
+	tryLock(first, false)
+
+	if err := second.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+	tryLock(first, true)
+}
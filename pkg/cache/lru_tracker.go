@@ -2,280 +2,1108 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
 	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	cleanupNamespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "cleanup", nil)
+
+	cleanupBacklogBlobs = cleanupNamespace.NewGauge("backlog_blobs", "The number of evictable blobs left after the last cleanup", "")
+	cleanupBacklogSize  = cleanupNamespace.NewGauge("backlog", "The size of the evictable blobs left after the last cleanup", metrics.Bytes)
+)
+
+func init() {
+	metrics.Register(cleanupNamespace)
+}
+
 // BlobMeta holds metadata about a blob for LRU tracking
 type BlobMeta struct {
 	Digest       string    `json:"digest"`
 	LastAccessed time.Time `json:"last_accessed"`
 	Size         int64     `json:"size"`
 	CreatedAt    time.Time `json:"created_at"`
+	// TTL overrides the tracker TTL for this blob when it is longer.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Repositories are the names of the repositories the blob was seen
+	// linked into, sorted. Evicting the blob removes these links too.
+	Repositories []string `json:"repositories,omitempty"`
+	// Reads counts the reads of the blob data since it was written, ReadDays
+	// those of the last readDays days per day, from day ReadDay backwards.
+	// Days are counted since the Unix epoch in UTC.
+	Reads    int64   `json:"reads,omitempty"`
+	ReadDays []int64 `json:"read_days,omitempty"`
+	ReadDay  int64   `json:"read_day,omitempty"`
+	// Pinned blobs are never evicted, whatever their age or the cache size
+	Pinned bool `json:"pinned,omitempty"`
+
+	// evicting is set while a cleanup deletes the blob, accesses are
+	// rejected until it is removed or released
+	evicting bool
+	// dirty is set while the entry has changes not saved to the store
+	dirty bool
+}
+
+// ErrBlobEvicting is returned for accesses to a blob being evicted
+var ErrBlobEvicting = errors.New("blob is being evicted")
+
+// cleanupProgressInterval is how often a running cleanup logs its progress
+const cleanupProgressInterval = 30 * time.Second
+
+// trackerShards is the number of independently locked parts the tracked
+// blobs are split into, so that concurrent requests for different blobs
+// rarely wait for each other
+const trackerShards = 64
+
+// trackerShard holds the tracked blobs whose key hashes to it
+type trackerShard struct {
+	mu    sync.RWMutex
+	blobs map[string]*BlobMeta
 }
 
 // LRUTracker tracks blob access times for LRU eviction
 type LRUTracker struct {
-	mu          sync.RWMutex
-	blobs       map[string]*BlobMeta
-	metaDir     string
+	shards      [trackerShards]trackerShard
+	store       MetaStore
 	ttl         time.Duration
 	logger      *logrus.Logger
 	stopCleanup chan struct{}
+	stopOnce    sync.Once
 	wg          sync.WaitGroup
+	saves       sync.WaitGroup // metadata writes in progress
+	locker      Locker
+
+	// maxSize limits the total size of tracked blobs, zero means unlimited.
+	// Exceeding it triggers a cleanup evicting the least recently accessed
+	// blobs.
+	maxSize        int64
+	totalSize      atomic.Int64
+	triggerCleanup chan struct{}
+
+	cleanupWorkers int // blobs deleted concurrently by a cleanup
+	cleanupRate    int // blobs deleted per second at most, zero if unlimited
+
+	// cleanupMaxDeletes and cleanupMaxDuration limit a single cleanup, the
+	// blobs left are evicted by the next ones. Zero means unlimited.
+	cleanupMaxDeletes  int
+	cleanupMaxDuration time.Duration
+	cleanupBacklog     atomic.Int64 // evictable blobs left by the last cleanup
+
+	// namespaceTTLs replace ttl for the blobs of the repositories of a
+	// namespace, the first component of their name
+	namespaceTTLs map[string]time.Duration
+
+	loaded chan struct{} // closed once the persisted metadata is loaded
 }
 
-// NewLRUTracker creates a new LRU tracker
+// NewLRUTracker creates a new LRU tracker keeping its metadata in metaDir
 func NewLRUTracker(metaDir string, ttl time.Duration, logger *logrus.Logger) (*LRUTracker, error) {
-	if logger == nil {
-		logger = logrus.StandardLogger()
+	store, err := NewFileMetaStore(metaDir, logger)
+	if err != nil {
+		return nil, err
 	}
+	return NewLRUTrackerWithStore(store, ttl, logger)
+}
 
-	// Ensure metadata directory exists
-	if err := os.MkdirAll(metaDir, 0755); err != nil {
-		return nil, fmt.Errorf("creating metadata directory: %w", err)
+// NewLRUTrackerWithStore creates a new LRU tracker keeping its metadata in
+// store. The persisted metadata is loaded in the background, the tracker
+// records accesses in the meantime.
+func NewLRUTrackerWithStore(store MetaStore, ttl time.Duration, logger *logrus.Logger) (*LRUTracker, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
 	}
 
 	tracker := &LRUTracker{
-		blobs:       make(map[string]*BlobMeta),
-		metaDir:     metaDir,
+		store:       store,
 		ttl:         ttl,
 		logger:      logger,
 		stopCleanup: make(chan struct{}),
+
+		cleanupWorkers: 1,
+		triggerCleanup: make(chan struct{}, 1),
+		loaded:         make(chan struct{}),
+	}
+	for i := range tracker.shards {
+		tracker.shards[i].blobs = make(map[string]*BlobMeta)
 	}
 
 	// Load existing metadata
-	if err := tracker.loadMetadata(); err != nil {
-		logger.Warnf("failed to load metadata: %v", err)
-	}
+	go func() {
+		defer close(tracker.loaded)
+		if err := tracker.loadMetadata(); err != nil {
+			logger.Warnf("failed to load metadata: %v", err)
+		}
+	}()
 
 	return tracker, nil
 }
 
-// RecordAccess updates the last access time for a blob
-func (t *LRUTracker) RecordAccess(dgst digest.Digest, size int64) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// Loaded returns a channel closed once the metadata persisted before the
+// tracker was created is loaded. Cleanup is postponed until then, as the
+// least recently accessed blobs are not known before.
+func (t *LRUTracker) Loaded() <-chan struct{} {
+	return t.loaded
+}
+
+// shard returns the shard holding the blob key. The end of a digest is
+// random, so the FNV-1a hash of its last characters spreads the blobs
+// evenly.
+func (t *LRUTracker) shard(key string) *trackerShard {
+	h := uint32(2166136261)
+	for i := max(len(key)-8, 0); i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &t.shards[h%trackerShards]
+}
+
+// RecordAccess updates the last access time for a blob, honoring the
+// AccessMode carried by ctx. Within a request, see WithRequestAccess, it is
+// updated by the first access only.
+func (t *LRUTracker) RecordAccess(ctx context.Context, dgst digest.Digest, size int64) error {
+	return t.record(requestAccessFromContext(ctx), dgst, size, AccessModeFromContext(ctx), false)
+}
+
+// RecordRead records an access reading the data of a blob, counted by the
+// popularity report. Within a request a read is counted once, and not at all
+// for a range request.
+func (t *LRUTracker) RecordRead(ctx context.Context, dgst digest.Digest, size int64) error {
+	access := requestAccessFromContext(ctx)
+	return t.record(access, dgst, size, AccessModeFromContext(ctx), access == nil || !access.partial)
+}
+
+// record updates the tracking entry of a blob according to mode, counting a
+// read if read is set. The accesses of the request access made already are
+// not repeated.
+func (t *LRUTracker) record(access *requestAccess, dgst digest.Digest, size int64, mode AccessMode, read bool) error {
+	if mode == AccessSkip {
+		return nil
+	}
+	accessed, counted := access.recorded(dgst)
+	if accessed && (!read || counted) {
+		return nil
+	}
 
 	key := dgst.String()
 	now := time.Now()
 
-	if meta, exists := t.blobs[key]; exists {
-		meta.LastAccessed = now
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if exists {
+		if meta.evicting {
+			return ErrBlobEvicting
+		}
+		if !accessed {
+			meta.LastAccessed = now
+		}
 	} else {
-		t.blobs[key] = &BlobMeta{
+		meta = &BlobMeta{
 			Digest:       key,
 			LastAccessed: now,
 			Size:         size,
 			CreatedAt:    now,
 		}
+		s.blobs[key] = meta
+		if total := t.totalSize.Add(size); t.maxSize > 0 && total > t.maxSize {
+			select {
+			case t.triggerCleanup <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if read {
+		meta.countRead(now)
 	}
+	meta.dirty = true
 
-	// Persist metadata asynchronously
-	go t.saveMetadata(key)
+	if mode == AccessPersist {
+		t.save(key)
+	}
+	access.record(dgst, read)
 
 	return nil
 }
 
+// Touch refreshes the last access time of an already tracked blob, honoring
+// the AccessMode carried by ctx, once per request. It reports whether the
+// blob was tracked; untracked blobs and blobs being evicted are left
+// untouched.
+func (t *LRUTracker) Touch(ctx context.Context, dgst digest.Digest) bool {
+	mode := AccessModeFromContext(ctx)
+	access := requestAccessFromContext(ctx)
+
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists || meta.evicting {
+		return false
+	}
+	if accessed, _ := access.recorded(dgst); mode == AccessSkip || accessed {
+		return true
+	}
+	meta.LastAccessed = time.Now()
+	meta.dirty = true
+
+	if mode == AccessPersist {
+		t.save(key)
+	}
+	access.record(dgst, false)
+
+	return true
+}
+
+// ExtendTTL raises the TTL of an already tracked blob to at least ttl. It
+// reports whether the blob was tracked. A blob shared by several images keeps
+// the longest TTL requested for any of them.
+func (t *LRUTracker) ExtendTTL(dgst digest.Digest, ttl time.Duration) bool {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists || meta.evicting {
+		return false
+	}
+	if ttl <= meta.TTL {
+		return true
+	}
+	meta.TTL = ttl
+	meta.dirty = true
+	t.save(key)
+
+	return true
+}
+
+// AddRepository records that a tracked blob is linked into the repository
+// name. It reports whether the blob was tracked.
+func (t *LRUTracker) AddRepository(dgst digest.Digest, name string) bool {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists || meta.evicting {
+		return false
+	}
+	i, found := slices.BinarySearch(meta.Repositories, name)
+	if found {
+		return true
+	}
+	// a new slice, snapshots being saved share the current one
+	meta.Repositories = slices.Insert(slices.Clip(meta.Repositories), i, name)
+	meta.dirty = true
+	t.save(key)
+
+	return true
+}
+
+// RemoveRepository removes the repository name from the repositories of the
+// tracked blobs, e.g. once it is deleted. It returns the blobs linked into no
+// other repository, which EvictBlob can delete.
+func (t *LRUTracker) RemoveRepository(name string) []digest.Digest {
+	var orphans []digest.Digest
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for key, meta := range s.blobs {
+			j, found := slices.BinarySearch(meta.Repositories, name)
+			if !found {
+				continue
+			}
+			// a new slice, snapshots being saved share the current one
+			meta.Repositories = slices.Delete(slices.Clone(meta.Repositories), j, j+1)
+			meta.dirty = true
+			t.save(key)
+			if len(meta.Repositories) == 0 && !meta.evicting {
+				if dgst, err := digest.Parse(key); err == nil {
+					orphans = append(orphans, dgst)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	return orphans
+}
+
+// RemoveBlobRepository removes the repository name from the repositories of
+// a tracked blob, e.g. once its link is deleted. It reports whether the blob
+// was linked into name and no other repository, leaving it for EvictBlob.
+func (t *LRUTracker) RemoveBlobRepository(dgst digest.Digest, name string) bool {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists {
+		return false
+	}
+	i, found := slices.BinarySearch(meta.Repositories, name)
+	if !found {
+		return false
+	}
+	// a new slice, snapshots being saved share the current one
+	meta.Repositories = slices.Delete(slices.Clone(meta.Repositories), i, i+1)
+	meta.dirty = true
+	t.save(key)
+
+	return len(meta.Repositories) == 0 && !meta.evicting
+}
+
+// EvictBlob deletes a blob with deleteFunc and stops tracking it, unless it
+// was accessed after since or is being evicted already. It reports whether
+// the blob was deleted.
+func (t *LRUTracker) EvictBlob(ctx context.Context, dgst digest.Digest, since time.Time, deleteFunc func(context.Context, digest.Digest) error) (bool, error) {
+	if _, claimed := t.claim(dgst, since); !claimed {
+		return false, nil
+	}
+	if err := deleteFunc(ctx, dgst); err != nil {
+		t.release(dgst)
+		return false, err
+	}
+	if err := t.RemoveBlob(dgst); err != nil {
+		t.logger.Errorf("failed to remove blob metadata %s: %v", dgst, err)
+	}
+	return true, nil
+}
+
+// SetPinned pins a tracked blob, protecting it from eviction, or unpins it.
+// It reports whether the blob was tracked.
+func (t *LRUTracker) SetPinned(dgst digest.Digest, pinned bool) bool {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists || meta.evicting {
+		return false
+	}
+	if meta.Pinned == pinned {
+		return true
+	}
+	meta.Pinned = pinned
+	meta.dirty = true
+	t.save(key)
+
+	return true
+}
+
+// Blobs returns copies of the tracking entries of all blobs not being evicted
+func (t *LRUTracker) Blobs() []BlobMeta {
+	var blobs []BlobMeta
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for _, meta := range s.blobs {
+			if !meta.evicting {
+				blobs = append(blobs, *meta)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return blobs
+}
+
+// Blob returns a copy of the tracking entry of a blob
+func (t *LRUTracker) Blob(dgst digest.Digest) (BlobMeta, bool) {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	meta, exists := s.blobs[key]
+	if !exists {
+		return BlobMeta{}, false
+	}
+	return *meta, true
+}
+
 // RecordWrite records when a blob is written
 func (t *LRUTracker) RecordWrite(dgst digest.Digest, size int64) error {
-	return t.RecordAccess(dgst, size)
+	return t.record(nil, dgst, size, AccessPersist, false)
 }
 
 // GetExpiredBlobs returns blobs that have exceeded the TTL
 func (t *LRUTracker) GetExpiredBlobs(ctx context.Context) []digest.Digest {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-
 	now := time.Now()
 	expired := []digest.Digest{}
+	total := 0
 
-	for key, meta := range t.blobs {
-		if now.Sub(meta.LastAccessed) > t.ttl {
-			if dgst, err := digest.Parse(key); err == nil {
-				expired = append(expired, dgst)
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for key, meta := range s.blobs {
+			if now.Sub(meta.LastAccessed) > t.blobTTL(meta) && !meta.evicting && !meta.Pinned {
+				if dgst, err := digest.Parse(key); err == nil {
+					expired = append(expired, dgst)
+				}
 			}
 		}
+		total += len(s.blobs)
+		s.mu.RUnlock()
 	}
 
-	t.logger.Infof("found %d expired blobs out of %d total", len(expired), len(t.blobs))
+	t.logger.Infof("found %d expired blobs out of %d total", len(expired), total)
 	return expired
 }
 
+// blobTTL returns the TTL of a blob: the longest of the TTLs of the
+// namespaces of its repositories, the tracker TTL standing for namespaces
+// without their own and blobs without repositories, and of the TTL of the
+// blob itself
+func (t *LRUTracker) blobTTL(meta *BlobMeta) time.Duration {
+	ttl := t.ttl
+	if len(t.namespaceTTLs) > 0 && len(meta.Repositories) > 0 {
+		ttl = 0
+		for _, name := range meta.Repositories {
+			namespace, _, _ := strings.Cut(name, "/")
+			namespaceTTL, ok := t.namespaceTTLs[namespace]
+			if !ok {
+				namespaceTTL = t.ttl
+			}
+			ttl = max(ttl, namespaceTTL)
+		}
+	}
+	return max(ttl, meta.TTL)
+}
+
+// claim marks a blob as being evicted unless it was accessed after
+// selected, the time the cleanup found it evictable, is pinned or is already
+// claimed.
+// It returns a copy of the entry and whether the blob was claimed. From then
+// on accesses are rejected until the blob is removed or released.
+func (t *LRUTracker) claim(dgst digest.Digest, selected time.Time) (BlobMeta, bool) {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.blobs[key]
+	if !exists || meta.evicting || meta.Pinned || meta.LastAccessed.After(selected) {
+		return BlobMeta{}, false
+	}
+	meta.evicting = true
+	return *meta, true
+}
+
+// release ends the eviction of a blob whose deletion failed, it is tracked
+// as before
+func (t *LRUTracker) release(dgst digest.Digest) {
+	key := dgst.String()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if meta, exists := s.blobs[key]; exists {
+		meta.evicting = false
+	}
+}
+
 // RemoveBlob removes a blob from tracking
 func (t *LRUTracker) RemoveBlob(dgst digest.Digest) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
 	key := dgst.String()
-	delete(t.blobs, key)
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Remove metadata file
-	metaFile := t.getMetaFilePath(key)
-	if err := os.Remove(metaFile); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("removing metadata file: %w", err)
+	if meta, exists := s.blobs[key]; exists {
+		t.totalSize.Add(-meta.Size)
+		delete(s.blobs, key)
 	}
 
-	return nil
+	return t.store.Delete(context.Background(), key)
 }
 
-// StartCleanup starts the periodic cleanup goroutine
-func (t *LRUTracker) StartCleanup(ctx context.Context, interval time.Duration, deleteFunc func(digest.Digest) error) {
+// SetMaxSize limits the total size of tracked blobs. Cleanup evicts the least
+// recently accessed blobs beyond it, and runs as soon as a new blob exceeds
+// it. It must be called before StartCleanup.
+func (t *LRUTracker) SetMaxSize(maxSize int64) {
+	t.maxSize = maxSize
+}
+
+// GetOverflowBlobs returns the least recently accessed blobs which have to be
+// evicted to bring the total size within the maximum size. Blobs in exclude,
+// e.g. expired blobs evicted anyway, are not returned and count as evicted.
+// Pinned blobs count toward the total size but are never returned.
+func (t *LRUTracker) GetOverflowBlobs(exclude []digest.Digest) []digest.Digest {
+	if t.maxSize <= 0 {
+		return nil
+	}
+
+	excluded := make(map[string]bool, len(exclude))
+	for _, dgst := range exclude {
+		excluded[dgst.String()] = true
+	}
+
+	// copies, the entries change once their shard is unlocked
+	var candidates []BlobMeta
+	var total int64
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for key, meta := range s.blobs {
+			if !excluded[key] && !meta.evicting {
+				total += meta.Size
+				if !meta.Pinned {
+					candidates = append(candidates, *meta)
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	if total <= t.maxSize {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastAccessed.Before(candidates[j].LastAccessed)
+	})
+
+	var overflow []digest.Digest
+	for _, meta := range candidates {
+		if total <= t.maxSize {
+			break
+		}
+		if dgst, err := digest.Parse(meta.Digest); err == nil {
+			overflow = append(overflow, dgst)
+			total -= meta.Size
+		}
+	}
+
+	t.logger.Infof("found %d blobs exceeding the maximum size of %d bytes", len(overflow), t.maxSize)
+	return overflow
+}
+
+// SetNamespaceTTLs replaces the tracker TTL for the blobs of the repositories
+// of the namespaces of ttls, the first component of their name. A blob linked
+// into several namespaces expires after the longest of their TTLs. It must
+// be called before StartCleanup.
+func (t *LRUTracker) SetNamespaceTTLs(ttls map[string]time.Duration) {
+	t.namespaceTTLs = ttls
+}
+
+// SetCleanupWorkers sets the number of blobs a cleanup deletes concurrently,
+// at least one. It must be called before StartCleanup.
+func (t *LRUTracker) SetCleanupWorkers(workers int) {
+	t.cleanupWorkers = max(workers, 1)
+}
+
+// SetCleanupRate limits the blobs a cleanup deletes per second, zero means
+// unlimited. It must be called before StartCleanup.
+func (t *LRUTracker) SetCleanupRate(rate int) {
+	t.cleanupRate = max(rate, 0)
+}
+
+// SetCleanupLimits limits the blobs a single cleanup deletes and how long it
+// keeps starting deletions, zero means unlimited. Evictable blobs beyond the
+// limits are left for the next cleanup. It must be called before
+// StartCleanup.
+func (t *LRUTracker) SetCleanupLimits(maxDeletes int, maxDuration time.Duration) {
+	t.cleanupMaxDeletes = max(maxDeletes, 0)
+	t.cleanupMaxDuration = max(maxDuration, 0)
+}
+
+// SetCleanupLocker makes every cleanup run acquire locker first, so that
+// only one of several instances sharing storage evicts blobs. It must be
+// called before StartCleanup.
+func (t *LRUTracker) SetCleanupLocker(locker Locker) {
+	t.locker = locker
+}
+
+// StartCleanup starts the periodic cleanup goroutine. Cleanups in progress
+// are interrupted once ctx is done or StopCleanup is called.
+func (t *LRUTracker) StartCleanup(ctx context.Context, interval time.Duration, deleteFunc func(context.Context, digest.Digest) error) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-t.stopCleanup:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
+		defer cancel()
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		t.logger.Infof("starting LRU cleanup with interval: %v, TTL: %v", interval, t.ttl)
+		t.logger.Infof("starting LRU cleanup with interval: %v, TTL: %v, workers: %d", interval, t.ttl, t.cleanupWorkers)
 
 		for {
 			select {
-			case <-ctx.Done():
-				t.logger.Info("cleanup stopped due to context cancellation")
-				return
 			case <-t.stopCleanup:
 				t.logger.Info("cleanup stopped")
 				return
+			case <-ctx.Done():
+				t.logger.Info("cleanup stopped due to context cancellation")
+				return
 			case <-ticker.C:
 				t.runCleanup(ctx, deleteFunc)
+			case <-t.triggerCleanup:
+				t.runCleanup(ctx, deleteFunc)
 			}
 		}
 	}()
 }
 
 // runCleanup performs the cleanup of expired blobs
-func (t *LRUTracker) runCleanup(ctx context.Context, deleteFunc func(digest.Digest) error) {
+func (t *LRUTracker) runCleanup(ctx context.Context, deleteFunc func(context.Context, digest.Digest) error) {
+	if !isClosed(t.loaded) {
+		t.logger.Info("metadata still loading, postponing LRU cleanup")
+		return
+	}
+	if t.locker != nil {
+		held, err := t.locker.TryLock(ctx)
+		if err != nil {
+			t.logger.Warnf("failed to acquire cleanup lease: %v", err)
+			return
+		}
+		if !held {
+			t.logger.Debug("cleanup lease held by another instance, skipping cleanup")
+			return
+		}
+	}
+
 	t.logger.Info("running LRU cleanup")
+	if t.locker != nil {
+		// instances sharing the metadata store may have recorded more recent
+		// accesses than this one has seen
+		if err := t.loadMetadata(); err != nil {
+			t.logger.Warnf("failed to reload metadata: %v", err)
+		}
+	}
+	// blobs accessed from now on are rescued
+	selected := time.Now()
 	expired := t.GetExpiredBlobs(ctx)
+	expired = append(expired, t.GetOverflowBlobs(expired)...)
 
 	if len(expired) == 0 {
 		t.logger.Debug("no expired blobs to clean up")
+		t.cleanupBacklog.Store(0)
+		cleanupBacklogBlobs.Set(0)
+		cleanupBacklogSize.Set(0)
 		return
 	}
 
-	deletedCount := 0
-	var totalSize int64
+	blobs := expired
+	if t.cleanupMaxDeletes > 0 && len(blobs) > t.cleanupMaxDeletes {
+		blobs = blobs[:t.cleanupMaxDeletes]
+	}
+	var deadline <-chan time.Time
+	if t.cleanupMaxDuration > 0 {
+		timer := time.NewTimer(t.cleanupMaxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	t.deleteBlobs(ctx, blobs, selected, deadline, deleteFunc)
 
+	// the blobs neither deleted nor accessed meanwhile
+	var backlog, size int64
 	for _, dgst := range expired {
-		if err := deleteFunc(dgst); err != nil {
-			t.logger.Errorf("failed to delete blob %s: %v", dgst, err)
-			continue
+		if meta, tracked := t.Blob(dgst); tracked && !meta.LastAccessed.After(selected) {
+			backlog++
+			size += meta.Size
 		}
+	}
+	t.cleanupBacklog.Store(backlog)
+	cleanupBacklogBlobs.Set(float64(backlog))
+	cleanupBacklogSize.Set(float64(size))
+	if backlog > 0 {
+		t.logger.Infof("%d evictable blobs (%d bytes) left for the next cleanup", backlog, size)
+	}
+}
 
-		// Get size before removing
-		t.mu.RLock()
-		if meta, exists := t.blobs[dgst.String()]; exists {
-			totalSize += meta.Size
-		}
-		t.mu.RUnlock()
+// deleteBlobs deletes blobs with deleteFunc and stops tracking them, using
+// the cleanup workers at the cleanup rate. Blobs accessed after selected are
+// kept. It logs its progress periodically, stops starting deletions once
+// deadline fires and stops early once ctx is done.
+func (t *LRUTracker) deleteBlobs(ctx context.Context, blobs []digest.Digest, selected time.Time, deadline <-chan time.Time, deleteFunc func(context.Context, digest.Digest) error) {
+	start := time.Now()
+	var deleted, failed, rescued, freed atomic.Int64
 
-		if err := t.RemoveBlob(dgst); err != nil {
-			t.logger.Errorf("failed to remove blob metadata %s: %v", dgst, err)
+	jobs := make(chan digest.Digest)
+	var wg sync.WaitGroup
+	for range min(t.cleanupWorkers, len(blobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dgst := range jobs {
+				meta, claimed := t.claim(dgst, selected)
+				if !claimed {
+					rescued.Add(1)
+					continue
+				}
+				if err := deleteFunc(ctx, dgst); err != nil {
+					if ctx.Err() == nil {
+						t.logger.Errorf("failed to delete blob %s: %v", dgst, err)
+					}
+					t.release(dgst)
+					failed.Add(1)
+					continue
+				}
+				if err := t.RemoveBlob(dgst); err != nil {
+					t.logger.Errorf("failed to remove blob metadata %s: %v", dgst, err)
+				}
+				deleted.Add(1)
+				freed.Add(meta.Size)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cleanupProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t.logger.Infof("cleanup in progress: deleted %d of %d blobs, %d failed, freed %d bytes",
+					deleted.Load(), len(blobs), failed.Load(), freed.Load())
+			}
 		}
+	}()
 
-		deletedCount++
+	var throttle <-chan time.Time
+	if t.cleanupRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(t.cleanupRate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	timedOut := false
+feed:
+	for i, dgst := range blobs {
+		if throttle != nil && i > 0 {
+			select {
+			case <-throttle:
+			case <-deadline:
+				timedOut = true
+				break feed
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		select {
+		case jobs <- dgst:
+		case <-deadline:
+			timedOut = true
+			break feed
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(jobs)
+	wg.Wait()
+	close(done)
 
-	t.logger.Infof("cleanup completed: deleted %d blobs, freed %d bytes", deletedCount, totalSize)
+	switch {
+	case ctx.Err() != nil:
+		t.logger.Warnf("cleanup interrupted after %v: deleted %d of %d blobs, freed %d bytes",
+			time.Since(start), deleted.Load(), len(blobs), freed.Load())
+	case timedOut:
+		t.logger.Infof("cleanup reached its maximum duration after %v: deleted %d of %d blobs, %d failed, freed %d bytes",
+			time.Since(start), deleted.Load(), len(blobs), failed.Load(), freed.Load())
+	default:
+		t.logger.Infof("cleanup completed in %v: deleted %d blobs, %d failed, %d accessed meanwhile, freed %d bytes",
+			time.Since(start), deleted.Load(), failed.Load(), rescued.Load(), freed.Load())
+	}
 }
 
-// StopCleanup stops the cleanup goroutine
+// StopCleanup stops the cleanup goroutine, and the reload goroutine of
+// StartReload. Further calls do nothing.
 func (t *LRUTracker) StopCleanup() {
-	close(t.stopCleanup)
-	t.wg.Wait()
+	t.stopOnce.Do(func() {
+		close(t.stopCleanup)
+		t.wg.Wait()
+
+		if t.locker != nil {
+			if err := t.locker.Unlock(context.Background()); err != nil {
+				t.logger.Warnf("failed to release cleanup lease: %v", err)
+			}
+		}
+	})
 }
 
-// loadMetadata loads metadata from disk
+// loadMetadata loads persisted metadata, keeping the most recent access
+// time and longest TTL of entries already in memory. Entries of stores
+// implementing MetaWalker are used as soon as they are read.
 func (t *LRUTracker) loadMetadata() error {
-	entries, err := os.ReadDir(t.metaDir)
+	start := time.Now()
+	var count atomic.Int64
+	if err := t.walkStore(func(meta *BlobMeta) {
+		t.merge(meta)
+		count.Add(1)
+	}); err != nil {
+		return err
+	}
+
+	t.logger.Infof("loaded %d blob metadata entries in %v", count.Load(), time.Since(start))
+	return nil
+}
+
+// walkStore calls fn with every persisted entry, possibly concurrently
+func (t *LRUTracker) walkStore(fn func(meta *BlobMeta)) error {
+	if walker, ok := t.store.(MetaWalker); ok {
+		return walker.Walk(context.Background(), fn)
+	}
+	metas, err := t.store.Load(context.Background())
 	if err != nil {
-		return fmt.Errorf("reading metadata directory: %w", err)
+		return err
+	}
+	for _, meta := range metas {
+		fn(meta)
 	}
+	return nil
+}
 
-	for _, entry := range entries {
-		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
-			continue
-		}
+// ReloadMetadata loads the persisted metadata again like on creation, and
+// drops the entries no longer persisted: the instance writing the store
+// deleted their data along with them. Entries recorded while reloading are
+// kept.
+func (t *LRUTracker) ReloadMetadata() error {
+	start := time.Now()
+	var mu sync.Mutex
+	persisted := make(map[string]bool)
+	if err := t.walkStore(func(meta *BlobMeta) {
+		t.merge(meta)
+		mu.Lock()
+		persisted[meta.Digest] = true
+		mu.Unlock()
+	}); err != nil {
+		return err
+	}
 
-		metaFile := filepath.Join(t.metaDir, entry.Name())
-		data, err := os.ReadFile(metaFile)
-		if err != nil {
-			t.logger.Warnf("failed to read metadata file %s: %v", metaFile, err)
-			continue
+	dropped := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for key, meta := range s.blobs {
+			if !persisted[key] && meta.LastAccessed.Before(start) {
+				t.totalSize.Add(-meta.Size)
+				delete(s.blobs, key)
+				dropped++
+			}
 		}
+		s.mu.Unlock()
+	}
+	t.logger.Debugf("reloaded %d blob metadata entries, dropped %d in %v", len(persisted), dropped, time.Since(start))
+	return nil
+}
+
+// StartReload reloads the persisted metadata every interval until ctx is
+// done or StopCleanup is called, for replicas sharing the store of the
+// instance writing it. See ReloadMetadata.
+func (t *LRUTracker) StartReload(ctx context.Context, interval time.Duration) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-		var meta BlobMeta
-		if err := json.Unmarshal(data, &meta); err != nil {
-			t.logger.Warnf("failed to unmarshal metadata file %s: %v", metaFile, err)
-			continue
+		select {
+		case <-t.loaded:
+		case <-t.stopCleanup:
+			return
+		case <-ctx.Done():
+			return
 		}
+		for {
+			select {
+			case <-t.stopCleanup:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := t.ReloadMetadata(); err != nil {
+					t.logger.Warnf("failed to reload metadata: %v", err)
+				}
+			}
+		}
+	}()
+}
 
-		t.blobs[meta.Digest] = &meta
+// merge adds a persisted entry, or updates the entry already in memory
+func (t *LRUTracker) merge(meta *BlobMeta) {
+	s := t.shard(meta.Digest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.blobs[meta.Digest]
+	if !exists {
+		s.blobs[meta.Digest] = meta
+		t.totalSize.Add(meta.Size)
+		return
+	}
+	if meta.LastAccessed.After(current.LastAccessed) {
+		current.LastAccessed = meta.LastAccessed
+	}
+	if meta.TTL > current.TTL {
+		current.TTL = meta.TTL
+	}
+	if meta.Pinned {
+		current.Pinned = true
 	}
+	if meta.Reads > current.Reads {
+		// reads recorded since the start, if any, may have been saved
+		// already, adding them would count them twice
+		current.Reads, current.ReadDays, current.ReadDay = meta.Reads, meta.ReadDays, meta.ReadDay
+	}
+	for _, name := range meta.Repositories {
+		if i, found := slices.BinarySearch(current.Repositories, name); !found {
+			current.Repositories = slices.Insert(slices.Clip(current.Repositories), i, name)
+		}
+	}
+}
 
-	t.logger.Infof("loaded %d blob metadata entries", len(t.blobs))
-	return nil
+// save persists the metadata of a blob asynchronously
+func (t *LRUTracker) save(key string) {
+	t.saves.Add(1)
+	go func() {
+		defer t.saves.Done()
+		if err := t.saveMetadata(key); err != nil {
+			t.logger.Errorf("failed to save metadata for %s: %v", key, err)
+		}
+	}()
 }
 
-// saveMetadata saves metadata for a specific blob to disk
-func (t *LRUTracker) saveMetadata(key string) {
-	t.mu.RLock()
-	meta, exists := t.blobs[key]
-	t.mu.RUnlock()
+// saveMetadata persists metadata for a specific blob
+func (t *LRUTracker) saveMetadata(key string) error {
+	s := t.shard(key)
+	s.mu.Lock()
+	meta, exists := s.blobs[key]
+	var snapshot BlobMeta
+	if exists {
+		snapshot = *meta
+		meta.dirty = false
+	}
+	s.mu.Unlock()
 
 	if !exists {
-		return
+		return nil
 	}
 
-	metaFile := t.getMetaFilePath(key)
-	data, err := json.Marshal(meta)
-	if err != nil {
-		t.logger.Errorf("failed to marshal metadata for %s: %v", key, err)
-		return
+	if err := t.store.Save(context.Background(), &snapshot); err != nil {
+		// saved again by the next change or flush
+		s.mu.Lock()
+		if meta, exists := s.blobs[key]; exists {
+			meta.dirty = true
+		}
+		s.mu.Unlock()
+		return err
 	}
+	return nil
+}
 
-	// Ensure directory exists
-	dir := filepath.Dir(metaFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		t.logger.Errorf("failed to create metadata directory for %s: %v", key, err)
-		return
+// Flush waits for the metadata writes in progress, then saves the entries
+// with changes not saved yet, such as accesses recorded in memory only. It
+// is called on shutdown so that the most recent accesses are not lost.
+func (t *LRUTracker) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.saves.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for metadata writes: %w", ctx.Err())
 	}
 
-	if err := os.WriteFile(metaFile, data, 0644); err != nil {
-		t.logger.Errorf("failed to write metadata file %s: %v", metaFile, err)
+	var keys []string
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for key, meta := range s.blobs {
+			if meta.dirty && !meta.evicting {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.RUnlock()
 	}
-}
 
-// getMetaFilePath returns the path to the metadata file for a digest
-func (t *LRUTracker) getMetaFilePath(key string) string {
-	// Create subdirectories based on first few characters to avoid too many files in one directory
-	if len(key) > 10 {
-		return filepath.Join(t.metaDir, key[:2], key[2:4], key+".json")
+	var failed int
+	var firstErr error
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("flushing metadata, %d entries not saved: %w", len(keys)-i, err)
+		}
+		if err := t.saveMetadata(key); err != nil {
+			if failed == 0 {
+				firstErr = fmt.Errorf("saving metadata for %s: %w", key, err)
+			}
+			failed++
+		}
 	}
-	return filepath.Join(t.metaDir, key+".json")
+	if failed > 0 {
+		return fmt.Errorf("flushing metadata, %d of %d entries not saved: %w", failed, len(keys), firstErr)
+	}
+	t.logger.Infof("flushed %d blob metadata entries", len(keys))
+	return nil
+}
+
+// Usage returns the total size of the tracked blobs and the maximum size,
+// zero if unlimited
+func (t *LRUTracker) Usage() (size, maxSize int64) {
+	return t.totalSize.Load(), t.maxSize
+}
+
+// CleanupBacklog returns the number of evictable blobs the last cleanup left
+// for the next one
+func (t *LRUTracker) CleanupBacklog() int64 {
+	return t.cleanupBacklog.Load()
 }
 
 // GetStats returns statistics about tracked blobs
 func (t *LRUTracker) GetStats() map[string]interface{} {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-
-	var totalSize int64
-	for _, meta := range t.blobs {
-		totalSize += meta.Size
+	totalBlobs := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		totalBlobs += len(s.blobs)
+		s.mu.RUnlock()
 	}
 
 	return map[string]interface{}{
-		"total_blobs": len(t.blobs),
-		"total_size":  totalSize,
+		"total_blobs": totalBlobs,
+		"total_size":  t.totalSize.Load(),
+		"loading":     !isClosed(t.loaded),
+		"max_size":    t.maxSize,
+		"backlog":     t.cleanupBacklog.Load(),
 		"ttl":         t.ttl.String(),
 	}
 }
+
+// isClosed reports whether ch is closed
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,684 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// setLastAccessed changes the last access time of a tracked blob
+func (t *LRUTracker) setLastAccessed(dgst digest.Digest, lastAccessed time.Time) {
+	s := t.shard(dgst.String())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[dgst.String()].LastAccessed = lastAccessed
+}
+
+func TestExtendTTL(t *testing.T) {
+	// metadata is persisted asynchronously, so the directory is removed
+	// without failing on files written after the test finished
+	metaDir, err := os.MkdirTemp("", "lru-tracker")
+	if err != nil {
+		t.Fatalf("unexpected error creating metadata directory: %v", err)
+	}
+	defer os.RemoveAll(metaDir)
+
+	tracker, err := NewLRUTracker(metaDir, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+
+	golden := digest.FromString("golden")
+	regular := digest.FromString("regular")
+	untracked := digest.FromString("untracked")
+
+	for _, dgst := range []digest.Digest{golden, regular} {
+		if err := tracker.RecordAccess(context.Background(), dgst, 1); err != nil {
+			t.Fatalf("unexpected error recording access: %v", err)
+		}
+	}
+
+	if !tracker.ExtendTTL(golden, 3*time.Hour) {
+		t.Fatal("expected tracked blob to accept TTL")
+	}
+	// a shorter TTL must not shrink an extended one
+	tracker.ExtendTTL(golden, 30*time.Minute)
+	if tracker.ExtendTTL(untracked, 3*time.Hour) {
+		t.Fatal("expected untracked blob to be ignored")
+	}
+
+	for _, dgst := range []digest.Digest{golden, regular} {
+		tracker.setLastAccessed(dgst, time.Now().Add(-2*time.Hour))
+	}
+
+	expired := tracker.GetExpiredBlobs(context.Background())
+	if len(expired) != 1 || expired[0] != regular {
+		t.Fatalf("unexpected expired blobs: %v != [%v]", expired, regular)
+	}
+}
+
+func TestAccessModes(t *testing.T) {
+	metaDir, err := os.MkdirTemp("", "lru-tracker")
+	if err != nil {
+		t.Fatalf("unexpected error creating metadata directory: %v", err)
+	}
+	defer os.RemoveAll(metaDir)
+
+	tracker, err := NewLRUTracker(metaDir, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+
+	dgst := digest.FromString("probed")
+	ctx := context.Background()
+
+	if err := tracker.RecordAccess(WithAccessMode(ctx, AccessSkip), dgst, 1); err != nil {
+		t.Fatalf("unexpected error recording access: %v", err)
+	}
+	if _, tracked := tracker.Blob(dgst); tracked {
+		t.Fatal("expected skipped access not to be tracked")
+	}
+
+	if err := tracker.RecordAccess(WithAccessMode(ctx, AccessMemory), dgst, 1); err != nil {
+		t.Fatalf("unexpected error recording access: %v", err)
+	}
+	if _, tracked := tracker.Blob(dgst); !tracked {
+		t.Fatal("expected in-memory access to be tracked")
+	}
+	// nothing is persisted asynchronously, so the file cannot show up later
+	if _, err := os.Stat(tracker.store.(*FileMetaStore).path(dgst.String())); !os.IsNotExist(err) {
+		t.Fatalf("expected no metadata file, got %v", err)
+	}
+
+	for _, s := range []string{"", "persist", "memory", "skip"} {
+		if _, err := ParseAccessMode(s); err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", s, err)
+		}
+	}
+	if _, err := ParseAccessMode("never"); err == nil {
+		t.Fatal("expected error parsing invalid access mode")
+	}
+}
+
+// countingMetaStore counts the entries saved
+type countingMetaStore struct {
+	MemoryMetaStore
+	saves *atomic.Int64
+}
+
+func (s countingMetaStore) Save(ctx context.Context, meta *BlobMeta) error {
+	s.saves.Add(1)
+	return nil
+}
+
+func TestRequestAccess(t *testing.T) {
+	saves := new(atomic.Int64)
+	tracker, err := NewLRUTrackerWithStore(countingMetaStore{saves: saves}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	dgst := digest.FromString("layer")
+	if err := tracker.RecordWrite(dgst, 100); err != nil {
+		t.Fatalf("unexpected error recording write: %v", err)
+	}
+	tracker.setLastAccessed(dgst, time.Now().Add(-time.Hour))
+	tracker.saves.Wait()
+	saves.Store(0)
+
+	// a request of several ranges opens the blob once per range
+	ctx := WithRequestAccess(context.Background(), true)
+	if !tracker.Touch(ctx, dgst) {
+		t.Fatal("expected tracked blob to be touched")
+	}
+	for range 3 {
+		if err := tracker.RecordRead(ctx, dgst, 100); err != nil {
+			t.Fatalf("unexpected error recording read: %v", err)
+		}
+	}
+	tracker.saves.Wait()
+	meta, _ := tracker.Blob(dgst)
+	if time.Since(meta.LastAccessed) > time.Minute {
+		t.Fatalf("last access not updated: %v", meta.LastAccessed)
+	}
+	if meta.Reads != 0 || saves.Load() != 1 {
+		t.Fatalf("expected one access and no read, got %d saves and %d reads", saves.Load(), meta.Reads)
+	}
+
+	// a full read counts once, even after the link was read
+	ctx = WithRequestAccess(context.Background(), false)
+	tracker.Touch(ctx, dgst)
+	for range 2 {
+		if err := tracker.RecordRead(ctx, dgst, 100); err != nil {
+			t.Fatalf("unexpected error recording read: %v", err)
+		}
+	}
+	if meta, _ := tracker.Blob(dgst); meta.Reads != 1 {
+		t.Fatalf("expected one read, got %d", meta.Reads)
+	}
+
+	// outside of a request every access counts
+	tracker.RecordRead(context.Background(), dgst, 100)
+	tracker.RecordRead(context.Background(), dgst, 100)
+	if meta, _ := tracker.Blob(dgst); meta.Reads != 3 {
+		t.Fatalf("expected three reads, got %d", meta.Reads)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	tracker.SetMaxSize(250)
+
+	oldest := digest.FromString("oldest")
+	older := digest.FromString("older")
+	recent := digest.FromString("recent")
+	for _, dgst := range []digest.Digest{oldest, older, recent} {
+		if err := tracker.RecordWrite(dgst, 100); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+	}
+
+	select {
+	case <-tracker.triggerCleanup:
+	default:
+		t.Fatal("expected exceeding the maximum size to trigger a cleanup")
+	}
+
+	tracker.setLastAccessed(oldest, time.Now().Add(-2*time.Minute))
+	tracker.setLastAccessed(older, time.Now().Add(-time.Minute))
+
+	overflow := tracker.GetOverflowBlobs(nil)
+	if len(overflow) != 1 || overflow[0] != oldest {
+		t.Fatalf("unexpected overflow blobs: %v != [%v]", overflow, oldest)
+	}
+	// blobs evicted for other reasons free space as well
+	if overflow := tracker.GetOverflowBlobs([]digest.Digest{recent}); len(overflow) != 0 {
+		t.Fatalf("unexpected overflow blobs: %v", overflow)
+	}
+
+	if err := tracker.RemoveBlob(oldest); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	if size := tracker.GetStats()["total_size"]; size != int64(200) {
+		t.Fatalf("unexpected total size: %v", size)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	tracker.SetMaxSize(150)
+	ctx := context.Background()
+
+	pinned := digest.FromString("pinned")
+	regular := digest.FromString("regular")
+	for _, dgst := range []digest.Digest{pinned, regular} {
+		if err := tracker.RecordWrite(dgst, 100); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		tracker.setLastAccessed(dgst, time.Now().Add(-2*time.Hour))
+	}
+	if !tracker.SetPinned(pinned, true) {
+		t.Fatal("expected tracked blob to be pinned")
+	}
+	if tracker.SetPinned(digest.FromString("untracked"), true) {
+		t.Fatal("expected untracked blob to be ignored")
+	}
+
+	if expired := tracker.GetExpiredBlobs(ctx); len(expired) != 1 || expired[0] != regular {
+		t.Fatalf("unexpected expired blobs: %v != [%v]", expired, regular)
+	}
+	// the pinned blob still takes up space
+	if overflow := tracker.GetOverflowBlobs(nil); len(overflow) != 1 || overflow[0] != regular {
+		t.Fatalf("unexpected overflow blobs: %v != [%v]", overflow, regular)
+	}
+	deleted, err := tracker.EvictBlob(ctx, pinned, time.Now(), func(context.Context, digest.Digest) error {
+		return nil
+	})
+	if err != nil || deleted {
+		t.Fatalf("expected the pinned blob not to be evicted: %v, %v", deleted, err)
+	}
+
+	tracker.SetPinned(pinned, false)
+	if expired := tracker.GetExpiredBlobs(ctx); len(expired) != 2 {
+		t.Fatalf("expected the unpinned blob to expire: %v", expired)
+	}
+}
+
+// blockingMetaStore returns its entries once released
+type blockingMetaStore struct {
+	MemoryMetaStore
+	release chan struct{}
+	metas   []*BlobMeta
+}
+
+func (s blockingMetaStore) Load(ctx context.Context) ([]*BlobMeta, error) {
+	<-s.release
+	return s.metas, nil
+}
+
+func TestBackgroundLoad(t *testing.T) {
+	old := digest.FromString("old")
+	shared := digest.FromString("shared")
+	lastAccessed := time.Now().Add(-2 * time.Hour)
+	store := blockingMetaStore{
+		release: make(chan struct{}),
+		metas: []*BlobMeta{
+			{Digest: old.String(), LastAccessed: lastAccessed, Size: 5},
+			{Digest: shared.String(), LastAccessed: lastAccessed, Size: 10},
+		},
+	}
+	tracker, err := NewLRUTrackerWithStore(store, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+
+	var deleted []digest.Digest
+	deleteFunc := func(ctx context.Context, dgst digest.Digest) error {
+		deleted = append(deleted, dgst)
+		return nil
+	}
+
+	// accesses are recorded while loading, cleanup waits for the load
+	if err := tracker.RecordAccess(WithAccessMode(context.Background(), AccessMemory), shared, 10); err != nil {
+		t.Fatalf("unexpected error recording access: %v", err)
+	}
+	tracker.runCleanup(context.Background(), deleteFunc)
+	if len(deleted) != 0 {
+		t.Fatalf("expected cleanup to be postponed while loading, deleted %v", deleted)
+	}
+	if loading := tracker.GetStats()["loading"]; loading != true {
+		t.Fatalf("expected tracker to be loading, got %v", loading)
+	}
+
+	close(store.release)
+	<-tracker.Loaded()
+	if meta, _ := tracker.Blob(shared); !meta.LastAccessed.After(lastAccessed) {
+		t.Fatalf("expected the access recorded while loading to be kept: %+v", meta)
+	}
+	if size := tracker.GetStats()["total_size"]; size != int64(15) {
+		t.Fatalf("unexpected total size: %v", size)
+	}
+
+	tracker.runCleanup(context.Background(), deleteFunc)
+	if len(deleted) != 1 || deleted[0] != old {
+		t.Fatalf("unexpected deleted blobs: %v != [%v]", deleted, old)
+	}
+}
+
+// newExpiredTracker returns a tracker with n expired blobs
+func newExpiredTracker(t *testing.T, n int) *LRUTracker {
+	t.Helper()
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+	for i := range n {
+		dgst := digest.FromString(fmt.Sprintf("blob-%d", i))
+		if err := tracker.RecordWrite(dgst, 1); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		tracker.setLastAccessed(dgst, time.Now().Add(-2*time.Hour))
+	}
+	return tracker
+}
+
+func TestCleanupWorkers(t *testing.T) {
+	tracker := newExpiredTracker(t, 100)
+	tracker.SetCleanupWorkers(4)
+
+	var running, maxRunning, deleted atomic.Int32
+	deleteFunc := func(ctx context.Context, dgst digest.Digest) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		deleted.Add(1)
+		return nil
+	}
+
+	tracker.runCleanup(context.Background(), deleteFunc)
+	if deleted.Load() != 100 {
+		t.Fatalf("unexpected number of deleted blobs: %d", deleted.Load())
+	}
+	if maxRunning.Load() > 4 {
+		t.Fatalf("more deletions than workers ran concurrently: %d", maxRunning.Load())
+	}
+	if stats := tracker.GetStats(); stats["total_blobs"] != 0 || stats["total_size"] != int64(0) {
+		t.Fatalf("deleted blobs are still tracked: %v", stats)
+	}
+}
+
+func TestCleanupRate(t *testing.T) {
+	tracker := newExpiredTracker(t, 10)
+	tracker.SetCleanupWorkers(4)
+	tracker.SetCleanupRate(100)
+
+	start := time.Now()
+	tracker.runCleanup(context.Background(), func(ctx context.Context, dgst digest.Digest) error {
+		return nil
+	})
+	// the first deletion starts right away, the others wait 10ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("cleanup exceeded its rate, took %v", elapsed)
+	}
+	if total := tracker.GetStats()["total_blobs"]; total != 0 {
+		t.Fatalf("unexpected number of tracked blobs: %v", total)
+	}
+}
+
+func TestCleanupCancel(t *testing.T) {
+	tracker := newExpiredTracker(t, 100)
+	tracker.SetCleanupWorkers(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var deleted atomic.Int32
+	tracker.runCleanup(ctx, func(ctx context.Context, dgst digest.Digest) error {
+		if deleted.Add(1) == 10 {
+			cancel()
+		}
+		return ctx.Err()
+	})
+
+	// blobs whose deletion failed stay tracked for the next cleanup
+	if total := tracker.GetStats()["total_blobs"].(int); total < 90 {
+		t.Fatalf("cleanup went on after cancellation, %d blobs left", total)
+	}
+}
+
+func TestStopCleanupTwice(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	tracker.StartCleanup(context.Background(), time.Hour, func(context.Context, digest.Digest) error {
+		return nil
+	})
+
+	// a server shut down twice stops the cleanup twice
+	tracker.StopCleanup()
+	tracker.StopCleanup()
+}
+
+func TestCleanupLimits(t *testing.T) {
+	tracker := newExpiredTracker(t, 25)
+	tracker.SetCleanupWorkers(2)
+	tracker.SetCleanupLimits(10, 0)
+
+	deleteFunc := func(ctx context.Context, dgst digest.Digest) error {
+		return nil
+	}
+
+	// the blobs beyond the limit roll over to the next cleanups
+	for _, backlog := range []int64{15, 5, 0} {
+		tracker.runCleanup(context.Background(), deleteFunc)
+		if got := tracker.GetStats()["backlog"]; got != backlog {
+			t.Fatalf("unexpected backlog: %v != %d", got, backlog)
+		}
+	}
+	if total := tracker.GetStats()["total_blobs"]; total != 0 {
+		t.Fatalf("unexpected number of tracked blobs: %v", total)
+	}
+
+	// deletions are not started once the maximum duration is reached
+	tracker = newExpiredTracker(t, 25)
+	tracker.SetCleanupLimits(0, 50*time.Millisecond)
+	tracker.runCleanup(context.Background(), func(ctx context.Context, dgst digest.Digest) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	backlog := tracker.GetStats()["backlog"].(int64)
+	if backlog == 0 || backlog >= 25 {
+		t.Fatalf("unexpected backlog after reaching the maximum duration: %d", backlog)
+	}
+	if total := tracker.GetStats()["total_blobs"]; total != int(backlog) {
+		t.Fatalf("backlog %d does not match the %v blobs left", backlog, total)
+	}
+}
+
+func TestCleanupClaim(t *testing.T) {
+	tracker := newExpiredTracker(t, 3)
+	ctx := context.Background()
+	blobs := tracker.GetExpiredBlobs(ctx)
+
+	var evicted digest.Digest
+	tracker.runCleanup(ctx, func(ctx context.Context, dgst digest.Digest) error {
+		if evicted != "" {
+			t.Errorf("blob %s deleted after being accessed", dgst)
+			return nil
+		}
+		evicted = dgst
+		// the claimed blob rejects accesses, the others are rescued
+		if err := tracker.RecordAccess(ctx, dgst, 1); !errors.Is(err, ErrBlobEvicting) {
+			t.Errorf("expected access to the evicted blob to be rejected, got %v", err)
+		}
+		if tracker.Touch(ctx, dgst) {
+			t.Error("expected the evicted blob not to be touched")
+		}
+		for _, other := range blobs {
+			if other != dgst {
+				if err := tracker.RecordAccess(ctx, other, 1); err != nil {
+					t.Errorf("unexpected error recording access: %v", err)
+				}
+			}
+		}
+		return nil
+	})
+
+	if _, tracked := tracker.Blob(evicted); tracked {
+		t.Fatal("evicted blob is still tracked")
+	}
+	stats := tracker.GetStats()
+	if stats["total_blobs"] != 2 || stats["backlog"] != int64(0) {
+		t.Fatalf("expected the accessed blobs to be kept out of the backlog: %v", stats)
+	}
+
+	// a blob whose deletion failed is released
+	tracker = newExpiredTracker(t, 1)
+	tracker.runCleanup(ctx, func(ctx context.Context, dgst digest.Digest) error {
+		evicted = dgst
+		return fmt.Errorf("storage unavailable")
+	})
+	if backlog := tracker.GetStats()["backlog"]; backlog != int64(1) {
+		t.Fatalf("unexpected backlog: %v", backlog)
+	}
+	if err := tracker.RecordAccess(ctx, evicted, 1); err != nil {
+		t.Fatalf("unexpected error accessing the released blob: %v", err)
+	}
+}
+
+// BenchmarkRecordAccess records accesses to many blobs from concurrent
+// goroutines, as done by concurrent layer requests.
+func BenchmarkRecordAccess(b *testing.B) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		b.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	dgsts := make([]digest.Digest, 4096)
+	for i := range dgsts {
+		dgsts[i] = digest.FromString(fmt.Sprint(i))
+	}
+	ctx := WithAccessMode(context.Background(), AccessMemory)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			dgst := dgsts[i%len(dgsts)]
+			if i%4 == 0 {
+				tracker.RecordAccess(ctx, dgst, 1)
+			} else {
+				tracker.Touch(ctx, dgst)
+			}
+		}
+	})
+}
+
+func TestNamespaceTTLs(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+	tracker.SetNamespaceTTLs(map[string]time.Duration{
+		"short": 10 * time.Minute,
+		"long":  3 * time.Hour,
+	})
+
+	blobs := map[string][]string{
+		"untracked": nil,
+		"short":     {"short/app"},
+		"long":      {"long/tools/build"},
+		"other":     {"library/alpine"},
+		"shared":    {"long/app", "short/app"},
+		"mixed":     {"library/alpine", "short/app"},
+	}
+	for name, repositories := range blobs {
+		dgst := digest.FromString(name)
+		if err := tracker.RecordWrite(dgst, 1); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		for _, repository := range repositories {
+			tracker.AddRepository(dgst, repository)
+		}
+		tracker.setLastAccessed(dgst, time.Now().Add(-30*time.Minute))
+	}
+
+	expired := tracker.GetExpiredBlobs(context.Background())
+	if want := []digest.Digest{digest.FromString("short")}; !slices.Equal(expired, want) {
+		t.Fatalf("expired blobs after 30 minutes = %v, want %v", expired, want)
+	}
+
+	for name := range blobs {
+		tracker.setLastAccessed(digest.FromString(name), time.Now().Add(-2*time.Hour))
+	}
+	expired = tracker.GetExpiredBlobs(context.Background())
+	slices.Sort(expired)
+	want := []digest.Digest{digest.FromString("untracked"), digest.FromString("short"), digest.FromString("other"), digest.FromString("mixed")}
+	slices.Sort(want)
+	if !slices.Equal(expired, want) {
+		t.Fatalf("expired blobs after 2 hours = %v, want %v", expired, want)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+
+	dgst := digest.FromString("layer")
+	if tracker.AddRepository(dgst, "alpine") {
+		t.Fatal("expected untracked blob not to be associated")
+	}
+	if err := tracker.RecordWrite(dgst, 1); err != nil {
+		t.Fatalf("unexpected error recording write: %v", err)
+	}
+	for _, name := range []string{"library/alpine", "alpine", "library/alpine"} {
+		if !tracker.AddRepository(dgst, name) {
+			t.Fatalf("expected blob to be tracked")
+		}
+	}
+	meta, _ := tracker.Blob(dgst)
+
+	// persisted associations are merged with the ones made since startup
+	tracker.merge(&BlobMeta{Digest: dgst.String(), Repositories: []string{"alpine", "busybox"}})
+
+	if want := []string{"alpine", "library/alpine"}; !slices.Equal(meta.Repositories, want) {
+		t.Errorf("repositories = %v, want %v", meta.Repositories, want)
+	}
+	merged, _ := tracker.Blob(dgst)
+	if want := []string{"alpine", "busybox", "library/alpine"}; !slices.Equal(merged.Repositories, want) {
+		t.Errorf("merged repositories = %v, want %v", merged.Repositories, want)
+	}
+}
+
+func TestRemoveRepository(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+
+	ctx := context.Background()
+	shared, exclusive, accessed := digest.FromString("shared"), digest.FromString("exclusive"), digest.FromString("accessed")
+	for _, dgst := range []digest.Digest{shared, exclusive, accessed} {
+		if err := tracker.RecordWrite(dgst, 1); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		tracker.AddRepository(dgst, "alpine")
+	}
+	tracker.AddRepository(shared, "busybox")
+
+	since := time.Now()
+	orphans := tracker.RemoveRepository("alpine")
+	want := []digest.Digest{accessed, exclusive}
+	slices.Sort(orphans)
+	slices.Sort(want)
+	if !slices.Equal(orphans, want) {
+		t.Fatalf("orphans = %v, want %v", orphans, want)
+	}
+	meta, _ := tracker.Blob(shared)
+	if want := []string{"busybox"}; !slices.Equal(meta.Repositories, want) {
+		t.Fatalf("repositories = %v, want %v", meta.Repositories, want)
+	}
+
+	// a blob accessed since is kept
+	tracker.setLastAccessed(accessed, since.Add(time.Second))
+	var deleted []digest.Digest
+	deleteFunc := func(ctx context.Context, dgst digest.Digest) error {
+		deleted = append(deleted, dgst)
+		return nil
+	}
+	for _, dgst := range orphans {
+		evicted, err := tracker.EvictBlob(ctx, dgst, since, deleteFunc)
+		if err != nil {
+			t.Fatalf("unexpected error evicting %s: %v", dgst, err)
+		}
+		if evicted != (dgst == exclusive) {
+			t.Errorf("EvictBlob(%s) = %v", dgst, evicted)
+		}
+	}
+	if !slices.Equal(deleted, []digest.Digest{exclusive}) {
+		t.Fatalf("deleted = %v", deleted)
+	}
+	if _, tracked := tracker.Blob(exclusive); tracked {
+		t.Fatal("evicted blob is still tracked")
+	}
+
+	// removing the last repository of a single blob leaves it orphaned
+	if tracker.RemoveBlobRepository(shared, "alpine") {
+		t.Fatal("expected a blob not linked into the repository not to be orphaned")
+	}
+	if !tracker.RemoveBlobRepository(shared, "busybox") {
+		t.Fatal("expected the blob to be orphaned")
+	}
+
+	// a blob whose deletion failed is released
+	evicted, err := tracker.EvictBlob(ctx, shared, time.Now(), func(context.Context, digest.Digest) error {
+		return fmt.Errorf("storage unavailable")
+	})
+	if evicted || err == nil {
+		t.Fatalf("expected the eviction to fail, got %v, %v", evicted, err)
+	}
+	if !tracker.Touch(ctx, shared) {
+		t.Fatal("expected the released blob to be tracked")
+	}
+}
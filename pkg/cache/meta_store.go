@@ -0,0 +1,470 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// MetaStore persists the tracked blob metadata.
+type MetaStore interface {
+	// Load returns every persisted entry.
+	Load(ctx context.Context) ([]*BlobMeta, error)
+
+	// Save persists an entry, replacing any previous one.
+	Save(ctx context.Context, meta *BlobMeta) error
+
+	// Delete removes the entry of the blob with the given digest.
+	Delete(ctx context.Context, key string) error
+
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+// MetaWalker is implemented by stores able to pass their entries on as they
+// are read, so that the tracker uses them while the rest is still loading.
+type MetaWalker interface {
+	// Walk calls fn with every persisted entry, possibly concurrently.
+	Walk(ctx context.Context, fn func(meta *BlobMeta)) error
+}
+
+// fileLoadWorkers is the number of metadata files read in parallel, which
+// mostly wait for the filesystem
+const fileLoadWorkers = 16
+
+// FileModes are the permissions of the directories and files created on
+// the local file system, before the umask
+type FileModes struct {
+	Dir  os.FileMode
+	File os.FileMode
+}
+
+// DefaultFileModes are the permissions used unless configured otherwise
+var DefaultFileModes = FileModes{Dir: 0755, File: 0644}
+
+// FileMetaStore stores one JSON file per blob below a directory. Files are
+// written to a temporary file first and renamed, so that a crash never
+// leaves a partially written file.
+type FileMetaStore struct {
+	dir    string
+	logger *logrus.Logger
+	fsync  bool
+	modes  FileModes
+	locks  *FileLocks
+}
+
+// NewFileMetaStore creates a store in dir, creating the directory if needed.
+func NewFileMetaStore(dir string, logger *logrus.Logger) (*FileMetaStore, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	if err := os.MkdirAll(dir, DefaultFileModes.Dir); err != nil {
+		return nil, fmt.Errorf("creating metadata directory: %w", err)
+	}
+	return &FileMetaStore{
+		dir:    dir,
+		logger: logger,
+		modes:  DefaultFileModes,
+	}, nil
+}
+
+// SetModes sets the permissions of the metadata directories and files
+// created from now on.
+func (s *FileMetaStore) SetModes(modes FileModes) {
+	s.modes = modes
+}
+
+// SetFsync makes Save flush every file and its directory to disk before
+// returning, so that saved metadata survives a power loss at the cost of
+// slower writes.
+func (s *FileMetaStore) SetFsync(fsync bool) {
+	s.fsync = fsync
+}
+
+// SetLocks makes Save and Delete take the lock of the digest, for instances
+// sharing the directory, e.g. on NFS.
+func (s *FileMetaStore) SetLocks(locks *FileLocks) {
+	s.locks = locks
+}
+
+// lock takes the lock of key if locks are set
+func (s *FileMetaStore) lock(key string) (func(), error) {
+	if s.locks == nil {
+		return func() {}, nil
+	}
+	return s.locks.Lock(key)
+}
+
+// Load implements MetaStore
+func (s *FileMetaStore) Load(ctx context.Context) ([]*BlobMeta, error) {
+	var mu sync.Mutex
+	var metas []*BlobMeta
+	err := s.Walk(ctx, func(meta *BlobMeta) {
+		mu.Lock()
+		defer mu.Unlock()
+		metas = append(metas, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// Walk implements MetaWalker, reading the files in parallel
+func (s *FileMetaStore) Walk(ctx context.Context, fn func(meta *BlobMeta)) error {
+	metaFiles := make(chan string, fileLoadWorkers)
+	var wg sync.WaitGroup
+	for range fileLoadWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for metaFile := range metaFiles {
+				if meta := s.read(metaFile); meta != nil {
+					fn(meta)
+				}
+			}
+		}()
+	}
+
+	err := filepath.WalkDir(s.dir, func(metaFile string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".json":
+		case ".tmp":
+			// left by a crash while saving
+			if err := os.Remove(metaFile); err != nil {
+				s.logger.Warnf("failed to remove temporary metadata file %s: %v", metaFile, err)
+			}
+			return nil
+		default:
+			return nil
+		}
+		select {
+		case metaFiles <- metaFile:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(metaFiles)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("reading metadata directory: %w", err)
+	}
+	return nil
+}
+
+// read reads a metadata file, returning nil for unreadable files
+func (s *FileMetaStore) read(metaFile string) *BlobMeta {
+	data, err := os.ReadFile(metaFile)
+	if err != nil {
+		s.logger.Warnf("failed to read metadata file %s: %v", metaFile, err)
+		return nil
+	}
+
+	var meta BlobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		// saved again by the next access to the blob
+		s.logger.Warnf("removing corrupt metadata file %s: %v", metaFile, err)
+		if err := os.Remove(metaFile); err != nil {
+			s.logger.Warnf("failed to remove metadata file %s: %v", metaFile, err)
+		}
+		return nil
+	}
+	return &meta
+}
+
+// Save implements MetaStore
+func (s *FileMetaStore) Save(ctx context.Context, meta *BlobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %w", err)
+	}
+
+	unlock, err := s.lock(meta.Digest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metaFile := s.path(meta.Digest)
+	dir := filepath.Dir(metaFile)
+	if err := os.MkdirAll(dir, s.modes.Dir); err != nil {
+		return fmt.Errorf("creating metadata directory: %w", err)
+	}
+	if err := s.writeFile(metaFile, data); err != nil {
+		return fmt.Errorf("writing metadata file %s: %w", metaFile, err)
+	}
+	if s.fsync {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("syncing metadata directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeFile replaces metaFile with data by renaming a temporary file
+func (s *FileMetaStore) writeFile(metaFile string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(metaFile), filepath.Base(metaFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil && s.fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// CreateTemp creates the file 0600
+		err = os.Chmod(tmp, s.modes.File)
+	}
+	if err == nil {
+		err = os.Rename(tmp, metaFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// syncDir flushes the entries of a directory, such as a renamed file, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Delete implements MetaStore
+func (s *FileMetaStore) Delete(ctx context.Context, key string) error {
+	unlock, err := s.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing metadata file: %w", err)
+	}
+	return nil
+}
+
+// Ping implements MetaStore
+func (s *FileMetaStore) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return fmt.Errorf("checking metadata directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("metadata path %s is not a directory", s.dir)
+	}
+	return nil
+}
+
+// path returns the path to the metadata file for a digest
+func (s *FileMetaStore) path(key string) string {
+	// Create subdirectories based on first few characters to avoid too many files in one directory
+	if len(key) > 10 {
+		return filepath.Join(s.dir, key[:2], key[2:4], key+".json")
+	}
+	return filepath.Join(s.dir, key+".json")
+}
+
+// MemoryMetaStore persists nothing, the metadata only lives in the tracker.
+// It suits ephemeral caches whose content does not outlive the process.
+type MemoryMetaStore struct{}
+
+// Load implements MetaStore
+func (MemoryMetaStore) Load(ctx context.Context) ([]*BlobMeta, error) {
+	return nil, nil
+}
+
+// Save implements MetaStore
+func (MemoryMetaStore) Save(ctx context.Context, meta *BlobMeta) error {
+	return nil
+}
+
+// Delete implements MetaStore
+func (MemoryMetaStore) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+// Ping implements MetaStore
+func (MemoryMetaStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// RedisMetaStore stores one JSON value per blob in Redis, so that instances
+// without local state share the metadata.
+type RedisMetaStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisMetaStore creates a store keeping its entries under prefix.
+func NewRedisMetaStore(client redis.UniversalClient, prefix string) *RedisMetaStore {
+	return &RedisMetaStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Load implements MetaStore
+func (s *RedisMetaStore) Load(ctx context.Context) ([]*BlobMeta, error) {
+	var metas []*BlobMeta
+	if err := s.Walk(ctx, func(meta *BlobMeta) {
+		metas = append(metas, meta)
+	}); err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// Walk implements MetaWalker, reading the entries of every scanned page in a
+// single pipeline
+func (s *RedisMetaStore) Walk(ctx context.Context, fn func(meta *BlobMeta)) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, s.prefix+"*", 1000).Result()
+		if err != nil {
+			return fmt.Errorf("scanning metadata: %w", err)
+		}
+		if len(keys) > 0 {
+			pipe := s.client.Pipeline()
+			gets := make([]*redis.StringCmd, len(keys))
+			for i, key := range keys {
+				gets[i] = pipe.Get(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				return fmt.Errorf("reading metadata: %w", err)
+			}
+			for _, get := range gets {
+				data, err := get.Bytes()
+				if err != nil {
+					// removed since the scan
+					continue
+				}
+				var meta BlobMeta
+				if err := json.Unmarshal(data, &meta); err != nil {
+					continue
+				}
+				fn(&meta)
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Save implements MetaStore
+func (s *RedisMetaStore) Save(ctx context.Context, meta *BlobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %w", err)
+	}
+	if err := s.client.Set(ctx, s.prefix+meta.Digest, data, 0).Err(); err != nil {
+		return fmt.Errorf("writing metadata %s: %w", meta.Digest, err)
+	}
+	return nil
+}
+
+// Delete implements MetaStore
+func (s *RedisMetaStore) Delete(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, s.prefix+key).Err(); err != nil {
+		return fmt.Errorf("removing metadata %s: %w", key, err)
+	}
+	return nil
+}
+
+// Ping implements MetaStore
+func (s *RedisMetaStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// ExportMeta writes every entry of store to w as JSON lines sorted by
+// digest, the format read by ImportMeta, and returns the number of entries.
+func ExportMeta(ctx context.Context, store MetaStore, w io.Writer) (int, error) {
+	metas, err := store.Load(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("loading metadata: %w", err)
+	}
+	slices.SortFunc(metas, func(a, b *BlobMeta) int { return strings.Compare(a.Digest, b.Digest) })
+	enc := json.NewEncoder(w)
+	for i, meta := range metas {
+		if err := enc.Encode(meta); err != nil {
+			return i, err
+		}
+	}
+	return len(metas), nil
+}
+
+// ImportMeta saves the entries written by ExportMeta to store, replacing
+// those of the same blobs, and returns the number of entries saved.
+func ImportMeta(ctx context.Context, store MetaStore, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	for n := 0; ; n++ {
+		var meta BlobMeta
+		if err := dec.Decode(&meta); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("entry %d: %w", n+1, err)
+		}
+		if _, err := digest.Parse(meta.Digest); err != nil {
+			return n, fmt.Errorf("entry %d: %w", n+1, err)
+		}
+		if err := store.Save(ctx, &meta); err != nil {
+			return n, err
+		}
+	}
+}
+
+// ReadOnlyMetaStore loads the entries of a store and never modifies it, for
+// replicas sharing the metadata of a primary instance. The accesses of the
+// replica are only kept in memory.
+type ReadOnlyMetaStore struct {
+	MetaStore
+}
+
+// Save implements MetaStore
+func (ReadOnlyMetaStore) Save(ctx context.Context, meta *BlobMeta) error {
+	return nil
+}
+
+// Delete implements MetaStore
+func (ReadOnlyMetaStore) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+// Walk implements MetaWalker
+func (s ReadOnlyMetaStore) Walk(ctx context.Context, fn func(meta *BlobMeta)) error {
+	if walker, ok := s.MetaStore.(MetaWalker); ok {
+		return walker.Walk(ctx, fn)
+	}
+	metas, err := s.MetaStore.Load(ctx)
+	for _, meta := range metas {
+		fn(meta)
+	}
+	return err
+}
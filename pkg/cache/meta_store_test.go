@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFileMetaStoreReload(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+
+	dgst := digest.FromString("persisted")
+	lastAccessed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := store.Save(ctx, &BlobMeta{
+		Digest:       dgst.String(),
+		LastAccessed: lastAccessed,
+		Size:         42,
+		TTL:          3 * time.Hour,
+	}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+
+	tracker, err := NewLRUTrackerWithStore(store, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+	meta, exists := tracker.Blob(dgst)
+	if !exists {
+		t.Fatal("expected persisted metadata to be loaded")
+	}
+	if !meta.LastAccessed.Equal(lastAccessed) || meta.Size != 42 || meta.TTL != 3*time.Hour {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	if err := tracker.RemoveBlob(dgst); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	metas, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading metadata: %v", err)
+	}
+	if len(metas) != 0 {
+		t.Fatalf("unexpected metadata after removal: %v", metas)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	tracker, err := NewLRUTrackerWithStore(store, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+
+	persisted := digest.FromString("persisted")
+	inMemory := digest.FromString("in memory")
+	if err := tracker.RecordWrite(persisted, 1); err != nil {
+		t.Fatalf("unexpected error recording write: %v", err)
+	}
+	if err := tracker.RecordAccess(WithAccessMode(ctx, AccessMemory), inMemory, 2); err != nil {
+		t.Fatalf("unexpected error recording access: %v", err)
+	}
+
+	if err := tracker.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing metadata: %v", err)
+	}
+	metas, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading metadata: %v", err)
+	}
+	if len(metas) != 2 {
+		t.Fatalf("expected both entries to be saved, got %d", len(metas))
+	}
+
+	// nothing is left to save
+	if meta, _ := tracker.Blob(inMemory); meta.dirty {
+		t.Fatal("expected flushed entry not to be dirty")
+	}
+}
+
+func TestFileMetaStoreAtomicSave(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileMetaStore(dir, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	store.SetFsync(true)
+
+	saved := digest.FromString("saved")
+	if err := store.Save(ctx, &BlobMeta{Digest: saved.String(), Size: 1}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+	// files left by a crash: a partial temporary file and a corrupt file
+	// written in place by an older version
+	metaFile := store.path(saved.String())
+	if err := os.WriteFile(metaFile+".123.tmp", []byte(`{"dig`), 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+	corrupt := store.path(digest.FromString("corrupt").String())
+	if err := os.MkdirAll(filepath.Dir(corrupt), 0755); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	if err := os.WriteFile(corrupt, []byte(`{"digest":"sha`), 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+
+	metas, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading metadata: %v", err)
+	}
+	if len(metas) != 1 || metas[0].Digest != saved.String() {
+		t.Fatalf("unexpected metadata: %v", metas)
+	}
+	for _, path := range []string{metaFile + ".123.tmp", corrupt} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(metaFile), "*.tmp"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("unexpected temporary files: %v, %v", matches, err)
+	}
+}
+
+func TestFileMetaStoreModes(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	store.SetModes(FileModes{Dir: 0750, File: 0640})
+
+	dgst := digest.FromString("modes")
+	if err := store.Save(ctx, &BlobMeta{Digest: dgst.String(), Size: 1}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+	metaFile := store.path(dgst.String())
+	for path, want := range map[string]os.FileMode{filepath.Dir(metaFile): 0750, metaFile: 0640} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// the umask may only clear bits
+		if got := fi.Mode().Perm(); got&^want != 0 {
+			t.Errorf("%s: got mode %v, want at most %v", path, got, want)
+		}
+	}
+}
+
+func TestExportImportMeta(t *testing.T) {
+	ctx := context.Background()
+	source, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	now := time.Now().Truncate(time.Second).UTC()
+	metas := []*BlobMeta{
+		{Digest: digest.FromString("a").String(), LastAccessed: now, Size: 1, CreatedAt: now.Add(-time.Hour), Repositories: []string{"library/alpine"}},
+		{Digest: digest.FromString("b").String(), LastAccessed: now, Size: 2, TTL: time.Hour, Reads: 5, ReadDays: []int64{2, 3}, ReadDay: 20000, Pinned: true},
+	}
+	for _, meta := range metas {
+		if err := source.Save(ctx, meta); err != nil {
+			t.Fatalf("unexpected error saving metadata: %v", err)
+		}
+	}
+
+	var exported bytes.Buffer
+	if n, err := ExportMeta(ctx, source, &exported); err != nil || n != 2 {
+		t.Fatalf("exported %d entries: %v", n, err)
+	}
+	if lines := strings.Count(exported.String(), "\n"); lines != 2 {
+		t.Fatalf("expected one line per entry, got %q", exported.String())
+	}
+
+	target, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	if n, err := ImportMeta(ctx, target, &exported); err != nil || n != 2 {
+		t.Fatalf("imported %d entries: %v", n, err)
+	}
+	imported, err := target.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading metadata: %v", err)
+	}
+	byDigest := func(a, b *BlobMeta) int { return strings.Compare(a.Digest, b.Digest) }
+	slices.SortFunc(imported, byDigest)
+	slices.SortFunc(metas, byDigest)
+	if !reflect.DeepEqual(imported, metas) {
+		t.Fatalf("imported %+v, want %+v", imported, metas)
+	}
+
+	if _, err := ImportMeta(ctx, target, strings.NewReader(`{"digest":"invalid"}`)); err == nil {
+		t.Fatal("expected an error importing an invalid digest")
+	}
+}
+
+func TestReadOnlyMetaStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	shared := digest.FromString("shared")
+	lastAccessed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := store.Save(ctx, &BlobMeta{Digest: shared.String(), LastAccessed: lastAccessed, Size: 1}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+
+	tracker, err := NewLRUTrackerWithStore(ReadOnlyMetaStore{MetaStore: store}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+	if _, exists := tracker.Blob(shared); !exists {
+		t.Fatal("expected the shared metadata to be loaded")
+	}
+	if err := tracker.RecordAccess(ctx, shared, 1); err != nil {
+		t.Fatalf("unexpected error recording access: %v", err)
+	}
+	if err := tracker.RecordWrite(digest.FromString("local"), 2); err != nil {
+		t.Fatalf("unexpected error recording write: %v", err)
+	}
+	if err := tracker.RemoveBlob(shared); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	if err := tracker.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing metadata: %v", err)
+	}
+
+	metas, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading metadata: %v", err)
+	}
+	if len(metas) != 1 || metas[0].Digest != shared.String() || !metas[0].LastAccessed.Equal(lastAccessed) {
+		t.Fatalf("the shared metadata was modified: %+v", metas)
+	}
+}
+
+func TestReloadMetadata(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMetaStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	evicted := digest.FromString("evicted")
+	kept := digest.FromString("kept")
+	written := digest.FromString("written")
+	lastAccessed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, dgst := range []digest.Digest{evicted, kept} {
+		if err := store.Save(ctx, &BlobMeta{Digest: dgst.String(), LastAccessed: lastAccessed, Size: 1}); err != nil {
+			t.Fatalf("unexpected error saving metadata: %v", err)
+		}
+	}
+
+	tracker, err := NewLRUTrackerWithStore(ReadOnlyMetaStore{MetaStore: store}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+
+	// the primary evicts a blob, writes another and reads the last one
+	if err := store.Delete(ctx, evicted.String()); err != nil {
+		t.Fatalf("unexpected error deleting metadata: %v", err)
+	}
+	if err := store.Save(ctx, &BlobMeta{Digest: written.String(), LastAccessed: lastAccessed, Size: 2}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+	accessed := lastAccessed.Add(time.Minute)
+	if err := store.Save(ctx, &BlobMeta{Digest: kept.String(), LastAccessed: accessed, Size: 1}); err != nil {
+		t.Fatalf("unexpected error saving metadata: %v", err)
+	}
+
+	if err := tracker.ReloadMetadata(); err != nil {
+		t.Fatalf("unexpected error reloading metadata: %v", err)
+	}
+	if _, exists := tracker.Blob(evicted); exists {
+		t.Fatal("expected the evicted blob to be dropped")
+	}
+	if _, exists := tracker.Blob(written); !exists {
+		t.Fatal("expected the written blob to be loaded")
+	}
+	if meta, _ := tracker.Blob(kept); !meta.LastAccessed.Equal(accessed) {
+		t.Fatalf("unexpected last access of the kept blob: %v != %v", meta.LastAccessed, accessed)
+	}
+	if size, _ := tracker.Usage(); size != 3 {
+		t.Fatalf("unexpected size: %d", size)
+	}
+}
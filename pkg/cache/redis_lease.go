@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// RedisLease is a Locker backed by a Redis key which expires after the lease
+// duration.
+type RedisLease struct {
+	client   redis.UniversalClient
+	key      string
+	owner    string
+	duration time.Duration
+}
+
+// NewRedisLease creates a lease stored under key. An empty owner selects
+// DefaultLeaseOwner.
+func NewRedisLease(client redis.UniversalClient, key, owner string, duration time.Duration) (*RedisLease, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("lease duration must be positive")
+	}
+	if key == "" {
+		return nil, fmt.Errorf("lease key cannot be empty")
+	}
+	if owner == "" {
+		owner = DefaultLeaseOwner()
+	}
+	return &RedisLease{
+		client:   client,
+		key:      key,
+		owner:    owner,
+		duration: duration,
+	}, nil
+}
+
+// TryLock implements Locker
+func (l *RedisLease) TryLock(ctx context.Context) (bool, error) {
+	acquired, err := l.client.SetNX(ctx, l.key, l.owner, l.duration).Result()
+	if err != nil {
+		return false, fmt.Errorf("acquiring lease: %w", err)
+	}
+	if acquired {
+		return true, nil
+	}
+
+	renewed, err := renewLeaseScript.Run(ctx, l.client, []string{l.key}, l.owner, l.duration.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("renewing lease: %w", err)
+	}
+	return renewed == 1, nil
+}
+
+// Unlock implements Locker
+func (l *RedisLease) Unlock(ctx context.Context) error {
+	if err := releaseLeaseScript.Run(ctx, l.client, []string{l.key}, l.owner).Err(); err != nil {
+		return fmt.Errorf("releasing lease: %w", err)
+	}
+	return nil
+}
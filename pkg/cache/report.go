@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// readDays is the number of days the reads of blobs are kept per day, the
+// longest window of the popularity report
+const readDays = 30
+
+// day is the length of the days reads are counted per
+const day = 24 * time.Hour
+
+// unixDay returns the day of t since the Unix epoch in UTC
+func unixDay(t time.Time) int64 {
+	return t.Unix() / int64(day/time.Second)
+}
+
+// countRead counts a read of the blob at now
+func (m *BlobMeta) countRead(now time.Time) {
+	today := unixDay(now)
+	if len(m.ReadDays) == 0 {
+		m.ReadDay = today
+	}
+	// reads while the clock went back count for the last day
+	shift := max(today-m.ReadDay, 0)
+	// a new slice, snapshots being saved share the current one
+	var days []int64
+	if shift < readDays {
+		days = make([]int64, max(min(int64(len(m.ReadDays))+shift, readDays), 1))
+		copy(days[shift:], m.ReadDays)
+	} else {
+		days = make([]int64, 1)
+	}
+	days[0]++
+	m.ReadDays, m.ReadDay = days, m.ReadDay+shift
+	m.Reads++
+}
+
+// readsSince returns the reads of the blob from the day since on
+func (m *BlobMeta) readsSince(since int64) int64 {
+	var reads int64
+	for i, n := range m.ReadDays {
+		if m.ReadDay-int64(i) < since {
+			break
+		}
+		reads += n
+	}
+	return reads
+}
+
+// BlobReads are the reads of a blob in the window of a popularity report
+type BlobReads struct {
+	Digest       string    `json:"digest"`
+	Size         int64     `json:"size"`
+	Reads        int64     `json:"reads"`       // in the window
+	TotalReads   int64     `json:"total_reads"` // since the blob was written
+	CreatedAt    time.Time `json:"created_at"`
+	LastAccessed time.Time `json:"last_accessed"`
+	Repositories []string  `json:"repositories,omitempty"`
+}
+
+// RepositoryReads are the reads of the blobs of a repository in the window
+// of a popularity report. A blob shared by several repositories counts for
+// each of them, as reads of the blob data are not told apart by repository.
+type RepositoryReads struct {
+	Name  string `json:"name"`
+	Reads int64  `json:"reads"`
+	Blobs int    `json:"blobs"`
+	Size  int64  `json:"size"`
+}
+
+// ColdData counts blobs written before the window of a popularity report
+// and not read since
+type ColdData struct {
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// PopularityReport ranks the tracked blobs and repositories by their reads
+// over a window, to tune the TTL and maximum size of the cache
+type PopularityReport struct {
+	Window string `json:"window"`
+	Blobs  int    `json:"blobs"`
+	Size   int64  `json:"size"`
+
+	MostRead              []BlobReads       `json:"most_read"`
+	LeastRead             []BlobReads       `json:"least_read"` // written before the window
+	MostReadRepositories  []RepositoryReads `json:"most_read_repositories"`
+	LeastReadRepositories []RepositoryReads `json:"least_read_repositories"`
+
+	// NeverRead are the blobs not read since they were written,
+	// NotReadInWindow those not read in the window, both written before it
+	NeverRead       ColdData `json:"never_read"`
+	NotReadInWindow ColdData `json:"not_read_in_window"`
+}
+
+// PopularityReport reports the top most and least read blobs and
+// repositories over window, rounded up to whole days and at most readDays
+// days. Reads are counted by RecordRead, in the days of UTC.
+func (t *LRUTracker) PopularityReport(window time.Duration, top int) (PopularityReport, error) {
+	days := int64((window + day - 1) / day)
+	if window <= 0 || days > readDays {
+		return PopularityReport{}, fmt.Errorf("window must be positive and at most %d days", readDays)
+	}
+	now := time.Now()
+	since := unixDay(now) - days + 1
+	writtenBefore := now.Add(-window)
+
+	report := PopularityReport{Window: window.String()}
+	blobs, cold := []BlobReads{}, []BlobReads{}
+	repositories := make(map[string]*RepositoryReads)
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for _, meta := range s.blobs {
+			if meta.evicting {
+				continue
+			}
+			reads := BlobReads{
+				Digest:       meta.Digest,
+				Size:         meta.Size,
+				Reads:        meta.readsSince(since),
+				TotalReads:   meta.Reads,
+				CreatedAt:    meta.CreatedAt,
+				LastAccessed: meta.LastAccessed,
+				// never modified in place
+				Repositories: meta.Repositories,
+			}
+			blobs = append(blobs, reads)
+			report.Blobs++
+			report.Size += meta.Size
+			if meta.CreatedAt.Before(writtenBefore) {
+				cold = append(cold, reads)
+				if reads.Reads == 0 {
+					report.NotReadInWindow.Blobs++
+					report.NotReadInWindow.Bytes += meta.Size
+				}
+				if reads.TotalReads == 0 {
+					report.NeverRead.Blobs++
+					report.NeverRead.Bytes += meta.Size
+				}
+			}
+			for _, name := range meta.Repositories {
+				repository, ok := repositories[name]
+				if !ok {
+					repository = &RepositoryReads{Name: name}
+					repositories[name] = repository
+				}
+				repository.Reads += reads.Reads
+				repository.Blobs++
+				repository.Size += meta.Size
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	// most read first, the larger first among equals
+	slices.SortFunc(blobs, func(a, b BlobReads) int {
+		return cmp.Or(cmp.Compare(b.Reads, a.Reads), cmp.Compare(b.Size, a.Size), cmp.Compare(a.Digest, b.Digest))
+	})
+	report.MostRead = blobs[:min(top, len(blobs))]
+	// least read first, the least recently accessed first among equals
+	slices.SortFunc(cold, func(a, b BlobReads) int {
+		return cmp.Or(cmp.Compare(a.Reads, b.Reads), a.LastAccessed.Compare(b.LastAccessed), cmp.Compare(a.Digest, b.Digest))
+	})
+	report.LeastRead = cold[:min(top, len(cold))]
+
+	ranked := make([]RepositoryReads, 0, len(repositories))
+	for _, repository := range repositories {
+		ranked = append(ranked, *repository)
+	}
+	slices.SortFunc(ranked, func(a, b RepositoryReads) int {
+		return cmp.Or(cmp.Compare(b.Reads, a.Reads), cmp.Compare(b.Size, a.Size), cmp.Compare(a.Name, b.Name))
+	})
+	report.MostReadRepositories = ranked[:min(top, len(ranked))]
+	report.LeastReadRepositories = make([]RepositoryReads, 0, min(top, len(ranked)))
+	for i := len(ranked) - 1; i >= 0 && len(report.LeastReadRepositories) < top; i-- {
+		report.LeastReadRepositories = append(report.LeastReadRepositories, ranked[i])
+	}
+	return report, nil
+}
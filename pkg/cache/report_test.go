@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCountRead(t *testing.T) {
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	var meta BlobMeta
+	meta.countRead(start)
+	meta.countRead(start.Add(time.Hour))
+	meta.countRead(start.Add(2 * day))
+	// the clock going back counts for the last day
+	meta.countRead(start.Add(day))
+
+	if want := []int64{2, 0, 2}; !slices.Equal(meta.ReadDays, want) || meta.ReadDay != unixDay(start)+2 {
+		t.Fatalf("read days = %v from %d, want %v from %d", meta.ReadDays, meta.ReadDay, want, unixDay(start)+2)
+	}
+	if meta.Reads != 4 {
+		t.Fatalf("reads = %d, want 4", meta.Reads)
+	}
+	if reads := meta.readsSince(unixDay(start) + 1); reads != 2 {
+		t.Fatalf("reads since the next day = %d, want 2", reads)
+	}
+
+	// days beyond readDays are dropped
+	meta.countRead(start.Add((readDays + 2) * day))
+	if want := []int64{1}; !slices.Equal(meta.ReadDays, want) || meta.Reads != 5 {
+		t.Fatalf("read days = %v with %d reads, want %v with 5", meta.ReadDays, meta.Reads, want)
+	}
+}
+
+func TestPopularityReport(t *testing.T) {
+	tracker, err := NewLRUTrackerWithStore(MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+
+	hot := digest.FromString("hot")
+	warm := digest.FromString("warm")
+	cold := digest.FromString("cold")
+	fresh := digest.FromString("fresh")
+	for _, dgst := range []digest.Digest{hot, warm, cold, fresh} {
+		if err := tracker.RecordWrite(dgst, 10); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		tracker.AddRepository(dgst, "library/"+dgst.Encoded()[:4])
+	}
+	tracker.AddRepository(hot, "team/app")
+	for range 3 {
+		if err := tracker.RecordRead(context.Background(), hot, 10); err != nil {
+			t.Fatalf("unexpected error recording read: %v", err)
+		}
+	}
+	if err := tracker.RecordRead(context.Background(), warm, 10); err != nil {
+		t.Fatalf("unexpected error recording read: %v", err)
+	}
+	for _, dgst := range []digest.Digest{hot, warm, cold} {
+		s := tracker.shard(dgst.String())
+		s.mu.Lock()
+		s.blobs[dgst.String()].CreatedAt = time.Now().Add(-2 * day)
+		s.mu.Unlock()
+	}
+
+	if _, err := tracker.PopularityReport((readDays+1)*day, 10); err == nil {
+		t.Fatal("expected error for a window beyond the reads kept")
+	}
+	report, err := tracker.PopularityReport(day, 2)
+	if err != nil {
+		t.Fatalf("unexpected error reporting: %v", err)
+	}
+
+	if report.Blobs != 4 || report.Size != 40 {
+		t.Errorf("blobs = %d of %d bytes, want 4 of 40 bytes", report.Blobs, report.Size)
+	}
+	var mostRead []string
+	for _, blob := range report.MostRead {
+		mostRead = append(mostRead, blob.Digest)
+	}
+	if want := []string{hot.String(), warm.String()}; !slices.Equal(mostRead, want) {
+		t.Errorf("most read = %v, want %v", mostRead, want)
+	}
+	// fresh blobs are not cold yet
+	if len(report.LeastRead) != 2 || report.LeastRead[0].Digest != cold.String() || report.LeastRead[1].Digest != warm.String() {
+		t.Errorf("unexpected least read %+v", report.LeastRead)
+	}
+	if want := (ColdData{Blobs: 1, Bytes: 10}); report.NeverRead != want || report.NotReadInWindow != want {
+		t.Errorf("never read = %+v, not read in window = %+v, want %+v", report.NeverRead, report.NotReadInWindow, want)
+	}
+	if len(report.MostReadRepositories) != 2 || report.MostReadRepositories[0].Reads != 3 || report.MostReadRepositories[0].Name != "library/"+hot.Encoded()[:4] {
+		t.Errorf("unexpected most read repositories %+v", report.MostReadRepositories)
+	}
+	if len(report.LeastReadRepositories) != 2 || report.LeastReadRepositories[0].Reads != 0 {
+		t.Errorf("unexpected least read repositories %+v", report.LeastReadRepositories)
+	}
+}
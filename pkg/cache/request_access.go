@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type requestAccessKey struct{}
+
+// requestAccess records the blobs accessed on behalf of one client request
+type requestAccess struct {
+	// partial is set for range requests, which read part of a blob
+	partial bool
+
+	mu sync.Mutex
+	// blobs maps the blobs accessed to whether a read of them was counted
+	blobs map[digest.Digest]bool
+}
+
+// WithRequestAccess returns a context recording the blob accesses made on
+// behalf of one client request, so that the last access of a blob is updated
+// once per request however many times the blob is opened, e.g. once per
+// range of a multi-range request. partial marks a range request, which reads
+// part of the blob and is not counted as a read of it.
+func WithRequestAccess(ctx context.Context, partial bool) context.Context {
+	return context.WithValue(ctx, requestAccessKey{}, &requestAccess{partial: partial, blobs: make(map[digest.Digest]bool)})
+}
+
+// requestAccessFromContext returns the accesses of the request of ctx, nil
+// outside of a request
+func requestAccessFromContext(ctx context.Context) *requestAccess {
+	access, _ := ctx.Value(requestAccessKey{}).(*requestAccess)
+	return access
+}
+
+// recorded reports whether the request accessed dgst already and whether a
+// read of it was counted. Outside of a request nothing is recorded.
+func (a *requestAccess) recorded(dgst digest.Digest) (accessed, read bool) {
+	if a == nil {
+		return false, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	read, accessed = a.blobs[dgst]
+	return accessed, read
+}
+
+// record records an access of dgst by the request, reading it if read is set
+func (a *requestAccess) record(dgst digest.Digest, read bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.blobs[dgst] = a.blobs[dgst] || read
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Eviction orders of the simulated caches
+const (
+	// EvictLRU evicts the least recently accessed blobs first, as the
+	// tracker does
+	EvictLRU = "lru"
+	// EvictLFU evicts the least frequently accessed blobs first, the least
+	// recently accessed among equals
+	EvictLFU = "lfu"
+	// EvictFIFO evicts the blobs written first
+	EvictFIFO = "fifo"
+)
+
+// SimulatedAccess is a read of a blob replayed by Simulate
+type SimulatedAccess struct {
+	Time   time.Time
+	Digest string
+	Size   int64
+}
+
+// SimulationPolicy are the settings of a simulated cache
+type SimulationPolicy struct {
+	// TTL evicts the blobs not accessed for this long, zero for never
+	TTL time.Duration `json:"ttl"`
+	// MaxSize evicts blobs in the Eviction order beyond this many bytes,
+	// zero for unlimited
+	MaxSize  int64  `json:"max_size"`
+	Eviction string `json:"eviction"`
+	// CleanupInterval is the time between two evictions of the expired
+	// blobs, as cache.cleanup_interval
+	CleanupInterval time.Duration `json:"cleanup_interval"`
+}
+
+// SimulationResult is the outcome of replaying accesses against a policy.
+// Misses are pulled from the upstream.
+type SimulationResult struct {
+	Policy SimulationPolicy `json:"policy"`
+
+	Requests    int64   `json:"requests"`
+	Hits        int64   `json:"hits"`
+	HitRate     float64 `json:"hit_rate"`
+	Bytes       int64   `json:"bytes"`
+	HitBytes    int64   `json:"hit_bytes"`
+	ByteHitRate float64 `json:"byte_hit_rate"`
+
+	// UpstreamBytes are the bytes of the misses
+	UpstreamBytes int64 `json:"upstream_bytes"`
+	Evictions     int64 `json:"evictions"`
+
+	// PeakSize and AverageSize are the bytes stored, averaged over the time
+	// of the accesses
+	PeakSize    int64 `json:"peak_size"`
+	AverageSize int64 `json:"average_size"`
+}
+
+// simulatedBlob is a blob stored by the simulated cache
+type simulatedBlob struct {
+	digest       string
+	size         int64
+	written      time.Time
+	lastAccessed time.Time
+	accesses     int64
+
+	// indexes in the heaps
+	recencyIndex int
+	victimIndex  int
+}
+
+// blobHeap orders the stored blobs, keeping their index up to date
+type blobHeap struct {
+	blobs []*simulatedBlob
+	less  func(a, b *simulatedBlob) bool
+	index func(b *simulatedBlob) *int
+}
+
+func (h *blobHeap) Len() int           { return len(h.blobs) }
+func (h *blobHeap) Less(i, j int) bool { return h.less(h.blobs[i], h.blobs[j]) }
+func (h *blobHeap) Swap(i, j int) {
+	h.blobs[i], h.blobs[j] = h.blobs[j], h.blobs[i]
+	*h.index(h.blobs[i]) = i
+	*h.index(h.blobs[j]) = j
+}
+func (h *blobHeap) Push(x any) {
+	b := x.(*simulatedBlob)
+	*h.index(b) = len(h.blobs)
+	h.blobs = append(h.blobs, b)
+}
+func (h *blobHeap) Pop() any {
+	b := h.blobs[len(h.blobs)-1]
+	h.blobs = h.blobs[:len(h.blobs)-1]
+	return b
+}
+
+// simulation is the state of a simulated cache
+type simulation struct {
+	policy SimulationPolicy
+	result SimulationResult
+
+	blobs   map[string]*simulatedBlob
+	size    int64
+	recency *blobHeap // least recently accessed first, for the TTL
+	victims *blobHeap // in the eviction order, for the maximum size
+
+	// last is the time of the previous access, sizeTime the integral of the
+	// size over time since the first one
+	first, last time.Time
+	sizeTime    float64
+	nextCleanup time.Time
+}
+
+// Simulate replays accesses, sorted by time, against a cache empty at first
+// evicting blobs according to policy, and reports its hit rate and size.
+func Simulate(accesses []SimulatedAccess, policy SimulationPolicy) (SimulationResult, error) {
+	recency := &blobHeap{
+		less:  func(a, b *simulatedBlob) bool { return a.lastAccessed.Before(b.lastAccessed) },
+		index: func(b *simulatedBlob) *int { return &b.recencyIndex },
+	}
+	victimIndex := func(b *simulatedBlob) *int { return &b.victimIndex }
+	var victims *blobHeap
+	switch policy.Eviction {
+	case "", EvictLRU:
+		policy.Eviction = EvictLRU
+		victims = &blobHeap{less: recency.less, index: victimIndex}
+	case EvictLFU:
+		victims = &blobHeap{less: func(a, b *simulatedBlob) bool {
+			if a.accesses != b.accesses {
+				return a.accesses < b.accesses
+			}
+			return a.lastAccessed.Before(b.lastAccessed)
+		}, index: victimIndex}
+	case EvictFIFO:
+		victims = &blobHeap{less: func(a, b *simulatedBlob) bool { return a.written.Before(b.written) }, index: victimIndex}
+	default:
+		return SimulationResult{}, fmt.Errorf("unknown eviction %q, want %s, %s or %s", policy.Eviction, EvictLRU, EvictLFU, EvictFIFO)
+	}
+	if policy.TTL > 0 && policy.CleanupInterval <= 0 {
+		return SimulationResult{}, fmt.Errorf("cleanup interval must be positive")
+	}
+	if !slices.IsSortedFunc(accesses, func(a, b SimulatedAccess) int { return a.Time.Compare(b.Time) }) {
+		return SimulationResult{}, fmt.Errorf("accesses are not sorted by time")
+	}
+
+	s := &simulation{
+		policy:  policy,
+		result:  SimulationResult{Policy: policy},
+		blobs:   make(map[string]*simulatedBlob),
+		recency: recency,
+		victims: victims,
+	}
+	for _, access := range accesses {
+		s.access(access)
+	}
+
+	r := &s.result
+	if r.Requests > 0 {
+		r.HitRate = float64(r.Hits) / float64(r.Requests)
+	}
+	if r.Bytes > 0 {
+		r.ByteHitRate = float64(r.HitBytes) / float64(r.Bytes)
+	}
+	if elapsed := s.last.Sub(s.first).Seconds(); elapsed > 0 {
+		r.AverageSize = int64(s.sizeTime / elapsed)
+	} else {
+		r.AverageSize = s.size
+	}
+	return *r, nil
+}
+
+// access replays an access, after the cleanups due until then
+func (s *simulation) access(access SimulatedAccess) {
+	if s.first.IsZero() {
+		s.first, s.last = access.Time, access.Time
+		s.nextCleanup = access.Time.Add(s.policy.CleanupInterval)
+	}
+	s.expire(access.Time)
+	s.advance(access.Time)
+
+	r := &s.result
+	r.Requests++
+	r.Bytes += access.Size
+	if b, ok := s.blobs[access.Digest]; ok {
+		r.Hits++
+		r.HitBytes += access.Size
+		b.lastAccessed = access.Time
+		b.accesses++
+		heap.Fix(s.recency, b.recencyIndex)
+		heap.Fix(s.victims, b.victimIndex)
+		return
+	}
+
+	r.UpstreamBytes += access.Size
+	b := &simulatedBlob{
+		digest:       access.Digest,
+		size:         access.Size,
+		written:      access.Time,
+		lastAccessed: access.Time,
+		accesses:     1,
+	}
+	s.blobs[b.digest] = b
+	heap.Push(s.recency, b)
+	heap.Push(s.victims, b)
+	s.size += b.size
+	// an overflow triggers a cleanup at once
+	for s.policy.MaxSize > 0 && s.size > s.policy.MaxSize {
+		s.evict(heap.Pop(s.victims).(*simulatedBlob))
+	}
+	r.PeakSize = max(r.PeakSize, s.size)
+}
+
+// expire evicts the blobs expired at the cleanups due until now
+func (s *simulation) expire(now time.Time) {
+	if s.policy.TTL <= 0 {
+		return
+	}
+	for !s.nextCleanup.After(now) {
+		if s.recency.Len() == 0 {
+			// nothing to expire until the next cleanup after now
+			s.nextCleanup = s.nextCleanup.Add((now.Sub(s.nextCleanup)/s.policy.CleanupInterval + 1) * s.policy.CleanupInterval)
+			break
+		}
+		s.advance(s.nextCleanup)
+		for s.recency.Len() > 0 && s.nextCleanup.Sub(s.recency.blobs[0].lastAccessed) > s.policy.TTL {
+			b := s.recency.blobs[0]
+			heap.Remove(s.victims, b.victimIndex)
+			s.evict(b)
+		}
+		s.nextCleanup = s.nextCleanup.Add(s.policy.CleanupInterval)
+	}
+}
+
+// evict removes a blob, already removed from the victims
+func (s *simulation) evict(b *simulatedBlob) {
+	heap.Remove(s.recency, b.recencyIndex)
+	delete(s.blobs, b.digest)
+	s.size -= b.size
+	s.result.Evictions++
+}
+
+// advance accounts for the size stored until now
+func (s *simulation) advance(now time.Time) {
+	if now.After(s.last) {
+		s.sizeTime += float64(s.size) * now.Sub(s.last).Seconds()
+		s.last = now
+	}
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, dgst string, size int64) SimulatedAccess {
+		return SimulatedAccess{Time: start.Add(d), Digest: dgst, Size: size}
+	}
+	accesses := []SimulatedAccess{
+		at(0, "a", 10),
+		at(time.Hour, "b", 10),
+		at(2*time.Hour, "a", 10),
+		at(2*time.Hour, "a", 10),
+		at(3*time.Hour, "c", 10),
+		at(4*time.Hour, "b", 10),
+		at(30*time.Hour, "a", 10),
+	}
+
+	for _, testcase := range []struct {
+		name      string
+		policy    SimulationPolicy
+		hits      int64
+		evictions int64
+		peak      int64
+	}{
+		{"unlimited", SimulationPolicy{}, 4, 0, 30},
+		// c evicts b, the least recently accessed, then b evicts a and a
+		// evicts c
+		{"lru", SimulationPolicy{MaxSize: 20}, 2, 3, 20},
+		// c evicts b, the least frequently accessed, then b evicts c
+		{"lfu", SimulationPolicy{MaxSize: 20, Eviction: EvictLFU}, 3, 2, 20},
+		// c evicts a, written first, then b hits, then a evicts b
+		{"fifo", SimulationPolicy{MaxSize: 20, Eviction: EvictFIFO}, 3, 2, 20},
+		// every blob expires before a is accessed again
+		{"ttl", SimulationPolicy{TTL: 12 * time.Hour, CleanupInterval: time.Hour}, 3, 3, 30},
+	} {
+		result, err := Simulate(accesses, testcase.policy)
+		if err != nil {
+			t.Fatalf("%s: unexpected error simulating: %v", testcase.name, err)
+		}
+		if result.Requests != 7 || result.Hits != testcase.hits || result.Evictions != testcase.evictions || result.PeakSize != testcase.peak {
+			t.Errorf("%s: unexpected result %+v", testcase.name, result)
+		}
+		if result.UpstreamBytes != result.Bytes-result.HitBytes {
+			t.Errorf("%s: upstream bytes %d, want %d", testcase.name, result.UpstreamBytes, result.Bytes-result.HitBytes)
+		}
+	}
+
+	if _, err := Simulate(accesses, SimulationPolicy{Eviction: "random"}); err == nil {
+		t.Error("expected error for an unknown eviction")
+	}
+	if _, err := Simulate([]SimulatedAccess{at(time.Hour, "a", 1), at(0, "a", 1)}, SimulationPolicy{}); err == nil {
+		t.Error("expected error for unsorted accesses")
+	}
+}
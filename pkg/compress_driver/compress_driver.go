@@ -0,0 +1,445 @@
+package compress_driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A compressed blob consists of a header, the content compressed in
+// independent zstd frames of chunkSize bytes each, an index holding the
+// compressed size of every frame and a footer. The index allows reading from
+// an offset without decompressing the preceding frames.
+//
+// Blobs which do not compress well are stored as they are. Both forms are
+// recognized when reading, so compression can be enabled on an existing cache.
+const (
+	chunkSize  = 1024 * 1024
+	headerSize = 8
+	footerSize = 16
+)
+
+var magic = []byte("DCSZ")
+
+const version = 1
+
+// minSavings is the fraction of the first chunk compression has to save for
+// a blob to be stored compressed. Layers are mostly gzip compressed already.
+const minSavings = 0.1
+
+// Driver wraps a storage driver to store blob data zstd compressed
+type Driver struct {
+	driver.StorageDriver
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// New creates a new compressing storage driver. level is one of "fastest",
+// "default", "better" or "best"; empty selects "default".
+func New(base driver.StorageDriver, level string) (*Driver, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != "" {
+		var ok bool
+		if ok, encoderLevel = zstd.EncoderLevelFromString(level); !ok {
+			return nil, fmt.Errorf("unknown compression level %q", level)
+		}
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Driver{
+		StorageDriver: base,
+		encoder:       encoder,
+		decoder:       decoder,
+	}, nil
+}
+
+// GetContent wraps the base driver's GetContent and decompresses blobs
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	data, err := d.StorageDriver.GetContent(ctx, path)
+	if err != nil || !isBlobData(path) || !hasHeader(data) {
+		return data, err
+	}
+
+	frames, size, err := parseIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	content := make([]byte, 0, size)
+	pos := int64(headerSize)
+	end := int64(len(data)) - footerSize - int64(len(frames))*4
+	for i, frameSize := range frames {
+		if pos+frameSize > end {
+			return nil, fmt.Errorf("%s: invalid compression index", path)
+		}
+		content, err = d.decoder.DecodeAll(data[pos:pos+frameSize], content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: decompressing frame %d: %w", path, i, err)
+		}
+		pos += frameSize
+	}
+	return content, nil
+}
+
+// PutContent compresses blobs before storing them through the base driver
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if !isBlobData(path) {
+		return d.StorageDriver.PutContent(ctx, path, content)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header())
+	var frames []int64
+	for rest := content; len(rest) > 0; {
+		n := min(len(rest), chunkSize)
+		frame := d.encoder.EncodeAll(rest[:n], nil)
+		buf.Write(frame)
+		frames = append(frames, int64(len(frame)))
+		rest = rest[n:]
+	}
+	buf.Write(index(frames, int64(len(content))))
+
+	if !worthCompressing(len(content), buf.Len()) {
+		return d.StorageDriver.PutContent(ctx, path, content)
+	}
+	return d.StorageDriver.PutContent(ctx, path, buf.Bytes())
+}
+
+// Reader returns a reader decompressing blobs from offset
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !isBlobData(path) {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	frames, size, err := d.readIndex(ctx, path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if frames == nil {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+	if offset < 0 || offset > size {
+		return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+	}
+
+	first := int(offset / chunkSize)
+	pos := int64(headerSize)
+	for _, frameSize := range frames[:first] {
+		pos += frameSize
+	}
+	reader, err := d.StorageDriver.Reader(ctx, path, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &frameReader{
+		reader:  reader,
+		decoder: d.decoder,
+		frames:  frames[first:],
+	}
+	if skip := offset % chunkSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Move wraps the base driver's Move and compresses blobs moved into place,
+// e.g. completed uploads. Blobs which do not compress well are moved as
+// they are.
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if !isBlobData(destPath) {
+		return d.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	reader, err := d.StorageDriver.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	chunk := make([]byte, chunkSize)
+	n, err := io.ReadFull(reader, chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	frame := d.encoder.EncodeAll(chunk[:n], nil)
+	if !worthCompressing(n, len(frame)+headerSize+footerSize+4) {
+		reader.Close()
+		return d.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	writer, err := d.StorageDriver.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if err := d.writeCompressed(writer, reader, chunk, frame, int64(n)); err != nil {
+		writer.Cancel(ctx)
+		return fmt.Errorf("compressing %s: %w", destPath, err)
+	}
+	if err := writer.Commit(ctx); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return d.StorageDriver.Delete(ctx, sourcePath)
+}
+
+// writeCompressed writes the first compressed frame followed by the
+// remaining content read from reader
+func (d *Driver) writeCompressed(writer io.Writer, reader io.Reader, chunk, frame []byte, size int64) error {
+	if _, err := writer.Write(header()); err != nil {
+		return err
+	}
+	var frames []int64
+	for {
+		if _, err := writer.Write(frame); err != nil {
+			return err
+		}
+		frames = append(frames, int64(len(frame)))
+
+		n, err := io.ReadFull(reader, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		size += int64(n)
+		frame = d.encoder.EncodeAll(chunk[:n], frame[:0])
+	}
+	_, err := writer.Write(index(frames, size))
+	return err
+}
+
+// Stat wraps the base driver's Stat and reports the uncompressed size
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() || !isBlobData(path) {
+		return fi, err
+	}
+	_, size, err := d.readIndex(ctx, path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	return withSize(fi, size), nil
+}
+
+// Walk wraps the base driver's Walk and reports uncompressed blob sizes
+func (d *Driver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	return d.StorageDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+		if fi.IsDir() || !isBlobData(fi.Path()) {
+			return f(fi)
+		}
+		_, size, err := d.readIndex(ctx, fi.Path(), fi.Size())
+		if err != nil {
+			return err
+		}
+		return f(withSize(fi, size))
+	}, options...)
+}
+
+// RedirectURL disables redirects to compressed blobs, which clients could
+// not read
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if isBlobData(path) {
+		fi, err := d.StorageDriver.Stat(r.Context(), path)
+		if err != nil {
+			return "", err
+		}
+		frames, _, err := d.readIndex(r.Context(), path, fi.Size())
+		if err != nil || frames != nil {
+			return "", err
+		}
+	}
+	return d.StorageDriver.RedirectURL(r, path)
+}
+
+// readIndex returns the compressed frame sizes and the uncompressed size of
+// the blob at path of the given stored size. The frames are nil for blobs
+// stored uncompressed.
+func (d *Driver) readIndex(ctx context.Context, path string, storedSize int64) ([]int64, int64, error) {
+	if storedSize < headerSize+footerSize {
+		return nil, storedSize, nil
+	}
+
+	footer, err := d.readAt(ctx, path, storedSize-footerSize, footerSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	count, size, ok := parseFooter(footer, storedSize)
+	if !ok {
+		return nil, storedSize, nil
+	}
+
+	indexSize := int64(count) * 4
+	data, err := d.readAt(ctx, path, storedSize-footerSize-indexSize, indexSize+footerSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	frames, size, err := parseIndex(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return frames, size, nil
+}
+
+// readAt reads n bytes at offset of the file at path
+func (d *Driver) readAt(ctx context.Context, path string, offset, n int64) ([]byte, error) {
+	reader, err := d.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// isBlobData reports whether path is the data file of a blob, e.g.
+// /docker/registry/v2/blobs/sha256/ab/abc.../data
+func isBlobData(path string) bool {
+	parts := strings.Split(path, "/")
+	n := len(parts)
+	return n >= 5 && parts[n-1] == "data" && parts[n-5] == "blobs"
+}
+
+// worthCompressing reports whether compressing size bytes into
+// compressedSize bytes saves enough space
+func worthCompressing(size, compressedSize int) bool {
+	return float64(compressedSize) <= float64(size)*(1-minSavings)
+}
+
+func header() []byte {
+	h := make([]byte, headerSize)
+	copy(h, magic)
+	h[len(magic)] = version
+	return h
+}
+
+func hasHeader(data []byte) bool {
+	return len(data) >= headerSize+footerSize &&
+		bytes.Equal(data[:len(magic)], magic) && data[len(magic)] == version
+}
+
+// index encodes the frame sizes followed by the footer
+func index(frames []int64, size int64) []byte {
+	buf := make([]byte, len(frames)*4+footerSize)
+	for i, frameSize := range frames {
+		binary.BigEndian.PutUint32(buf[i*4:], uint32(frameSize))
+	}
+	footer := buf[len(frames)*4:]
+	binary.BigEndian.PutUint32(footer, uint32(len(frames)))
+	binary.BigEndian.PutUint64(footer[4:], uint64(size))
+	copy(footer[12:], magic)
+	return buf
+}
+
+// parseFooter decodes the footer of a file of the given stored size. It
+// reports false when the file is not compressed.
+func parseFooter(footer []byte, storedSize int64) (uint32, int64, bool) {
+	if !bytes.Equal(footer[12:], magic) {
+		return 0, 0, false
+	}
+	count := binary.BigEndian.Uint32(footer)
+	size := int64(binary.BigEndian.Uint64(footer[4:]))
+	if headerSize+int64(count)*4+footerSize > storedSize || size < 0 {
+		return 0, 0, false
+	}
+	return count, size, true
+}
+
+// parseIndex decodes the index and footer at the end of data
+func parseIndex(data []byte) ([]int64, int64, error) {
+	if len(data) < footerSize {
+		return nil, 0, errors.New("invalid compression footer")
+	}
+	count, size, ok := parseFooter(data[len(data)-footerSize:], int64(len(data))+headerSize)
+	if !ok {
+		return nil, 0, errors.New("invalid compression footer")
+	}
+	entries := data[len(data)-footerSize-int(count)*4 : len(data)-footerSize]
+	frames := make([]int64, count)
+	for i := range frames {
+		frames[i] = int64(binary.BigEndian.Uint32(entries[i*4:]))
+	}
+	return frames, size, nil
+}
+
+// withSize returns fi reporting the given size
+func withSize(fi driver.FileInfo, size int64) driver.FileInfo {
+	return driver.FileInfoInternal{
+		FileInfoFields: driver.FileInfoFields{
+			Path:    fi.Path(),
+			Size:    size,
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		},
+	}
+}
+
+// frameReader decompresses consecutive frames read from the base driver
+type frameReader struct {
+	reader  io.ReadCloser
+	decoder *zstd.Decoder
+	frames  []int64
+	frame   []byte
+	buf     []byte
+	plain   []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.frames) == 0 {
+			return 0, io.EOF
+		}
+		frameSize := r.frames[0]
+		r.frames = r.frames[1:]
+		if int64(cap(r.frame)) < frameSize {
+			r.frame = make([]byte, frameSize)
+		}
+		r.frame = r.frame[:frameSize]
+		if _, err := io.ReadFull(r.reader, r.frame); err != nil {
+			return 0, err
+		}
+
+		var err error
+		r.plain, err = r.decoder.DecodeAll(r.frame, r.plain[:0])
+		if err != nil {
+			return 0, err
+		}
+		r.buf = r.plain
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *frameReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,149 @@
+package compress_driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+const blobPath = "/docker/registry/v2/blobs/sha256/ab/abcdef/data"
+
+func newTestDriver(t *testing.T) (*Driver, *inmemory.Driver) {
+	t.Helper()
+	base := inmemory.New()
+	d, err := New(base, "fastest")
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	return d, base
+}
+
+// compressible returns content of the given size repeating a short pattern
+func compressible(size int) []byte {
+	return bytes.Repeat([]byte("docker-cache-server "), size/20+1)[:size]
+}
+
+func TestMoveCompressesBlobs(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+	content := compressible(2*chunkSize + 12345)
+
+	if err := base.PutContent(ctx, "/uploads/1/data", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/uploads/1/data", blobPath); err != nil {
+		t.Fatalf("unexpected error moving blob: %v", err)
+	}
+
+	stored, err := base.Stat(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Size() >= int64(len(content))/2 {
+		t.Fatalf("expected blob to be stored compressed, stored %d bytes", stored.Size())
+	}
+	if _, err := base.Stat(ctx, "/uploads/1/data"); err == nil {
+		t.Fatal("expected source to be removed")
+	}
+
+	fi, err := d.Stat(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), fi.Size())
+	}
+
+	got, err := d.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content does not round trip")
+	}
+
+	for _, off := range []int64{0, 100, chunkSize, chunkSize + 1, int64(len(content))} {
+		r, err := d.Reader(ctx, blobPath, off)
+		if err != nil {
+			t.Fatalf("unexpected error reading from %d: %v", off, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading from %d: %v", off, err)
+		}
+		if !bytes.Equal(got, content[off:]) {
+			t.Fatalf("unexpected content from offset %d", off)
+		}
+	}
+}
+
+func TestIncompressibleBlobsStoredAsIs(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+	content := make([]byte, 100000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := base.PutContent(ctx, "/uploads/1/data", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/uploads/1/data", blobPath); err != nil {
+		t.Fatalf("unexpected error moving blob: %v", err)
+	}
+	stored, err := base.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Fatal("expected incompressible blob to be stored as is")
+	}
+
+	r, err := d.Reader(ctx, blobPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[10:]) {
+		t.Fatal("unexpected content")
+	}
+}
+
+func TestPutContent(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+
+	manifest := compressible(5000)
+	if err := d.PutContent(ctx, blobPath, manifest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, manifest) {
+		t.Fatal("content does not round trip")
+	}
+
+	// only blob data is compressed
+	link := []byte("sha256:abcdef")
+	if err := d.PutContent(ctx, "/docker/registry/v2/repositories/foo/_layers/sha256/abcdef/link", link); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := base.GetContent(ctx, "/docker/registry/v2/repositories/foo/_layers/sha256/abcdef/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, link) {
+		t.Fatal("expected link to be stored as is")
+	}
+}
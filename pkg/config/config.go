@@ -15,25 +15,120 @@ import (
 
 // Config holds the configuration for the docker cache server
 type Config struct {
+	Server  ServerConfig  `koanf:"server"`
 	Http    HttpConfig    `koanf:"http"`
 	Storage StorageConfig `koanf:"storage"`
 	Auth    AuthConfig    `koanf:"auth"`
 	Cache   CacheConfig   `koanf:"cache"`
+	Catalog CatalogConfig `koanf:"catalog"`
+	Tags    TagsConfig    `koanf:"tags"`
+	Shard   ShardConfig   `koanf:"shard"`
+
+	Upstream    UpstreamConfig    `koanf:"upstream"`
+	Replication ReplicationConfig `koanf:"replication"`
+	Replica     ReplicaConfig     `koanf:"replica"`
+	Health      HealthConfig      `koanf:"health"`
+	Trust       TrustConfig       `koanf:"trust"`
+	Quota       QuotaConfig       `koanf:"quota"`
+	Tenants     []TenantConfig    `koanf:"tenants"`
+	Limits      LimitsConfig      `koanf:"limits"`
+	Alerts      AlertsConfig      `koanf:"alerts"`
+	Log         LogConfig         `koanf:"log"`
+}
+
+// ServerConfig holds process-wide configuration
+type ServerConfig struct {
+	// User and Group, names or numeric IDs, the process switches to once
+	// its listeners are bound, e.g. to listen on :443 as root and then
+	// serve unprivileged. Group defaults to the primary group of User.
+	User  string `koanf:"user"`
+	Group string `koanf:"group"`
+
+	// ShutdownTimeout is how long shutdown waits for in-flight requests,
+	// such as large blob uploads, to finish. It overrides http.drain.timeout
+	// when set.
+	ShutdownTimeout time.Duration `koanf:"shutdown_timeout"`
 }
 
 // HttpConfig holds server-specific configuration
 type HttpConfig struct {
-	Addr   string `koanf:"addr"`
+	// Addr is the address listened on, a host or a full address
+	Addr string `koanf:"addr"`
+	// Port overrides the port of Addr when set, see ListenAddr
+	Port   int    `koanf:"port"`
 	Prefix string `koanf:"prefix"`
 	// Host e.g. "http://myregistryaddress.org:5000
 	Host         string          `koanf:"host"`
 	Relativeurls bool            `koanf:"relativeurls"`
+	Secret       string          `koanf:"secret"` // signs upload state, must be shared by instances serving the same uploads
 	Debug        HttpDebugConfig `koanf:"debug"`
+	Drain        DrainConfig     `koanf:"drain"`
+	ReusePort    bool            `koanf:"reuse_port"` // lets a new process bind addr while the old one drains
+	TLS          TLSConfig       `koanf:"tls"`
+	HTTP2        HTTP2Config     `koanf:"http2"`
+	H2C          H2CConfig       `koanf:"h2c"`
+	// Headers are added to every response, e.g. security headers or Via.
+	Headers map[string][]string `koanf:"headers"`
+
+	Compression ResponseCompressionConfig `koanf:"compression"`
+}
+
+// ResponseCompressionConfig controls the zstd or gzip compression of the
+// JSON responses, manifests, tag lists, catalog and admin endpoints, for
+// clients accepting it. Blobs are never compressed.
+type ResponseCompressionConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// MinSize is the size in bytes from which responses of a known length
+	// are compressed.
+	MinSize int64 `koanf:"min_size"`
+}
+
+// TLSConfig serves addr over TLS when the certificate and key are set
+type TLSConfig struct {
+	Certificate string `koanf:"certificate"` // PEM encoded certificate chain file
+	Key         string `koanf:"key"`         // PEM encoded private key file
+}
+
+// HTTP2Config controls HTTP/2 over TLS, negotiated with ALPN
+type HTTP2Config struct {
+	// Disabled limits TLS connections to HTTP/1.1, e.g. when a proxy in the
+	// path breaks HTTP/2.
+	Disabled bool `koanf:"disabled"`
+}
+
+// H2CConfig controls HTTP/2 without TLS (h2c) on a cleartext addr
+type H2CConfig struct {
+	Enabled bool `koanf:"enabled"`
+}
+
+// DrainConfig controls the graceful shutdown on SIGTERM or interrupt
+type DrainConfig struct {
+	// Delay is how long the server keeps accepting connections after
+	// reporting not ready, giving load balancers time to stop routing to it.
+	Delay time.Duration `koanf:"delay"`
+
+	// Timeout is how long in-flight requests may take to finish before
+	// their connections are closed.
+	Timeout time.Duration `koanf:"timeout"`
 }
 
 type HttpDebugConfig struct {
-	Addr       string           `koanf:"addr"`
+	Addr string `koanf:"addr"`
+	Port int    `koanf:"port"`
+	// OnError is what happens when the debug server can not listen on
+	// Addr: "log" (default, the server runs without it), "fatal" (startup
+	// fails) or "retry" (retried with backoff until it succeeds).
+	OnError    string           `koanf:"on_error"`
 	Prometheus PrometheusConfig `koanf:"prometheus"`
+	Admin      AdminConfig      `koanf:"admin"`
+}
+
+// AdminConfig protects the admin endpoints of the debug server
+type AdminConfig struct {
+	// Token is required as Bearer token by the admin endpoints if set.
+	// Without it, they are only served on a loopback debug address.
+	Token string `koanf:"token"`
 }
 
 type PrometheusConfig struct {
@@ -43,25 +138,686 @@ type PrometheusConfig struct {
 
 // StorageConfig holds storage-specific configuration
 type StorageConfig struct {
+	// Type is the storage driver, "filesystem" (default), "inmemory" or any
+	// driver registered with the distribution storage driver factory, e.g.
+	// "s3aws" when built with the s3 build tag.
+	Type string `koanf:"type"`
+
 	Directory string `koanf:"directory"`
+
+	// Directories spread the blob data of the filesystem storage across
+	// several disks by digest prefix. Directory keeps everything else and
+	// holds blobs only if listed.
+	Directories []string `koanf:"directories"`
+
+	// Parameters are passed to drivers other than "filesystem".
+	Parameters map[string]interface{} `koanf:"parameters"`
+
+	// UploadDirectory keeps upload sessions on another filesystem, e.g. a
+	// fast scratch disk, instead of the storage above.
+	UploadDirectory string `koanf:"upload_directory"`
+
+	Encryption  EncryptionConfig  `koanf:"encryption"`
+	Compression CompressionConfig `koanf:"compression"`
+	Tier        TierConfig        `koanf:"tier"`
+	Usage       UsageConfig       `koanf:"usage"`
+	S3          S3Config          `koanf:"s3"`
+
+	// DirMode and FileMode are the octal permissions of the directories
+	// and files the server creates on the local file system, e.g. "0750"
+	// and "0640", before the umask. Metadata files get FileMode exactly.
+	DirMode  string `koanf:"dir_mode"`
+	FileMode string `koanf:"file_mode"`
+
+	// Umask of the process, e.g. "0027", which also applies to the blobs of
+	// the filesystem storage created 0666 in directories created 0777.
+	// Empty keeps the inherited umask.
+	Umask string `koanf:"umask"`
+
+	// Redirect answers blob downloads with a 307 to a short-lived URL of
+	// the storage driver, such as a pre-signed S3 URL, so clients
+	// download from the bucket rather than through the cache. Drivers
+	// without such URLs, encrypted and compressed blobs, and HEAD requests
+	// are served as usual.
+	Redirect bool `koanf:"redirect"`
+
+	// Locking takes advisory file locks around metadata writes and blob
+	// writes and deletions, for instances sharing the filesystem storage,
+	// e.g. an NFS export. The file system must support POSIX locks.
+	Locking bool `koanf:"locking"`
+
+	// VerifyReads checks the digest of blobs read in full. Blobs not
+	// matching it are quarantined. Off by default as it hashes every blob
+	// served.
+	VerifyReads bool `koanf:"verify_reads"`
+}
+
+// UsageConfig controls the periodic measure of the storage actually used,
+// reported as the dcs_storage_usage_bytes and dcs_storage_objects metrics
+type UsageConfig struct {
+	// Interval between measures, which walk the whole storage. Zero
+	// disables measuring.
+	Interval time.Duration `koanf:"interval"`
+}
+
+// TierConfig moves blob data between the storage above, the hot tier, and a
+// cold tier. Tiering is enabled when the cold tier type is set.
+type TierConfig struct {
+	// MaxSize is the maximum size of blob data on the hot tier in bytes.
+	MaxSize int64 `koanf:"max_size"`
+
+	Cold ColdStorageConfig `koanf:"cold"`
+}
+
+// ColdStorageConfig holds the storage driver of the cold tier
+type ColdStorageConfig struct {
+	Type       string                 `koanf:"type"`
+	Directory  string                 `koanf:"directory"`
+	Parameters map[string]interface{} `koanf:"parameters"`
+}
+
+// S3Config tunes the "s3aws" storage drivers, of the storage and of the
+// cold tier. Driver parameters set explicitly take precedence.
+type S3Config struct {
+	// ChunkSize is the part size of multipart uploads, at least 5 MiB. Zero
+	// keeps the driver default of 10 MiB.
+	ChunkSize int64 `koanf:"chunk_size"`
+
+	// CopyChunkSize, CopyConcurrency and CopyThreshold tune the multipart
+	// copies moving completed uploads into place: the part size, the parts
+	// copied concurrently and the size from which copies are multipart.
+	// Zero keeps the driver defaults.
+	CopyChunkSize   int64 `koanf:"copy_chunk_size"`
+	CopyConcurrency int   `koanf:"copy_concurrency"`
+	CopyThreshold   int64 `koanf:"copy_threshold"`
+
+	// Accelerate uses the S3 Transfer Acceleration endpoints, which must be
+	// enabled on the bucket.
+	Accelerate bool `koanf:"accelerate"`
+
+	// MaxRetries is the number of retries of a failed operation, on top of
+	// the retries of the AWS SDK. The delay starts at RetryInterval and
+	// doubles with every retry up to MaxRetryInterval.
+	MaxRetries       int           `koanf:"max_retries"`
+	RetryInterval    time.Duration `koanf:"retry_interval"`
+	MaxRetryInterval time.Duration `koanf:"max_retry_interval"`
+}
+
+// CompressionConfig controls the zstd compression of stored blobs
+type CompressionConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// Level is "fastest", "default", "better" or "best".
+	Level string `koanf:"level"`
+}
+
+// EncryptionConfig holds the key encrypting stored content. Encryption is
+// enabled when one of the key sources is set.
+type EncryptionConfig struct {
+	// Key is the base64 encoded 32 byte key.
+	Key string `koanf:"key"`
+
+	// KeyFile is a file holding the base64 encoded key, e.g. a mounted
+	// secret.
+	KeyFile string `koanf:"key_file"`
+
+	// KeyCommand is run to obtain the base64 encoded key on its standard
+	// output, e.g. to decrypt it with a KMS.
+	KeyCommand []string `koanf:"key_command"`
 }
 
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	Enabled bool        `koanf:"enabled"`
-	Users   []UserCreds `koanf:"users"`
+	Enabled bool `koanf:"enabled"`
+
+	// Type selects the access controller: "userpass" for Users, "pat",
+	// "kubernetes", or a type registered by another module with
+	// auth.Register
+	Type string `koanf:"type"`
+	// Parameters are the settings of types registered by other modules
+	Parameters map[string]any `koanf:"parameters"`
+
+	Users []UserCreds `koanf:"users"`
+	// UsersFile is a YAML or JSON file of users, in the format of Users
+	// under a "users" key, with bcrypt hashed passwords. It is reloaded
+	// when it changes.
+	UsersFile string `koanf:"users_file"`
+
+	Lockout LockoutConfig `koanf:"lockout"`
+	Tokens  TokensConfig  `koanf:"tokens"`
+	PAT     PATConfig     `koanf:"pat"`
+
+	Kubernetes KubernetesAuthConfig `koanf:"kubernetes"`
+}
+
+// KubernetesAuthConfig authenticates Kubernetes service accounts by their
+// token given as password, for the auth type "kubernetes"
+type KubernetesAuthConfig struct {
+	// APIServer is the URL of the cluster API. Empty means the cluster the
+	// cache server runs in.
+	APIServer string `koanf:"api_server"`
+	// CAFile and TokenFile are the CA certificate of the cluster API and the
+	// token the cache server authenticates with. Empty means the ones of
+	// the service account of the pod.
+	CAFile    string `koanf:"ca_file"`
+	TokenFile string `koanf:"token_file"`
+
+	// Audiences the tokens must be issued for, e.g. of a projected token
+	// volume. Empty means the audiences of the cluster API.
+	Audiences []string `koanf:"audiences"`
+
+	// CacheTTL is how long the result of reviewing a token is reused
+	CacheTTL time.Duration `koanf:"cache_ttl"`
+
+	// Rules grant access to service accounts. A service account matching no
+	// rule is denied access to every repository.
+	Rules []KubernetesRule `koanf:"rules"`
+}
+
+// KubernetesRule grants service accounts access to repositories
+type KubernetesRule struct {
+	// Namespace of the service accounts, "*" for every namespace
+	Namespace string `koanf:"namespace"`
+	// ServiceAccount is the name of the service account, empty or "*" for
+	// every service account of Namespace
+	ServiceAccount string `koanf:"service_account"`
+
+	// Access is "pull", or "push" which includes pull and delete
+	Access string `koanf:"access"`
+
+	// Repositories restricts the rule to repositories matching one of the
+	// given glob patterns, in which $namespace and $serviceaccount are
+	// replaced by the ones of the service account (e.g. "$namespace/*").
+	// Empty means all repositories.
+	Repositories []string `koanf:"repositories"`
+}
+
+// PATConfig authenticates users by a GitHub or GitLab personal access token
+// given as password, for the auth type "pat"
+type PATConfig struct {
+	// Provider is "github" or "gitlab"
+	Provider string `koanf:"provider"`
+
+	// URL is the base URL of the API, e.g. "https://github.example.com/api/v3"
+	// for GitHub Enterprise. Empty means the public service.
+	URL string `koanf:"url"`
+
+	// CacheTTL is how long the result of validating a token is reused
+	CacheTTL time.Duration `koanf:"cache_ttl"`
+
+	// Rules grant access to the members of organizations or groups. A user
+	// matching no rule is denied access to every repository.
+	Rules []PATRule `koanf:"rules"`
+}
+
+// PATRule grants the members of an organization or group access to
+// repositories
+type PATRule struct {
+	// Org is the GitHub organization or the full path of the GitLab group,
+	// "*" for every user with a valid token
+	Org string `koanf:"org"`
+
+	// Access is "pull", or "push" which includes pull and delete
+	Access string `koanf:"access"`
+
+	// Repositories restricts the rule to repositories matching one of the
+	// given glob patterns (e.g. "my-org/*"). Empty means all repositories.
+	Repositories []string `koanf:"repositories"`
+}
+
+// TokensConfig issues session tokens to users authenticated with Basic
+// authentication, so that further requests skip checking their password
+type TokensConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// TTL is how long a session token is valid
+	TTL time.Duration `koanf:"ttl"`
+
+	// Secret signs the session tokens, it must be shared by instances behind
+	// the same load balancer. Empty means a random secret, which does not
+	// survive a restart.
+	Secret string `koanf:"secret"`
+}
+
+// LockoutConfig locks out users after repeated authentication failures
+type LockoutConfig struct {
+	// MaxFailures locks out a user once this many authentications in a row
+	// failed, each within Duration of the previous one. Zero disables the
+	// lockout.
+	MaxFailures int `koanf:"max_failures"`
+
+	// Duration a locked out user is rejected for, whatever its password
+	Duration time.Duration `koanf:"duration"`
 }
 
 // UserCreds holds username and password for a user
 type UserCreds struct {
 	Username string `koanf:"username"`
 	Password string `koanf:"password"`
+	// Repositories restricts the user to repositories matching one of the
+	// given glob patterns (e.g. "team-a/*"). Empty means all repositories.
+	Repositories []string `koanf:"repositories"`
+	// Access restricts the actions of the user per repository, e.g. to pull
+	// every repository but push only to its own. With Repositories, the user
+	// may take every action on those and the actions of Access on the others.
+	Access []AccessRule `koanf:"access"`
+}
+
+// AccessRule allows actions on repositories
+type AccessRule struct {
+	// Repositories are glob patterns of the repositories the rule applies
+	// to (e.g. "team-a/*"). Empty means all repositories.
+	Repositories []string `koanf:"repositories"`
+	// Actions are "pull", "push", "delete", or "*" for all of them. Pushing
+	// also requires pull.
+	Actions []string `koanf:"actions"`
 }
 
 // CacheConfig holds cache-specific configuration
 type CacheConfig struct {
 	TTL             time.Duration `koanf:"ttl"`
 	CleanupInterval time.Duration `koanf:"cleanup_interval"`
+
+	// MaxSize limits the total size of cached blobs in bytes. The least
+	// recently accessed blobs beyond it are evicted. Zero means unlimited.
+	MaxSize int64 `koanf:"max_size"`
+
+	// CleanupWorkers is the number of blobs a cleanup deletes concurrently.
+	CleanupWorkers int `koanf:"cleanup_workers"`
+	// CleanupRate limits the blobs a cleanup deletes per second, e.g. to
+	// stay below the request rate of object storage. Zero means unlimited.
+	CleanupRate int `koanf:"cleanup_rate"`
+	// CleanupMaxDeletes and CleanupMaxDuration limit a single cleanup run,
+	// the evictable blobs left roll over to the next one. Zero means
+	// unlimited.
+	CleanupMaxDeletes  int           `koanf:"cleanup_max_deletes"`
+	CleanupMaxDuration time.Duration `koanf:"cleanup_max_duration"`
+
+	// HeadAccess controls how HEAD existence checks update the last access
+	// time of blobs: "persist" (default), "memory" (no metadata write) or
+	// "skip" (not updated at all).
+	HeadAccess string `koanf:"head_access"`
+
+	LeaderElection LeaderElectionConfig `koanf:"leader_election"`
+
+	Metadata MetadataConfig `koanf:"metadata"`
+}
+
+// MetadataConfig selects where blob access metadata is stored
+type MetadataConfig struct {
+	// Type is "file" (below the storage directory), "redis" or "memory"
+	// (not persisted). Empty selects "memory" for inmemory storage and
+	// "file" otherwise.
+	Type string `koanf:"type"`
+
+	// Fsync flushes every metadata file of the "file" type to disk when
+	// saved, so that access times survive a power loss.
+	Fsync bool `koanf:"fsync"`
+
+	Redis RedisMetadataConfig `koanf:"redis"`
+}
+
+// RedisMetadataConfig holds the Redis connection for the "redis" metadata
+// type
+type RedisMetadataConfig struct {
+	Addr     string `koanf:"addr"`
+	Password string `koanf:"password"`
+	DB       int    `koanf:"db"`
+	Prefix   string `koanf:"prefix"`
+}
+
+// LeaderElectionConfig elects a single instance to run cleanup when several
+// instances share one storage backend
+type LeaderElectionConfig struct {
+	// Type is "" (disabled), "file" or "redis".
+	Type string `koanf:"type"`
+
+	// LeaseDuration is how long a lease stays valid without renewal. The
+	// lease is renewed on every cleanup run, so it defaults to twice the
+	// cleanup interval.
+	LeaseDuration time.Duration `koanf:"lease_duration"`
+
+	// File is the lease file for the "file" type. Defaults to
+	// <storage.directory>/meta/cleanup.lease.
+	File string `koanf:"file"`
+
+	Redis RedisLeaseConfig `koanf:"redis"`
+}
+
+// RedisLeaseConfig holds the Redis connection for the "redis" leader
+// election type
+type RedisLeaseConfig struct {
+	Addr     string `koanf:"addr"`
+	Password string `koanf:"password"`
+	DB       int    `koanf:"db"`
+	Key      string `koanf:"key"`
+}
+
+// CatalogConfig holds catalog endpoint configuration
+type CatalogConfig struct {
+	// MaxEntries is the maximum number of repositories returned by a single
+	// catalog request.
+	MaxEntries int `koanf:"maxentries"`
+
+	// DefaultEntries is the number of repositories returned when a request
+	// does not ask for a page size with n.
+	DefaultEntries int `koanf:"defaultentries"`
+}
+
+// TagsConfig holds tags list endpoint configuration
+type TagsConfig struct {
+	// MaxEntries is the maximum number of tags returned by a single request,
+	// larger pages are cut with a Link to the rest. Zero if unlimited.
+	MaxEntries int `koanf:"maxentries"`
+
+	// DefaultEntries is the number of tags returned when a request does not
+	// ask for a page size with n. Zero returns all tags.
+	DefaultEntries int `koanf:"defaultentries"`
+}
+
+// ShardConfig partitions blobs between several cache nodes by consistent
+// hashing of their digests
+type ShardConfig struct {
+	// Self is the base URL under which the other nodes reach this node. It
+	// must be listed in Nodes.
+	Self string `koanf:"self"`
+
+	// Nodes lists the base URLs of all nodes. Sharding is disabled when
+	// empty.
+	Nodes []string `koanf:"nodes"`
+
+	// Replicas is the number of virtual nodes per node on the hash ring.
+	Replicas int `koanf:"replicas"`
+}
+
+// UpstreamConfig enables pull-through caching: content missing from the
+// cache is pulled from the upstream registry
+type UpstreamConfig struct {
+	// URL is the base URL of the upstream registry, e.g.
+	// "https://registry-1.docker.io". Empty disables pulling.
+	URL      string `koanf:"url"`
+	Username string `koanf:"username"`
+	Password string `koanf:"password"`
+
+	// CredentialHelper names a docker credential helper asked for the
+	// credentials, e.g. "ecr-login" runs docker-credential-ecr-login.
+	CredentialHelper string `koanf:"credential_helper"`
+
+	// DockerConfig is the path of a docker config.json file the credentials
+	// are taken from, including those of its credential helpers.
+	DockerConfig string `koanf:"docker_config"`
+
+	// ProxyURL is the forward proxy the upstream is reached through, e.g.
+	// "http://proxy.example.com:3128". The HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY environment variables are honored if empty.
+	ProxyURL string `koanf:"proxy_url"`
+
+	// MaxBandwidth limits the download rate from the upstream in bytes per
+	// second, shared by all pulls. Zero disables the limit.
+	MaxBandwidth int64 `koanf:"max_bandwidth"`
+
+	// Segments is the number of parallel range requests blobs of at least
+	// SegmentMinSize bytes are pulled with. One or zero disables segmented
+	// downloads.
+	Segments       int   `koanf:"segments"`
+	SegmentMinSize int64 `koanf:"segment_min_size"`
+
+	// Signatures pulls the cosign signatures, attestations and SBOMs and the
+	// referrers tag of every manifest pulled, so that they can be verified
+	// against the cache offline.
+	Signatures bool `koanf:"signatures"`
+
+	// Allow restricts pulling to repositories matching one of the patterns
+	// (path.Match syntax, e.g. "library/*"). All repositories may be pulled
+	// if empty.
+	Allow []string `koanf:"allow"`
+
+	// Deny lists patterns of repositories never pulled, taking precedence
+	// over Allow.
+	Deny []string `koanf:"deny"`
+
+	// RefreshInterval is the time between refreshes of the most pulled tags
+	// from the upstream, so that they are fresh when clients ask. Zero
+	// disables refreshing.
+	RefreshInterval time.Duration `koanf:"refresh_interval"`
+
+	// RefreshTags is the number of most pulled tags refreshed.
+	RefreshTags int `koanf:"refresh_tags"`
+
+	Prefetch PrefetchConfig `koanf:"prefetch"`
+}
+
+// PrefetchConfig controls pulling the blobs of a manifest from the upstream
+// as soon as a client pulls the manifest
+type PrefetchConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// Workers is the number of manifests prefetched concurrently.
+	Workers int `koanf:"workers"`
+
+	// Platforms restricts the entries of manifest lists prefetched to the
+	// given os/arch[/variant], e.g. linux/amd64. All are prefetched if empty.
+	Platforms []string `koanf:"platforms"`
+}
+
+// ReplicaConfig makes the server a read-only replica of a primary instance,
+// mounting the same storage and metadata to scale pulls out
+type ReplicaConfig struct {
+	// Enabled serves GET and HEAD requests only and never writes to the
+	// storage or metadata, evicts blobs or pulls from the upstream
+	Enabled bool `koanf:"enabled"`
+
+	// RefreshInterval is how often the metadata of the primary is loaded
+	// again, dropping the blobs it evicted. Zero loads it on start only.
+	RefreshInterval time.Duration `koanf:"refresh_interval"`
+}
+
+// ReplicationConfig holds the remote cache servers receiving pushed
+// manifests and their blobs
+type ReplicationConfig struct {
+	Targets []ReplicationTarget `koanf:"targets"`
+
+	// Workers is the number of manifests replicated concurrently.
+	Workers int `koanf:"workers"`
+
+	// QueueSize is the number of manifests waiting for replication before
+	// new ones are dropped.
+	QueueSize int `koanf:"queue_size"`
+
+	// MaxRetries is the number of retries of a failed replication. The delay
+	// starts at RetryInterval and doubles with every retry.
+	MaxRetries    int           `koanf:"max_retries"`
+	RetryInterval time.Duration `koanf:"retry_interval"`
+}
+
+// ReplicationTarget is a remote cache server receiving replicated content
+type ReplicationTarget struct {
+	Name     string `koanf:"name"`
+	URL      string `koanf:"url"`
+	Username string `koanf:"username"`
+	Password string `koanf:"password"`
+
+	// Repositories restricts replication to repositories matching one of the
+	// given glob patterns. Empty means all repositories.
+	Repositories []string `koanf:"repositories"`
+}
+
+// HealthConfig controls the periodic checks reported by /readyz
+type HealthConfig struct {
+	// Interval is the time between check runs, Timeout the limit of a
+	// single check.
+	Interval time.Duration `koanf:"interval"`
+	Timeout  time.Duration `koanf:"timeout"`
+
+	// MinFreeBytes fails readiness when less space is available to the
+	// filesystem storage directory. Zero disables the check.
+	MinFreeBytes int64 `koanf:"min_free_bytes"`
+}
+
+// TrustConfig restricts the served and cached manifests to those signed
+// with cosign by one of the public keys
+type TrustConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// PublicKeys are the paths of PEM encoded ECDSA, RSA or Ed25519 public
+	// keys, e.g. cosign.pub files.
+	PublicKeys []string `koanf:"public_keys"`
+}
+
+// QuotaConfig limits the storage used by the repositories of each
+// namespace, the first component of repository names, e.g. "team-a" of
+// "team-a/app". Pushes exceeding the quota of their namespace are rejected.
+type QuotaConfig struct {
+	Enabled bool `koanf:"enabled"`
+
+	// Default is the quota in bytes of the namespaces not in Namespaces,
+	// zero for unlimited.
+	Default int64 `koanf:"default"`
+
+	// Namespaces are the quotas in bytes of individual namespaces.
+	Namespaces map[string]int64 `koanf:"namespaces"`
+
+	// RefreshInterval is how often the storage used per namespace is
+	// recomputed from the storage. Pushes in between are added as they
+	// complete.
+	RefreshInterval time.Duration `koanf:"refresh_interval"`
+}
+
+// TenantConfig is a team sharing the cache, isolated in a namespace of
+// repositories
+type TenantConfig struct {
+	// Name identifies the tenant in the admin API.
+	Name string `koanf:"name"`
+
+	// Namespace is the first component of the names of the repositories of
+	// the tenant, e.g. "team-a" for "team-a/app". Defaults to Name.
+	Namespace string `koanf:"namespace"`
+
+	// Users may take every action on the repositories of the namespace and
+	// on no other. Their repositories and access rules are ignored. Their
+	// passwords must be set, preferably as bcrypt hashes.
+	Users []UserCreds `koanf:"users"`
+
+	// TTL replaces cache.ttl for the blobs of the namespace when set. Blobs
+	// also linked into other namespaces keep the longest TTL.
+	TTL time.Duration `koanf:"ttl"`
+
+	// Quota is the storage quota in bytes of the namespace, enabling the
+	// quotas with quota.refresh_interval. Zero applies quota.default.
+	Quota int64 `koanf:"quota"`
+}
+
+// NamespaceName returns the namespace of the tenant
+func (t TenantConfig) NamespaceName() string {
+	if t.Namespace != "" {
+		return t.Namespace
+	}
+	return t.Name
+}
+
+// LimitsConfig protects the server from clients using too many resources
+type LimitsConfig struct {
+	// MaxUploadsPerClient limits the blob uploads in progress per user, or
+	// per IP address for anonymous clients. Uploads beyond it are rejected
+	// with 429 Too Many Requests. Zero means unlimited.
+	MaxUploadsPerClient int `koanf:"max_uploads_per_client"`
+
+	// MaxBlobSize rejects pushed blobs, and blobs pulled from the upstream,
+	// larger than this many bytes with 413. Zero means unlimited.
+	MaxBlobSize int64 `koanf:"max_blob_size"`
+
+	// MaxImageSize rejects pushed images, and images pulled from the
+	// upstream, whose config and layers together are larger than this many
+	// bytes with 413. Each image of a manifest list is checked on its own.
+	// Zero means unlimited.
+	MaxImageSize int64 `koanf:"max_image_size"`
+
+	// MaxConnections limits the connections served at once on addr. Further
+	// connections wait in the listen backlog until one closes. Zero means
+	// unlimited.
+	MaxConnections int `koanf:"max_connections"`
+
+	// Exempt are the clients MaxUploadsPerClient and the quotas do not apply
+	// to, e.g. the CI
+	Exempt LimitsExemptConfig `koanf:"exempt"`
+}
+
+// LimitsExemptConfig selects clients by address or user
+type LimitsExemptConfig struct {
+	// CIDRs match the address of the connection, e.g. "10.0.8.0/24" or
+	// "10.0.8.5". Proxy headers are not trusted, behind a reverse proxy
+	// exempt users instead.
+	CIDRs []string `koanf:"cidrs"`
+
+	// Users are authenticated user names
+	Users []string `koanf:"users"`
+}
+
+// AlertsConfig posts alerts to webhooks when the cache needs attention,
+// for teams without a monitoring stack. Alerts are disabled without
+// webhooks.
+type AlertsConfig struct {
+	Webhooks []AlertWebhook `koanf:"webhooks"`
+
+	// Interval is the time between two evaluations of the conditions.
+	Interval time.Duration `koanf:"interval"`
+
+	// DiskUsage are the percentages of use alerting when crossed, of
+	// cache.max_size if set, else of the file system holding
+	// storage.directory.
+	DiskUsage []float64 `koanf:"disk_usage"`
+
+	// EvictionBacklog alerts when the cleanup has left evictable blobs
+	// behind for this long. Zero disables the alert.
+	EvictionBacklog time.Duration `koanf:"eviction_backlog"`
+
+	// UpstreamFailing alerts when every request to the upstream has failed
+	// for this long. Zero disables the alert.
+	UpstreamFailing time.Duration `koanf:"upstream_failing"`
+}
+
+// AlertWebhook is an URL alerts are posted to
+type AlertWebhook struct {
+	URL string `koanf:"url"`
+
+	// Format of the body: "json" (default) or "slack", also understood by
+	// Mattermost and Rocket.Chat incoming webhooks
+	Format string `koanf:"format"`
+}
+
+// LogConfig selects where the server logs go
+type LogConfig struct {
+	// Output: "stdout" (default), "file", "syslog" or "journald"
+	Output string        `koanf:"output"`
+	File   LogFileConfig `koanf:"file"`
+	Syslog SyslogConfig  `koanf:"syslog"`
+}
+
+// LogFileConfig configures the log file of the "file" output and its
+// rotation
+type LogFileConfig struct {
+	Path string `koanf:"path"`
+
+	// MaxSize rotates the file once it would grow beyond this many bytes.
+	// Zero disables rotation.
+	MaxSize int64 `koanf:"max_size"`
+
+	// MaxAge deletes rotated files older than this. Zero keeps them.
+	MaxAge time.Duration `koanf:"max_age"`
+
+	// MaxBackups is the number of rotated files kept. Zero keeps them all.
+	MaxBackups int `koanf:"max_backups"`
+}
+
+// SyslogConfig configures the "syslog" output
+type SyslogConfig struct {
+	// Network and Address of the syslog server, e.g. "udp" and
+	// "logs.example.com:514". Empty for the local syslog daemon.
+	Network string `koanf:"network"`
+	Address string `koanf:"address"`
+
+	// Tag the messages are sent with
+	Tag string `koanf:"tag"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -76,17 +832,101 @@ func DefaultConfig() *Config {
 					Enabled: true,
 				},
 			},
+			Drain: DrainConfig{
+				Timeout: 5 * time.Minute,
+			},
+			Compression: ResponseCompressionConfig{
+				MinSize: 1024,
+			},
+			Headers: map[string][]string{
+				"X-Content-Type-Options": {"nosniff"},
+			},
 		},
 		Storage: StorageConfig{
 			Directory: "/var/cache/docker-cache-server",
+			DirMode:   "0755",
+			FileMode:  "0644",
+			S3: S3Config{
+				MaxRetries:       3,
+				RetryInterval:    500 * time.Millisecond,
+				MaxRetryInterval: 10 * time.Second,
+			},
 		},
 		Auth: AuthConfig{
 			Enabled: false,
+			Type:    "userpass",
 			Users:   []UserCreds{},
+			Lockout: LockoutConfig{
+				Duration: 15 * time.Minute,
+			},
+			Tokens: TokensConfig{
+				TTL: 15 * time.Minute,
+			},
+			PAT: PATConfig{
+				CacheTTL: 5 * time.Minute,
+			},
+			Kubernetes: KubernetesAuthConfig{
+				CacheTTL: time.Minute,
+			},
 		},
 		Cache: CacheConfig{
 			TTL:             7 * 24 * time.Hour, // 7 days
 			CleanupInterval: 1 * time.Hour,      // 1 hour
+			CleanupWorkers:  4,
+			HeadAccess:      "persist",
+			Metadata: MetadataConfig{
+				Redis: RedisMetadataConfig{
+					Prefix: "docker-cache-server:blob:",
+				},
+			},
+			LeaderElection: LeaderElectionConfig{
+				Redis: RedisLeaseConfig{
+					Key: "docker-cache-server:cleanup-leader",
+				},
+			},
+		},
+		Catalog: CatalogConfig{
+			MaxEntries:     1000,
+			DefaultEntries: 100,
+		},
+		Upstream: UpstreamConfig{
+			RefreshTags:    100,
+			SegmentMinSize: 100 * 1024 * 1024,
+			Prefetch: PrefetchConfig{
+				Workers: 4,
+			},
+		},
+		Replication: ReplicationConfig{
+			Workers:       2,
+			QueueSize:     1000,
+			MaxRetries:    5,
+			RetryInterval: 30 * time.Second,
+		},
+		Replica: ReplicaConfig{
+			RefreshInterval: time.Minute,
+		},
+		Health: HealthConfig{
+			Interval: 30 * time.Second,
+			Timeout:  10 * time.Second,
+		},
+		Quota: QuotaConfig{
+			RefreshInterval: 10 * time.Minute,
+		},
+		Alerts: AlertsConfig{
+			Interval:        time.Minute,
+			DiskUsage:       []float64{80, 90, 95},
+			EvictionBacklog: 30 * time.Minute,
+			UpstreamFailing: 10 * time.Minute,
+		},
+		Log: LogConfig{
+			Output: "stdout",
+			File: LogFileConfig{
+				MaxSize:    100 * 1024 * 1024,
+				MaxBackups: 5,
+			},
+			Syslog: SyslogConfig{
+				Tag: "docker-cache-server",
+			},
 		},
 	}
 }
@@ -110,9 +950,9 @@ func Load(configFile string, flags *pflag.FlagSet) (*Config, error) {
 	}
 
 	// Load environment variables (prefix: DCS_)
-	// e.g., DCS_SERVER_PORT=8080
+	// e.g., DCS_HTTP_PORT=8080
 	if err := k.Load(env.Provider("DCS_", "_", func(s string) string {
-		// Convert DCS_SERVER_PORT to server.port
+		// Convert DCS_HTTP_PORT to http.port
 		return strings.ToLower(s[4:]) // Remove DCS_ prefix
 	}), nil); err != nil {
 		return nil, fmt.Errorf("loading environment variables: %w", err)
@@ -132,3 +972,17 @@ func Load(configFile string, flags *pflag.FlagSet) (*Config, error) {
 
 	return cfg, nil
 }
+
+// LoadUsers loads the users of a users file, a YAML or JSON document with
+// the users under a "users" key
+func LoadUsers(usersFile string) ([]UserCreds, error) {
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(usersFile), yaml.Parser()); err != nil {
+		return nil, fmt.Errorf("loading users file: %w", err)
+	}
+	var users []UserCreds
+	if err := k.Unmarshal("users", &users); err != nil {
+		return nil, fmt.Errorf("unmarshaling users file: %w", err)
+	}
+	return users, nil
+}
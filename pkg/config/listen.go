@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ListenAddr returns the address a server listens on, given as a host
+// ("0.0.0.0", "::"), a full address ("0.0.0.0:5000", ":5000") or empty for
+// every interface, and a port overriding the one of addr unless zero.
+func ListenAddr(addr string, port int) (string, error) {
+	if port < 0 || port > 65535 {
+		return "", fmt.Errorf("port %d out of range", port)
+	}
+
+	host, addrPort := addr, ""
+	switch {
+	case addr == "":
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		host = addr[1 : len(addr)-1]
+	case !strings.Contains(addr, ":"):
+	default:
+		if _, err := netip.ParseAddr(addr); err == nil {
+			// IPv6 address without port
+			break
+		}
+		var err error
+		if host, addrPort, err = net.SplitHostPort(addr); err != nil {
+			return "", fmt.Errorf("address %q: %w", addr, err)
+		}
+		if _, err := net.LookupPort("tcp", addrPort); err != nil {
+			return "", fmt.Errorf("address %q: %w", addr, err)
+		}
+	}
+
+	switch {
+	case port != 0:
+		addrPort = strconv.Itoa(port)
+	case addrPort == "":
+		return "", fmt.Errorf("address %q has no port and no port is set", addr)
+	}
+	return net.JoinHostPort(host, addrPort), nil
+}
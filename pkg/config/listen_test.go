@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+func TestListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		port int
+		want string
+	}{
+		{"0.0.0.0:5000", 0, "0.0.0.0:5000"},
+		{"0.0.0.0", 5000, "0.0.0.0:5000"},
+		{"0.0.0.0:5000", 8080, "0.0.0.0:8080"},
+		{":5000", 0, ":5000"},
+		{"", 5000, ":5000"},
+		{"localhost", 443, "localhost:443"},
+		{"::", 5000, "[::]:5000"},
+		{"[::1]", 5000, "[::1]:5000"},
+		{"[::1]:5000", 0, "[::1]:5000"},
+		{"fe80::1%eth0", 5000, "[fe80::1%eth0]:5000"},
+	} {
+		got, err := ListenAddr(tc.addr, tc.port)
+		if err != nil || got != tc.want {
+			t.Errorf("ListenAddr(%q, %d) = %q, %v, want %q", tc.addr, tc.port, got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		addr string
+		port int
+	}{
+		{"0.0.0.0", 0},
+		{"", 0},
+		{"0.0.0.0:5000", 70000},
+		{"0.0.0.0:5000", -1},
+		{"0.0.0.0:99999", 0},
+		{"0.0.0.0:5000:1", 0},
+		{"[::1", 5000},
+	} {
+		if got, err := ListenAddr(tc.addr, tc.port); err == nil {
+			t.Errorf("ListenAddr(%q, %d) = %q, expected an error", tc.addr, tc.port, got)
+		}
+	}
+}
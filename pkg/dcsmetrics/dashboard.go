@@ -0,0 +1,194 @@
+package dcsmetrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rateInterval is the range of the rates of counters and histograms, which
+// Grafana sizes to the scrape interval and the resolution of the panel
+const rateInterval = "[$__rate_interval]"
+
+// panelWidth and panelHeight are the size of every panel in the grid of 24
+// columns of Grafana, two panels per line
+const (
+	panelWidth  = 12
+	panelHeight = 8
+)
+
+type target struct {
+	expr   string
+	legend string
+}
+
+type panel struct {
+	title   string
+	unit    string
+	targets []target
+}
+
+type row struct {
+	title  string
+	panels []panel
+}
+
+// metric returns the selector of the metric name of the cache server on the
+// instances chosen in the dashboard, with the additional label matchers
+func metric(name string, matchers ...string) string {
+	return fmt.Sprintf(`%s_%s{%s}`, NamespacePrefix, name,
+		strings.Join(append([]string{`instance=~"$instance"`}, matchers...), ","))
+}
+
+// quantile returns the q-quantile of the histogram name by the labels
+func quantile(q float64, name string, by string) string {
+	return fmt.Sprintf(`histogram_quantile(%g, sum by (%s, le) (rate(%s%s)))`, q, by, metric(name+"_bucket"), rateInterval)
+}
+
+var rows = []row{
+	{"Registry API", []panel{
+		{"Requests", "reqps", []target{
+			{`sum by (method, route) (rate(` + metric("http_request_duration_seconds_count") + rateInterval + `))`, "{{method}} {{route}}"},
+		}},
+		{"Errors", "reqps", []target{
+			{`sum by (method, route, status) (rate(` + metric("http_request_duration_seconds_count", `status=~"4xx|5xx"`) + rateInterval + `))`, "{{method}} {{route}} {{status}}"},
+		}},
+		{"Latency p50", "s", []target{
+			{quantile(0.5, "http_request_duration_seconds", "method, route"), "{{method}} {{route}}"},
+		}},
+		{"Latency p95", "s", []target{
+			{quantile(0.95, "http_request_duration_seconds", "method, route"), "{{method}} {{route}}"},
+		}},
+	}},
+	{"Transfers", []panel{
+		{"Blobs in transfer", "short", []target{
+			{`sum by (direction) (` + metric("inflight_transfers") + `)`, "{{direction}}"},
+			{`sum(` + metric("inflight_upload_sessions") + `)`, "upload sessions"},
+		}},
+		{"Size of blobs in transfer", "bytes", []target{
+			{`sum by (direction) (` + metric("inflight_transfer_bytes") + `)`, "{{direction}}"},
+		}},
+	}},
+	{"Upstream", []panel{
+		{"Upstream requests", "reqps", []target{
+			{`sum by (registry, result) (rate(` + metric("registry_client_requests_total") + rateInterval + `))`, "{{registry}} {{result}}"},
+		}},
+		{"Upstream latency p95", "s", []target{
+			{quantile(0.95, "registry_client_request_latency_seconds", "registry"), "{{registry}}"},
+		}},
+		{"Upstream digest mismatches", "short", []target{
+			{`sum by (kind) (increase(` + metric("upstream_digest_mismatches_total") + rateInterval + `))`, "{{kind}}"},
+		}},
+	}},
+	{"Storage", []panel{
+		{"Storage usage", "bytes", []target{
+			{`sum by (instance) (` + metric("storage_usage_bytes") + `)`, "used {{instance}}"},
+			{`sum by (instance) (` + metric("health_storage_free_bytes") + `)`, "free {{instance}}"},
+		}},
+		{"Storage objects", "short", []target{
+			{`sum by (instance) (` + metric("storage_objects") + `)`, "{{instance}}"},
+		}},
+		{"Cleanup backlog", "bytes", []target{
+			{`sum by (instance) (` + metric("cleanup_backlog_bytes") + `)`, "{{instance}}"},
+		}},
+		{"Quota usage", "bytes", []target{
+			{`max by (namespace) (` + metric("quota_usage_bytes") + `)`, "{{namespace}}"},
+		}},
+		{"Quota rejections", "short", []target{
+			{`sum by (namespace) (increase(` + metric("quota_rejections_total") + rateInterval + `))`, "{{namespace}}"},
+		}},
+	}},
+	{"Health and authentication", []panel{
+		{"Health checks", "short", []target{
+			{`min by (check) (` + metric("health_check_status") + `)`, "{{check}}"},
+		}},
+		{"Authentication failures", "short", []target{
+			{`sum by (reason) (increase(` + metric("auth_failures_total") + rateInterval + `))`, "{{reason}}"},
+			{`sum(increase(` + metric("auth_lockouts_total") + rateInterval + `))`, "lockouts"},
+		}},
+		{"Authentication challenges", "short", []target{
+			{`sum by (reason) (increase(` + metric("auth_challenges_total") + rateInterval + `))`, "{{reason}}"},
+		}},
+	}},
+}
+
+// Dashboard returns a Grafana dashboard of the metrics of the cache server,
+// to be encoded as JSON and imported. It asks for a Prometheus data source
+// and the instances to show.
+func Dashboard() map[string]any {
+	datasource := map[string]any{"type": "prometheus", "uid": "${datasource}"}
+
+	var panels []map[string]any
+	id, y := 1, 0
+	for _, r := range rows {
+		panels = append(panels, map[string]any{
+			"id":        id,
+			"type":      "row",
+			"title":     r.title,
+			"collapsed": false,
+			"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+			"panels":    []any{},
+		})
+		id++
+		y++
+		for i, p := range r.panels {
+			var targets []map[string]any
+			for j, t := range p.targets {
+				targets = append(targets, map[string]any{
+					"datasource":   datasource,
+					"expr":         t.expr,
+					"legendFormat": t.legend,
+					"refId":        string(rune('A' + j)),
+				})
+			}
+			panels = append(panels, map[string]any{
+				"id":         id,
+				"type":       "timeseries",
+				"title":      p.title,
+				"datasource": datasource,
+				"gridPos": map[string]int{
+					"h": panelHeight, "w": panelWidth,
+					"x": i % 2 * panelWidth, "y": y + i/2*panelHeight,
+				},
+				"fieldConfig": map[string]any{
+					"defaults":  map[string]any{"unit": p.unit},
+					"overrides": []any{},
+				},
+				"targets": targets,
+			})
+			id++
+		}
+		y += (len(r.panels) + 1) / 2 * panelHeight
+	}
+
+	return map[string]any{
+		"uid":           "docker-cache-server",
+		"title":         "docker-cache-server",
+		"tags":          []string{"docker-cache-server"},
+		"schemaVersion": 39,
+		"version":       1,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]any{"list": []any{
+			map[string]any{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			map[string]any{
+				"name":       "instance",
+				"label":      "Instance",
+				"type":       "query",
+				"datasource": datasource,
+				"query":      fmt.Sprintf("label_values(%s_http_request_duration_seconds_count, instance)", NamespacePrefix),
+				"refresh":    2,
+				"multi":      true,
+				"includeAll": true,
+				"allValue":   ".*",
+				"current":    map[string]any{"text": "All", "value": "$__all"},
+			},
+		}},
+		"panels": panels,
+	}
+}
@@ -0,0 +1,62 @@
+package dcsmetrics
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	data, err := json.Marshal(Dashboard())
+	if err != nil {
+		t.Fatalf("unexpected error encoding dashboard: %v", err)
+	}
+	var dashboard struct {
+		Panels []struct {
+			ID      int    `json:"id"`
+			Type    string `json:"type"`
+			Title   string `json:"title"`
+			GridPos struct {
+				H, W, X, Y int
+			} `json:"gridPos"`
+			Targets []struct {
+				Expr  string `json:"expr"`
+				RefID string `json:"refId"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(data, &dashboard); err != nil {
+		t.Fatalf("unexpected error decoding dashboard: %v", err)
+	}
+	if len(dashboard.Panels) == 0 {
+		t.Fatal("dashboard without panels")
+	}
+
+	ids := make(map[int]bool)
+	cells := make(map[[2]int]string)
+	for _, p := range dashboard.Panels {
+		if ids[p.ID] {
+			t.Errorf("duplicate panel id %d", p.ID)
+		}
+		ids[p.ID] = true
+		for x := p.GridPos.X; x < p.GridPos.X+p.GridPos.W; x++ {
+			for y := p.GridPos.Y; y < p.GridPos.Y+p.GridPos.H; y++ {
+				if other, ok := cells[[2]int{x, y}]; ok {
+					t.Errorf("panel %q overlaps %q", p.Title, other)
+				}
+				cells[[2]int{x, y}] = p.Title
+			}
+		}
+		if p.Type == "row" {
+			continue
+		}
+		if len(p.Targets) == 0 {
+			t.Errorf("panel %q without targets", p.Title)
+		}
+		for _, target := range p.Targets {
+			if !strings.Contains(target.Expr, NamespacePrefix+"_") || !strings.Contains(target.Expr, `instance=~"$instance"`) {
+				t.Errorf("unexpected expression of panel %q: %s", p.Title, target.Expr)
+			}
+		}
+	}
+}
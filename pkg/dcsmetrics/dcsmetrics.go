@@ -0,0 +1,8 @@
+// Package dcsmetrics holds the namespace of the metrics of the cache server
+// and generates a Grafana dashboard of them.
+package dcsmetrics
+
+// NamespacePrefix prefixes the metrics of the cache server. The http
+// metrics of the registry API inherited from distribution keep its
+// "registry" prefix.
+const NamespacePrefix = "dcs"
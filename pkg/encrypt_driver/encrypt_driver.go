@@ -0,0 +1,542 @@
+package encrypt_driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// Every file starts with a header holding a random salt from which the file
+// key is derived, followed by the content encrypted with AES-256-GCM in
+// chunks of chunkSize bytes. Only the last chunk may be shorter, so that
+// offsets and the plaintext size can be computed from the file size.
+//
+// Chunks are not bound to their position in the file beyond their nonce, a
+// file truncated at a chunk boundary still decrypts. Blobs are verified
+// against their digest by the registry, which detects such truncation.
+const (
+	chunkSize = 64 * 1024
+	tagSize   = 16
+	sealSize  = chunkSize + tagSize
+
+	headerSize = 32
+	keyIDSize  = 8
+	saltSize   = 16
+)
+
+var magic = []byte("DCSE")
+
+const version = 1
+
+// ErrKeyMismatch is returned when reading a file encrypted with another key.
+var ErrKeyMismatch = errors.New("file was encrypted with a different key")
+
+// Driver wraps a storage driver to encrypt everything written to it
+type Driver struct {
+	driver.StorageDriver
+	key   []byte
+	keyID []byte
+}
+
+// New creates a new encrypting storage driver using a 32 byte key
+func New(base driver.StorageDriver, key []byte) (*Driver, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &Driver{
+		StorageDriver: base,
+		key:           key,
+		keyID:         sum[:keyIDSize],
+	}, nil
+}
+
+// GetContent wraps the base driver's GetContent and decrypts the content
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	data, err := d.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%s: encrypted file too short", path)
+	}
+	aead, err := d.parseHeader(data[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	body := data[headerSize:]
+	content := make([]byte, 0, plainSize(int64(len(data))))
+	for index := uint64(0); len(body) > 0; index++ {
+		n := min(len(body), sealSize)
+		content, err = aead.Open(content, nonce(index), body[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: decrypting chunk %d: %w", path, index, err)
+		}
+		body = body[n:]
+	}
+	return content, nil
+}
+
+// PutContent encrypts the content and stores it through the base driver
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	header, aead, err := d.newHeader()
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 0, encryptedSize(int64(len(content))))
+	data = append(data, header...)
+	for index := uint64(0); len(content) > 0; index++ {
+		n := min(len(content), chunkSize)
+		data = aead.Seal(data, nonce(index), content[:n], nil)
+		content = content[n:]
+	}
+	return d.StorageDriver.PutContent(ctx, path, data)
+}
+
+// Reader returns a reader decrypting the content from offset
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+	}
+
+	aead, err := d.readHeader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := uint64(offset / chunkSize)
+	reader, err := d.StorageDriver.Reader(ctx, path, headerSize+int64(index)*sealSize)
+	if err != nil {
+		if errors.As(err, new(driver.InvalidOffsetError)) {
+			return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+		}
+		return nil, err
+	}
+
+	r := &chunkReader{
+		reader: reader,
+		aead:   aead,
+		index:  index,
+	}
+	if skip := offset % chunkSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			reader.Close()
+			if err == io.EOF {
+				return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Writer returns a writer encrypting the content. Appending to a file ending
+// with a partial chunk rewrites the file with a new key, as the chunk has to
+// be sealed again and a nonce is never used twice with the same key.
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	var encryptedLen int64
+	if append {
+		fi, err := d.StorageDriver.Stat(ctx, path)
+		if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			return nil, err
+		}
+		if err == nil {
+			encryptedLen = fi.Size()
+		}
+	}
+	if encryptedLen == 0 {
+		return d.newWriter(ctx, path)
+	}
+
+	aead, err := d.readHeader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	full := (encryptedLen - headerSize) / sealSize
+	w := &fileWriter{
+		driver: d,
+		ctx:    ctx,
+		path:   path,
+		aead:   aead,
+		index:  uint64(full),
+		size:   full * chunkSize,
+	}
+
+	tailLen := (encryptedLen - headerSize) % sealSize
+	if tailLen == 0 {
+		w.writer, err = d.StorageDriver.Writer(ctx, path, true)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// the tail has to be sealed again once completed, under the nonce it
+	// was sealed with already: the file is encrypted again with a new salt,
+	// hence a new key, rather than reusing the nonce
+	header, rekeyed, err := d.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := d.StorageDriver.Reader(ctx, path, headerSize)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	w.rewritePath = path + ".rewrite"
+	w.writer, err = d.StorageDriver.Writer(ctx, w.rewritePath, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.writer.Write(header); err != nil {
+		w.writer.Cancel(ctx)
+		return nil, err
+	}
+	chunks := &chunkReader{reader: reader, aead: aead}
+	chunk := make([]byte, chunkSize)
+	for index := uint64(0); index < w.index; index++ {
+		if _, err := io.ReadFull(chunks, chunk); err != nil {
+			w.writer.Cancel(ctx)
+			return nil, fmt.Errorf("%s: decrypting chunk %d: %w", path, index, err)
+		}
+		if _, err := w.writer.Write(rekeyed.Seal(nil, nonce(index), chunk, nil)); err != nil {
+			w.writer.Cancel(ctx)
+			return nil, err
+		}
+	}
+	w.buf, err = io.ReadAll(chunks)
+	if err != nil {
+		w.writer.Cancel(ctx)
+		return nil, fmt.Errorf("%s: decrypting last chunk: %w", path, err)
+	}
+	w.aead = rekeyed
+	w.size += int64(len(w.buf))
+	return w, nil
+}
+
+// newWriter starts a new encrypted file at path
+func (d *Driver) newWriter(ctx context.Context, path string) (*fileWriter, error) {
+	header, aead, err := d.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	writer, err := d.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(header); err != nil {
+		writer.Cancel(ctx)
+		return nil, err
+	}
+	return &fileWriter{
+		driver: d,
+		ctx:    ctx,
+		path:   path,
+		writer: writer,
+		aead:   aead,
+	}, nil
+}
+
+// Stat wraps the base driver's Stat and reports the plaintext size
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return plainFileInfo(fi), nil
+}
+
+// Walk wraps the base driver's Walk and reports plaintext sizes
+func (d *Driver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	return d.StorageDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+		return f(plainFileInfo(fi))
+	}, options...)
+}
+
+// RedirectURL disables redirects, which would hand out the encrypted content
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+// newHeader returns the header of a new file and the cipher of its content
+func (d *Driver) newHeader() ([]byte, cipher.AEAD, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	copy(header[8:], d.keyID)
+	salt := header[8+keyIDSize:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := d.fileCipher(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// parseHeader returns the cipher of the content following header
+func (d *Driver) parseHeader(header []byte) (cipher.AEAD, error) {
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errors.New("not an encrypted file")
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported encryption version %d", header[len(magic)])
+	}
+	if !bytes.Equal(header[8:8+keyIDSize], d.keyID) {
+		return nil, ErrKeyMismatch
+	}
+	return d.fileCipher(header[8+keyIDSize:])
+}
+
+// readHeader reads the header of the file at path
+func (d *Driver) readHeader(ctx context.Context, path string) (cipher.AEAD, error) {
+	reader, err := d.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%s: reading encryption header: %w", path, err)
+	}
+	aead, err := d.parseHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return aead, nil
+}
+
+// fileCipher derives the key of a file from its salt
+func (d *Driver) fileCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of the chunk with the given index
+func nonce(index uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], index)
+	return n
+}
+
+// plainSize returns the content size of an encrypted file of the given size
+func plainSize(encryptedLen int64) int64 {
+	body := encryptedLen - headerSize
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + sealSize - 1) / sealSize
+	return max(body-chunks*tagSize, 0)
+}
+
+// encryptedSize returns the size of the encrypted file holding size bytes
+func encryptedSize(size int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	return headerSize + size + chunks*tagSize
+}
+
+// plainFileInfo reports the content size of encrypted files
+func plainFileInfo(fi driver.FileInfo) driver.FileInfo {
+	if fi.IsDir() {
+		return fi
+	}
+	return driver.FileInfoInternal{
+		FileInfoFields: driver.FileInfoFields{
+			Path:    fi.Path(),
+			Size:    plainSize(fi.Size()),
+			ModTime: fi.ModTime(),
+			IsDir:   false,
+		},
+	}
+}
+
+// chunkReader decrypts chunks read from the base driver
+type chunkReader struct {
+	reader io.ReadCloser
+	aead   cipher.AEAD
+	index  uint64
+	sealed []byte
+	plain  []byte
+	buf    []byte
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.sealed == nil {
+			r.sealed = make([]byte, sealSize)
+		}
+		n, err := io.ReadFull(r.reader, r.sealed)
+		if err == io.EOF {
+			r.err = io.EOF
+			continue
+		}
+		if err == io.ErrUnexpectedEOF {
+			// the last chunk
+			r.err = io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		r.plain, err = r.aead.Open(r.plain[:0], nonce(r.index), r.sealed[:n], nil)
+		if err != nil {
+			r.err = fmt.Errorf("decrypting chunk %d: %w", r.index, err)
+			return 0, r.err
+		}
+		r.buf = r.plain
+		r.index++
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	return r.reader.Close()
+}
+
+// fileWriter seals full chunks as they are written and the remaining
+// partial chunk when the writer is closed or committed
+type fileWriter struct {
+	driver *Driver
+	ctx    context.Context
+	path   string
+	writer driver.FileWriter
+	aead   cipher.AEAD
+	index  uint64
+	buf    []byte
+	size   int64
+
+	// rewritePath is written instead of path, and moved to path once
+	// closed, when appending to a file ending with a partial chunk
+	rewritePath string
+
+	flushed   bool
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, chunkSize-len(w.buf))
+		w.buf = append(w.buf, p[written:written+n]...)
+		written += n
+		w.size += int64(n)
+		if len(w.buf) == chunkSize {
+			if err := w.seal(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// seal encrypts and writes the buffered chunk
+func (w *fileWriter) seal() error {
+	if _, err := w.writer.Write(w.aead.Seal(nil, nonce(w.index), w.buf, nil)); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// flush seals the remaining partial chunk, after which nothing can be
+// written anymore
+func (w *fileWriter) flush() error {
+	if w.flushed {
+		return nil
+	}
+	w.flushed = true
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.seal()
+}
+
+func (w *fileWriter) Size() int64 {
+	return w.size
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if !w.cancelled {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if err := w.writer.Close(); err != nil {
+		return err
+	}
+	if w.rewritePath != "" && !w.cancelled {
+		return w.driver.StorageDriver.Move(w.ctx, w.rewritePath, w.path)
+	}
+	return nil
+}
+
+func (w *fileWriter) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	return w.writer.Cancel(ctx)
+}
+
+func (w *fileWriter) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.writer.Commit(ctx); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
@@ -0,0 +1,199 @@
+package encrypt_driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func newTestDriver(t *testing.T) (*Driver, *inmemory.Driver) {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	base := inmemory.New()
+	d, err := New(base, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	return d, base
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestContentRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize - 7} {
+		content := randomContent(t, size)
+		if err := d.PutContent(ctx, "/content", content); err != nil {
+			t.Fatalf("unexpected error putting %d bytes: %v", size, err)
+		}
+
+		stored, err := base.GetContent(ctx, "/content")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 16 && bytes.Contains(stored, content[:16]) {
+			t.Fatalf("content of %d bytes stored in plaintext", size)
+		}
+
+		got, err := d.GetContent(ctx, "/content")
+		if err != nil {
+			t.Fatalf("unexpected error getting %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("content of %d bytes does not round trip", size)
+		}
+
+		fi, err := d.Stat(ctx, "/content")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(size) {
+			t.Fatalf("expected size %d, got %d", size, fi.Size())
+		}
+	}
+}
+
+func TestWriterAppendAndReader(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+	content := randomContent(t, 2*chunkSize+100)
+
+	// write in parts ending inside chunks, reopening the file in between as
+	// resumed uploads do
+	parts := []int{10, chunkSize + 5, 85, chunkSize}
+	offset := 0
+	for i, n := range parts {
+		w, err := d.Writer(ctx, "/upload", i > 0)
+		if err != nil {
+			t.Fatalf("unexpected error opening writer: %v", err)
+		}
+		if w.Size() != int64(offset) {
+			t.Fatalf("expected writer size %d, got %d", offset, w.Size())
+		}
+		if _, err := w.Write(content[offset : offset+n]); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		offset += n
+		if i == len(parts)-1 {
+			if err := w.Commit(ctx); err != nil {
+				t.Fatalf("unexpected error committing: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+	}
+
+	fi, err := d.Stat(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), fi.Size())
+	}
+
+	for _, off := range []int64{0, 7, chunkSize, chunkSize + 3, int64(len(content))} {
+		r, err := d.Reader(ctx, "/upload", off)
+		if err != nil {
+			t.Fatalf("unexpected error reading from %d: %v", off, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading from %d: %v", off, err)
+		}
+		if !bytes.Equal(got, content[off:]) {
+			t.Fatalf("unexpected content from offset %d", off)
+		}
+	}
+
+	if _, err := d.Reader(ctx, "/upload", int64(len(content))+1); err == nil {
+		t.Fatal("expected error reading beyond the end")
+	}
+}
+
+func TestKeyMismatch(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+	if err := d.PutContent(ctx, "/content", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := New(base, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetContent(ctx, "/content"); err == nil {
+		t.Fatal("expected error reading with another key")
+	}
+}
+
+func TestAppendPartialChunkChangesKey(t *testing.T) {
+	ctx := context.Background()
+	d, base := newTestDriver(t)
+	content := randomContent(t, chunkSize+30)
+
+	salt := func() []byte {
+		t.Helper()
+		stored, err := base.GetContent(ctx, "/upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored[8+keyIDSize : headerSize]
+	}
+	write := func(p []byte) {
+		t.Helper()
+		w, err := d.Writer(ctx, "/upload", true)
+		if err != nil {
+			t.Fatalf("unexpected error opening writer: %v", err)
+		}
+		if _, err := w.Write(p); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+	}
+
+	// the first part ends inside the second chunk, which is sealed again
+	// with the second part
+	write(content[:chunkSize+10])
+	first := salt()
+	write(content[chunkSize+10:])
+	if bytes.Equal(salt(), first) {
+		t.Fatal("expected a partial chunk sealed again under a new key")
+	}
+	got, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("appended content does not round trip")
+	}
+
+	// appending at a chunk boundary seals new chunks only
+	if err := d.PutContent(ctx, "/upload", content[:chunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	first = salt()
+	write(content[chunkSize:])
+	if !bytes.Equal(salt(), first) {
+		t.Fatal("expected the key kept when appending whole chunks")
+	}
+}
@@ -0,0 +1,54 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+)
+
+// StorageReadable returns a check listing dir through driver, for instances
+// which may not write to the storage.
+func StorageReadable(driver storagedriver.StorageDriver, dir string) CheckFunc {
+	return func(ctx context.Context) error {
+		if _, err := driver.List(ctx, dir); err != nil && !errors.As(err, new(storagedriver.PathNotFoundError)) {
+			return fmt.Errorf("listing %s: %w", dir, err)
+		}
+		return nil
+	}
+}
+
+// StorageWritable returns a check writing and deleting a probe file below
+// dir through driver. Every call uses a new file name, so that instances
+// sharing the storage do not interfere.
+func StorageWritable(driver storagedriver.StorageDriver, dir string) CheckFunc {
+	return func(ctx context.Context) error {
+		probe := path.Join(dir, uuid.NewString())
+		if err := driver.PutContent(ctx, probe, []byte("ok")); err != nil {
+			return fmt.Errorf("writing probe: %w", err)
+		}
+		if err := driver.Delete(ctx, probe); err != nil {
+			return fmt.Errorf("deleting probe: %w", err)
+		}
+		return nil
+	}
+}
+
+// MinFreeSpace returns a check failing when less than minBytes are available
+// to dir. The free space is also exported as a metric.
+func MinFreeSpace(dir string, minBytes int64) CheckFunc {
+	return func(ctx context.Context) error {
+		free, err := diskFree(dir)
+		if err != nil {
+			return fmt.Errorf("reading free space: %w", err)
+		}
+		freeSpace.Set(float64(free))
+		if free < uint64(minBytes) {
+			return fmt.Errorf("%d bytes free, below the minimum of %d", free, minBytes)
+		}
+		return nil
+	}
+}
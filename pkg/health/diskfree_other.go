@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package health
+
+import "errors"
+
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on this platform")
+}
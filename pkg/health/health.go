@@ -0,0 +1,157 @@
+// Package health periodically runs checks of the cache dependencies and
+// reports their results for readiness probes and metrics.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "health", nil)
+
+	checkStatus = namespace.NewLabeledGauge("check_status", "Whether a health check passes (1) or fails (0)", "", "check")
+	freeSpace   = namespace.NewGauge("storage_free", "Free space available to the storage directory", metrics.Bytes)
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// CheckFunc returns an error when the checked dependency is unhealthy.
+type CheckFunc func(ctx context.Context) error
+
+// Checker runs a set of named checks at a fixed interval and keeps their
+// latest results.
+type Checker struct {
+	interval time.Duration
+	timeout  time.Duration
+	logger   *logrus.Logger
+
+	checks map[string]CheckFunc
+
+	mu      sync.RWMutex
+	results map[string]error
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewChecker creates a checker running its checks every interval, each with
+// the given timeout.
+func NewChecker(interval, timeout time.Duration, logger *logrus.Logger) *Checker {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Checker{
+		interval: interval,
+		timeout:  timeout,
+		logger:   logger,
+		checks:   make(map[string]CheckFunc),
+		results:  make(map[string]error),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Register adds a named check. It must be called before Start.
+func (c *Checker) Register(name string, check CheckFunc) {
+	c.checks[name] = check
+}
+
+// Start runs the checks immediately and then every interval until ctx is
+// done or Stop is called.
+func (c *Checker) Start(ctx context.Context) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run(ctx)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.run(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks.
+func (c *Checker) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+// run executes every check and records its result.
+func (c *Checker) run(ctx context.Context) {
+	for name, check := range c.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		err := check(checkCtx)
+		cancel()
+
+		c.mu.Lock()
+		previous, known := c.results[name]
+		c.results[name] = err
+		c.mu.Unlock()
+
+		if err != nil {
+			checkStatus.WithValues(name).Set(0)
+			if !known || previous == nil {
+				c.logger.Errorf("health check %s failed: %v", name, err)
+			}
+		} else {
+			checkStatus.WithValues(name).Set(1)
+			if known && previous != nil {
+				c.logger.Infof("health check %s recovered", name)
+			}
+		}
+	}
+}
+
+// Healthy reports whether every check passed on its latest run. Checks
+// which have not run yet count as failing.
+func (c *Checker) Healthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.results) < len(c.checks) {
+		return false
+	}
+	for _, err := range c.results {
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the latest result of every check: "ok", "pending" or the
+// error message.
+func (c *Checker) Status() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := make(map[string]string, len(c.checks))
+	for name := range c.checks {
+		err, known := c.results[name]
+		if !known {
+			status[name] = "pending"
+		} else if err != nil {
+			status[name] = err.Error()
+		} else {
+			status[name] = "ok"
+		}
+	}
+	return status
+}
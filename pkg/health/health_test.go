@@ -0,0 +1,55 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestChecker(t *testing.T) {
+	failing := errors.New("unreachable")
+	var metadataErr error
+
+	checker := NewChecker(time.Hour, time.Second, nil)
+	checker.Register("storage", StorageWritable(inmemory.New(), "/health"))
+	checker.Register("metadata", func(ctx context.Context) error {
+		return metadataErr
+	})
+
+	if checker.Healthy() {
+		t.Fatal("expected checker to be unhealthy before the first run")
+	}
+	if status := checker.Status()["storage"]; status != "pending" {
+		t.Fatalf("unexpected status before the first run: %q", status)
+	}
+
+	checker.run(context.Background())
+	if !checker.Healthy() {
+		t.Fatalf("expected checker to be healthy: %v", checker.Status())
+	}
+
+	metadataErr = failing
+	checker.run(context.Background())
+	if checker.Healthy() {
+		t.Fatal("expected checker to be unhealthy")
+	}
+	status := checker.Status()
+	if status["storage"] != "ok" || status["metadata"] != failing.Error() {
+		t.Fatalf("unexpected status: %v", status)
+	}
+}
+
+func TestStorageWritableRemovesProbe(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	if err := StorageWritable(driver, "/health")(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := driver.List(ctx, "/health")
+	if err == nil && len(entries) != 0 {
+		t.Fatalf("expected probe to be removed, found %v", entries)
+	}
+}
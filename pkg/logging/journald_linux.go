@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSocket is where journald receives entries with its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// journaldHook sends log entries to journald with the syslog priority of
+// their level and their fields as journal fields. Entries too large for a
+// datagram are rejected by the socket.
+type journaldHook struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+func newJournaldHook(identifier string) (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn, identifier: identifier}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(journalPriority(entry.Level)))
+	if h.identifier != "" {
+		writeJournalField(&b, "SYSLOG_IDENTIFIER", h.identifier)
+	}
+	for key, value := range entry.Data {
+		if name := journalFieldName(key); name != "" {
+			writeJournalField(&b, name, fmt.Sprint(value))
+		}
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+// Close closes the connection to journald
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// writeJournalField appends a field, in the binary form if the value spans
+// several lines
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName turns a logrus field into a journal field name: upper
+// case letters, digits and underscores, not starting with an underscore,
+// reserved to trusted fields, or a digit
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// journalPriority returns the syslog priority of a level
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	}
+	return 7 // debug
+}
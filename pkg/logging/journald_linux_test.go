@@ -0,0 +1,16 @@
+package logging
+
+import "testing"
+
+func TestJournalFieldName(t *testing.T) {
+	for key, want := range map[string]string{
+		"repository":          "REPOSITORY",
+		"http.request.method": "HTTP_REQUEST_METHOD",
+		"_hostname":           "HOSTNAME",
+		"1st":                 "ST",
+	} {
+		if got := journalFieldName(key); got != want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package logging
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+type journaldHook struct {
+	logrus.Hook
+}
+
+func newJournaldHook(string) (*journaldHook, error) {
+	return nil, errors.New("journald is only supported on linux")
+}
+
+func (h *journaldHook) Close() error { return nil }
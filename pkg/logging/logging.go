@@ -0,0 +1,71 @@
+// Package logging sends the server logs to the output selected by the log
+// configuration: stdout, a rotated file, syslog or journald.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// nopCloser is returned by Setup for outputs with nothing to close
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Setup sends the logs of logger, and of the logrus standard logger used by
+// the registry handlers, to the output of cfg. The returned closer releases
+// the output once logging is done.
+func Setup(logger *logrus.Logger, cfg config.LogConfig) (io.Closer, error) {
+	loggers := []*logrus.Logger{logger}
+	if std := logrus.StandardLogger(); std != logger {
+		loggers = append(loggers, std)
+	}
+
+	switch cfg.Output {
+	case "", "stdout":
+		for _, l := range loggers {
+			l.SetOutput(os.Stdout)
+		}
+		return nopCloser{}, nil
+
+	case "file":
+		if cfg.File.Path == "" {
+			return nil, fmt.Errorf("log.file.path is required with the file output")
+		}
+		f, err := newRotatingFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range loggers {
+			l.SetOutput(f)
+		}
+		return f, nil
+
+	case "syslog":
+		hook, err := newSyslogHook(cfg.Syslog)
+		if err != nil {
+			return nil, fmt.Errorf("log.syslog: %w", err)
+		}
+		for _, l := range loggers {
+			l.SetOutput(io.Discard)
+			l.AddHook(hook)
+		}
+		return hook, nil
+
+	case "journald":
+		hook, err := newJournaldHook(cfg.Syslog.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("log.output journald: %w", err)
+		}
+		for _, l := range loggers {
+			l.SetOutput(io.Discard)
+			l.AddHook(hook)
+		}
+		return hook, nil
+	}
+	return nil, fmt.Errorf("unknown log.output %q, expected stdout, file, syslog or journald", cfg.Output)
+}
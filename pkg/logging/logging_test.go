@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "server.log")
+	f, err := newRotatingFile(config.LogFileConfig{Path: path, MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	f.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "gggg\n" {
+		t.Errorf("current file = %q, want %q", content, "gggg\n")
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2", backups)
+	}
+	var rotated []string
+	for _, backup := range backups {
+		content, err := os.ReadFile(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated = append(rotated, string(content))
+	}
+	if got, want := strings.Join(rotated, ""), "cccc\ndddd\neeee\nffff\n"; got != want {
+		t.Errorf("rotated files hold %q, want %q", got, want)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	old := path + "." + time.Now().Add(-48*time.Hour).Format(backupTimeFormat)
+	if err := os.WriteFile(old, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := filepath.Join(dir, "server.log.keep")
+	if err := os.WriteFile(unrelated, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newRotatingFile(config.LogFileConfig{Path: path, MaxSize: 4, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	f.Write([]byte("two\n"))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("backup older than max age not deleted: %v", err)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("file not rotated by the server deleted: %v", err)
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 1 {
+		t.Errorf("backups = %v, want the one just rotated", backups)
+	}
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+// backupTimeFormat is the suffix of rotated files, e.g.
+// server.log.20061016T150405.000
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file renamed with a timestamp suffix once it would
+// grow beyond the maximum size, keeping a bounded number of rotated files
+type rotatingFile struct {
+	cfg config.LogFileConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// newRotatingFile opens the log file of cfg for appending
+func newRotatingFile(cfg config.LogFileConfig) (*rotatingFile, error) {
+	f := &rotatingFile{cfg: cfg, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would make it grow
+// beyond the maximum size
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.cfg.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file with a timestamp suffix, opens a new one and
+// deletes the rotated files beyond MaxBackups or older than MaxAge
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.cfg.Path + "." + f.now().Format(backupTimeFormat)
+	if err := os.Rename(f.cfg.Path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.removeBackups()
+	return nil
+}
+
+// removeBackups deletes the rotated files beyond MaxBackups, oldest first,
+// and those older than MaxAge
+func (f *rotatingFile) removeBackups() {
+	matches, err := filepath.Glob(f.cfg.Path + ".*")
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, path := range matches {
+		rotated, err := time.ParseInLocation(backupTimeFormat, strings.TrimPrefix(path, f.cfg.Path+"."), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path, rotated})
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotated.After(backups[j].rotated)
+	})
+	for i, b := range backups {
+		tooMany := f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups
+		tooOld := f.cfg.MaxAge > 0 && f.now().Sub(b.rotated) > f.cfg.MaxAge
+		if tooMany || tooOld {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// Close closes the file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+
+package logging
+
+import (
+	"errors"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+type syslogHook struct {
+	logrus.Hook
+}
+
+func newSyslogHook(config.SyslogConfig) (*syslogHook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (h *syslogHook) Close() error { return nil }
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package logging
+
+import (
+	"log/syslog"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// syslogHook sends log entries to syslog with the severity of their level
+type syslogHook struct {
+	*lsyslog.SyslogHook
+}
+
+func newSyslogHook(cfg config.SyslogConfig) (*syslogHook, error) {
+	hook, err := lsyslog.NewSyslogHook(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, cfg.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{hook}, nil
+}
+
+// Close closes the connection to syslog
+func (h *syslogHook) Close() error {
+	return h.Writer.Close()
+}
@@ -2,7 +2,12 @@ package lru_driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/jc-lab/docker-cache-server/pkg/cache"
 
@@ -11,11 +16,24 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrDigestMismatch is returned by the Commit of blob data not matching the
+// digest of its path
+var ErrDigestMismatch = errors.New("content does not match its digest")
+
 // Driver wraps a storage driver to track blob access for LRU eviction
 type Driver struct {
 	driver.StorageDriver
 	tracker *cache.LRUTracker
 	logger  *logrus.Logger
+
+	// verifyReads checks the digest of blob data read in full
+	verifyReads bool
+	// locks serialize the writes and deletions of blobs with the other
+	// instances sharing the storage, if set
+	locks *cache.FileLocks
+
+	quarantineMu sync.RWMutex
+	quarantined  map[digest.Digest]QuarantinedBlob
 }
 
 // New creates a new LRU tracking storage driver
@@ -28,59 +46,201 @@ func New(base driver.StorageDriver, tracker *cache.LRUTracker, logger *logrus.Lo
 		StorageDriver: base,
 		tracker:       tracker,
 		logger:        logger,
+		quarantined:   make(map[digest.Digest]QuarantinedBlob),
+	}
+}
+
+// SetVerifyReads enables checking the digest of blob data read in full, the
+// blobs not matching it are quarantined. It must be called before the
+// driver is used.
+func (lru *Driver) SetVerifyReads(verify bool) {
+	lru.verifyReads = verify
+}
+
+// SetLocks makes the writes and deletions of blobs take the lock of their
+// digest, so that an instance does not delete a blob another instance
+// sharing the storage is writing. It must be called before the driver is
+// used.
+func (lru *Driver) SetLocks(locks *cache.FileLocks) {
+	lru.locks = locks
+}
+
+// lockBlob takes the lock of the blob dgst if locks are set. Locks are not
+// reentrant, nothing taking a lock may be called while holding one.
+func (lru *Driver) lockBlob(dgst digest.Digest) (func(), error) {
+	if lru.locks == nil {
+		return func() {}, nil
+	}
+	return lru.locks.Lock("blob:" + dgst.String())
+}
+
+// Stat wraps the base driver's Stat, hiding the data of quarantined blobs
+func (lru *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	if err := lru.quarantinedPath(path); err != nil {
+		return nil, err
 	}
+	return lru.StorageDriver.Stat(ctx, path)
 }
 
 // GetContent wraps the base driver's GetContent and tracks access
 func (lru *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := lru.quarantinedPath(path); err != nil {
+		return nil, err
+	}
 	content, err := lru.StorageDriver.GetContent(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	// Track access if this is a blob data file
-	if dgst := extractDigestFromPath(path); dgst != "" {
-		if err := lru.tracker.RecordAccess(dgst, int64(len(content))); err != nil {
-			lru.logger.Warnf("failed to record access for %s: %v", dgst, err)
+	// Track access if this is a blob data file or a link to a blob
+	switch p := parsePath(path); {
+	case p.kind == pathBlobData:
+		if lru.verifyReads && p.digest.Algorithm().Available() && p.digest.Algorithm().FromBytes(content) != p.digest {
+			if err := lru.Quarantine(ctx, p.digest, QuarantineRead, "stored content does not match the digest"); err != nil {
+				lru.logger.Errorf("failed to quarantine blob %s: %v", p.digest, err)
+			}
+			return nil, driver.PathNotFoundError{Path: path, DriverName: lru.Name()}
 		}
+		if err := lru.tracker.RecordRead(ctx, p.digest, int64(len(content))); err != nil {
+			lru.logger.Warnf("failed to record access for %s: %v", p.digest, err)
+		}
+	case p.isLink():
+		lru.recordLinkAccess(ctx, p, content)
 	}
 
 	return content, nil
 }
 
-// Reader wraps the base driver's Reader and tracks access
+// PutContent wraps the base driver's PutContent and tracks the write
+func (lru *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := lru.quarantinedWrite(path); err != nil {
+		return err
+	}
+	p := parsePath(path)
+	if p.kind == pathBlobData {
+		unlock, err := lru.lockBlob(p.digest)
+		if err != nil {
+			return err
+		}
+		err = lru.StorageDriver.PutContent(ctx, path, content)
+		unlock()
+		if err != nil {
+			return err
+		}
+	} else if err := lru.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+
+	// Manifests are stored through PutContent rather than a Writer
+	switch {
+	case p.kind == pathBlobData:
+		if err := lru.tracker.RecordWrite(p.digest, int64(len(content))); err != nil {
+			lru.logger.Warnf("failed to record write for %s: %v", p.digest, err)
+		}
+	case p.isLink():
+		lru.recordLinkAccess(ctx, p, content)
+	}
+
+	return nil
+}
+
+// Reader wraps the base driver's Reader and tracks access. Once ctx is
+// done, e.g. the client disconnected, the reader fails rather than reading
+// on from the storage.
 func (lru *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := lru.quarantinedPath(path); err != nil {
+		return nil, err
+	}
+	// nor does a request given up wait for the storage to open it
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	reader, err := lru.StorageDriver.Reader(ctx, path, offset)
 	if err != nil {
 		return nil, err
 	}
+	if ctx.Done() != nil {
+		reader = &contextReader{ReadCloser: reader, ctx: ctx}
+	}
 
-	// Track access if this is a blob data file
-	if dgst := extractDigestFromPath(path); dgst != "" {
+	// Track access if this is a blob data file, counting a read from the
+	// start only so that resumed requests count once. The tracker records
+	// the ranges of one request as a single access, not counted as a read.
+	if p := parsePath(path); p.kind == pathBlobData {
+		dgst := p.digest
+		record := lru.tracker.RecordAccess
+		if offset == 0 {
+			record = lru.tracker.RecordRead
+		}
 		// Get file info to track size
+		size := int64(-1)
 		if fi, err := lru.StorageDriver.Stat(ctx, path); err == nil {
-			if err := lru.tracker.RecordAccess(dgst, fi.Size()); err != nil {
+			size = fi.Size()
+			if err := record(ctx, dgst, size); err != nil {
 				lru.logger.Warnf("failed to record access for %s: %v", dgst, err)
 			}
 		}
+		if lru.verifyReads && offset == 0 && dgst.Algorithm().Available() {
+			reader = &verifyingReader{ReadCloser: reader, driver: lru, digest: dgst, verifier: dgst.Verifier(), size: size}
+		}
 	}
 
 	return reader, nil
 }
 
-// Writer wraps the base driver's Writer to track writes
-func (lru *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
-	lru.logger.Warnf("WRITER : %s | %v", path, append)
+// RedirectURL wraps the base driver's RedirectURL, tracking the access of
+// blob data served by a redirect as a read. Quarantined blobs, blobs read
+// for verification and HEAD requests are not redirected.
+func (lru *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	p := parsePath(path)
+	if p.kind != pathBlobData {
+		return lru.StorageDriver.RedirectURL(r, path)
+	}
+	if r.Method != http.MethodGet || lru.verifyReads || lru.isQuarantined(p.digest) {
+		return "", nil
+	}
+	redirectURL, err := lru.StorageDriver.RedirectURL(r, path)
+	if err != nil || redirectURL == "" {
+		return redirectURL, err
+	}
+
+	ctx := r.Context()
+	if fi, err := lru.StorageDriver.Stat(ctx, path); err == nil {
+		// as Reader, a range request does not count as a read
+		record := lru.tracker.RecordRead
+		if r.Header.Get("Range") != "" {
+			record = lru.tracker.RecordAccess
+		}
+		if err := record(ctx, p.digest, fi.Size()); err != nil {
+			lru.logger.Warnf("failed to record access for %s: %v", p.digest, err)
+		}
+	}
+	return redirectURL, nil
+}
 
+// Writer wraps the base driver's Writer to track writes. Once ctx is done
+// the writer fails rather than writing on. Writes to complete after the
+// client is gone, such as caching a pulled blob, pass a context without
+// cancellation.
+func (lru *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	if err := lru.quarantinedWrite(path); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	writer, err := lru.StorageDriver.Writer(ctx, path, append)
 	if err != nil {
 		return nil, err
 	}
 
-	// Extract digest from path if available
-	dgst := extractDigestFromPath(path)
+	// Only the data of blobs is tracked, uploads are tracked once moved
+	var dgst digest.Digest
+	if p := parsePath(path); p.kind == pathBlobData {
+		dgst = p.digest
+	}
 
-	return &lruFileWriter{
+	w := &lruFileWriter{
 		FileWriter: writer,
 		tracker:    lru.tracker,
 		digest:     dgst,
@@ -88,19 +248,52 @@ func (lru *Driver) Writer(ctx context.Context, path string, append bool) (driver
 		driver:     lru,
 		ctx:        ctx,
 		logger:     lru.logger,
-	}, nil
+	}
+	if dgst != "" && dgst.Algorithm().Available() {
+		w.verifier = dgst.Verifier()
+		if append && writer.Size() > 0 {
+			if err := lru.hashWritten(ctx, path, writer.Size(), w.verifier); err != nil {
+				writer.Close()
+				return nil, err
+			}
+		}
+	}
+	return w, nil
+}
+
+// hashWritten passes the size bytes already written at path to verifier,
+// when a writer appends to them
+func (lru *Driver) hashWritten(ctx context.Context, path string, size int64, verifier digest.Verifier) error {
+	r, err := lru.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return fmt.Errorf("reading %s to verify: %w", path, err)
+	}
+	defer r.Close()
+	if _, err := io.CopyN(verifier, r, size); err != nil {
+		return fmt.Errorf("reading %s to verify: %w", path, err)
+	}
+	return nil
 }
 
 func (lru *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	lru.logger.Warnf("MOVE : %s -> %s", sourcePath, destPath)
-	if err := lru.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+	if err := lru.quarantinedWrite(destPath); err != nil {
 		return err
 	}
+	p := parsePath(destPath)
+	if p.kind != pathBlobData {
+		return lru.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
 
-	dgst := extractDigestFromPath(destPath)
-	if dgst != "" {
-		lru.recordWrite(ctx, destPath, dgst)
+	unlock, err := lru.lockBlob(p.digest)
+	if err != nil {
+		return err
 	}
+	err = lru.StorageDriver.Move(ctx, sourcePath, destPath)
+	unlock()
+	if err != nil {
+		return err
+	}
+	lru.recordWrite(ctx, destPath, p.digest)
 
 	return nil
 }
@@ -114,6 +307,19 @@ func (lru *Driver) recordWrite(ctx context.Context, path string, dgst digest.Dig
 	}
 }
 
+// contextReader fails the reads once its context is done
+type contextReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
 // lruFileWriter wraps a FileWriter to track writes when committed
 type lruFileWriter struct {
 	driver.FileWriter
@@ -123,10 +329,37 @@ type lruFileWriter struct {
 	driver  *Driver
 	ctx     context.Context
 	logger  *logrus.Logger
+
+	// verifier hashes the content of blob data, nil for other paths
+	verifier digest.Verifier
 }
 
-// Commit wraps the base writer's Commit and tracks the write
+// Write wraps the base writer's Write and hashes the content of blob data
+func (w *lruFileWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.FileWriter.Write(p)
+	if w.verifier != nil {
+		w.verifier.Write(p[:n])
+	}
+	return n, err
+}
+
+// Commit wraps the base writer's Commit and tracks the write. Blob data not
+// matching the digest of its path is quarantined instead, so that corrupt
+// content never enters the cache.
 func (w *lruFileWriter) Commit(ctx context.Context) error {
+	if w.verifier != nil && !w.verifier.Verified() {
+		w.logger.Warnf("rejecting blob %s: content of %d bytes does not match its digest", w.digest, w.Size())
+		if err := w.FileWriter.Commit(ctx); err != nil {
+			w.FileWriter.Cancel(ctx)
+		} else if err := w.driver.Quarantine(ctx, w.digest, QuarantineUpload, "written content does not match the digest"); err != nil {
+			w.logger.Errorf("failed to quarantine blob %s: %v", w.digest, err)
+			w.driver.StorageDriver.Delete(ctx, w.path)
+		}
+		return fmt.Errorf("%w: %s", ErrDigestMismatch, w.digest)
+	}
 	if err := w.FileWriter.Commit(ctx); err != nil {
 		return err
 	}
@@ -139,47 +372,139 @@ func (w *lruFileWriter) Commit(ctx context.Context) error {
 	return nil
 }
 
-// extractDigestFromPath extracts the digest from a blob storage path
-// Blob paths typically look like: /docker/registry/v2/blobs/sha256/ab/abc123.../data
-func extractDigestFromPath(path string) digest.Digest {
-	// This is a simplified extraction - you may need to adjust based on actual path structure
-	// The distribution library uses paths like: /docker/registry/v2/blobs/{algorithm}/{first2}/{digest}/data
-	if len(path) < 20 {
-		return ""
-	}
-
-	// Look for pattern like "sha256/ab/abc..." or "blobs/sha256/..."
-	// We'll parse this more carefully
-	parts := splitPath(path)
-	for i, part := range parts {
-		if part == "blobs" && i+3 < len(parts) {
-			// Next should be algorithm (sha256), then first2, then full digest
-			algorithm := parts[i+1]
-			fullDigest := parts[i+3]
-			dgstStr := algorithm + ":" + fullDigest
-			if dgst, err := digest.Parse(dgstStr); err == nil {
-				return dgst
-			}
+// recordLinkAccess tracks an access to the blob a repository link refers to.
+// Resolving a blob or manifest by repository only reads its link, the data
+// is read from the blob store or a cache, so the link is the only access the
+// driver sees. Untracked blobs are recorded with the size of their data.
+// Links also associate the blob with their repository, except the current
+// link of a tag, whose manifest is associated by its revision link.
+func (lru *Driver) recordLinkAccess(ctx context.Context, p storagePath, content []byte) {
+	dgst := p.digest
+	if p.kind == pathTagCurrentLink {
+		var err error
+		if dgst, err = digest.Parse(strings.TrimSpace(string(content))); err != nil {
+			return
 		}
 	}
+	tracked := lru.tracker.Touch(ctx, dgst)
+	if !tracked && cache.AccessModeFromContext(ctx) != cache.AccessSkip {
+		fi, err := lru.StorageDriver.Stat(ctx, blobDataPath(dgst))
+		if err != nil {
+			return
+		}
+		if err := lru.tracker.RecordAccess(ctx, dgst, fi.Size()); err != nil {
+			lru.logger.Warnf("failed to record access for %s: %v", dgst, err)
+			return
+		}
+		tracked = true
+	}
+	if tracked && p.kind != pathTagCurrentLink {
+		lru.tracker.AddRepository(dgst, p.repository)
+	}
+}
 
-	return ""
+// Evict deletes a blob together with its links in the repositories it was
+// seen linked into. Links go first, so that a failed eviction leaves no link
+// to missing data, and the tags of a manifest before its revision, so that
+// clients get a clean not found rather than a tag without its manifest.
+// Links and data already gone are ignored. It is the deletion function of
+// the cleanup, which claims the blob beforehand and stops tracking it once
+// deleted.
+func (lru *Driver) Evict(ctx context.Context, dgst digest.Digest) error {
+	meta, _ := lru.tracker.Blob(dgst)
+	unlock, err := lru.lockBlob(dgst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, name := range meta.Repositories {
+		if err := lru.deleteLinks(ctx, name, dgst); err != nil {
+			return fmt.Errorf("deleting links of %s in %s: %w", dgst, name, err)
+		}
+	}
+	if err := lru.StorageDriver.Delete(ctx, blobDir(dgst)); err != nil && !isNotFound(err) {
+		return fmt.Errorf("deleting %s: %w", dgst, err)
+	}
+	return nil
 }
 
-// splitPath splits a path by '/' separator
-func splitPath(path string) []string {
-	var parts []string
-	start := 0
-	for i := 0; i < len(path); i++ {
-		if path[i] == '/' {
-			if i > start {
-				parts = append(parts, path[start:i])
+// repositoryContents are the directories of a repository below its own
+// directory: its manifests and tags, its layer links and its upload sessions
+var repositoryContents = []string{"_manifests", "_layers", "_uploads"}
+
+// DeleteRepository deletes the manifests, tags, layer links and upload
+// sessions of the repository name, but not the repositories nested in it.
+// Blobs and their tracking are left to the caller. It returns a
+// driver.PathNotFoundError if the repository does not exist.
+func (lru *Driver) DeleteRepository(ctx context.Context, name string) error {
+	found := false
+	for _, dir := range repositoryContents {
+		path := repositoryDir(name) + "/" + dir
+		if err := lru.StorageDriver.Delete(ctx, path); err != nil {
+			if isNotFound(err) {
+				continue
 			}
-			start = i + 1
+			return fmt.Errorf("deleting %s of %s: %w", dir, name, err)
+		}
+		found = true
+	}
+	if !found {
+		return driver.PathNotFoundError{Path: repositoryDir(name), DriverName: lru.Name()}
+	}
+	return nil
+}
+
+// deleteLinks deletes the links of the blob dgst in the repository name: its
+// layer link, and if it is a manifest the tags pointing to it, its entries in
+// the index of other tags and its revision.
+func (lru *Driver) deleteLinks(ctx context.Context, name string, dgst digest.Digest) error {
+	revision := manifestRevisionDir(name, dgst)
+	if _, err := lru.StorageDriver.Stat(ctx, revision); err == nil {
+		if err := lru.deleteTags(ctx, name, dgst); err != nil {
+			return err
+		}
+		if err := lru.StorageDriver.Delete(ctx, revision); err != nil && !isNotFound(err) {
+			return err
+		}
+	} else if !isNotFound(err) {
+		return err
+	}
+	if err := lru.StorageDriver.Delete(ctx, layerLinkDir(name, dgst)); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteTags deletes the tags of the repository name pointing to the manifest
+// dgst, and the entries of the manifest in the index of the other tags
+func (lru *Driver) deleteTags(ctx context.Context, name string, dgst digest.Digest) error {
+	tags, err := lru.StorageDriver.List(ctx, tagsDir(name))
+	if err != nil {
+		if isNotFound(err) {
+			return nil
 		}
+		return err
 	}
-	if start < len(path) {
-		parts = append(parts, path[start:])
+	for _, tag := range tags {
+		content, err := lru.StorageDriver.GetContent(ctx, tag+"/current/link")
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err == nil && digest.Digest(strings.TrimSpace(string(content))) == dgst {
+			lru.logger.Infof("deleting tag %s of deleted manifest %s", tag, dgst)
+			if err := lru.StorageDriver.Delete(ctx, tag); err != nil && !isNotFound(err) {
+				return err
+			}
+			continue
+		}
+		index := tag + "/index/" + dgst.Algorithm().String() + "/" + dgst.Encoded()
+		if err := lru.StorageDriver.Delete(ctx, index); err != nil && !isNotFound(err) {
+			return err
+		}
 	}
-	return parts
+	return nil
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, new(driver.PathNotFoundError))
 }
@@ -0,0 +1,442 @@
+package lru_driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+func newTestDriver(t *testing.T) (*Driver, *cache.LRUTracker) {
+	t.Helper()
+	tracker, err := cache.NewLRUTrackerWithStore(cache.MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	<-tracker.Loaded()
+	return New(inmemory.New(), tracker, nil), tracker
+}
+
+func TestLinkAccess(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+
+	data := []byte("layer")
+	dgst := digest.FromBytes(data)
+	if err := d.StorageDriver.PutContent(ctx, blobDataPath(dgst), data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	link := layerLinkDir("alpine", dgst) + "/link"
+	if err := d.StorageDriver.PutContent(ctx, link, []byte(dgst)); err != nil {
+		t.Fatalf("unexpected error writing link: %v", err)
+	}
+
+	if _, err := d.GetContent(cache.WithAccessMode(ctx, cache.AccessSkip), link); err != nil {
+		t.Fatalf("unexpected error reading link: %v", err)
+	}
+	if _, tracked := tracker.Blob(dgst); tracked {
+		t.Fatal("link read with AccessSkip was tracked")
+	}
+
+	if _, err := d.GetContent(ctx, link); err != nil {
+		t.Fatalf("unexpected error reading link: %v", err)
+	}
+	meta, tracked := tracker.Blob(dgst)
+	if !tracked || meta.Size != int64(len(data)) {
+		t.Fatalf("link read was not tracked with the size of the blob: %+v", meta)
+	}
+	if !slices.Equal(meta.Repositories, []string{"alpine"}) {
+		t.Fatalf("repositories = %v, want [alpine]", meta.Repositories)
+	}
+
+	// the current link of a tag refers to its manifest by content
+	manifest := []byte("{}")
+	manifestDigest := digest.FromBytes(manifest)
+	if err := d.StorageDriver.PutContent(ctx, blobDataPath(manifestDigest), manifest); err != nil {
+		t.Fatalf("unexpected error writing manifest: %v", err)
+	}
+	current := "/docker/registry/v2/repositories/alpine/_manifests/tags/latest/current/link"
+	if err := d.PutContent(ctx, current, []byte(manifestDigest)); err != nil {
+		t.Fatalf("unexpected error writing tag: %v", err)
+	}
+	meta, tracked = tracker.Blob(manifestDigest)
+	if !tracked {
+		t.Fatal("tag write was not tracked")
+	}
+	if len(meta.Repositories) != 0 {
+		t.Errorf("manifest associated with repositories %v by its tag", meta.Repositories)
+	}
+}
+
+func TestWriterVerifiesDigest(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+
+	data := []byte("layer data")
+	dgst := digest.FromBytes(data)
+	path := blobDataPath(dgst)
+
+	// content resumed by an appending writer is verified as a whole
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(data[:5]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+	if w, err = d.Writer(ctx, path, true); err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if _, err := w.Write(data[5:]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if meta, tracked := tracker.Blob(dgst); !tracked || meta.Size != int64(len(data)) {
+		t.Fatalf("committed blob was not tracked with its size: %+v", meta)
+	}
+
+	corrupt := digest.FromString("other")
+	if w, err = d.Writer(ctx, blobDataPath(corrupt), false); err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("commit error = %v, want %v", err, ErrDigestMismatch)
+	}
+	if _, tracked := tracker.Blob(corrupt); tracked {
+		t.Error("mismatching blob was tracked")
+	}
+	if _, err := d.StorageDriver.Stat(ctx, blobDataPath(corrupt)); !isNotFound(err) {
+		t.Errorf("mismatching blob was not cleaned up: %v", err)
+	}
+	if blobs := d.QuarantinedBlobs(); len(blobs) != 1 || blobs[0].Digest != corrupt || blobs[0].Source != QuarantineUpload {
+		t.Errorf("unexpected quarantined blobs %+v", blobs)
+	}
+}
+
+func TestCanceledTransfer(t *testing.T) {
+	d, tracker := newTestDriver(t)
+
+	data := []byte("layer data")
+	dgst := digest.FromBytes(data)
+	path := blobDataPath(dgst)
+	if err := d.StorageDriver.PutContent(context.Background(), path, data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+
+	// a pull aborted by the client stops reading
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	cancel()
+	if _, err := r.Read(make([]byte, 5)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read error after cancel = %v, want %v", err, context.Canceled)
+	}
+	if blobs := d.QuarantinedBlobs(); len(blobs) != 0 {
+		t.Fatalf("aborted read quarantined %+v", blobs)
+	}
+	tracker.RemoveBlob(dgst)
+	if _, err := d.Reader(ctx, path, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("open error after cancel = %v, want %v", err, context.Canceled)
+	}
+	if _, tracked := tracker.Blob(dgst); tracked {
+		t.Fatal("read of a canceled request was tracked")
+	}
+
+	// and so does a push
+	other := digest.FromString("other")
+	ctx, cancel = context.WithCancel(context.Background())
+	w, err := d.Writer(ctx, blobDataPath(other), false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Write(data[:5]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	cancel()
+	if _, err := w.Write(data[5:]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("write error after cancel = %v, want %v", err, context.Canceled)
+	}
+	if w.Size() != 5 {
+		t.Fatalf("writer size = %d after cancel, want 5", w.Size())
+	}
+	if _, err := d.Writer(ctx, blobDataPath(other), true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("writer error after cancel = %v, want %v", err, context.Canceled)
+	}
+
+	// unless the transfer is meant to outlive the request
+	ctx, cancel = context.WithCancel(context.Background())
+	r, err = d.Reader(context.WithoutCancel(ctx), path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	defer r.Close()
+	cancel()
+	if _, err := r.Read(make([]byte, len(data))); err != nil {
+		t.Fatalf("unexpected error reading without cancellation: %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+
+	data := []byte("layer")
+	dgst := digest.FromBytes(data)
+	if err := d.PutContent(ctx, blobDataPath(dgst), data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	for _, name := range []string{"alpine", "library/alpine"} {
+		if err := d.PutContent(ctx, layerLinkDir(name, dgst)+"/link", []byte(dgst)); err != nil {
+			t.Fatalf("unexpected error writing link: %v", err)
+		}
+	}
+	// a link the tracker never saw is kept
+	other := layerLinkDir("busybox", dgst) + "/link"
+	if err := d.StorageDriver.PutContent(ctx, other, []byte(dgst)); err != nil {
+		t.Fatalf("unexpected error writing link: %v", err)
+	}
+
+	if meta, _ := tracker.Blob(dgst); !slices.Equal(meta.Repositories, []string{"alpine", "library/alpine"}) {
+		t.Fatalf("repositories = %v, want [alpine library/alpine]", meta.Repositories)
+	}
+
+	if err := d.Evict(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error evicting blob: %v", err)
+	}
+	for _, path := range []string{blobDataPath(dgst), layerLinkDir("alpine", dgst), layerLinkDir("library/alpine", dgst)} {
+		if _, err := d.Stat(ctx, path); !isNotFound(err) {
+			t.Errorf("%s was not deleted: %v", path, err)
+		}
+	}
+	if _, err := d.Stat(ctx, other); err != nil {
+		t.Errorf("untracked link was deleted: %v", err)
+	}
+
+	// evicting again finds nothing left to delete
+	if err := d.Evict(ctx, dgst); err != nil {
+		t.Errorf("unexpected error evicting blob again: %v", err)
+	}
+}
+
+func TestEvictManifest(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+
+	manifest := []byte("{}")
+	dgst := digest.FromBytes(manifest)
+	other := digest.FromString("other")
+	if err := d.PutContent(ctx, blobDataPath(dgst), manifest); err != nil {
+		t.Fatalf("unexpected error writing manifest: %v", err)
+	}
+	tags := tagsDir("alpine")
+	indexEntry := tags + "/old/index/" + dgst.Algorithm().String() + "/" + dgst.Encoded()
+	links := map[string]digest.Digest{
+		manifestRevisionDir("alpine", dgst) + "/link":                                        dgst,
+		tags + "/latest/current/link":                                                        dgst,
+		tags + "/latest/index/" + dgst.Algorithm().String() + "/" + dgst.Encoded() + "/link": dgst,
+		tags + "/old/current/link":                                                           other,
+		indexEntry + "/link":                                                                 dgst,
+	}
+	for path, target := range links {
+		if err := d.PutContent(ctx, path, []byte(target)); err != nil {
+			t.Fatalf("unexpected error writing %s: %v", path, err)
+		}
+	}
+
+	if err := d.Evict(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error evicting manifest: %v", err)
+	}
+	for _, path := range []string{blobDataPath(dgst), manifestRevisionDir("alpine", dgst), tags + "/latest", indexEntry} {
+		if _, err := d.Stat(ctx, path); !isNotFound(err) {
+			t.Errorf("%s was not deleted: %v", path, err)
+		}
+	}
+	// tags pointing to other manifests are kept
+	if _, err := d.Stat(ctx, tags+"/old/current/link"); err != nil {
+		t.Errorf("tag of another manifest was deleted: %v", err)
+	}
+}
+
+func TestDeleteRepository(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+
+	dgst := digest.FromString("layer")
+	paths := []string{
+		layerLinkDir("alpine", dgst) + "/link",
+		manifestRevisionDir("alpine", dgst) + "/link",
+		tagsDir("alpine") + "/latest/current/link",
+		repositoryDir("alpine") + "/_uploads/0b7f0b9c/data",
+	}
+	// a nested repository is kept
+	nested := layerLinkDir("alpine/nested", dgst) + "/link"
+	for _, path := range append(paths, nested) {
+		if err := d.StorageDriver.PutContent(ctx, path, []byte(dgst)); err != nil {
+			t.Fatalf("unexpected error writing %s: %v", path, err)
+		}
+	}
+
+	if err := d.DeleteRepository(ctx, "alpine"); err != nil {
+		t.Fatalf("unexpected error deleting repository: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := d.Stat(ctx, path); !isNotFound(err) {
+			t.Errorf("%s was not deleted: %v", path, err)
+		}
+	}
+	if _, err := d.Stat(ctx, nested); err != nil {
+		t.Errorf("nested repository was deleted: %v", err)
+	}
+
+	if err := d.DeleteRepository(ctx, "alpine"); !isNotFound(err) {
+		t.Errorf("expected deleting the repository again to fail with not found, got %v", err)
+	}
+}
+
+func TestPruneRepository(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+
+	put := func(path string, content []byte) {
+		t.Helper()
+		if err := d.PutContent(ctx, path, content); err != nil {
+			t.Fatalf("unexpected error writing %s: %v", path, err)
+		}
+	}
+	blob := func(content string) digest.Digest {
+		dgst := digest.FromString(content)
+		put(blobDataPath(dgst), []byte(content))
+		return dgst
+	}
+	manifest := func(format string, args ...any) digest.Digest {
+		dgst := blob(fmt.Sprintf(format, args...))
+		put(manifestRevisionDir("alpine", dgst)+"/link", []byte(dgst))
+		return dgst
+	}
+	layer := func(content string) digest.Digest {
+		dgst := blob(content)
+		put(layerLinkDir("alpine", dgst)+"/link", []byte(dgst))
+		return dgst
+	}
+
+	keptLayer, oldLayer := layer("kept layer"), layer("old layer")
+	child := manifest(`{"layers":[{"digest":%q}]}`, keptLayer)
+	list := manifest(`{"manifests":[{"digest":%q}]}`, child)
+	old := manifest(`{"layers":[{"digest":%q}]}`, oldLayer)
+	put(tagsDir("alpine")+"/latest/current/link", []byte(list))
+	put(tagsDir("alpine")+"/old/current/link", []byte(old))
+	// the old layer is also linked into another repository
+	put(layerLinkDir("busybox", oldLayer)+"/link", []byte(oldLayer))
+
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	// pulling the list by tag keeps it with the image it references
+	if _, err := d.GetContent(ctx, tagsDir("alpine")+"/latest/current/link"); err != nil {
+		t.Fatalf("unexpected error reading tag: %v", err)
+	}
+
+	want := PruneResult{
+		Repository: "alpine",
+		Tags:       []string{"old"},
+		Manifests:  []digest.Digest{old},
+		Blobs:      []digest.Digest{oldLayer},
+		Orphans:    []digest.Digest{old},
+	}
+	dryRun, err := d.PruneRepository(ctx, "alpine", cutoff, true)
+	if err != nil {
+		t.Fatalf("unexpected error in dry run: %v", err)
+	}
+	if !reflect.DeepEqual(dryRun, want) {
+		t.Fatalf("dry run = %+v, want %+v", dryRun, want)
+	}
+	if _, err := d.Stat(ctx, manifestRevisionDir("alpine", old)); err != nil {
+		t.Fatalf("dry run deleted the manifest: %v", err)
+	}
+
+	result, err := d.PruneRepository(ctx, "alpine", cutoff, false)
+	if err != nil {
+		t.Fatalf("unexpected error pruning: %v", err)
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("result = %+v, want %+v", result, want)
+	}
+	for _, path := range []string{manifestRevisionDir("alpine", old), layerLinkDir("alpine", oldLayer), tagsDir("alpine") + "/old"} {
+		if _, err := d.Stat(ctx, path); !isNotFound(err) {
+			t.Errorf("%s was not deleted: %v", path, err)
+		}
+	}
+	for _, path := range []string{manifestRevisionDir("alpine", list), manifestRevisionDir("alpine", child), layerLinkDir("alpine", keptLayer), layerLinkDir("busybox", oldLayer)} {
+		if _, err := d.Stat(ctx, path); err != nil {
+			t.Errorf("%s was deleted: %v", path, err)
+		}
+	}
+	if meta, _ := tracker.Blob(oldLayer); !slices.Equal(meta.Repositories, []string{"busybox"}) {
+		t.Errorf("repositories of the old layer = %v, want [busybox]", meta.Repositories)
+	}
+}
+
+// presignDriver redirects to pre-signed URLs of an object storage
+type presignDriver struct {
+	driver.StorageDriver
+}
+
+func (presignDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "https://bucket.example.com" + path + "?X-Amz-Signature=abc", nil
+}
+
+func TestRedirectURL(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+	d.StorageDriver = presignDriver{d.StorageDriver}
+
+	data := []byte("layer")
+	dgst := digest.FromBytes(data)
+	if err := d.StorageDriver.PutContent(ctx, blobDataPath(dgst), data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+
+	head := httptest.NewRequest(http.MethodHead, "/v2/alpine/blobs/"+dgst.String(), nil)
+	if url, err := d.RedirectURL(head, blobDataPath(dgst)); err != nil || url != "" {
+		t.Errorf("unexpected redirect of HEAD: %q, %v", url, err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/v2/alpine/blobs/"+dgst.String(), nil)
+	url, err := d.RedirectURL(get, blobDataPath(dgst))
+	if err != nil || url == "" {
+		t.Fatalf("expected redirect, got %q, %v", url, err)
+	}
+	if meta, tracked := tracker.Blob(dgst); !tracked || meta.Reads != 1 || meta.Size != int64(len(data)) {
+		t.Errorf("redirected read not tracked: %+v", meta)
+	}
+
+	d.SetVerifyReads(true)
+	if url, err := d.RedirectURL(get, blobDataPath(dgst)); err != nil || url != "" {
+		t.Errorf("unexpected redirect of a blob verified on read: %q, %v", url, err)
+	}
+}
@@ -0,0 +1,169 @@
+package lru_driver
+
+import (
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// storageRoot is the root of the layout distribution uses in the storage
+// driver, see registry/storage/paths.go of distribution
+const storageRoot = "/docker/registry/v2/"
+
+// pathKind is the kind of file a storage path refers to
+type pathKind int
+
+const (
+	// pathOther is any path not referring to a blob
+	pathOther pathKind = iota
+	// pathBlobData is the data of a blob:
+	// blobs/<algorithm>/<first two hex bytes>/<hex digest>/data
+	pathBlobData
+	// pathLayerLink links a blob into a repository:
+	// repositories/<name>/_layers/<algorithm>/<hex digest>/link
+	pathLayerLink
+	// pathRevisionLink links a manifest into a repository:
+	// repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/link
+	pathRevisionLink
+	// pathTagIndexLink records a manifest a tag pointed to:
+	// repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/link
+	pathTagIndexLink
+	// pathTagCurrentLink holds the digest of the manifest a tag points to:
+	// repositories/<name>/_manifests/tags/<tag>/current/link
+	pathTagCurrentLink
+)
+
+// storagePath is a storage path parsed according to the layout of
+// distribution
+type storagePath struct {
+	kind       pathKind
+	repository string        // empty for blob data
+	digest     digest.Digest // empty for the current link of a tag
+}
+
+// isLink reports whether the path is a link file of a repository
+func (p storagePath) isLink() bool {
+	return p.kind >= pathLayerLink
+}
+
+// parsePath parses a storage path. Paths not referring to a blob, such as
+// upload sessions or directories, are of kind pathOther.
+func parsePath(path string) storagePath {
+	rest, ok := strings.CutPrefix(path, storageRoot)
+	if !ok {
+		return storagePath{}
+	}
+	parts := strings.Split(rest, "/")
+	switch parts[0] {
+	case "blobs":
+		return parseBlobPath(parts[1:])
+	case "repositories":
+		return parseRepositoryPath(parts[1:])
+	}
+	return storagePath{}
+}
+
+// parseBlobPath parses the components of a path below blobs/
+func parseBlobPath(parts []string) storagePath {
+	if len(parts) != 4 || parts[3] != "data" {
+		return storagePath{}
+	}
+	alg, prefix, encoded := parts[0], parts[1], parts[2]
+	if len(encoded) < 2 || encoded[:2] != prefix {
+		return storagePath{}
+	}
+	dgst := parseDigest(alg, encoded)
+	if dgst == "" {
+		return storagePath{}
+	}
+	return storagePath{kind: pathBlobData, digest: dgst}
+}
+
+// parseRepositoryPath parses the components of a path below repositories/.
+// The repository name spans the components up to the first one starting
+// with an underscore, which repository names can not contain.
+func parseRepositoryPath(parts []string) storagePath {
+	i := 0
+	for i < len(parts) && !strings.HasPrefix(parts[i], "_") {
+		i++
+	}
+	if i == 0 || i == len(parts) {
+		return storagePath{}
+	}
+	repository := strings.Join(parts[:i], "/")
+	parts = parts[i:]
+
+	var p storagePath
+	switch {
+	case parts[0] == "_layers" && len(parts) == 4:
+		p = storagePath{kind: pathLayerLink, digest: parseDigest(parts[1], parts[2])}
+		parts = parts[3:]
+	case parts[0] == "_manifests" && len(parts) == 5 && parts[1] == "revisions":
+		p = storagePath{kind: pathRevisionLink, digest: parseDigest(parts[2], parts[3])}
+		parts = parts[4:]
+	case parts[0] == "_manifests" && len(parts) == 7 && parts[1] == "tags" && parts[3] == "index":
+		p = storagePath{kind: pathTagIndexLink, digest: parseDigest(parts[4], parts[5])}
+		parts = parts[6:]
+	case parts[0] == "_manifests" && len(parts) == 5 && parts[1] == "tags" && parts[3] == "current":
+		return storagePath{kind: pathTagCurrentLink, repository: repository}.link(parts[4:])
+	default:
+		return storagePath{}
+	}
+	if p.digest == "" {
+		return storagePath{}
+	}
+	p.repository = repository
+	return p.link(parts)
+}
+
+// link returns p if parts is the trailing link component of its path
+func (p storagePath) link(parts []string) storagePath {
+	if len(parts) != 1 || parts[0] != "link" {
+		return storagePath{}
+	}
+	return p
+}
+
+// parseDigest returns the digest of algorithm alg and hex encoded value, or
+// an empty digest if invalid
+func parseDigest(alg, encoded string) digest.Digest {
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+	if dgst.Validate() != nil {
+		return ""
+	}
+	return dgst
+}
+
+// blobDir returns the directory holding the data of the blob dgst
+func blobDir(dgst digest.Digest) string {
+	encoded := dgst.Encoded()
+	return storageRoot + "blobs/" + dgst.Algorithm().String() + "/" + encoded[:2] + "/" + encoded
+}
+
+// blobDataPath returns the path of the data of the blob dgst
+func blobDataPath(dgst digest.Digest) string {
+	return blobDir(dgst) + "/data"
+}
+
+// repositoryDir returns the directory of the repository name. It also holds
+// the directories of the repositories nested in name.
+func repositoryDir(name string) string {
+	return storageRoot + "repositories/" + name
+}
+
+// layerLinkDir returns the directory holding the link of the blob dgst into
+// the repository name
+func layerLinkDir(name string, dgst digest.Digest) string {
+	return repositoryDir(name) + "/_layers/" + dgst.Algorithm().String() + "/" + dgst.Encoded()
+}
+
+// manifestRevisionDir returns the directory holding the revision link of the
+// manifest dgst in the repository name
+func manifestRevisionDir(name string, dgst digest.Digest) string {
+	return repositoryDir(name) + "/_manifests/revisions/" + dgst.Algorithm().String() + "/" + dgst.Encoded()
+}
+
+// tagsDir returns the directory holding the tags of the repository name
+func tagsDir(name string) string {
+	return repositoryDir(name) + "/_manifests/tags"
+}
@@ -0,0 +1,86 @@
+package lru_driver
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	testHex    = "4c1f5ea5e0a1c2e4b1f0b2b5c1b0d8f53d4c7c1e2e6b0f0a9e0d2c1b0a9f8e7d"
+	testDigest = digest.Digest("sha256:" + testHex)
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want storagePath
+	}{
+		{
+			name: "blob data",
+			path: "/docker/registry/v2/blobs/sha256/4c/" + testHex + "/data",
+			want: storagePath{kind: pathBlobData, digest: testDigest},
+		},
+		{
+			name: "layer link",
+			path: "/docker/registry/v2/repositories/library/alpine/_layers/sha256/" + testHex + "/link",
+			want: storagePath{kind: pathLayerLink, repository: "library/alpine", digest: testDigest},
+		},
+		{
+			name: "manifest revision link",
+			path: "/docker/registry/v2/repositories/alpine/_manifests/revisions/sha256/" + testHex + "/link",
+			want: storagePath{kind: pathRevisionLink, repository: "alpine", digest: testDigest},
+		},
+		{
+			name: "tag index link",
+			path: "/docker/registry/v2/repositories/alpine/_manifests/tags/3.19/index/sha256/" + testHex + "/link",
+			want: storagePath{kind: pathTagIndexLink, repository: "alpine", digest: testDigest},
+		},
+		{
+			name: "tag current link",
+			path: "/docker/registry/v2/repositories/alpine/_manifests/tags/latest/current/link",
+			want: storagePath{kind: pathTagCurrentLink, repository: "alpine"},
+		},
+		{
+			name: "nested repository",
+			path: "/docker/registry/v2/repositories/ghcr.io/org/team/app/_layers/sha256/" + testHex + "/link",
+			want: storagePath{kind: pathLayerLink, repository: "ghcr.io/org/team/app", digest: testDigest},
+		},
+		{
+			name: "repository named like a component",
+			path: "/docker/registry/v2/repositories/blobs/_layers/sha256/" + testHex + "/link",
+			want: storagePath{kind: pathLayerLink, repository: "blobs", digest: testDigest},
+		},
+		{name: "upload data", path: "/docker/registry/v2/repositories/alpine/_uploads/0b7f0b9c-3c4f-4a5e-9a7b-4d1c2e3f4a5b/data"},
+		{name: "upload hash state", path: "/docker/registry/v2/repositories/alpine/_uploads/0b7f0b9c/hashstates/sha256/0"},
+		{name: "blob directory", path: "/docker/registry/v2/blobs/sha256/4c/" + testHex},
+		{name: "blob prefix mismatch", path: "/docker/registry/v2/blobs/sha256/ab/" + testHex + "/data"},
+		{name: "invalid digest", path: "/docker/registry/v2/blobs/sha256/4c/4c1f/data"},
+		{name: "unknown algorithm", path: "/docker/registry/v2/blobs/md5/4c/" + testHex + "/data"},
+		{name: "layers directory", path: "/docker/registry/v2/repositories/alpine/_layers/sha256/" + testHex},
+		{name: "tags directory", path: "/docker/registry/v2/repositories/alpine/_manifests/tags/latest"},
+		{name: "repository without name", path: "/docker/registry/v2/repositories/_layers/sha256/" + testHex + "/link"},
+		{name: "repository root", path: "/docker/registry/v2/repositories/alpine"},
+		{name: "outside the root", path: "/other/blobs/sha256/4c/" + testHex + "/data"},
+		{name: "empty", path: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePath(tt.path); got != tt.want {
+				t.Errorf("parsePath(%q) = %+v, want %+v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobDataPath(t *testing.T) {
+	path := blobDataPath(testDigest)
+	if want := "/docker/registry/v2/blobs/sha256/4c/" + testHex + "/data"; path != want {
+		t.Errorf("blobDataPath = %q, want %q", path, want)
+	}
+	if p := parsePath(path); p.kind != pathBlobData || p.digest != testDigest {
+		t.Errorf("parsePath(blobDataPath) = %+v", p)
+	}
+}
@@ -0,0 +1,243 @@
+package lru_driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PruneResult lists what pruning a repository deleted, or would delete
+type PruneResult struct {
+	Repository string          `json:"repository"`
+	Tags       []string        `json:"tags,omitempty"`
+	Manifests  []digest.Digest `json:"manifests,omitempty"`
+	Blobs      []digest.Digest `json:"blobs,omitempty"`
+
+	// Orphans are the pruned manifests and blobs linked into no other
+	// repository, left for the caller to evict
+	Orphans []digest.Digest `json:"orphans,omitempty"`
+}
+
+// PruneRepository unlinks from the repository name the manifests last used
+// before cutoff, with their tags, and the blobs last used before cutoff no
+// longer referenced by a manifest kept. Manifests and blobs referenced by a
+// kept manifest, e.g. the images of a recently pulled manifest list, are
+// kept whatever their age. Last use is the last access tracked, else the
+// time the link was written. With dryRun nothing is changed.
+func (lru *Driver) PruneRepository(ctx context.Context, name string, cutoff time.Time, dryRun bool) (PruneResult, error) {
+	result := PruneResult{Repository: name}
+	revisions, err := lru.listDigests(ctx, repositoryDir(name)+"/_manifests/revisions")
+	if err != nil {
+		return result, err
+	}
+	layers, err := lru.listDigests(ctx, repositoryDir(name)+"/_layers")
+	if err != nil {
+		return result, err
+	}
+
+	// the manifests used since cutoff and everything they reference
+	isRevision := make(map[digest.Digest]bool, len(revisions))
+	var queue []digest.Digest
+	for _, dgst := range revisions {
+		isRevision[dgst] = true
+		if lru.lastUsed(ctx, dgst, manifestRevisionDir(name, dgst)).After(cutoff) {
+			queue = append(queue, dgst)
+		}
+	}
+	kept := make(map[digest.Digest]bool)
+	for len(queue) > 0 {
+		dgst := queue[0]
+		queue = queue[1:]
+		if kept[dgst] {
+			continue
+		}
+		kept[dgst] = true
+		if !isRevision[dgst] {
+			continue
+		}
+		refs, err := lru.manifestReferences(ctx, dgst)
+		if err != nil {
+			return result, fmt.Errorf("reading manifest %s: %w", dgst, err)
+		}
+		queue = append(queue, refs...)
+	}
+
+	for _, dgst := range revisions {
+		if !kept[dgst] {
+			result.Manifests = append(result.Manifests, dgst)
+		}
+	}
+	for _, dgst := range layers {
+		if !kept[dgst] && !lru.lastUsed(ctx, dgst, layerLinkDir(name, dgst)).After(cutoff) {
+			result.Blobs = append(result.Blobs, dgst)
+		}
+	}
+	if result.Tags, err = lru.tagsOf(ctx, name, result.Manifests); err != nil {
+		return result, err
+	}
+
+	for _, dgst := range append(result.Manifests, result.Blobs...) {
+		if dryRun {
+			meta, _ := lru.tracker.Blob(dgst)
+			if len(meta.Repositories) == 1 && meta.Repositories[0] == name {
+				result.Orphans = append(result.Orphans, dgst)
+			}
+			continue
+		}
+		if err := lru.deleteLinks(ctx, name, dgst); err != nil {
+			return result, fmt.Errorf("deleting links of %s: %w", dgst, err)
+		}
+		if lru.tracker.RemoveBlobRepository(dgst, name) {
+			result.Orphans = append(result.Orphans, dgst)
+		}
+	}
+	return result, nil
+}
+
+// lastUsed returns the last tracked access of the blob dgst, else the time
+// its link in dir was written
+func (lru *Driver) lastUsed(ctx context.Context, dgst digest.Digest, dir string) time.Time {
+	if meta, tracked := lru.tracker.Blob(dgst); tracked {
+		return meta.LastAccessed
+	}
+	fi, err := lru.StorageDriver.Stat(ctx, dir+"/link")
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// listDigests lists the digests of the <algorithm>/<hex digest> directories
+// below dir, none if it does not exist
+func (lru *Driver) listDigests(ctx context.Context, dir string) ([]digest.Digest, error) {
+	algorithms, err := lru.StorageDriver.List(ctx, dir)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dgsts []digest.Digest
+	for _, alg := range algorithms {
+		entries, err := lru.StorageDriver.List(ctx, alg)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if dgst := parseDigest(path.Base(alg), path.Base(entry)); dgst != "" {
+				dgsts = append(dgsts, dgst)
+			}
+		}
+	}
+	return dgsts, nil
+}
+
+// tagsOf returns the tags of the repository name pointing to one of the
+// manifests dgsts
+func (lru *Driver) tagsOf(ctx context.Context, name string, dgsts []digest.Digest) ([]string, error) {
+	if len(dgsts) == 0 {
+		return nil, nil
+	}
+	tags, err := lru.StorageDriver.List(ctx, tagsDir(name))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var matched []string
+	for _, tag := range tags {
+		content, err := lru.StorageDriver.GetContent(ctx, tag+"/current/link")
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		current := digest.Digest(strings.TrimSpace(string(content)))
+		for _, dgst := range dgsts {
+			if current == dgst {
+				matched = append(matched, path.Base(tag))
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// Tag is a tag of a repository and the manifest it points to
+type Tag struct {
+	Name     string        `json:"name"`
+	Digest   digest.Digest `json:"digest"`
+	LastUsed time.Time     `json:"last_used"`
+}
+
+// Tags lists the tags of the repository name, none if it does not exist.
+// Last use is that of the manifest, as for pruning.
+func (lru *Driver) Tags(ctx context.Context, name string) ([]Tag, error) {
+	dirs, err := lru.StorageDriver.List(ctx, tagsDir(name))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tags []Tag
+	for _, dir := range dirs {
+		content, err := lru.StorageDriver.GetContent(ctx, dir+"/current/link")
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		dgst, err := digest.Parse(strings.TrimSpace(string(content)))
+		if err != nil {
+			continue
+		}
+		tags = append(tags, Tag{
+			Name:     path.Base(dir),
+			Digest:   dgst,
+			LastUsed: lru.lastUsed(ctx, dgst, manifestRevisionDir(name, dgst)),
+		})
+	}
+	return tags, nil
+}
+
+// manifestReferences returns the digests a manifest references: the config
+// and layers of an image manifest, the manifests of a manifest list or
+// index. Reading it is not recorded as an access.
+func (lru *Driver) manifestReferences(ctx context.Context, dgst digest.Digest) ([]digest.Digest, error) {
+	payload, err := lru.StorageDriver.GetContent(ctx, blobDataPath(dgst))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config"`
+		Layers    []v1.Descriptor `json:"layers"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return nil, err
+	}
+	var refs []digest.Digest
+	for _, desc := range append(manifest.Layers, manifest.Manifests...) {
+		refs = append(refs, desc.Digest)
+	}
+	if manifest.Config != nil {
+		refs = append(refs, manifest.Config.Digest)
+	}
+	return refs, nil
+}
@@ -0,0 +1,271 @@
+package lru_driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// quarantineRoot holds the blobs failing digest verification, out of the
+// layout of distribution: <algorithm>/<hex digest>/data and reason
+const quarantineRoot = "/docker-cache-server/quarantine"
+
+// Sources of the quarantined blobs
+const (
+	QuarantineRead     = "read"
+	QuarantineUpload   = "upload"
+	QuarantineUpstream = "upstream"
+)
+
+// ErrQuarantined is returned by writes of the data of a quarantined blob
+var ErrQuarantined = errors.New("blob is quarantined")
+
+// QuarantinedBlob is a blob which failed digest verification, excluded from
+// serving until released or purged
+type QuarantinedBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Source string        `json:"source"` // read, upload or upstream
+	Reason string        `json:"reason"`
+	Size   int64         `json:"size"` // of the content kept, zero if none
+	Time   time.Time     `json:"time"`
+}
+
+func quarantineDir(dgst digest.Digest) string {
+	return path.Join(quarantineRoot, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// LoadQuarantine loads the blobs quarantined before the driver was created.
+func (lru *Driver) LoadQuarantine(ctx context.Context) error {
+	algorithms, err := lru.StorageDriver.List(ctx, quarantineRoot)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	blobs := make(map[digest.Digest]QuarantinedBlob)
+	for _, dir := range algorithms {
+		entries, err := lru.StorageDriver.List(ctx, dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			content, err := lru.StorageDriver.GetContent(ctx, path.Join(entry, "reason"))
+			if err != nil {
+				lru.logger.Warnf("skipping quarantined blob %s: %v", entry, err)
+				continue
+			}
+			var blob QuarantinedBlob
+			if err := json.Unmarshal(content, &blob); err != nil {
+				lru.logger.Warnf("skipping quarantined blob %s: %v", entry, err)
+				continue
+			}
+			blobs[blob.Digest] = blob
+		}
+	}
+
+	lru.quarantineMu.Lock()
+	defer lru.quarantineMu.Unlock()
+	for dgst, blob := range blobs {
+		lru.quarantined[dgst] = blob
+	}
+	if len(blobs) > 0 {
+		lru.logger.Warnf("%d blobs are quarantined after failing digest verification", len(blobs))
+	}
+	return nil
+}
+
+// isQuarantined reports whether the blob dgst is quarantined
+func (lru *Driver) isQuarantined(dgst digest.Digest) bool {
+	lru.quarantineMu.RLock()
+	defer lru.quarantineMu.RUnlock()
+	_, ok := lru.quarantined[dgst]
+	return ok
+}
+
+// Quarantine moves the stored data of a blob which failed digest
+// verification to the quarantine, where it is kept for inspection. The blob
+// is not served until released, its links are kept.
+func (lru *Driver) Quarantine(ctx context.Context, dgst digest.Digest, source, reason string) error {
+	blob := QuarantinedBlob{Digest: dgst, Source: source, Reason: reason, Time: time.Now()}
+	if !lru.addQuarantined(blob) {
+		return nil
+	}
+	data := path.Join(quarantineDir(dgst), "data")
+	if err := lru.StorageDriver.Move(ctx, blobDataPath(dgst), data); err != nil && !isNotFound(err) {
+		lru.removeQuarantined(dgst)
+		return fmt.Errorf("moving %s to the quarantine: %w", dgst, err)
+	}
+	if fi, err := lru.StorageDriver.Stat(ctx, data); err == nil {
+		blob.Size = fi.Size()
+	}
+	return lru.writeReason(ctx, blob)
+}
+
+// QuarantineContent keeps content received for a blob which failed digest
+// verification before it was stored, e.g. pulled from the upstream, in the
+// quarantine. The blob is not served nor stored until released.
+func (lru *Driver) QuarantineContent(ctx context.Context, dgst digest.Digest, content io.Reader, source, reason string) error {
+	blob := QuarantinedBlob{Digest: dgst, Source: source, Reason: reason, Time: time.Now()}
+	if !lru.addQuarantined(blob) {
+		return nil
+	}
+	w, err := lru.StorageDriver.Writer(ctx, path.Join(quarantineDir(dgst), "data"), false)
+	if err != nil {
+		lru.removeQuarantined(dgst)
+		return err
+	}
+	if blob.Size, err = io.Copy(w, content); err != nil {
+		w.Cancel(ctx)
+		lru.removeQuarantined(dgst)
+		return fmt.Errorf("writing %s to the quarantine: %w", dgst, err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		lru.removeQuarantined(dgst)
+		return err
+	}
+	return lru.writeReason(ctx, blob)
+}
+
+// addQuarantined excludes a blob from serving, reporting false if it already
+// was
+func (lru *Driver) addQuarantined(blob QuarantinedBlob) bool {
+	lru.quarantineMu.Lock()
+	defer lru.quarantineMu.Unlock()
+	if _, ok := lru.quarantined[blob.Digest]; ok {
+		return false
+	}
+	lru.quarantined[blob.Digest] = blob
+	lru.logger.Errorf("quarantined blob %s (%s): %s", blob.Digest, blob.Source, blob.Reason)
+	return true
+}
+
+func (lru *Driver) removeQuarantined(dgst digest.Digest) {
+	lru.quarantineMu.Lock()
+	defer lru.quarantineMu.Unlock()
+	delete(lru.quarantined, dgst)
+}
+
+// writeReason records why a blob is quarantined next to its data
+func (lru *Driver) writeReason(ctx context.Context, blob QuarantinedBlob) error {
+	lru.quarantineMu.Lock()
+	lru.quarantined[blob.Digest] = blob
+	lru.quarantineMu.Unlock()
+	content, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	if err := lru.StorageDriver.PutContent(ctx, path.Join(quarantineDir(blob.Digest), "reason"), content); err != nil {
+		return fmt.Errorf("writing the quarantine reason of %s: %w", blob.Digest, err)
+	}
+	return nil
+}
+
+// QuarantinedBlobs returns the quarantined blobs, most recent first.
+func (lru *Driver) QuarantinedBlobs() []QuarantinedBlob {
+	lru.quarantineMu.RLock()
+	blobs := make([]QuarantinedBlob, 0, len(lru.quarantined))
+	for _, blob := range lru.quarantined {
+		blobs = append(blobs, blob)
+	}
+	lru.quarantineMu.RUnlock()
+	slices.SortFunc(blobs, func(a, b QuarantinedBlob) int {
+		return b.Time.Compare(a.Time)
+	})
+	return blobs
+}
+
+// ReleaseBlob serves a quarantined blob again, moving its data back if kept
+// and not stored again meanwhile. It reports false if the blob is not
+// quarantined.
+func (lru *Driver) ReleaseBlob(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if !lru.isQuarantined(dgst) {
+		return false, nil
+	}
+	dir := quarantineDir(dgst)
+	lru.removeQuarantined(dgst)
+	if _, err := lru.StorageDriver.Stat(ctx, blobDataPath(dgst)); isNotFound(err) {
+		if err := lru.Move(ctx, path.Join(dir, "data"), blobDataPath(dgst)); err != nil && !isNotFound(err) {
+			return true, fmt.Errorf("moving %s out of the quarantine: %w", dgst, err)
+		}
+	}
+	if err := lru.StorageDriver.Delete(ctx, dir); err != nil && !isNotFound(err) {
+		return true, fmt.Errorf("deleting the quarantine of %s: %w", dgst, err)
+	}
+	lru.logger.Infof("released blob %s from the quarantine", dgst)
+	return true, nil
+}
+
+// PurgeBlob deletes a quarantined blob for good, with its links in the
+// repositories it was seen linked into, so that it may be stored again. It
+// reports false if the blob is not quarantined.
+func (lru *Driver) PurgeBlob(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if !lru.isQuarantined(dgst) {
+		return false, nil
+	}
+	if err := lru.Evict(ctx, dgst); err != nil {
+		return true, err
+	}
+	if err := lru.StorageDriver.Delete(ctx, quarantineDir(dgst)); err != nil && !isNotFound(err) {
+		return true, fmt.Errorf("deleting the quarantine of %s: %w", dgst, err)
+	}
+	if err := lru.tracker.RemoveBlob(dgst); err != nil {
+		lru.logger.Warnf("failed to stop tracking %s: %v", dgst, err)
+	}
+	lru.removeQuarantined(dgst)
+	lru.logger.Infof("purged blob %s from the quarantine", dgst)
+	return true, nil
+}
+
+// quarantinedPath returns a not found error for the data of a quarantined
+// blob, nil for other paths
+func (lru *Driver) quarantinedPath(path string) error {
+	if p := parsePath(path); p.kind == pathBlobData && lru.isQuarantined(p.digest) {
+		return driver.PathNotFoundError{Path: path, DriverName: lru.Name()}
+	}
+	return nil
+}
+
+// quarantinedWrite returns an error for writes of the data of a quarantined
+// blob, nil for other paths
+func (lru *Driver) quarantinedWrite(path string) error {
+	if p := parsePath(path); p.kind == pathBlobData && lru.isQuarantined(p.digest) {
+		return fmt.Errorf("%w: %s", ErrQuarantined, p.digest)
+	}
+	return nil
+}
+
+// verifyingReader quarantines a blob whose content read in full does not
+// match its digest. Readers serving the blob stop at its size rather than
+// at the end of the file.
+type verifyingReader struct {
+	io.ReadCloser
+	driver   *Driver
+	digest   digest.Digest
+	verifier digest.Verifier
+	size     int64 // -1 if unknown
+	read     int64
+	done     bool
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.verifier.Write(p[:n])
+	r.read += int64(n)
+	if !r.done && (err == io.EOF || (r.size >= 0 && r.read >= r.size)) {
+		r.done = true
+		if !r.verifier.Verified() {
+			if qerr := r.driver.Quarantine(context.Background(), r.digest, QuarantineRead, "stored content does not match the digest"); qerr != nil {
+				r.driver.logger.Errorf("failed to quarantine blob %s: %v", r.digest, qerr)
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package lru_driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	d, tracker := newTestDriver(t)
+
+	data := []byte("layer")
+	dgst := digest.FromBytes(data)
+	if err := d.PutContent(ctx, blobDataPath(dgst), data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	link := layerLinkDir("alpine", dgst) + "/link"
+	if err := d.PutContent(ctx, link, []byte(dgst)); err != nil {
+		t.Fatalf("unexpected error writing link: %v", err)
+	}
+
+	if err := d.Quarantine(ctx, dgst, QuarantineRead, "test"); err != nil {
+		t.Fatalf("unexpected error quarantining blob: %v", err)
+	}
+	if _, err := d.Stat(ctx, blobDataPath(dgst)); !isNotFound(err) {
+		t.Errorf("quarantined blob is served: %v", err)
+	}
+	if err := d.PutContent(ctx, blobDataPath(dgst), data); !errors.Is(err, ErrQuarantined) {
+		t.Errorf("write error = %v, want %v", err, ErrQuarantined)
+	}
+
+	// the quarantine is kept in the storage
+	reloaded := New(d.StorageDriver, tracker, nil)
+	if err := reloaded.LoadQuarantine(ctx); err != nil {
+		t.Fatalf("unexpected error loading quarantine: %v", err)
+	}
+	blobs := reloaded.QuarantinedBlobs()
+	if len(blobs) != 1 || blobs[0].Digest != dgst || blobs[0].Source != QuarantineRead || blobs[0].Size != int64(len(data)) {
+		t.Fatalf("unexpected quarantined blobs %+v", blobs)
+	}
+
+	if found, err := reloaded.ReleaseBlob(ctx, dgst); err != nil || !found {
+		t.Fatalf("release = %v, %v, want true, nil", found, err)
+	}
+	if content, err := reloaded.GetContent(ctx, blobDataPath(dgst)); err != nil || string(content) != string(data) {
+		t.Fatalf("released blob = %q, %v, want %q", content, err, data)
+	}
+	if len(reloaded.QuarantinedBlobs()) != 0 {
+		t.Fatal("released blob is still quarantined")
+	}
+	if found, _ := reloaded.ReleaseBlob(ctx, dgst); found {
+		t.Error("released a blob not quarantined")
+	}
+
+	if err := reloaded.Quarantine(ctx, dgst, QuarantineRead, "test"); err != nil {
+		t.Fatalf("unexpected error quarantining blob: %v", err)
+	}
+	if found, err := reloaded.PurgeBlob(ctx, dgst); err != nil || !found {
+		t.Fatalf("purge = %v, %v, want true, nil", found, err)
+	}
+	for _, path := range []string{blobDataPath(dgst), link, quarantineDir(dgst)} {
+		if _, err := reloaded.StorageDriver.Stat(ctx, path); !isNotFound(err) {
+			t.Errorf("%s was not purged: %v", path, err)
+		}
+	}
+	if _, tracked := tracker.Blob(dgst); tracked {
+		t.Error("purged blob is still tracked")
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+	d.SetVerifyReads(true)
+
+	corrupt := digest.FromString("expected")
+	if err := d.StorageDriver.PutContent(ctx, blobDataPath(corrupt), []byte("corrupt")); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	r, err := d.Reader(ctx, blobDataPath(corrupt), 0)
+	if err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	// served content stops at the size of the blob
+	if _, err := io.CopyN(io.Discard, r, int64(len("corrupt"))); err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	r.Close()
+	if !d.isQuarantined(corrupt) {
+		t.Fatal("corrupt blob read was not quarantined")
+	}
+
+	corrupt = digest.FromString("manifest")
+	if err := d.StorageDriver.PutContent(ctx, blobDataPath(corrupt), []byte("{}")); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	if _, err := d.GetContent(ctx, blobDataPath(corrupt)); !isNotFound(err) {
+		t.Errorf("corrupt content error = %v, want not found", err)
+	}
+	if !d.isQuarantined(corrupt) {
+		t.Fatal("corrupt content read was not quarantined")
+	}
+
+	data := []byte("layer")
+	dgst := digest.FromBytes(data)
+	if err := d.PutContent(ctx, blobDataPath(dgst), data); err != nil {
+		t.Fatalf("unexpected error writing blob: %v", err)
+	}
+	if _, err := d.GetContent(ctx, blobDataPath(dgst)); err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	if d.isQuarantined(dgst) {
+		t.Error("matching blob was quarantined")
+	}
+}
@@ -0,0 +1,42 @@
+package readonly_driver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// ErrReadOnly is returned for the operations modifying the storage
+var ErrReadOnly = errors.New("storage is read-only")
+
+// Driver serves the reads of a storage driver and rejects every write, move
+// and deletion, for replicas serving the storage of a primary instance.
+type Driver struct {
+	driver.StorageDriver
+}
+
+// New creates a driver serving the reads of base only.
+func New(base driver.StorageDriver) *Driver {
+	return &Driver{StorageDriver: base}
+}
+
+// PutContent implements driver.StorageDriver
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	return ErrReadOnly
+}
+
+// Writer implements driver.StorageDriver
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	return nil, ErrReadOnly
+}
+
+// Move implements driver.StorageDriver
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return ErrReadOnly
+}
+
+// Delete implements driver.StorageDriver
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
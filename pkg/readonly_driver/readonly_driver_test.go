@@ -0,0 +1,51 @@
+package readonly_driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	base := inmemory.New()
+	if err := base.PutContent(ctx, "/a", []byte("a")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := New(base)
+
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "a" {
+		t.Errorf("unexpected content: %q, %v", content, err)
+	}
+	r, err := d.Reader(ctx, "/a", 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(content) != "a" {
+		t.Errorf("unexpected content read: %q, %v", content, err)
+	}
+
+	if err := d.PutContent(ctx, "/b", []byte("b")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PutContent: got %v, want ErrReadOnly", err)
+	}
+	if _, err := d.Writer(ctx, "/b", false); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Writer: got %v, want ErrReadOnly", err)
+	}
+	if err := d.Move(ctx, "/a", "/b"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Move: got %v, want ErrReadOnly", err)
+	}
+	if err := d.Delete(ctx, "/a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete: got %v, want ErrReadOnly", err)
+	}
+	if _, err := base.Stat(ctx, "/a"); err != nil {
+		t.Errorf("the content was modified: %v", err)
+	}
+	if _, err := base.Stat(ctx, "/b"); err == nil {
+		t.Error("the content was written")
+	}
+}
@@ -0,0 +1,264 @@
+// Package replication pushes manifests stored in the cache, together with the
+// blobs they reference, to remote cache servers.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWorkers       = 2
+	defaultQueueSize     = 1000
+	defaultRetryInterval = 30 * time.Second
+)
+
+type target struct {
+	config.ReplicationTarget
+	client *registryclient.Client
+}
+
+// matches reports whether the repository is replicated to the target
+func (t *target) matches(name string) bool {
+	if len(t.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range t.Repositories {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type job struct {
+	target  *target
+	name    reference.Named
+	tag     string
+	dgst    digest.Digest
+	attempt int
+}
+
+// Replicator queues pushed manifests and copies them to the configured
+// targets in the background, retrying failures with exponential backoff.
+type Replicator struct {
+	targets       []*target
+	queue         chan *job
+	workers       int
+	maxRetries    int
+	retryInterval time.Duration
+	logger        *logrus.Logger
+
+	registry distribution.Namespace
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New creates a replicator for the configured targets. Manifests are queued
+// from creation on, but only copied once Start is called.
+func New(cfg config.ReplicationConfig, logger *logrus.Logger) (*Replicator, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	r := &Replicator{
+		workers:       cfg.Workers,
+		maxRetries:    cfg.MaxRetries,
+		retryInterval: cfg.RetryInterval,
+		logger:        logger,
+	}
+	if r.workers <= 0 {
+		r.workers = defaultWorkers
+	}
+	if r.maxRetries < 0 {
+		r.maxRetries = 0
+	}
+	if r.retryInterval <= 0 {
+		r.retryInterval = defaultRetryInterval
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	r.queue = make(chan *job, queueSize)
+
+	for _, targetConfig := range cfg.Targets {
+		if targetConfig.URL == "" {
+			return nil, fmt.Errorf("replication target %q has no url", targetConfig.Name)
+		}
+		for _, pattern := range targetConfig.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid repository pattern %q for replication target %q: %w", pattern, targetConfig.Name, err)
+			}
+		}
+
+		client, err := registryclient.New(targetConfig.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("replication target %q: %w", targetConfig.Name, err)
+		}
+		if targetConfig.Username != "" {
+			username, password := targetConfig.Username, targetConfig.Password
+			client.Prepare = func(req *http.Request) {
+				req.SetBasicAuth(username, password)
+			}
+		}
+
+		r.targets = append(r.targets, &target{
+			ReplicationTarget: targetConfig,
+			client:            client,
+		})
+	}
+
+	return r, nil
+}
+
+// ManifestPushed queues the manifest for every target replicating the
+// repository. It implements the manifest listener of the registry handlers.
+func (r *Replicator) ManifestPushed(name reference.Named, tag string, dgst digest.Digest) {
+	for _, t := range r.targets {
+		if !t.matches(name.Name()) {
+			continue
+		}
+		r.enqueue(&job{
+			target: t,
+			name:   name,
+			tag:    tag,
+			dgst:   dgst,
+		})
+	}
+}
+
+func (r *Replicator) enqueue(j *job) {
+	select {
+	case r.queue <- j:
+	default:
+		r.logger.Warnf("replication queue full, dropping %s@%s for %s", j.name, j.dgst, j.target.Name)
+	}
+}
+
+// Start starts the workers copying queued manifests from registry until ctx
+// is cancelled or Stop is called.
+func (r *Replicator) Start(ctx context.Context, registry distribution.Namespace) {
+	r.registry = registry
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	r.logger.Infof("starting replication to %d targets with %d workers", len(r.targets), r.workers)
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for {
+				select {
+				case <-r.ctx.Done():
+					return
+				case j := <-r.queue:
+					r.process(j)
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the workers. Queued manifests are dropped.
+func (r *Replicator) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+}
+
+// process replicates a job, scheduling a retry on failure
+func (r *Replicator) process(j *job) {
+	err := r.replicate(r.ctx, j)
+	if err == nil {
+		r.logger.Infof("replicated %s@%s to %s", j.name, j.dgst, j.target.Name)
+		return
+	}
+	if r.ctx.Err() != nil {
+		return
+	}
+	if j.attempt >= r.maxRetries {
+		r.logger.Errorf("giving up replicating %s@%s to %s after %d attempts: %v", j.name, j.dgst, j.target.Name, j.attempt+1, err)
+		return
+	}
+
+	delay := r.retryInterval << j.attempt
+	j.attempt++
+	r.logger.Warnf("failed to replicate %s@%s to %s, retrying in %v: %v", j.name, j.dgst, j.target.Name, delay, err)
+	time.AfterFunc(delay, func() {
+		if r.ctx.Err() == nil {
+			r.enqueue(j)
+		}
+	})
+}
+
+func (r *Replicator) replicate(ctx context.Context, j *job) error {
+	repository, err := r.registry.Repository(ctx, j.name)
+	if err != nil {
+		return err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	return r.copyManifest(ctx, j.target, repository, manifests, j.dgst, j.tag)
+}
+
+// copyManifest copies a manifest after everything it references, so that the
+// target can verify it
+func (r *Replicator) copyManifest(ctx context.Context, t *target, repository distribution.Repository, manifests distribution.ManifestService, dgst digest.Digest, tag string) error {
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("reading manifest %s: %w", dgst, err)
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range manifest.References() {
+		if mediaType == manifestlist.MediaTypeManifestList || mediaType == v1.MediaTypeImageIndex {
+			err = r.copyManifest(ctx, t, repository, manifests, desc.Digest, "")
+		} else {
+			err = r.copyBlob(ctx, t, repository, desc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.client.PushManifest(ctx, repository.Named(), tag, mediaType, payload)
+}
+
+func (r *Replicator) copyBlob(ctx context.Context, t *target, repository distribution.Repository, desc v1.Descriptor) error {
+	exists, err := t.client.BlobExists(ctx, repository.Named(), desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	blob, err := repository.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("reading blob %s: %w", desc.Digest, err)
+	}
+	defer blob.Close()
+
+	return t.client.PushBlob(ctx, repository.Named(), desc, blob)
+}
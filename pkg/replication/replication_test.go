@@ -0,0 +1,122 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/internal/handlers"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReplicateManifest(t *testing.T) {
+	ctx := context.Background()
+
+	remote, err := handlers.NewApp(ctx, &handlers.Config{
+		Driver: inmemory.New(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating remote: %v", err)
+	}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+
+	name, _ := reference.WithName("team-a/app")
+	repository, err := registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("unexpected error creating repository: %v", err)
+	}
+	blobs := repository.Blobs(ctx)
+	configDesc, err := blobs.Put(ctx, v1.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %v", err)
+	}
+	layerDesc, err := blobs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %v", err)
+	}
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []v1.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest: %v", err)
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest service: %v", err)
+	}
+	dgst, err := manifests.Put(ctx, manifest, distribution.WithTag("latest"))
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+
+	replicator, err := New(config.ReplicationConfig{
+		Targets: []config.ReplicationTarget{
+			{
+				Name:         "branch",
+				URL:          server.URL,
+				Repositories: []string{"team-a/*"},
+			},
+		},
+		RetryInterval: 10 * time.Millisecond,
+		MaxRetries:    3,
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+	replicator.Start(ctx, registry)
+	defer replicator.Stop()
+
+	// filtered out by the repository patterns
+	other, _ := reference.WithName("team-b/app")
+	replicator.ManifestPushed(other, "latest", dgst)
+	replicator.ManifestPushed(name, "latest", dgst)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(http.MethodHead, server.URL+"/v2/team-a/app/manifests/latest", nil)
+		req.Header.Set("Accept", v1.MediaTypeImageManifest)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error checking manifest: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if got := resp.Header.Get("Docker-Content-Digest"); got != dgst.String() {
+				t.Fatalf("unexpected manifest digest: %s != %s", got, dgst)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("manifest was not replicated: %s", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Head(server.URL + "/v2/team-b/app/manifests/latest")
+	if err != nil {
+		t.Fatalf("unexpected error checking manifest: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status for filtered repository: %s", resp.Status)
+	}
+}
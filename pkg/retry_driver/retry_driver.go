@@ -0,0 +1,182 @@
+package retry_driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "storage_driver", nil)
+
+	retries = namespace.NewLabeledCounter("retries", "The number of storage driver operations retried after a failure", "operation")
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// Policy is how failed operations are retried
+type Policy struct {
+	// MaxRetries is the number of retries of a failed operation
+	MaxRetries int
+	// Interval is the delay before the first retry, doubling with every
+	// retry up to MaxInterval
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// Driver retries the operations of a remote storage driver, e.g. S3, failing
+// with transient errors such as timeouts or throttling. Only operations
+// which can be repeated safely are retried: reads, whole file writes,
+// moves and deletions, and opening readers and writers. Data written to a
+// writer and walks are not retried.
+type Driver struct {
+	driver.StorageDriver
+	policy Policy
+	logger *logrus.Logger
+}
+
+// New creates a driver retrying the operations of base by policy.
+func New(base driver.StorageDriver, policy Policy, logger *logrus.Logger) *Driver {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	if policy.MaxInterval < policy.Interval {
+		policy.MaxInterval = policy.Interval
+	}
+	return &Driver{
+		StorageDriver: base,
+		policy:        policy,
+		logger:        logger,
+	}
+}
+
+// retry runs op until it succeeds, fails permanently or the retries are
+// exhausted
+func (d *Driver) retry(ctx context.Context, operation, path string, op func() error) error {
+	interval := d.policy.Interval
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= d.policy.MaxRetries || !retryable(ctx, err) {
+			return err
+		}
+		retries.WithValues(operation).Inc(1)
+		d.logger.Warnf("storage %s %s failed, retrying in %v: %v", operation, path, interval, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, d.policy.MaxInterval)
+	}
+}
+
+// retryable reports whether err may be transient. Errors about the path or
+// the request itself fail the same way again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch {
+	case errors.As(err, new(driver.PathNotFoundError)),
+		errors.As(err, new(driver.InvalidPathError)),
+		errors.As(err, new(driver.InvalidOffsetError)),
+		errors.As(err, new(driver.ErrUnsupportedMethod)):
+		return false
+	}
+	return true
+}
+
+// GetContent retries the base driver's GetContent
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := d.retry(ctx, "get_content", path, func() (err error) {
+		content, err = d.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent retries the base driver's PutContent
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	return d.retry(ctx, "put_content", path, func() error {
+		return d.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// Reader retries opening the base driver's Reader
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := d.retry(ctx, "reader", path, func() (err error) {
+		reader, err = d.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return reader, err
+}
+
+// Writer retries opening the base driver's Writer
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	var writer driver.FileWriter
+	err := d.retry(ctx, "writer", path, func() (err error) {
+		writer, err = d.StorageDriver.Writer(ctx, path, append)
+		return err
+	})
+	return writer, err
+}
+
+// Stat retries the base driver's Stat
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	var fi driver.FileInfo
+	err := d.retry(ctx, "stat", path, func() (err error) {
+		fi, err = d.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List retries the base driver's List
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	var children []string
+	err := d.retry(ctx, "list", path, func() (err error) {
+		children, err = d.StorageDriver.List(ctx, path)
+		return err
+	})
+	return children, err
+}
+
+// Move retries the base driver's Move. A retry not finding the source after
+// a failed attempt checks whether the attempt moved it after all.
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	failed := false
+	return d.retry(ctx, "move", sourcePath, func() error {
+		err := d.StorageDriver.Move(ctx, sourcePath, destPath)
+		if failed && errors.As(err, new(driver.PathNotFoundError)) {
+			if _, statErr := d.StorageDriver.Stat(ctx, destPath); statErr == nil {
+				return nil
+			}
+		}
+		failed = err != nil
+		return err
+	})
+}
+
+// Delete retries the base driver's Delete. A retry not finding the path
+// after a failed attempt succeeds, the attempt deleted it.
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	failed := false
+	return d.retry(ctx, "delete", path, func() error {
+		err := d.StorageDriver.Delete(ctx, path)
+		if failed && errors.As(err, new(driver.PathNotFoundError)) {
+			return nil
+		}
+		failed = err != nil
+		return err
+	})
+}
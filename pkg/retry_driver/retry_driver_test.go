@@ -0,0 +1,78 @@
+package retry_driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// flakyDriver fails the next failures operations
+type flakyDriver struct {
+	driver.StorageDriver
+	failures int
+	calls    int
+}
+
+var errTransient = errors.New("503 slow down")
+
+func (d *flakyDriver) fail() error {
+	d.calls++
+	if d.failures > 0 {
+		d.failures--
+		return errTransient
+	}
+	return nil
+}
+
+func (d *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *flakyDriver) Delete(ctx context.Context, path string) error {
+	if err := d.fail(); err != nil {
+		// the deletion happened, its response was lost
+		d.StorageDriver.Delete(ctx, path)
+		return err
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	base := &flakyDriver{StorageDriver: inmemory.New()}
+	d := New(base, Policy{MaxRetries: 2, Interval: time.Millisecond}, nil)
+	if err := d.PutContent(ctx, "/a", []byte("a")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	base.failures, base.calls = 2, 0
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "a" {
+		t.Errorf("unexpected content after retries: %q, %v", content, err)
+	}
+	if base.calls != 3 {
+		t.Errorf("got %d calls, want 3", base.calls)
+	}
+
+	base.failures, base.calls = 3, 0
+	if _, err := d.GetContent(ctx, "/a"); !errors.Is(err, errTransient) {
+		t.Errorf("expected error once retries are exhausted, got %v", err)
+	}
+
+	// not found is not retried
+	base.calls = 0
+	if _, err := d.GetContent(ctx, "/missing"); !errors.As(err, new(driver.PathNotFoundError)) || base.calls != 1 {
+		t.Errorf("unexpected not found after %d calls: %v", base.calls, err)
+	}
+
+	base.failures = 1
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Errorf("unexpected error deleting after a lost response: %v", err)
+	}
+}
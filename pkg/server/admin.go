@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/gorilla/mux"
+	"github.com/jc-lab/docker-cache-server/internal/handlers"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/opencontainers/go-digest"
+)
+
+// registerAdmin registers the admin endpoints on the router of the debug
+// server
+func (s *cacheServer) registerAdmin(router *mux.Router) {
+	admin := router.PathPrefix("/admin/").Subrouter()
+	admin.Use(withoutWriteTimeout)
+	if token := s.config.Http.Debug.Admin.Token; token != "" {
+		admin.Use(withAdminToken(token))
+	}
+	if s.config.Replica.Enabled {
+		admin.Use(rejectWrites)
+	}
+	admin.Path("/repositories").Methods(http.MethodGet).HandlerFunc(s.serveRepositories)
+	admin.Path("/repositories/{name:.+}").Methods(http.MethodDelete).HandlerFunc(s.serveDeleteRepository)
+	admin.Path("/tags").Methods(http.MethodGet).HandlerFunc(s.serveTags)
+	admin.Path("/blobs").Methods(http.MethodGet).HandlerFunc(s.serveBlobs)
+	admin.Path("/blobs/{digest}").Methods(http.MethodDelete).HandlerFunc(s.serveDeleteBlob)
+	admin.Path("/blobs/{digest}/pin").Methods(http.MethodPut).HandlerFunc(s.servePinBlob)
+	admin.Path("/blobs/{digest}/pin").Methods(http.MethodDelete).HandlerFunc(s.serveUnpinBlob)
+	admin.Path("/prune").Methods(http.MethodPost).HandlerFunc(s.servePrune)
+	admin.Path("/jobs").Methods(http.MethodGet).HandlerFunc(s.serveJobs)
+	admin.Path("/jobs/{id}").Methods(http.MethodGet).HandlerFunc(s.serveJob)
+	admin.Path("/jobs/{id}").Methods(http.MethodDelete).HandlerFunc(s.serveCancelJob)
+	admin.Path("/quarantine").Methods(http.MethodGet).HandlerFunc(s.serveQuarantinedBlobs)
+	admin.Path("/quarantine/{digest}/release").Methods(http.MethodPost).HandlerFunc(s.serveReleaseBlob)
+	admin.Path("/quarantine/{digest}").Methods(http.MethodDelete).HandlerFunc(s.servePurgeBlob)
+	admin.Path("/tenants").Methods(http.MethodGet).HandlerFunc(s.serveTenants)
+	admin.Path("/activity").Methods(http.MethodGet).HandlerFunc(s.serveActivity)
+	admin.Path("/dashboard.json").Methods(http.MethodGet).HandlerFunc(s.serveDashboard)
+}
+
+// withAdminToken answers the requests to handler without token as Bearer
+// token with 401
+func withAdminToken(token string) mux.MiddlewareFunc {
+	expected := []byte("Bearer " + token)
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "admin token required", http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectWrites answers the requests to handler modifying the cache with
+// 403, on replicas which may not write to the storage they share
+func rejectWrites(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read-only replica", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// repositorySummary is a repository as listed by serveRepositories
+type repositorySummary struct {
+	Name         string    `json:"name"`
+	Blobs        int       `json:"blobs"`
+	Pinned       int       `json:"pinned,omitempty"`
+	Size         int64     `json:"size"`
+	LastAccessed time.Time `json:"last_accessed"`
+}
+
+// serveRepositories lists the repositories the tracked blobs are linked
+// into, with the number and size of their blobs and their last access
+func (s *cacheServer) serveRepositories(w http.ResponseWriter, r *http.Request) {
+	repositories := make(map[string]*repositorySummary)
+	for _, meta := range s.tracker.Blobs() {
+		for _, name := range meta.Repositories {
+			repo := repositories[name]
+			if repo == nil {
+				repo = &repositorySummary{Name: name}
+				repositories[name] = repo
+			}
+			repo.Blobs++
+			repo.Size += meta.Size
+			if meta.Pinned {
+				repo.Pinned++
+			}
+			if meta.LastAccessed.After(repo.LastAccessed) {
+				repo.LastAccessed = meta.LastAccessed
+			}
+		}
+	}
+	list := make([]*repositorySummary, 0, len(repositories))
+	for _, repo := range repositories {
+		list = append(list, repo)
+	}
+	slices.SortFunc(list, func(a, b *repositorySummary) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		s.logger.Errorf("error encoding repositories: %v", err)
+	}
+}
+
+// serveTags lists the tags of the repository of the "repo" query parameter
+func (s *cacheServer) serveTags(w http.ResponseWriter, r *http.Request) {
+	named, err := reference.WithName(r.URL.Query().Get("repo"))
+	if err != nil {
+		http.Error(w, "invalid repo parameter", http.StatusBadRequest)
+		return
+	}
+	tags, err := s.storage.Tags(r.Context(), named.Name())
+	if err != nil {
+		s.logger.Errorf("error listing tags of %s: %v", named.Name(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tags); err != nil {
+		s.logger.Errorf("error encoding tags: %v", err)
+	}
+}
+
+// serveBlobs lists the tracked blobs, those linked into the repository of the
+// optional "repo" query parameter only, sorted by digest
+func (s *cacheServer) serveBlobs(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get("repo")
+	blobs := s.tracker.Blobs()
+	if repo != "" {
+		blobs = slices.DeleteFunc(blobs, func(meta cache.BlobMeta) bool {
+			_, found := slices.BinarySearch(meta.Repositories, repo)
+			return !found
+		})
+	}
+	if blobs == nil {
+		blobs = []cache.BlobMeta{}
+	}
+	slices.SortFunc(blobs, func(a, b cache.BlobMeta) int {
+		return strings.Compare(a.Digest, b.Digest)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(blobs); err != nil {
+		s.logger.Errorf("error encoding blobs: %v", err)
+	}
+}
+
+// serveDeleteBlob evicts a tracked blob at once, along with its links.
+// Pinned blobs are kept.
+func (s *cacheServer) serveDeleteBlob(w http.ResponseWriter, r *http.Request) {
+	dgst, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "invalid digest", http.StatusBadRequest)
+		return
+	}
+	meta, tracked := s.tracker.Blob(dgst)
+	if !tracked {
+		http.Error(w, "blob not tracked", http.StatusNotFound)
+		return
+	}
+	if meta.Pinned {
+		http.Error(w, "blob is pinned", http.StatusConflict)
+		return
+	}
+	evicted, err := s.tracker.EvictBlob(r.Context(), dgst, time.Now(), s.deleteBlob)
+	if err != nil {
+		s.logger.Errorf("error deleting blob %s: %v", dgst, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !evicted {
+		http.Error(w, "blob is being evicted or was accessed meanwhile", http.StatusConflict)
+		return
+	}
+	s.logger.Infof("deleted blob %s", dgst)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// servePinBlob pins a tracked blob, protecting it from eviction
+func (s *cacheServer) servePinBlob(w http.ResponseWriter, r *http.Request) {
+	s.setPinned(w, r, true)
+}
+
+// serveUnpinBlob unpins a tracked blob, evicted like the others again
+func (s *cacheServer) serveUnpinBlob(w http.ResponseWriter, r *http.Request) {
+	s.setPinned(w, r, false)
+}
+
+func (s *cacheServer) setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	dgst, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "invalid digest", http.StatusBadRequest)
+		return
+	}
+	if !s.tracker.SetPinned(dgst, pinned) {
+		http.Error(w, "blob not tracked", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDeleteRepository deletes a repository: its tags, manifest revisions,
+// layer links and upload sessions at once, then in a background job the
+// blobs linked into no other repository along with their metadata. It
+// responds with the job to poll.
+func (s *cacheServer) serveDeleteRepository(w http.ResponseWriter, r *http.Request) {
+	named, err := reference.WithName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "invalid repository name", http.StatusBadRequest)
+		return
+	}
+	name := named.Name()
+
+	since := time.Now()
+	if err := s.storage.DeleteRepository(r.Context(), name); err != nil {
+		if errors.As(err, new(driver.PathNotFoundError)) {
+			http.Error(w, "repository not found", http.StatusNotFound)
+			return
+		}
+		s.logger.Errorf("error deleting repository %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("deleted repository %s", name)
+
+	j := s.jobs.start(s.appContext, "delete-repository", name, func(ctx context.Context, progress func(done, total int)) (any, error) {
+		_, err := s.evictOrphans(ctx, s.tracker.RemoveRepository(name), since, progress)
+		return nil, err
+	})
+	w.Header().Set("Location", "/admin/jobs/"+j.ID)
+	s.writeJob(w, http.StatusAccepted, j)
+}
+
+// evictOrphans evicts blobs linked into no repository anymore, unless
+// accessed after since. It returns the number of blobs evicted.
+func (s *cacheServer) evictOrphans(ctx context.Context, orphans []digest.Digest, since time.Time, progress func(done, total int)) (int, error) {
+	progress(0, len(orphans))
+	evicted, failed := 0, 0
+	for i, dgst := range orphans {
+		ok, err := s.tracker.EvictBlob(ctx, dgst, since, s.deleteBlob)
+		switch {
+		case ctx.Err() != nil:
+			return evicted, ctx.Err()
+		case err != nil:
+			s.logger.Errorf("failed to delete blob %s: %v", dgst, err)
+			failed++
+		case ok:
+			evicted++
+		}
+		progress(i+1, len(orphans))
+	}
+	s.logger.Infof("evicted %d blobs left in no repository", evicted)
+	if failed > 0 {
+		return evicted, fmt.Errorf("failed to delete %d of %d blobs", failed, len(orphans))
+	}
+	return evicted, nil
+}
+
+// serveJob reports the state of a job
+func (s *cacheServer) serveJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	s.writeJob(w, http.StatusOK, j)
+}
+
+// serveJobs lists the running jobs and those finished within jobRetention
+func (s *cacheServer) serveJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.jobs.list()); err != nil {
+		s.logger.Errorf("error encoding jobs: %v", err)
+	}
+}
+
+// serveCancelJob cancels a running job. The work done so far is kept.
+func (s *cacheServer) serveCancelJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.cancel(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	s.writeJob(w, http.StatusAccepted, j)
+}
+
+// serveQuarantinedBlobs lists the blobs quarantined after failing digest
+// verification, most recent first
+func (s *cacheServer) serveQuarantinedBlobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.storage.QuarantinedBlobs()); err != nil {
+		s.logger.Errorf("error encoding quarantined blobs: %v", err)
+	}
+}
+
+// serveReleaseBlob serves a quarantined blob again
+func (s *cacheServer) serveReleaseBlob(w http.ResponseWriter, r *http.Request) {
+	s.updateQuarantine(w, r, s.storage.ReleaseBlob)
+}
+
+// servePurgeBlob deletes a quarantined blob and its links
+func (s *cacheServer) servePurgeBlob(w http.ResponseWriter, r *http.Request) {
+	s.updateQuarantine(w, r, s.storage.PurgeBlob)
+}
+
+func (s *cacheServer) updateQuarantine(w http.ResponseWriter, r *http.Request, update func(context.Context, digest.Digest) (bool, error)) {
+	dgst, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "invalid digest", http.StatusBadRequest)
+		return
+	}
+	found, err := update(r.Context(), dgst)
+	if err != nil {
+		s.logger.Errorf("error updating quarantined blob %s: %v", dgst, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "blob not quarantined", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveActivity lists the recent pulls, pushes, deletes and evictions, most
+// recent first. The optional "limit" query parameter bounds the number listed
+// and "kind" keeps those of a kind.
+func (s *cacheServer) serveActivity(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case "", handlers.ActivityPull, handlers.ActivityPush, handlers.ActivityDelete, handlers.ActivityEvict:
+	default:
+		http.Error(w, "invalid kind parameter", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.handler.Activity(limit, kind)); err != nil {
+		s.logger.Errorf("error encoding activity: %v", err)
+	}
+}
+
+// serveDashboard serves the Grafana dashboard of the metrics of the server
+func (s *cacheServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(dcsmetrics.Dashboard()); err != nil {
+		s.logger.Errorf("error encoding dashboard: %v", err)
+	}
+}
+
+func (s *cacheServer) writeJob(w http.ResponseWriter, status int, j job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(j); err != nil {
+		s.logger.Errorf("error encoding job: %v", err)
+	}
+}
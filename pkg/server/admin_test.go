@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// newAdminServer returns the admin endpoints of a server tracking the blobs
+// of dgsts, linked into repository "library/alpine"
+func newAdminServer(t *testing.T, dgsts ...digest.Digest) (*cacheServer, http.Handler) {
+	t.Helper()
+	return newAdminServerWithConfig(t, config.DefaultConfig(), dgsts...)
+}
+
+func newAdminServerWithConfig(t *testing.T, cfg *config.Config, dgsts ...digest.Digest) (*cacheServer, http.Handler) {
+	t.Helper()
+	tracker, err := cache.NewLRUTrackerWithStore(cache.MemoryMetaStore{}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating tracker: %v", err)
+	}
+	for _, dgst := range dgsts {
+		if err := tracker.RecordWrite(dgst, 100); err != nil {
+			t.Fatalf("unexpected error recording write: %v", err)
+		}
+		tracker.AddRepository(dgst, "library/alpine")
+	}
+	s := &cacheServer{config: cfg, tracker: tracker, logger: logrus.New()}
+	router := mux.NewRouter()
+	s.registerAdmin(router)
+	return s, router
+}
+
+func adminDo(t *testing.T, handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestAdminPin(t *testing.T) {
+	dgst := digest.FromString("layer")
+	s, handler := newAdminServer(t, dgst)
+
+	for _, tc := range []struct {
+		method string
+		target string
+		status int
+		pinned bool
+	}{
+		{http.MethodPut, "/admin/blobs/" + dgst.String() + "/pin", http.StatusNoContent, true},
+		{http.MethodPut, "/admin/blobs/" + dgst.String() + "/pin", http.StatusNoContent, true},
+		{http.MethodDelete, "/admin/blobs/" + dgst.String() + "/pin", http.StatusNoContent, false},
+		{http.MethodPut, "/admin/blobs/" + digest.FromString("untracked").String() + "/pin", http.StatusNotFound, false},
+		{http.MethodDelete, "/admin/blobs/" + digest.FromString("untracked").String() + "/pin", http.StatusNotFound, false},
+		{http.MethodPut, "/admin/blobs/sha256:invalid/pin", http.StatusBadRequest, false},
+	} {
+		if rec := adminDo(t, handler, tc.method, tc.target); rec.Code != tc.status {
+			t.Fatalf("%s %s: unexpected status %d != %d: %s", tc.method, tc.target, rec.Code, tc.status, rec.Body)
+		}
+		if meta, _ := s.tracker.Blob(dgst); meta.Pinned != tc.pinned {
+			t.Fatalf("%s %s: unexpected pinned %v != %v", tc.method, tc.target, meta.Pinned, tc.pinned)
+		}
+	}
+}
+
+func TestAdminBlobs(t *testing.T) {
+	pinned := digest.FromString("pinned")
+	regular := digest.FromString("regular")
+	_, handler := newAdminServer(t, pinned, regular)
+	if rec := adminDo(t, handler, http.MethodPut, "/admin/blobs/"+pinned.String()+"/pin"); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status pinning: %d", rec.Code)
+	}
+
+	rec := adminDo(t, handler, http.MethodGet, "/admin/blobs?repo=library/alpine")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status listing blobs: %d", rec.Code)
+	}
+	var blobs []cache.BlobMeta
+	if err := json.NewDecoder(rec.Body).Decode(&blobs); err != nil {
+		t.Fatalf("unexpected error decoding blobs: %v", err)
+	}
+	if len(blobs) != 2 {
+		t.Fatalf("unexpected blobs: %v", blobs)
+	}
+	for _, meta := range blobs {
+		if meta.Pinned != (meta.Digest == pinned.String()) {
+			t.Fatalf("unexpected pinned %v of %s", meta.Pinned, meta.Digest)
+		}
+	}
+
+	rec = adminDo(t, handler, http.MethodGet, "/admin/blobs?repo=library/debian")
+	if body := rec.Body.String(); body != "[]\n" {
+		t.Fatalf("unexpected blobs of another repository: %s", body)
+	}
+
+	rec = adminDo(t, handler, http.MethodGet, "/admin/repositories")
+	var repos []repositorySummary
+	if err := json.NewDecoder(rec.Body).Decode(&repos); err != nil {
+		t.Fatalf("unexpected error decoding repositories: %v", err)
+	}
+	if len(repos) != 1 || repos[0].Name != "library/alpine" || repos[0].Blobs != 2 || repos[0].Pinned != 1 || repos[0].Size != 200 {
+		t.Fatalf("unexpected repositories: %+v", repos)
+	}
+}
+
+func TestAdminDeletePinnedBlob(t *testing.T) {
+	dgst := digest.FromString("layer")
+	s, handler := newAdminServer(t, dgst)
+	s.tracker.SetPinned(dgst, true)
+
+	if rec := adminDo(t, handler, http.MethodDelete, "/admin/blobs/"+dgst.String()); rec.Code != http.StatusConflict {
+		t.Fatalf("unexpected status deleting a pinned blob: %d", rec.Code)
+	}
+	if _, tracked := s.tracker.Blob(dgst); !tracked {
+		t.Fatal("expected the pinned blob to be kept")
+	}
+	if rec := adminDo(t, handler, http.MethodDelete, "/admin/blobs/"+digest.FromString("untracked").String()); rec.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status deleting an untracked blob: %d", rec.Code)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Http.Debug.Admin.Token = "secret"
+	_, handler := newAdminServerWithConfig(t, cfg, digest.FromString("layer"))
+
+	for _, tc := range []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/repositories", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("%q: unexpected status %d != %d", tc.authorization, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:5001": true,
+		"[::1]:5001":     true,
+		"localhost:5001": true,
+		":5001":          false,
+		"0.0.0.0:5001":   false,
+		"10.0.0.1:5001":  false,
+	} {
+		if isLoopbackAddr(addr) != expected {
+			t.Fatalf("%s: expected loopback %v", addr, expected)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// blobPathPattern matches the blob and blob upload endpoints, whose content
+// is not compressed: layers mostly are already, and range requests and
+// resumable uploads need the bytes as stored
+var blobPathPattern = regexp.MustCompile(`/blobs/(uploads/|[a-z0-9+._-]+:[a-zA-Z0-9=_-]+$)`)
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// withCompression compresses the JSON responses of handler, such as
+// manifests, tag lists, the catalog and the admin endpoints, in the
+// encoding negotiated by Accept-Encoding, zstd or gzip. Blobs and responses
+// smaller than minSize bytes are sent as they are.
+func withCompression(handler http.Handler, minSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || blobPathPattern.MatchString(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the encoding of the highest quality accepted,
+// zstd before gzip, or "" if none
+func negotiateEncoding(accept string) string {
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "zstd" && name != "gzip" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > bestQuality || (quality == bestQuality && name == "zstd") {
+			best, bestQuality = name, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of the content type are compressed
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// manifests are e.g. application/vnd.oci.image.manifest.v1+json or,
+	// for schema 1, application/vnd.docker.distribution.manifest.v1+prettyjws
+	return mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+prettyjws")
+}
+
+// compressWriter compresses the response if its headers allow it when they
+// are written
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int64
+
+	wroteHeader bool
+	encoder     io.WriteCloser // nil if the response is not compressed
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && compressible(h.Get("Content-Type")) {
+		length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil || length >= w.minSize {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			w.encoder = w.newEncoder()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) newEncoder() io.WriteCloser {
+	if w.encoding == "zstd" {
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(w.ResponseWriter)
+		return enc
+	}
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w.ResponseWriter)
+	return gz
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.encoder.Write(p)
+}
+
+// Flush flushes the data compressed so far to the client
+func (w *compressWriter) Flush() {
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close completes the compressed stream and returns the encoder to its pool
+func (w *compressWriter) close() {
+	if w.encoder == nil {
+		return
+	}
+	w.encoder.Close()
+	switch enc := w.encoder.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdWriters.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipWriters.Put(enc)
+	}
+	w.encoder = nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Backoff between attempts to listen on the debug address with the "retry"
+// http.debug.on_error
+const (
+	debugRetryMinBackoff = time.Second
+	debugRetryMaxBackoff = time.Minute
+)
+
+// States of the debug server reported by Stats
+const (
+	debugDisabled  = "disabled"
+	debugListening = "listening"
+	debugFailed    = "failed"
+	debugRetrying  = "retrying"
+)
+
+// debugState is the state of the debug server with the last error listening
+type debugState struct {
+	mu     sync.Mutex
+	status string
+	err    error
+}
+
+func (d *debugState) set(status string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+	d.err = err
+}
+
+func (d *debugState) get() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status == "" {
+		return debugDisabled, nil
+	}
+	return d.status, d.err
+}
+
+// serveDebug serves the debug server on l
+func (s *cacheServer) serveDebug(l net.Listener) {
+	s.listeners[debugListener] = l
+	s.debug.set(debugListening, nil)
+	go func() {
+		if err := s.debugServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("error serving debug server: %v", err)
+		}
+	}()
+}
+
+// retryDebugListen tries to listen on the debug address with exponential
+// backoff until it succeeds, passing the listener to ready, or ctx is done
+func (s *cacheServer) retryDebugListen(ctx context.Context, ready chan<- net.Listener) {
+	backoff := debugRetryMinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		l, err := s.listen(debugListener, s.debugServer.Addr)
+		if err == nil {
+			select {
+			case ready <- l:
+			case <-ctx.Done():
+				l.Close()
+			}
+			return
+		}
+		backoff = min(backoff*2, debugRetryMaxBackoff)
+		s.debug.set(debugRetrying, err)
+		s.logger.Warnf("error starting debug server, retrying in %v: %v", backoff, err)
+	}
+}
+
+// withoutWriteTimeout lifts the write timeout of the debug server for
+// handler. The reports walking the whole storage and the admin endpoints
+// take longer than it to respond on any real cache.
+func withoutWriteTimeout(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a zero deadline means none
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddr returns whether the listen address addr is only reachable
+// from the host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States of a job
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// jobRetention is how long finished jobs can still be polled
+const jobRetention = time.Hour
+
+// job is the state of an admin operation run in the background, polled with
+// GET /admin/jobs/{id}
+type job struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Target   string     `json:"target,omitempty"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Done     int        `json:"done"`
+	Total    int        `json:"total"`
+	Error    string     `json:"error,omitempty"`
+	Result   any        `json:"result,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// jobFunc is the operation of a job. It reports its progress through
+// progress, stops early once ctx is done and returns the result reported by
+// the job, if any.
+type jobFunc func(ctx context.Context, progress func(done, total int)) (any, error)
+
+// jobManager runs admin operations in the background, so that they do not
+// hold an HTTP request open, and keeps their state for polling
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	wg   sync.WaitGroup
+}
+
+// start runs fn in the background as a job of kind on target and returns its
+// state. The job is canceled once ctx is done.
+func (m *jobManager) start(ctx context.Context, kind, target string, fn jobFunc) job {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{
+		ID:      uuid.NewString(),
+		Kind:    kind,
+		Target:  target,
+		Status:  jobRunning,
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	m.mu.Lock()
+	if m.jobs == nil {
+		m.jobs = make(map[string]*job)
+	}
+	m.prune()
+	m.jobs[j.ID] = j
+	snapshot := *j
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		result, err := fn(ctx, func(done, total int) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			j.Done, j.Total = done, total
+		})
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		finished := time.Now()
+		j.Finished = &finished
+		j.Result = result
+		switch {
+		case errors.Is(err, context.Canceled):
+			j.Status = jobCanceled
+		case err != nil:
+			j.Status = jobFailed
+			j.Error = err.Error()
+		default:
+			j.Status = jobSucceeded
+		}
+	}()
+	return snapshot
+}
+
+// prune forgets the jobs finished for longer than jobRetention
+func (m *jobManager) prune() {
+	for id, j := range m.jobs {
+		if j.Finished != nil && time.Since(*j.Finished) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// get returns the state of the job id
+func (m *jobManager) get(id string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// list returns the state of the jobs, oldest first
+func (m *jobManager) list() []job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	jobs := make([]job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, *j)
+	}
+	slices.SortFunc(jobs, func(a, b job) int {
+		return a.Started.Compare(b.Started)
+	})
+	return jobs
+}
+
+// cancel cancels the job id if running and returns its state, or false if
+// there is no such job
+func (m *jobManager) cancel(id string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	if j.Status == jobRunning {
+		j.cancel()
+	}
+	return *j, true
+}
+
+// stop cancels the running jobs and waits for them to return
+func (m *jobManager) stop() {
+	m.mu.Lock()
+	for _, j := range m.jobs {
+		j.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/netutil"
+)
+
+// minOpenFiles is the open file limit below which busy caches risk failing
+// with "too many open files": every connection, blob being read or written
+// and upstream request holds a file descriptor
+const minOpenFiles = 4096
+
+// filesPerConnection is the open files counted per connection allowed by
+// limits.max_connections: the connection and a blob file or upstream
+// request
+const filesPerConnection = 2
+
+// checkFileLimit raises the open file limit as far as allowed and warns if
+// it stays too low for the configured connections
+func (s *cacheServer) checkFileLimit() {
+	soft, hard, err := raiseFileLimit()
+	if err != nil {
+		s.logger.Debugf("can not check the open file limit: %v", err)
+		return
+	}
+	wanted, hint := uint64(minOpenFiles), ""
+	if n := uint64(s.config.Limits.MaxConnections) * filesPerConnection; n > wanted {
+		wanted, hint = n, ", or lower limits.max_connections"
+	}
+	if soft < wanted {
+		s.logger.Warnf("open file limit is %d (hard limit %d), below the %d recommended: requests may fail with \"too many open files\" under load. "+
+			"Raise it with ulimit -n, LimitNOFILE= in the systemd unit or --ulimit nofile= for docker%s", soft, hard, wanted, hint)
+		return
+	}
+	s.logger.Infof("open file limit is %d", soft)
+}
+
+// limitConnections limits the connections served at once on l to
+// limits.max_connections, if set
+func (s *cacheServer) limitConnections(l net.Listener) net.Listener {
+	if s.config.Limits.MaxConnections <= 0 {
+		return l
+	}
+	s.logger.Infof("serving at most %d connections at once", s.config.Limits.MaxConnections)
+	return netutil.LimitListener(l, s.config.Limits.MaxConnections)
+}
+
+// parsePrefixes parses CIDRs, or single IP addresses
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
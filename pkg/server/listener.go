@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// listenFDsEnv names the listeners passed to a process started by an
+// upgrade, in the order of the inherited file descriptors starting at 3.
+const listenFDsEnv = "DOCKER_CACHE_SERVER_LISTEN_FDS"
+
+const (
+	mainListener  = "main"
+	debugListener = "debug"
+)
+
+// inheritedListeners returns the listeners passed by the parent process
+// during an upgrade, keyed by name.
+func inheritedListeners() (map[string]net.Listener, error) {
+	names := os.Getenv(listenFDsEnv)
+	if names == "" {
+		return nil, nil
+	}
+	// children started by this process must not see our descriptors
+	_ = os.Unsetenv(listenFDsEnv)
+
+	listeners := make(map[string]net.Listener)
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %s listener: %w", name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// listen returns the inherited listener of the given name, or a new one on
+// addr.
+func (s *cacheServer) listen(name, addr string) (net.Listener, error) {
+	if l, ok := s.inherited[name]; ok {
+		s.logger.Infof("using %s listener inherited from previous process (%s)", name, l.Addr())
+		delete(s.inherited, name)
+		return l, nil
+	}
+
+	lc := net.ListenConfig{}
+	if s.config.Http.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// upgrade starts a new instance of the executable which takes over the
+// listening sockets. The caller drains this process afterwards.
+func (s *cacheServer) upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range []string{mainListener, debugListener} {
+		l, ok := s.listeners[name]
+		if !ok {
+			continue
+		}
+		tcpListener, ok := l.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("%s listener cannot be passed on", name)
+		}
+		f, err := tcpListener.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s.logger.Infof("started upgraded process (pid %d)", cmd.Process.Pid)
+	return nil
+}
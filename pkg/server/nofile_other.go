@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import "errors"
+
+func raiseFileLimit() (soft, hard uint64, err error) {
+	return 0, 0, errors.New("open file limit is not supported on this platform")
+}
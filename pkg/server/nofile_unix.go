@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import "syscall"
+
+// raiseFileLimit raises the soft limit of open files to the hard limit, if
+// allowed, and returns both
+func raiseFileLimit() (soft, hard uint64, err error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	if rlimit.Cur < rlimit.Max {
+		raised := rlimit
+		raised.Cur = rlimit.Max
+		// e.g. macOS refuses more than kern.maxfilesperproc
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised) == nil {
+			rlimit = raised
+		}
+	}
+	return uint64(rlimit.Cur), uint64(rlimit.Max), nil
+}
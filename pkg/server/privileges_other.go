@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import "fmt"
+
+func dropPrivileges(username, groupname string) error {
+	return fmt.Errorf("server.user: dropping privileges is not supported on this platform")
+}
@@ -0,0 +1,84 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to username and groupname, the
+// primary group of the user if empty. It does nothing if the process already
+// runs as them, e.g. once upgraded with the listeners of a process which
+// dropped its privileges.
+func dropPrivileges(username, groupname string) error {
+	u, err := lookupUser(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("server.user: uid %q: %w", u.Uid, err)
+	}
+	gidString := u.Gid
+	if groupname != "" {
+		g, err := lookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		gidString = g.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return fmt.Errorf("server.group: gid %q: %w", gidString, err)
+	}
+
+	if os.Getuid() == uid && os.Geteuid() == uid && os.Getgid() == gid && os.Getegid() == gid {
+		return nil
+	}
+	// The supplementary groups of root must go first, while allowed to
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("root privileges could be regained after setuid %d", uid)
+	}
+	return nil
+}
+
+// lookupUser looks up a user by name, else by numeric ID
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, atoiErr := strconv.Atoi(name); atoiErr == nil {
+		if u, idErr := user.LookupId(name); idErr == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("server.user: %w", err)
+}
+
+// lookupGroup looks up a group by name, else by numeric ID
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g, nil
+	}
+	if _, atoiErr := strconv.Atoi(name); atoiErr == nil {
+		if g, idErr := user.LookupGroupId(name); idErr == nil {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("server.group: %w", err)
+}
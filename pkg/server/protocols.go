@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureProtocols sets up TLS, HTTP/2 over TLS and h2c on srv. HTTP/2 lets
+// clients such as buildkit multiplex many small blob requests over a few
+// connections.
+func configureProtocols(srv *http.Server, cfg config.HttpConfig) error {
+	if (cfg.TLS.Certificate == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("http.tls: certificate and key must be set together")
+	}
+	useTLS := cfg.TLS.Certificate != ""
+
+	if useTLS {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Certificate, cfg.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("http.tls: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if cfg.HTTP2.Disabled {
+			// A non-nil map keeps net/http from enabling HTTP/2
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		// Otherwise ServeTLS negotiates HTTP/2 with ALPN by itself
+	}
+
+	if !cfg.H2C.Enabled {
+		return nil
+	}
+	if useTLS {
+		return fmt.Errorf("http.h2c: requires a cleartext listener, unset http.tls")
+	}
+	if cfg.HTTP2.Disabled {
+		return fmt.Errorf("http.h2c: can not be enabled with http.http2.disabled")
+	}
+	h2s := &http2.Server{IdleTimeout: srv.IdleTimeout}
+	// Lets Shutdown close idle HTTP/2 connections gracefully
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return fmt.Errorf("http.h2c: %w", err)
+	}
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	return nil
+}
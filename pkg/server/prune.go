@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jc-lab/docker-cache-server/pkg/lru_driver"
+)
+
+// pruneResult is the result of a prune job
+type pruneResult struct {
+	DryRun bool `json:"dry_run"`
+	// Repositories lists what was pruned, or would be, in the repositories
+	// where anything was
+	Repositories []lru_driver.PruneResult `json:"repositories"`
+	// Evicted is the number of blobs deleted for being left in no repository
+	Evicted int `json:"evicted"`
+}
+
+// servePrune starts a job pruning the repositories whose name matches the
+// "repo" glob of the tags, manifests and blobs not used for "older_than",
+// then evicting the blobs left in no repository. With "dry_run" the job only
+// reports what would be pruned.
+func (s *cacheServer) servePrune(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pattern := q.Get("repo")
+	if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+		http.Error(w, "invalid repo pattern", http.StatusBadRequest)
+		return
+	}
+	olderThan, err := time.ParseDuration(q.Get("older_than"))
+	if err != nil || olderThan <= 0 {
+		http.Error(w, "invalid older_than duration", http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if v := q.Get("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid dry_run parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	j := s.jobs.start(s.appContext, "prune", pattern, func(ctx context.Context, progress func(done, total int)) (any, error) {
+		return s.prune(ctx, pattern, cutoff, dryRun, progress)
+	})
+	w.Header().Set("Location", "/admin/jobs/"+j.ID)
+	s.writeJob(w, http.StatusAccepted, j)
+}
+
+// prune prunes the repositories matching pattern, reporting the number of
+// repositories done as progress
+func (s *cacheServer) prune(ctx context.Context, pattern string, cutoff time.Time, dryRun bool, progress func(done, total int)) (*pruneResult, error) {
+	names, err := s.repositories(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	result := &pruneResult{DryRun: dryRun, Repositories: []lru_driver.PruneResult{}}
+	progress(0, len(names))
+	for i, name := range names {
+		since := time.Now()
+		pruned, err := s.storage.PruneRepository(ctx, name, cutoff, dryRun)
+		if len(pruned.Tags)+len(pruned.Manifests)+len(pruned.Blobs) > 0 {
+			result.Repositories = append(result.Repositories, pruned)
+		}
+		if err != nil {
+			return result, err
+		}
+		if !dryRun {
+			evicted, err := s.evictOrphans(ctx, pruned.Orphans, since, func(int, int) {})
+			result.Evicted += evicted
+			if err != nil {
+				return result, err
+			}
+		}
+		progress(i+1, len(names))
+	}
+	if !dryRun {
+		s.logger.Infof("pruned %d repositories matching %q", len(result.Repositories), pattern)
+	}
+	return result, nil
+}
+
+// repositories returns the names of the repositories matching pattern
+func (s *cacheServer) repositories(ctx context.Context, pattern string) ([]string, error) {
+	var names []string
+	batch := make([]string, 100)
+	last := ""
+	for {
+		n, err := s.handler.Registry().Repositories(ctx, batch, last)
+		for _, name := range batch[:n] {
+			if matched, _ := path.Match(pattern, name); matched {
+				names = append(names, name)
+			}
+		}
+		if n > 0 {
+			last = batch[n-1]
+		}
+		if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// upgradeSignals is empty, listener handoff is not supported on this platform.
+var upgradeSignals []os.Signal
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// upgradeSignals make the server hand its listeners to a new process and
+// drain.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reusePortControl sets SO_REUSEPORT, letting another process bind the same
+// address while this one is still listening.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -2,26 +2,57 @@ package server
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	auth2 "github.com/distribution/distribution/v3/registry/auth"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/docker/go-metrics"
 	"github.com/gorilla/mux"
 	"github.com/jc-lab/docker-cache-server/internal/handlers"
+	"github.com/jc-lab/docker-cache-server/internal/registryclient"
+	"github.com/jc-lab/docker-cache-server/pkg/alert"
+	"github.com/jc-lab/docker-cache-server/pkg/auth"
+	_ "github.com/jc-lab/docker-cache-server/pkg/auth/kubernetes"
+	_ "github.com/jc-lab/docker-cache-server/pkg/auth/pat"
 	"github.com/jc-lab/docker-cache-server/pkg/auth/silly"
 	"github.com/jc-lab/docker-cache-server/pkg/auth/userpass"
 	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/compress_driver"
 	"github.com/jc-lab/docker-cache-server/pkg/config"
+	"github.com/jc-lab/docker-cache-server/pkg/encrypt_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/health"
 	"github.com/jc-lab/docker-cache-server/pkg/lru_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/readonly_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/replication"
+	"github.com/jc-lab/docker-cache-server/pkg/retry_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/shard"
+	"github.com/jc-lab/docker-cache-server/pkg/spread_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/tiered_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/upload_driver"
+	"github.com/jc-lab/docker-cache-server/pkg/usage"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
@@ -49,7 +80,8 @@ type Options struct {
 	Logger *logrus.Logger
 
 	// AuthValidator is a custom authentication validator (optional)
-	// If provided, overrides the default basic auth
+	// If provided, overrides the default basic auth and auth.type. Other
+	// access controllers can be registered with auth.Register.
 	AuthValidator userpass.AuthenticateFunc
 
 	// OnBlobAccess is called when a blob is accessed (optional)
@@ -57,8 +89,23 @@ type Options struct {
 
 	// OnBlobDelete is called when a blob is deleted (optional)
 	OnBlobDelete func(digest string)
+
+	// OnRequest is called once a request of the registry API is authorized,
+	// before it is served (optional)
+	OnRequest func(RequestEvent)
+
+	// OnResponse is called once a request of the registry API is served,
+	// including those rejected, with its status and the bytes transferred
+	// (optional). Both hooks run on the goroutine serving the request and
+	// delay it until they return.
+	OnResponse func(RequestEvent)
 }
 
+// RequestEvent describes a request of the registry API: its route, the
+// repository and digest or tag it is about, the user and, in OnResponse,
+// the status and bytes of the response
+type RequestEvent = handlers.RequestEvent
+
 // cacheServer implements CacheServer
 type cacheServer struct {
 	config *config.Config
@@ -67,6 +114,7 @@ type cacheServer struct {
 	appCancel  context.CancelFunc
 
 	tracker    *cache.LRUTracker
+	storage    *lru_driver.Driver
 	logger     *logrus.Logger
 	opts       *Options
 	handler    *handlers.App
@@ -74,6 +122,23 @@ type cacheServer struct {
 
 	debugServer *http.Server
 	debugMux    *mux.Router
+	debug       debugState
+	jobs        jobManager
+
+	replicator *replication.Replicator
+	health     *health.Checker
+	usage      *usage.Sampler   // nil unless storage.usage.interval is set
+	alerts     *alert.Monitor   // nil unless alerts.webhooks are set
+	locks      *cache.FileLocks // nil unless the storage is a filesystem supporting locks
+	upstream   *registryclient.Client
+
+	// draining is set once shutdown starts, turning readiness off
+	draining atomic.Bool
+
+	// inherited holds the listeners passed on by the process this one
+	// replaced, listeners the ones in use, both by name
+	inherited map[string]net.Listener
+	listeners map[string]net.Listener
 }
 
 const authRelam = "docker-cache-server"
@@ -100,58 +165,296 @@ func New(opts *Options) (CacheServer, error) {
 
 	var err error
 	var accessController auth2.AccessController
-	if !opts.Config.Auth.Enabled {
+	authType := opts.Config.Auth.Type
+	if authType == "" {
+		authType = "userpass"
+	}
+	switch {
+	case !opts.Config.Auth.Enabled:
 		accessController = silly.MustNew(authRelam, authService)
-	} else if opts.AuthValidator != nil {
-		accessController, err = userpass.NewWithCallback(authRelam, opts.AuthValidator)
-	} else {
-		accessController, err = userpass.NewWithCreds(authRelam, opts.Config.Auth.Users)
+	case opts.AuthValidator != nil:
+		var options []userpass.Option
+		if options, err = userpass.ConfigOptions(opts.Config); err == nil {
+			accessController, err = userpass.NewWithCallback(authRelam, opts.AuthValidator, options...)
+		}
+	default:
+		accessController, err = auth.New(authType, authRelam, opts.Config)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if opts.Config.Auth.Enabled && opts.Config.Auth.Tokens.Enabled {
+		if _, ok := accessController.(http.Handler); !ok {
+			return nil, fmt.Errorf("auth.tokens: not supported by auth type %q", authType)
+		}
+	}
 
-	metaCacheDir := filepath.Join(opts.Config.Storage.Directory, "meta/cache")
-	repoDir := filepath.Join(opts.Config.Storage.Directory, "data")
+	replica := opts.Config.Replica.Enabled
+	if replica && opts.Config.Upstream.URL != "" {
+		return nil, fmt.Errorf("replica: upstream.url is not supported, pulls through the upstream write to the storage")
+	}
 
-	_ = os.MkdirAll(metaCacheDir, 0755)
-	_ = os.MkdirAll(repoDir, 0755)
+	modes, err := storageModes(opts.Config.Storage)
+	if err != nil {
+		return nil, err
+	}
+	baseDriver, err := newStorageDriver(opts.Config, modes, logger)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	if replica {
+		baseDriver = readonly_driver.New(baseDriver)
+	}
+	contentDriver, err := newEncryptDriver(opts.Config.Storage.Encryption, baseDriver)
+	if err != nil {
+		return nil, fmt.Errorf("storage.encryption: %w", err)
+	}
+	if compression := opts.Config.Storage.Compression; compression.Enabled {
+		// compress before encrypting, encrypted data does not compress
+		contentDriver, err = compress_driver.New(contentDriver, compression.Level)
+		if err != nil {
+			return nil, fmt.Errorf("storage.compression: %w", err)
+		}
+	}
+	metaStore, err := newMetaStore(opts.Config, modes, logger)
+	if err != nil {
+		return nil, fmt.Errorf("cache.metadata: %w", err)
+	}
+	// the locks and the cleanup lease guard writes, which a replica never
+	// makes
+	var locks *cache.FileLocks
+	if replica {
+		metaStore = cache.ReadOnlyMetaStore{MetaStore: metaStore}
+	} else if locks, err = openStorageLocks(opts.Config, modes, logger); err != nil {
+		return nil, fmt.Errorf("storage.locking: %w", err)
+	}
+	if fileStore, ok := metaStore.(*cache.FileMetaStore); ok && opts.Config.Storage.Locking {
+		fileStore.SetLocks(locks)
+	}
 
-	fsDriver := filesystem.New(filesystem.DriverParameters{
-		RootDirectory: repoDir,
-		MaxThreads:    100,
-	})
-	lruTracker, err := cache.NewLRUTracker(metaCacheDir, opts.Config.Cache.TTL, logger)
-	storageDriver := lru_driver.New(fsDriver, lruTracker, logger)
+	headAccessMode, err := cache.ParseAccessMode(opts.Config.Cache.HeadAccess)
+	if err != nil {
+		return nil, fmt.Errorf("cache.head_access: %w", err)
+	}
+
+	if err := validateTenants(opts.Config.Tenants); err != nil {
+		return nil, err
+	}
+	lruTracker, err := cache.NewLRUTrackerWithStore(metaStore, opts.Config.Cache.TTL, logger)
+	if err != nil {
+		return nil, err
+	}
+	lruTracker.SetMaxSize(opts.Config.Cache.MaxSize)
+	lruTracker.SetCleanupWorkers(opts.Config.Cache.CleanupWorkers)
+	lruTracker.SetCleanupRate(opts.Config.Cache.CleanupRate)
+	lruTracker.SetCleanupLimits(opts.Config.Cache.CleanupMaxDeletes, opts.Config.Cache.CleanupMaxDuration)
+	lruTracker.SetNamespaceTTLs(tenantTTLs(opts.Config.Tenants))
+	if !replica {
+		cleanupLocker, err := newCleanupLocker(opts.Config, modes)
+		if err != nil {
+			return nil, fmt.Errorf("cache.leader_election: %w", err)
+		}
+		if cleanupLocker != nil {
+			lruTracker.SetCleanupLocker(cleanupLocker)
+		}
+	}
+	storageDriver := lru_driver.New(contentDriver, lruTracker, logger)
+	storageDriver.SetVerifyReads(opts.Config.Storage.VerifyReads)
+	if opts.Config.Storage.Locking && locks != nil {
+		storageDriver.SetLocks(locks)
+	}
+	if err := storageDriver.LoadQuarantine(context.Background()); err != nil {
+		return nil, fmt.Errorf("loading quarantine: %w", err)
+	}
+
+	var blobRouter handlers.BlobRouter
+	if len(opts.Config.Shard.Nodes) > 0 {
+		router, err := shard.NewRouter(opts.Config.Shard.Self, opts.Config.Shard.Nodes, opts.Config.Shard.Replicas)
+		if err != nil {
+			return nil, fmt.Errorf("shard: %w", err)
+		}
+		blobRouter = router
+	}
+
+	var manifestListener handlers.ManifestListener
+	var replicator *replication.Replicator
+	if len(opts.Config.Replication.Targets) > 0 {
+		replicator, err = replication.New(opts.Config.Replication, logger)
+		if err != nil {
+			return nil, err
+		}
+		manifestListener = replicator
+	}
+
+	upstream, err := newUpstreamClient(opts.Config.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+
+	var trustPolicy *handlers.TrustPolicy
+	if opts.Config.Trust.Enabled {
+		if trustPolicy, err = newTrustPolicy(opts.Config.Trust); err != nil {
+			return nil, fmt.Errorf("trust: %w", err)
+		}
+	}
+
+	var prefetchWorkers int
+	if opts.Config.Upstream.Prefetch.Enabled {
+		prefetchWorkers = max(opts.Config.Upstream.Prefetch.Workers, 1)
+	}
+
+	switch opts.Config.Http.Debug.OnError {
+	case "", "log", "fatal", "retry":
+	default:
+		return nil, fmt.Errorf("http.debug.on_error: unknown value %q", opts.Config.Http.Debug.OnError)
+	}
+
+	if opts.Config.Cache.CleanupInterval <= 0 {
+		return nil, fmt.Errorf("cache: cleanup_interval must be positive")
+	}
+
+	// the quotas of the tenants enable the quotas on their own
+	quotas, err := quotaLimits(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		quotaDefault         int64
+		quotaRefreshInterval time.Duration
+	)
+	if opts.Config.Quota.Enabled {
+		quotaDefault = opts.Config.Quota.Default
+	}
+	if opts.Config.Quota.Enabled || len(quotas) > 0 {
+		quotaRefreshInterval = opts.Config.Quota.RefreshInterval
+		if quotaRefreshInterval <= 0 {
+			return nil, fmt.Errorf("quota: refresh_interval must be positive")
+		}
+	}
+	exemptPrefixes, err := parsePrefixes(opts.Config.Limits.Exempt.CIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("limits.exempt.cidrs: %w", err)
+	}
 
 	server := &cacheServer{
-		config: opts.Config,
-		logger: logger,
+		config:     opts.Config,
+		tracker:    lruTracker,
+		storage:    storageDriver,
+		opts:       opts,
+		logger:     logger,
+		replicator: replicator,
+		upstream:   upstream,
+		locks:      locks,
 	}
 	server.appContext, server.appCancel = context.WithCancel(context.Background())
 	server.handler, err = handlers.NewApp(server.appContext, &handlers.Config{
-		HttpPrefix:       opts.Config.Http.Prefix,
-		HttpHost:         opts.Config.Http.Host,
-		HttpRelativeURLs: opts.Config.Http.Relativeurls,
-		AccessController: accessController,
-		Driver:           storageDriver,
+		HttpPrefix:             opts.Config.Http.Prefix,
+		HttpHost:               opts.Config.Http.Host,
+		HttpRelativeURLs:       opts.Config.Http.Relativeurls,
+		HttpSecret:             opts.Config.Http.Secret,
+		HttpHeaders:            opts.Config.Http.Headers,
+		AccessController:       accessController,
+		Driver:                 storageDriver,
+		BlobRedirect:           opts.Config.Storage.Redirect,
+		CatalogMaxEntries:      opts.Config.Catalog.MaxEntries,
+		CatalogDefaultEntries:  opts.Config.Catalog.DefaultEntries,
+		TagsMaxEntries:         opts.Config.Tags.MaxEntries,
+		TagsDefaultEntries:     opts.Config.Tags.DefaultEntries,
+		Tracker:                lruTracker,
+		HeadAccessMode:         headAccessMode,
+		BlobRouter:             blobRouter,
+		ManifestListener:       manifestListener,
+		BlobQuarantine:         storageDriver,
+		Upstream:               upstream,
+		UpstreamAllow:          opts.Config.Upstream.Allow,
+		UpstreamDeny:           opts.Config.Upstream.Deny,
+		UpstreamSegments:       opts.Config.Upstream.Segments,
+		UpstreamSegmentMinSize: opts.Config.Upstream.SegmentMinSize,
+		UpstreamSignatures:     opts.Config.Upstream.Signatures,
+		TrustPolicy:            trustPolicy,
+		TagRefreshInterval:     opts.Config.Upstream.RefreshInterval,
+		TagRefreshCount:        opts.Config.Upstream.RefreshTags,
+		PrefetchWorkers:        prefetchWorkers,
+		PrefetchPlatforms:      opts.Config.Upstream.Prefetch.Platforms,
+		Quotas:                 quotas,
+		QuotaDefault:           quotaDefault,
+		QuotaRefreshInterval:   quotaRefreshInterval,
+		MaxUploadsPerClient:    opts.Config.Limits.MaxUploadsPerClient,
+		MaxBlobSize:            opts.Config.Limits.MaxBlobSize,
+		MaxImageSize:           opts.Config.Limits.MaxImageSize,
+		LimitExemptPrefixes:    exemptPrefixes,
+		LimitExemptUsers:       opts.Config.Limits.Exempt.Users,
+		ReadOnly:               replica,
+		OnRequest:              opts.OnRequest,
+		OnResponse:             opts.OnResponse,
 	})
+	if err != nil {
+		server.appCancel()
+		return nil, err
+	}
+	if replicator != nil {
+		replicator.Start(server.appContext, server.handler.Registry())
+	}
+
+	server.health = newHealthChecker(opts.Config, baseDriver, metaStore, logger)
+	server.health.Start(server.appContext)
+	if interval := opts.Config.Storage.Usage.Interval; interval > 0 {
+		measure := usage.Driver(baseDriver)
+		if storageType := opts.Config.Storage.Type; storageType == "" || storageType == "filesystem" {
+			measure = usage.Directory(storageDirectories(opts.Config.Storage)...)
+		}
+		server.usage = usage.NewSampler(interval, measure, logger)
+		server.usage.Start(server.appContext)
+	}
+	if len(opts.Config.Alerts.Webhooks) > 0 {
+		if server.alerts, err = server.newAlertMonitor(); err != nil {
+			server.appCancel()
+			return nil, fmt.Errorf("alerts: %w", err)
+		}
+		server.alerts.Start(server.appContext)
+	}
+
+	var handler http.Handler = server.handler
+	if opts.Config.Auth.Enabled && opts.Config.Auth.Tokens.Enabled {
+		handler = withTokenEndpoint(handler, userpass.TokenPath(opts.Config.Http), accessController.(http.Handler))
+	}
+	if compression := opts.Config.Http.Compression; compression.Enabled {
+		handler = withCompression(handler, compression.MinSize)
+	}
 
 	// Create HTTP server
+	addr, err := config.ListenAddr(opts.Config.Http.Addr, opts.Config.Http.Port)
+	if err != nil {
+		server.appCancel()
+		return nil, fmt.Errorf("http.addr: %w", err)
+	}
 	server.httpServer = &http.Server{
-		Addr:         opts.Config.Http.Addr,
-		Handler:      server.handler,
+		Addr:         addr,
+		Handler:      handler,
 		ReadTimeout:  300 * time.Second,
 		WriteTimeout: 300 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	if err := configureProtocols(server.httpServer, opts.Config.Http); err != nil {
+		server.appCancel()
+		return nil, err
+	}
 
-	if opts.Config.Http.Debug.Addr != "" {
+	if opts.Config.Http.Debug.Addr != "" || opts.Config.Http.Debug.Port != 0 {
+		debugAddr, err := config.ListenAddr(opts.Config.Http.Debug.Addr, opts.Config.Http.Debug.Port)
+		if err != nil {
+			server.appCancel()
+			return nil, fmt.Errorf("http.debug.addr: %w", err)
+		}
 		debugRouter := mux.NewRouter()
 		server.debugMux = debugRouter.PathPrefix("/debug/").Subrouter()
+		var debugHandler http.Handler = debugRouter
+		if compression := opts.Config.Http.Compression; compression.Enabled {
+			debugHandler = withCompression(debugHandler, compression.MinSize)
+		}
 		server.debugServer = &http.Server{
-			Addr:         opts.Config.Http.Debug.Addr,
-			Handler:      debugRouter,
+			Addr:         debugAddr,
+			Handler:      debugHandler,
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 5 * time.Second,
 			IdleTimeout:  120 * time.Second,
@@ -160,6 +463,21 @@ func New(opts *Options) (CacheServer, error) {
 		server.debugMux.Path("/health").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		})
+		debugRouter.Path("/readyz").HandlerFunc(server.serveReadiness)
+		// the admin endpoints modify the cache, they need a token unless
+		// only reachable from the host
+		if opts.Config.Http.Debug.Admin.Token != "" || isLoopbackAddr(debugAddr) {
+			server.registerAdmin(debugRouter)
+		} else {
+			server.logger.Warnf("admin endpoints disabled: http.debug.addr %s is not a loopback address and http.debug.admin.token is not set", debugAddr)
+		}
+
+		server.debugMux.Path("/dedup").Methods(http.MethodGet).Handler(withoutWriteTimeout(http.HandlerFunc(server.serveDedupStats)))
+		server.debugMux.Path("/upstreams").Methods(http.MethodGet).HandlerFunc(server.serveUpstreamStats)
+		server.debugMux.Path("/quarantine").Methods(http.MethodGet).HandlerFunc(server.serveQuarantine)
+		server.debugMux.Path("/quotas").Methods(http.MethodGet).HandlerFunc(server.serveQuotas)
+		server.debugMux.Path("/blobs/{digest}").Methods(http.MethodGet).HandlerFunc(server.serveBlob)
+		server.debugMux.Path("/popularity").Methods(http.MethodGet).Handler(withoutWriteTimeout(http.HandlerFunc(server.servePopularity)))
 
 		if prom := opts.Config.Http.Debug.Prometheus; prom.Enabled {
 			logger.Info("providing prometheus metrics on ", prom.Path)
@@ -173,42 +491,165 @@ func New(opts *Options) (CacheServer, error) {
 // Start starts the server and blocks until shutdown
 func (s *cacheServer) Start() error {
 	s.logger.Infof("starting Docker cache server (%s)", s.httpServer.Addr)
+	s.checkFileLimit()
+
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	s.inherited = inherited
+	s.listeners = make(map[string]net.Listener)
+
+	httpListener, err := s.listen(mainListener, s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	s.listeners[mainListener] = httpListener
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	upgradeChan := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeChan, upgradeSignals...)
+	}
 
 	// Start server in goroutine
 	errChan := make(chan error, 1)
+	debugReady := make(chan net.Listener)
+	retryCtx, cancelRetry := context.WithCancel(context.Background())
+	defer cancelRetry()
+	var debugL net.Listener
 	if s.debugServer != nil {
 		s.logger.Infof("starting debug server (%s)", s.debugServer.Addr)
-		go func() {
-			if err := s.debugServer.ListenAndServe(); err != nil {
+		l, err := s.listen(debugListener, s.debugServer.Addr)
+		if err != nil {
+			switch s.config.Http.Debug.OnError {
+			case "fatal":
+				httpListener.Close()
+				return fmt.Errorf("starting debug server: %w", err)
+			case "retry":
+				s.logger.Warnf("error starting debug server, retrying in %v: %v", debugRetryMinBackoff, err)
+				s.debug.set(debugRetrying, err)
+				go s.retryDebugListen(retryCtx, debugReady)
+			default:
 				s.logger.Errorf("error starting debug server: %v", err)
+				s.debug.set(debugFailed, err)
+			}
+		} else {
+			debugL = l
+		}
+	}
+
+	// Every listener is bound, privileged ports included
+	if s.config.Server.User != "" || s.config.Server.Group != "" {
+		if err := dropPrivileges(s.config.Server.User, s.config.Server.Group); err != nil {
+			httpListener.Close()
+			if debugL != nil {
+				debugL.Close()
 			}
-		}()
+			return fmt.Errorf("dropping privileges: %w", err)
+		}
+		s.logger.Infof("running as user %s (uid %d, gid %d)", s.config.Server.User, os.Getuid(), os.Getgid())
 	}
+	if debugL != nil {
+		s.serveDebug(debugL)
+	}
+
+	// s.listeners keeps the TCP listener itself for upgrades
+	served := s.limitConnections(httpListener)
 	go func() {
-		errChan <- s.httpServer.ListenAndServe()
+		if s.config.Http.TLS.Certificate != "" {
+			errChan <- s.httpServer.ServeTLS(served, "", "")
+			return
+		}
+		errChan <- s.httpServer.Serve(served)
 	}()
+	if !s.config.Replica.Enabled {
+		// the primary evicts the blobs of the storage it shares
+		s.tracker.StartCleanup(s.appContext, s.config.Cache.CleanupInterval, s.deleteBlob)
+	} else if interval := s.config.Replica.RefreshInterval; interval > 0 {
+		s.tracker.StartReload(s.appContext, interval)
+	}
 
 	// Wait for shutdown signal or error
-	select {
-	case err := <-errChan:
-		return err
-	case sig := <-sigChan:
-		s.logger.Infof("received signal: %v", sig)
-		return s.Shutdown(30 * time.Second)
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case l := <-debugReady:
+			s.logger.Infof("debug server started (%s)", l.Addr())
+			s.serveDebug(l)
+		case sig := <-upgradeChan:
+			s.logger.Infof("received signal: %v, handing listeners to a new process", sig)
+			if err := s.upgrade(); err != nil {
+				s.logger.Errorf("upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			return s.Shutdown(drainTimeout(s.config))
+		case sig := <-sigChan:
+			s.logger.Infof("received signal: %v", sig)
+			return s.Shutdown(drainTimeout(s.config))
+		}
+	}
+}
+
+// metadataFlushTimeout is how long shutdown waits for the blob metadata to be
+// saved, after the in-flight requests finished
+const metadataFlushTimeout = 30 * time.Second
+
+// drainTimeout returns how long shutdown waits for in-flight requests, such
+// as large blob uploads, to finish
+func drainTimeout(cfg *config.Config) time.Duration {
+	if timeout := cfg.Server.ShutdownTimeout; timeout > 0 {
+		return timeout
+	}
+	if timeout := cfg.Http.Drain.Timeout; timeout > 0 {
+		return timeout
+	}
+	return 30 * time.Second
+}
+
+// serveReadiness reports whether the server accepts new work. It fails as
+// soon as draining starts, while the server keeps serving in-flight requests,
+// and while a health check fails.
+func (s *cacheServer) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := "ready"
+	if s.draining.Load() {
+		status = "draining"
+	} else if !s.health.Healthy() {
+		status = "unhealthy"
 	}
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(readiness{
+		Status: status,
+		Checks: s.health.Status(),
+	})
 }
 
-// Shutdown gracefully shuts down the server
+// readiness is the body of /readyz
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Shutdown gracefully shuts down the server. Readiness is turned off first,
+// then in-flight requests get up to timeout to finish.
 func (s *cacheServer) Shutdown(timeout time.Duration) error {
 	var wg sync.WaitGroup
 	var errorMu sync.Mutex
 	var errorList []error
 
-	s.logger.Info("shutting down server...")
+	s.draining.Store(true)
+	if delay := s.config.Http.Drain.Delay; delay > 0 {
+		s.logger.Infof("draining, accepting connections for another %v", delay)
+		time.Sleep(delay)
+	}
+
+	s.logger.Infof("shutting down server, waiting up to %v for in-flight requests...", timeout)
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -216,7 +657,7 @@ func (s *cacheServer) Shutdown(timeout time.Duration) error {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		if err := s.httpServer.Shutdown(ctx); err != nil {
+		if err := shutdownHTTP(ctx, s.httpServer, s.logger); err != nil {
 			errorMu.Lock()
 			errorList = append(errorList, err)
 			errorMu.Unlock()
@@ -231,12 +672,54 @@ func (s *cacheServer) Shutdown(timeout time.Duration) error {
 		}
 	}()
 	wg.Wait()
+	// the quota refresh, prefetch and upload purger loops of the app and the
+	// jobs run until the app context is done
+	s.appCancel()
+	s.tracker.StopCleanup()
+	s.jobs.stop()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), metadataFlushTimeout)
+	if err := s.tracker.Flush(flushCtx); err != nil {
+		errorList = append(errorList, err)
+	}
+	cancelFlush()
+	if s.replicator != nil {
+		s.replicator.Stop()
+	}
+	s.health.Stop()
+	if s.usage != nil {
+		s.usage.Stop()
+	}
+	if s.alerts != nil {
+		s.alerts.Stop()
+	}
+	if s.locks != nil {
+		// after the cleanup stopped, nothing takes the locks anymore
+		defer s.locks.Close()
+	}
+	if s.debugServer != nil {
+		// kept up until now so that probes observe the drain, in-flight
+		// requests get what is left of the timeout
+		if err := shutdownHTTP(ctx, s.debugServer, s.logger); err != nil {
+			errorList = append(errorList, fmt.Errorf("debug server: %w", err))
+		}
+	}
 	if len(errorList) > 0 {
 		return errors.Join(errorList...)
 	}
 	return nil
 }
 
+// shutdownHTTP gracefully shuts srv down, closing the connections left once
+// ctx is done. Its listeners are closed either way.
+func shutdownHTTP(ctx context.Context, srv *http.Server, logger *logrus.Logger) error {
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warnf("drain timeout exceeded, closing remaining connections (%s)", srv.Addr)
+		err = srv.Close()
+	}
+	return err
+}
+
 // Config returns the server configuration
 func (s *cacheServer) Config() *config.Config {
 	return s.config
@@ -244,12 +727,153 @@ func (s *cacheServer) Config() *config.Config {
 
 // Stats returns cache statistics
 func (s *cacheServer) Stats() map[string]interface{} {
-	// This would need the tracker to be accessible
-	// For now return basic stats
-	return map[string]interface{}{
+	tracker := s.tracker.GetStats()
+	stats := map[string]interface{}{
 		"ttl":              s.config.Cache.TTL.String(),
 		"cleanup_interval": s.config.Cache.CleanupInterval.String(),
 		"storage_dir":      s.config.Storage.Directory,
+		"total_blobs":      tracker["total_blobs"],
+		"total_size":       tracker["total_size"],
+		"max_size":         tracker["max_size"],
+		"cleanup_backlog":  tracker["backlog"],
+		"metadata_loading": tracker["loading"],
+	}
+	if s.usage != nil {
+		if u, ok := s.usage.Last(); ok {
+			stats["storage_usage"] = u
+		}
+	}
+	status, err := s.debug.get()
+	stats["debug_server"] = status
+	if err != nil {
+		stats["debug_server_error"] = err.Error()
+	}
+	return stats
+}
+
+// deleteBlob evicts a blob from the storage, with its links in the
+// repositories using it
+func (s *cacheServer) deleteBlob(ctx context.Context, dgst digest.Digest) error {
+	if err := s.storage.Evict(ctx, dgst); err != nil {
+		return err
+	}
+	s.logger.Debugf("evicted blob %s", dgst)
+	s.handler.RecordActivity(handlers.Activity{Kind: handlers.ActivityEvict, Digest: dgst})
+	if s.opts != nil && s.opts.OnBlobDelete != nil {
+		s.opts.OnBlobDelete(dgst.String())
+	}
+	return nil
+}
+
+// serveDedupStats reports logical versus physical storage usage. The optional
+// "top" query parameter limits the number of shared blobs listed.
+func (s *cacheServer) serveDedupStats(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top parameter", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	stats, err := s.handler.DedupStats(r.Context(), top)
+	if err != nil {
+		s.logger.Errorf("error computing dedup stats: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.logger.Errorf("error encoding dedup stats: %v", err)
+	}
+}
+
+// serveUpstreamStats reports the request statistics of the upstream
+// registries, e.g. to tell failing upstream pulls from cache problems
+func (s *cacheServer) serveUpstreamStats(w http.ResponseWriter, r *http.Request) {
+	stats := []registryclient.Stats{}
+	if s.upstream != nil {
+		stats = append(stats, s.upstream.Stats())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.logger.Errorf("error encoding upstream stats: %v", err)
+	}
+}
+
+// serveQuarantine lists the upstream content quarantined after not matching
+// its digest
+func (s *cacheServer) serveQuarantine(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.handler.Quarantine()); err != nil {
+		s.logger.Errorf("error encoding quarantine: %v", err)
+	}
+}
+
+// serveQuotas reports the storage used per namespace with its quota
+func (s *cacheServer) serveQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.handler.Quotas()); err != nil {
+		s.logger.Errorf("error encoding quotas: %v", err)
+	}
+}
+
+// serveBlob reports the tracking entry of a blob, including the repositories
+// it was seen linked into
+func (s *cacheServer) serveBlob(w http.ResponseWriter, r *http.Request) {
+	dgst, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "invalid digest", http.StatusBadRequest)
+		return
+	}
+	meta, tracked := s.tracker.Blob(dgst)
+	if !tracked {
+		http.Error(w, "blob not tracked", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(meta); err != nil {
+		s.logger.Errorf("error encoding blob: %v", err)
+	}
+}
+
+// servePopularity reports the most and least read blobs and repositories
+// over the "window" query parameter, a week by default, and the bytes not
+// read since they were written. The optional "top" query parameter limits
+// the entries listed.
+func (s *cacheServer) servePopularity(w http.ResponseWriter, r *http.Request) {
+	window, top := 7*24*time.Hour, 10
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid window parameter", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top parameter", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	report, err := s.tracker.PopularityReport(window, top)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		s.logger.Errorf("error encoding popularity report: %v", err)
 	}
 }
 
@@ -271,7 +895,7 @@ func RunWithContext(ctx context.Context, opts *Options) error {
 	case err := <-errChan:
 		return err
 	case <-ctx.Done():
-		return server.Shutdown(30 * time.Second)
+		return server.Shutdown(drainTimeout(server.Config()))
 	}
 }
 
@@ -291,3 +915,497 @@ func ListenAndServe(cfg *config.Config) error {
 type Handler struct {
 	server CacheServer
 }
+
+// newCleanupLocker creates the locker electing the instance which runs
+// cleanup, or nil when leader election is disabled.
+func newCleanupLocker(cfg *config.Config, modes cache.FileModes) (cache.Locker, error) {
+	election := cfg.Cache.LeaderElection
+	leaseDuration := election.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = 2 * cfg.Cache.CleanupInterval
+	}
+
+	switch election.Type {
+	case "":
+		return nil, nil
+	case "file":
+		leaseFile := election.File
+		if leaseFile == "" {
+			leaseFile = filepath.Join(cfg.Storage.Directory, "meta", "cleanup.lease")
+		}
+		if err := os.MkdirAll(filepath.Dir(leaseFile), modes.Dir); err != nil {
+			return nil, err
+		}
+		lease, err := cache.NewFileLease(leaseFile, "", leaseDuration)
+		if err != nil {
+			return nil, err
+		}
+		lease.SetModes(modes)
+		return lease, nil
+	case "redis":
+		if election.Redis.Addr == "" {
+			return nil, fmt.Errorf("redis.addr is required")
+		}
+		client := redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:    []string{election.Redis.Addr},
+			Password: election.Redis.Password,
+			DB:       election.Redis.DB,
+		})
+		return cache.NewRedisLease(client, election.Redis.Key, "", leaseDuration)
+	}
+	return nil, fmt.Errorf("unknown type %q", election.Type)
+}
+
+// openStorageLocks opens the locks of the filesystem storage and warns if
+// another instance uses it. It returns nil for other storage types, or if
+// the file system does not support locks and storage.locking is off.
+func openStorageLocks(cfg *config.Config, modes cache.FileModes, logger *logrus.Logger) (*cache.FileLocks, error) {
+	storage := cfg.Storage
+	if storage.Type != "" && storage.Type != "filesystem" {
+		if storage.Locking {
+			return nil, fmt.Errorf("locking requires the filesystem storage")
+		}
+		return nil, nil
+	}
+	locks, err := cache.OpenFileLocks(filepath.Join(storage.Directory, "meta", "storage.lock"), modes)
+	if err != nil {
+		if storage.Locking {
+			return nil, err
+		}
+		logger.Warnf("cannot detect other instances using the storage: %v", err)
+		return nil, nil
+	}
+
+	pid, found, err := locks.OtherInstance()
+	switch {
+	case err != nil:
+		logger.Warnf("error detecting other instances using the storage: %v", err)
+	case found:
+		var missing []string
+		if !storage.Locking {
+			missing = append(missing, "storage.locking")
+		}
+		if cfg.Cache.LeaderElection.Type == "" {
+			missing = append(missing, "cache.leader_election")
+		}
+		hint := ""
+		if len(missing) > 0 {
+			hint = ", enable " + strings.Join(missing, " and ") + " to share it safely"
+		}
+		logger.Warnf("another instance (pid %d, possibly on another host) uses the storage directory %s%s", pid, storage.Directory, hint)
+	}
+	return locks, nil
+}
+
+// newStorageDriver creates the storage driver holding blobs, manifests and
+// upload sessions.
+func newStorageDriver(cfg *config.Config, modes cache.FileModes, logger *logrus.Logger) (storagedriver.StorageDriver, error) {
+	storage := cfg.Storage
+	if storage.Type == "inmemory" && cfg.Cache.MaxSize <= 0 {
+		// nothing bounds the memory use but the eviction of blobs
+		return nil, fmt.Errorf("inmemory storage requires cache.max_size")
+	}
+	hot, err := newDriver(storage.Type, storage.Directory, s3Parameters(storage.Type, storage.Parameters, storage.S3), modes)
+	if err != nil {
+		return nil, err
+	}
+	hot = withS3Retries(storage.Type, hot, storage.S3, logger)
+	if len(storage.Directories) > 0 {
+		if hot, err = newSpreadDriver(storage, hot, modes, logger); err != nil {
+			return nil, fmt.Errorf("directories: %w", err)
+		}
+	}
+	if storage.UploadDirectory != "" {
+		_ = os.MkdirAll(storage.UploadDirectory, modes.Dir)
+		hot = upload_driver.New(hot, filesystem.New(filesystem.DriverParameters{
+			RootDirectory: storage.UploadDirectory,
+			MaxThreads:    100,
+		}))
+	}
+
+	tier := storage.Tier
+	if tier.Cold.Type == "" {
+		return hot, nil
+	}
+	if tier.MaxSize <= 0 {
+		return nil, fmt.Errorf("tier requires max_size")
+	}
+	cold, err := newDriver(tier.Cold.Type, tier.Cold.Directory, s3Parameters(tier.Cold.Type, tier.Cold.Parameters, storage.S3), modes)
+	if err != nil {
+		return nil, fmt.Errorf("tier.cold: %w", err)
+	}
+	cold = withS3Retries(tier.Cold.Type, cold, storage.S3, logger)
+	tiered, err := tiered_driver.New(context.Background(), hot, cold, tier.MaxSize, logger)
+	if err != nil {
+		return nil, fmt.Errorf("tier: %w", err)
+	}
+	return tiered, nil
+}
+
+// newSpreadDriver spreads the blob data of the filesystem storage hot across
+// the configured directories. The storage directory keeps everything else
+// and holds blobs too if listed.
+func newSpreadDriver(storage config.StorageConfig, hot storagedriver.StorageDriver, modes cache.FileModes, logger *logrus.Logger) (storagedriver.StorageDriver, error) {
+	if storage.Type != "" && storage.Type != "filesystem" {
+		return nil, fmt.Errorf("spreading blobs requires the filesystem storage")
+	}
+	roots := make([]spread_driver.Root, 0, len(storage.Directories))
+	for _, dir := range storage.Directories {
+		dir = filepath.Clean(dir)
+		root := spread_driver.Root{Name: dir, Driver: hot}
+		if dir != filepath.Clean(storage.Directory) {
+			driver, err := newDriver("filesystem", dir, nil, modes)
+			if err != nil {
+				return nil, err
+			}
+			root.Driver = driver
+		}
+		roots = append(roots, root)
+	}
+	return spread_driver.New(context.Background(), hot, roots, logger)
+}
+
+// storageDirectories returns the directories of the filesystem storage, the
+// storage directory first
+func storageDirectories(storage config.StorageConfig) []string {
+	dirs := []string{filepath.Clean(storage.Directory)}
+	for _, dir := range storage.Directories {
+		if dir = filepath.Clean(dir); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// storageModes returns the permissions of the paths created on the local
+// file system, after setting the umask if configured
+func storageModes(storage config.StorageConfig) (cache.FileModes, error) {
+	modes := cache.DefaultFileModes
+	parse := func(key, value string, mode *os.FileMode) error {
+		if value == "" {
+			return nil
+		}
+		n, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || n > 0777 {
+			return fmt.Errorf("storage.%s: invalid mode %q, want octal permissions such as 0750", key, value)
+		}
+		*mode = os.FileMode(n)
+		return nil
+	}
+	if err := parse("dir_mode", storage.DirMode, &modes.Dir); err != nil {
+		return modes, err
+	}
+	if err := parse("file_mode", storage.FileMode, &modes.File); err != nil {
+		return modes, err
+	}
+	var umask os.FileMode
+	if err := parse("umask", storage.Umask, &umask); err != nil {
+		return modes, err
+	}
+	if storage.Umask != "" {
+		if err := setUmask(int(umask)); err != nil {
+			return modes, err
+		}
+	}
+	return modes, nil
+}
+
+// s3DriverType is the storage type of the S3 driver, tuned by storage.s3
+const s3DriverType = "s3aws"
+
+// s3Parameters adds the multipart and acceleration settings of s3 to the
+// parameters of an S3 driver. Parameters set explicitly take precedence.
+func s3Parameters(driverType string, parameters map[string]interface{}, s3 config.S3Config) map[string]interface{} {
+	if driverType != s3DriverType {
+		return parameters
+	}
+	tuned := make(map[string]interface{}, len(parameters)+5)
+	set := func(key string, value interface{}, ok bool) {
+		if ok {
+			tuned[key] = value
+		}
+	}
+	set("chunksize", s3.ChunkSize, s3.ChunkSize > 0)
+	set("multipartcopychunksize", s3.CopyChunkSize, s3.CopyChunkSize > 0)
+	set("multipartcopymaxconcurrency", s3.CopyConcurrency, s3.CopyConcurrency > 0)
+	set("multipartcopythresholdsize", s3.CopyThreshold, s3.CopyThreshold > 0)
+	set("accelerate", true, s3.Accelerate)
+	for key, value := range parameters {
+		tuned[key] = value
+	}
+	return tuned
+}
+
+// withS3Retries retries the failed operations of an S3 driver
+func withS3Retries(driverType string, driver storagedriver.StorageDriver, s3 config.S3Config, logger *logrus.Logger) storagedriver.StorageDriver {
+	if driverType != s3DriverType || s3.MaxRetries <= 0 {
+		return driver
+	}
+	return retry_driver.New(driver, retry_driver.Policy{
+		MaxRetries:  s3.MaxRetries,
+		Interval:    s3.RetryInterval,
+		MaxInterval: s3.MaxRetryInterval,
+	}, logger)
+}
+
+// newDriver creates a storage driver of the given type
+func newDriver(driverType, directory string, parameters map[string]interface{}, modes cache.FileModes) (storagedriver.StorageDriver, error) {
+	switch driverType {
+	case "inmemory":
+		return inmemory.New(), nil
+	case "", "filesystem":
+		repoDir := filepath.Join(directory, "data")
+		_ = os.MkdirAll(repoDir, modes.Dir)
+
+		return filesystem.New(filesystem.DriverParameters{
+			RootDirectory: repoDir,
+			MaxThreads:    100,
+		}), nil
+	}
+	return factory.Create(context.Background(), driverType, parameters)
+}
+
+// newAlertMonitor creates the monitor of the conditions posted to the alert
+// webhooks. Disk usage is that of cache.max_size if set, else of the file
+// system of the filesystem storage.
+func (s *cacheServer) newAlertMonitor() (*alert.Monitor, error) {
+	cfg := s.config.Alerts
+	alertConfig := alert.Config{
+		Interval:        cfg.Interval,
+		DiskUsage:       cfg.DiskUsage,
+		EvictionBacklog: cfg.EvictionBacklog,
+		UpstreamFailing: cfg.UpstreamFailing,
+	}
+	for _, webhook := range cfg.Webhooks {
+		alertConfig.Webhooks = append(alertConfig.Webhooks, alert.Webhook{URL: webhook.URL, Format: webhook.Format})
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		alertConfig.Instance = hostname
+	}
+
+	probes := alert.Probes{Backlog: s.tracker.CleanupBacklog}
+	if s.config.Cache.MaxSize > 0 {
+		probes.Usage = func(ctx context.Context) (int64, int64, error) {
+			size, maxSize := s.tracker.Usage()
+			return size, maxSize, nil
+		}
+	} else if storageType := s.config.Storage.Type; storageType == "" || storageType == "filesystem" {
+		probes.Usage = alert.FileSystem(s.config.Storage.Directory)
+	}
+	if s.upstream != nil {
+		probes.UpstreamFailingSince = func() time.Time {
+			if since := s.upstream.Stats().FailingSince; since != nil {
+				return *since
+			}
+			return time.Time{}
+		}
+	}
+	return alert.NewMonitor(alertConfig, probes, s.logger)
+}
+
+// newHealthChecker creates the checker of the storage backend and metadata
+// store reported by /readyz.
+func newHealthChecker(cfg *config.Config, driver storagedriver.StorageDriver, metaStore cache.MetaStore, logger *logrus.Logger) *health.Checker {
+	interval := cfg.Health.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	timeout := cfg.Health.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	checker := health.NewChecker(interval, timeout, logger)
+	if cfg.Replica.Enabled {
+		checker.Register("storage", health.StorageReadable(driver, "/"))
+	} else {
+		checker.Register("storage", health.StorageWritable(driver, "/docker-cache-server/health"))
+	}
+	checker.Register("metadata", metaStore.Ping)
+	if cfg.Health.MinFreeBytes > 0 && (cfg.Storage.Type == "" || cfg.Storage.Type == "filesystem") {
+		checker.Register("free_space", health.MinFreeSpace(cfg.Storage.Directory, cfg.Health.MinFreeBytes))
+	}
+	return checker
+}
+
+// newUpstreamClient creates the client of the registry content missing from
+// the cache is pulled from, or nil when pulling is disabled. Official images
+// of Docker Hub are pulled from the library namespace, so that clients can
+// use the cache as a mirror with names like "ubuntu".
+func newUpstreamClient(cfg config.UpstreamConfig) (*registryclient.Client, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	for _, patterns := range [][]string{cfg.Allow, cfg.Deny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	var httpClient *http.Client
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy_url %q", cfg.ProxyURL)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		httpClient = &http.Client{Transport: transport}
+	}
+	upstreamURL, err := url.Parse(cfg.URL)
+	if err != nil || upstreamURL.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", cfg.URL)
+	}
+	dockerHub := isDockerHub(upstreamURL.Hostname())
+	if dockerHub {
+		// docker.io only serves the website, the registry API is on its own host
+		upstreamURL.Host = dockerHubRegistryHost
+	}
+	client, err := registryclient.New(upstreamURL.String(), httpClient)
+	if err != nil {
+		return nil, err
+	}
+	client.Auth = &registryclient.Auth{
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+	if dockerHub {
+		client.DefaultNamespace = "library"
+	}
+	if cfg.MaxBandwidth > 0 {
+		client.Limiter = registryclient.NewLimiter(cfg.MaxBandwidth)
+	}
+
+	credentialHost := upstreamURL.Host
+	if dockerHub {
+		// docker stores the Docker Hub credentials under the index
+		credentialHost = "index.docker.io"
+	}
+	switch {
+	case cfg.CredentialHelper != "":
+		serverURL := credentialHost
+		if dockerHub {
+			serverURL = dockerHubIndexURL
+		}
+		client.Auth.Credentials = registryclient.CredentialHelper(cfg.CredentialHelper, serverURL)
+	case cfg.DockerConfig != "":
+		credentials, err := registryclient.DockerConfigCredentials(cfg.DockerConfig, credentialHost)
+		if err != nil {
+			return nil, fmt.Errorf("docker_config: %w", err)
+		}
+		client.Auth.Credentials = credentials
+	}
+	return client, nil
+}
+
+const (
+	// dockerHubRegistryHost is the host of the Docker Hub registry API
+	dockerHubRegistryHost = "registry-1.docker.io"
+
+	// dockerHubIndexURL is the server URL of the Docker Hub credentials
+	dockerHubIndexURL = "https://index.docker.io/v1/"
+)
+
+// isDockerHub reports whether host is one of the names Docker Hub is known by
+func isDockerHub(host string) bool {
+	switch host {
+	case "docker.io", "index.docker.io", dockerHubRegistryHost:
+		return true
+	}
+	return false
+}
+
+// newTrustPolicy loads the trusted public keys
+func newTrustPolicy(cfg config.TrustConfig) (*handlers.TrustPolicy, error) {
+	var keys [][]byte
+	for _, path := range cfg.PublicKeys {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, data)
+	}
+	return handlers.NewTrustPolicy(keys)
+}
+
+// newEncryptDriver wraps driver to encrypt the stored content when a key is
+// configured.
+func newEncryptDriver(cfg config.EncryptionConfig, driver storagedriver.StorageDriver) (storagedriver.StorageDriver, error) {
+	var encoded string
+	switch {
+	case cfg.Key != "":
+		encoded = cfg.Key
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	case len(cfg.KeyCommand) > 0:
+		cmd := exec.Command(cfg.KeyCommand[0], cfg.KeyCommand[1:]...)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running key command: %w", err)
+		}
+		encoded = string(output)
+	default:
+		return driver, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %w", err)
+	}
+	return encrypt_driver.New(driver, key)
+}
+
+// OpenMetaStore opens the store persisting the blob access metadata of a
+// server with the configuration cfg, for tools reading or migrating it.
+func OpenMetaStore(cfg *config.Config, logger *logrus.Logger) (cache.MetaStore, error) {
+	modes, err := storageModes(cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newMetaStore(cfg, modes, logger)
+	if err != nil {
+		return nil, fmt.Errorf("cache.metadata: %w", err)
+	}
+	return store, nil
+}
+
+// newMetaStore creates the store persisting blob access metadata.
+func newMetaStore(cfg *config.Config, modes cache.FileModes, logger *logrus.Logger) (cache.MetaStore, error) {
+	metadata := cfg.Cache.Metadata
+	if metadata.Type == "" && cfg.Storage.Type == "inmemory" {
+		metadata.Type = "memory"
+	}
+	switch metadata.Type {
+	case "memory":
+		return cache.MemoryMetaStore{}, nil
+	case "", "file":
+		dir := filepath.Join(cfg.Storage.Directory, "meta/cache")
+		if err := os.MkdirAll(dir, modes.Dir); err != nil {
+			return nil, err
+		}
+		store, err := cache.NewFileMetaStore(dir, logger)
+		if err != nil {
+			return nil, err
+		}
+		store.SetFsync(metadata.Fsync)
+		store.SetModes(modes)
+		return store, nil
+	case "redis":
+		if metadata.Redis.Addr == "" {
+			return nil, fmt.Errorf("redis.addr is required")
+		}
+		client := redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:    []string{metadata.Redis.Addr},
+			Password: metadata.Redis.Password,
+			DB:       metadata.Redis.DB,
+		})
+		return cache.NewRedisMetaStore(client, metadata.Redis.Prefix), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", metadata.Type)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jc-lab/docker-cache-server/pkg/cache"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+func TestNewMetaStoreDefault(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Storage.Directory = filepath.Join(t.TempDir(), "storage")
+
+	// inmemory storage needs no writable disk
+	cfg.Storage.Type = "inmemory"
+	store, err := newMetaStore(cfg, cache.DefaultFileModes, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating metadata store: %v", err)
+	}
+	if _, ok := store.(cache.MemoryMetaStore); !ok {
+		t.Fatalf("metadata store of inmemory storage is %T, want cache.MemoryMetaStore", store)
+	}
+	if _, err := os.Stat(cfg.Storage.Directory); !os.IsNotExist(err) {
+		t.Fatalf("storage directory created for inmemory storage: %v", err)
+	}
+
+	cfg.Storage.Type = "filesystem"
+	if store, err = newMetaStore(cfg, cache.DefaultFileModes, nil); err != nil {
+		t.Fatalf("unexpected error creating metadata store: %v", err)
+	}
+	if _, ok := store.(*cache.FileMetaStore); !ok {
+		t.Fatalf("metadata store of filesystem storage is %T, want *cache.FileMetaStore", store)
+	}
+
+	// an explicit type wins over the storage type
+	cfg.Storage.Type = "inmemory"
+	cfg.Cache.Metadata.Type = "file"
+	if store, err = newMetaStore(cfg, cache.DefaultFileModes, nil); err != nil {
+		t.Fatalf("unexpected error creating metadata store: %v", err)
+	}
+	if _, ok := store.(*cache.FileMetaStore); !ok {
+		t.Fatalf("metadata store of type file is %T, want *cache.FileMetaStore", store)
+	}
+}
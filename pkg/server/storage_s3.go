@@ -0,0 +1,7 @@
+//go:build s3
+
+package server
+
+// The S3 driver pulls in the AWS SDK, so it is only registered when building
+// with the s3 build tag. Select it with storage.type "s3aws".
+import _ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-cache-server/pkg/config"
+)
+
+// validateTenants checks that the tenants have distinct names and
+// namespaces, each a single component of repository names
+func validateTenants(tenants []config.TenantConfig) error {
+	names := make(map[string]bool)
+	namespaces := make(map[string]bool)
+	for i, tenant := range tenants {
+		if tenant.Name == "" {
+			return fmt.Errorf("tenants[%d]: name must be set", i)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenants[%d]: duplicate name %q", i, tenant.Name)
+		}
+		names[tenant.Name] = true
+
+		namespace := tenant.NamespaceName()
+		if _, err := reference.WithName(namespace); err != nil || strings.Contains(namespace, "/") {
+			return fmt.Errorf("tenants[%d]: invalid namespace %q", i, namespace)
+		}
+		if namespaces[namespace] {
+			return fmt.Errorf("tenants[%d]: namespace %q belongs to another tenant", i, namespace)
+		}
+		namespaces[namespace] = true
+
+		if tenant.TTL < 0 {
+			return fmt.Errorf("tenants[%d]: ttl must not be negative", i)
+		}
+		if tenant.Quota < 0 {
+			return fmt.Errorf("tenants[%d]: quota must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// tenantTTLs returns the TTLs of the namespaces of the tenants setting one
+func tenantTTLs(tenants []config.TenantConfig) map[string]time.Duration {
+	ttls := make(map[string]time.Duration)
+	for _, tenant := range tenants {
+		if tenant.TTL > 0 {
+			ttls[tenant.NamespaceName()] = tenant.TTL
+		}
+	}
+	return ttls
+}
+
+// quotaLimits returns the quotas of the namespaces of the quota section of
+// cfg if enabled and of its tenants, nil if there are none
+func quotaLimits(cfg *config.Config) (map[string]int64, error) {
+	var limits map[string]int64
+	if cfg.Quota.Enabled {
+		limits = maps.Clone(cfg.Quota.Namespaces)
+	}
+	for i, tenant := range cfg.Tenants {
+		if tenant.Quota == 0 {
+			continue
+		}
+		namespace := tenant.NamespaceName()
+		if _, ok := limits[namespace]; ok {
+			return nil, fmt.Errorf("tenants[%d]: quota of namespace %q is also set in quota.namespaces", i, namespace)
+		}
+		if limits == nil {
+			limits = make(map[string]int64)
+		}
+		limits[namespace] = tenant.Quota
+	}
+	return limits, nil
+}
+
+// tenantSummary is a tenant as listed by serveTenants
+type tenantSummary struct {
+	Name         string    `json:"name"`
+	Namespace    string    `json:"namespace"`
+	Users        int       `json:"users"`
+	TTL          string    `json:"ttl"`
+	Repositories int       `json:"repositories"`
+	Blobs        int       `json:"blobs"`
+	Pinned       int       `json:"pinned,omitempty"`
+	Size         int64     `json:"size"`
+	LastAccessed time.Time `json:"last_accessed"`
+	// Usage and Quota are those of the quotas if enabled, see serveQuotas
+	Usage int64 `json:"usage,omitempty"`
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// serveTenants lists the tenants with the number and size of the tracked
+// blobs linked into their namespace, their last access and their quota
+// usage. A blob shared by several repositories of a namespace counts once.
+func (s *cacheServer) serveTenants(w http.ResponseWriter, r *http.Request) {
+	list := make([]*tenantSummary, 0, len(s.config.Tenants))
+	tenants := make(map[string]*tenantSummary)
+	for _, tenant := range s.config.Tenants {
+		summary := &tenantSummary{
+			Name:      tenant.Name,
+			Namespace: tenant.NamespaceName(),
+			Users:     len(tenant.Users),
+		}
+		ttl := tenant.TTL
+		if ttl == 0 {
+			ttl = s.config.Cache.TTL
+		}
+		summary.TTL = ttl.String()
+		list = append(list, summary)
+		tenants[summary.Namespace] = summary
+	}
+
+	repositories := make(map[string]bool)
+	for _, meta := range s.tracker.Blobs() {
+		counted := make(map[*tenantSummary]bool)
+		for _, name := range meta.Repositories {
+			namespace, _, _ := strings.Cut(name, "/")
+			tenant := tenants[namespace]
+			if tenant == nil {
+				continue
+			}
+			if !repositories[name] {
+				repositories[name] = true
+				tenant.Repositories++
+			}
+			if counted[tenant] {
+				continue
+			}
+			counted[tenant] = true
+			tenant.Blobs++
+			tenant.Size += meta.Size
+			if meta.Pinned {
+				tenant.Pinned++
+			}
+			if meta.LastAccessed.After(tenant.LastAccessed) {
+				tenant.LastAccessed = meta.LastAccessed
+			}
+		}
+	}
+	for _, usage := range s.handler.Quotas() {
+		if tenant := tenants[usage.Namespace]; tenant != nil {
+			tenant.Usage = usage.Usage
+			tenant.Quota = usage.Limit
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		s.logger.Errorf("error encoding tenants: %v", err)
+	}
+}
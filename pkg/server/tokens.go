@@ -0,0 +1,17 @@
+package server
+
+import (
+	"net/http"
+)
+
+// withTokenEndpoint serves the session token endpoint at path by tokens and
+// the other requests by handler
+func withTokenEndpoint(handler http.Handler, path string, tokens http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			tokens.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import "fmt"
+
+func setUmask(mask int) error {
+	return fmt.Errorf("storage.umask: setting the umask is not supported on this platform")
+}
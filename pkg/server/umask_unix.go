@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import "syscall"
+
+// setUmask sets the umask of the process
+func setUmask(mask int) error {
+	syscall.Umask(mask)
+	return nil
+}
@@ -0,0 +1,104 @@
+package shard
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultReplicas is the number of virtual nodes placed on the ring per node.
+const DefaultReplicas = 128
+
+// Ring partitions keys between nodes by consistent hashing, so that adding
+// or removing a node only moves the keys owned by that node.
+type Ring struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+// NewRing places every node on the ring replicas times. A replicas value of
+// zero or less selects DefaultReplicas.
+func NewRing(nodes []string, replicas int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("ring requires at least one node")
+	}
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{
+		nodes: make(map[uint32]string, len(nodes)*replicas),
+	}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+			if _, exists := r.nodes[hash]; exists {
+				// collisions are rare, the first node keeps the point
+				continue
+			}
+			r.nodes[hash] = node
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+
+	return r, nil
+}
+
+// Get returns the node owning key.
+func (r *Ring) Get(key string) string {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// Router assigns blobs to nodes by digest. It implements the blob router of
+// the registry handlers.
+type Router struct {
+	ring *Ring
+	self string
+}
+
+// NewRouter creates a router for the node reachable at self, which must be
+// one of nodes. Node URLs are compared without trailing slashes.
+func NewRouter(self string, nodes []string, replicas int) (*Router, error) {
+	self = strings.TrimSuffix(self, "/")
+	normalized := make([]string, 0, len(nodes))
+	found := false
+	for _, node := range nodes {
+		node = strings.TrimSuffix(node, "/")
+		if node == self {
+			found = true
+		}
+		normalized = append(normalized, node)
+	}
+	if !found {
+		return nil, fmt.Errorf("self %q is not one of the nodes", self)
+	}
+
+	ring, err := NewRing(normalized, replicas)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{
+		ring: ring,
+		self: self,
+	}, nil
+}
+
+// Owner returns the base URL of the node owning dgst, or an empty string when
+// this node owns it.
+func (r *Router) Owner(dgst digest.Digest) string {
+	owner := r.ring.Get(dgst.String())
+	if owner == r.self {
+		return ""
+	}
+	return owner
+}
@@ -0,0 +1,73 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRingDistribution(t *testing.T) {
+	nodes := []string{"http://cache-0:5000", "http://cache-1:5000", "http://cache-2:5000"}
+	ring, err := NewRing(nodes, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating ring: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[ring.Get(digest.FromString(fmt.Sprint(i)).String())]++
+	}
+	for _, node := range nodes {
+		// perfectly even would be 1000 each
+		if counts[node] < 500 {
+			t.Fatalf("node %s owns too few keys: %v", node, counts)
+		}
+	}
+}
+
+func TestRingStability(t *testing.T) {
+	before, err := NewRing([]string{"a", "b", "c"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating ring: %v", err)
+	}
+	after, err := NewRing([]string{"a", "b", "c", "d"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating ring: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := digest.FromString(fmt.Sprint(i)).String()
+		// adding a node only moves keys to the new node
+		if owner := after.Get(key); owner != "d" && owner != before.Get(key) {
+			t.Fatalf("key %s moved from %s to %s", key, before.Get(key), owner)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	nodes := []string{"http://cache-0:5000/", "http://cache-1:5000"}
+	if _, err := NewRouter("http://cache-2:5000", nodes, 0); err == nil {
+		t.Fatal("expected error for self outside of nodes")
+	}
+
+	router, err := NewRouter("http://cache-0:5000", nodes, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating router: %v", err)
+	}
+
+	local, remote := 0, 0
+	for i := 0; i < 100; i++ {
+		switch owner := router.Owner(digest.FromString(fmt.Sprint(i))); owner {
+		case "":
+			local++
+		case "http://cache-1:5000":
+			remote++
+		default:
+			t.Fatalf("unexpected owner %q", owner)
+		}
+	}
+	if local == 0 || remote == 0 {
+		t.Fatalf("expected blobs on both nodes: local=%d remote=%d", local, remote)
+	}
+}
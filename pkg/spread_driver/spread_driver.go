@@ -0,0 +1,393 @@
+package spread_driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+	"github.com/jc-lab/docker-cache-server/internal/driverutil"
+	"github.com/sirupsen/logrus"
+)
+
+// blobsRoot holds the blob data spread across the roots
+const blobsRoot = "/docker/registry/v2/blobs"
+
+// mapPath is the lookup map of the digest prefixes to the roots, on the
+// primary driver
+const mapPath = "/docker-cache-server/spread.json"
+
+// stagingDir holds files copied between the roots until they are complete
+const stagingDir = "/docker-cache-server/staging"
+
+// prefixes is the number of two hex digit digest prefixes
+const prefixes = 256
+
+// Root is a storage the blob data is spread on, e.g. a local disk
+type Root struct {
+	// Name identifies the root in the lookup map, e.g. its directory
+	Name   string
+	Driver driver.StorageDriver
+}
+
+// Driver spreads blob data across several roots, e.g. local disks, by the
+// first two hex digits of their digest, so a cache can span disks without
+// RAID or LVM. Everything else, such as links, manifests and upload
+// sessions, stays on the primary driver, which may also be one of the roots.
+//
+// The prefixes are assigned to the roots in a lookup map persisted on the
+// primary driver. When roots are added or removed, prefixes are reassigned
+// for new blobs to be spread evenly again; blobs already stored are not
+// moved and are still found on the root they were written to.
+type Driver struct {
+	driver.StorageDriver
+	roots  []Root
+	logger *logrus.Logger
+
+	// lookup is the index of the root of every prefix
+	lookup [prefixes]int
+}
+
+// lookupMap is the persisted lookup map, the names of the roots by prefix
+type lookupMap struct {
+	Prefixes map[string]string `json:"prefixes"`
+}
+
+// New creates a driver spreading blob data across roots, loading the lookup
+// map from primary and updating it if the roots changed.
+func New(ctx context.Context, primary driver.StorageDriver, roots []Root, logger *logrus.Logger) (*Driver, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("spreading requires at least one root")
+	}
+	names := make([]string, len(roots))
+	for i, root := range roots {
+		for _, name := range names[:i] {
+			if name == root.Name {
+				return nil, fmt.Errorf("duplicate root %s", root.Name)
+			}
+		}
+		names[i] = root.Name
+	}
+
+	var previous lookupMap
+	content, err := primary.GetContent(ctx, mapPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(content, &previous); err != nil {
+			return nil, fmt.Errorf("reading lookup map: %w", err)
+		}
+	case !isNotFound(err):
+		return nil, fmt.Errorf("reading lookup map: %w", err)
+	}
+
+	d := &Driver{
+		StorageDriver: primary,
+		roots:         roots,
+		logger:        logger,
+	}
+	current, moved := assign(previous.Prefixes, names)
+	for i := range d.lookup {
+		d.lookup[i] = indexOf(names, current[prefixKey(i)])
+	}
+	if moved > 0 {
+		if previous.Prefixes != nil {
+			logger.Infof("roots changed, %d of %d digest prefixes reassigned to spread new blobs evenly", moved, prefixes)
+		}
+		content, err := json.Marshal(lookupMap{Prefixes: current})
+		if err != nil {
+			return nil, err
+		}
+		if err := primary.PutContent(ctx, mapPath, content); err != nil {
+			return nil, fmt.Errorf("writing lookup map: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// assign returns the lookup map of names keeping the prefixes of previous
+// on the roots still present, moving the fewest to balance the roots, and
+// the number of prefixes assigned anew
+func assign(previous map[string]string, names []string) (map[string]string, int) {
+	// at most maxCount prefixes per root, ceil(prefixes / roots)
+	maxCount := (prefixes + len(names) - 1) / len(names)
+	counts := make(map[string]int, len(names))
+	current := make(map[string]string, prefixes)
+	var unassigned []string
+	for i := 0; i < prefixes; i++ {
+		key := prefixKey(i)
+		name, ok := previous[key]
+		if ok && indexOf(names, name) >= 0 && counts[name] < maxCount {
+			current[key] = name
+			counts[name]++
+		} else {
+			unassigned = append(unassigned, key)
+		}
+	}
+	for _, key := range unassigned {
+		least := names[0]
+		for _, name := range names[1:] {
+			if counts[name] < counts[least] {
+				least = name
+			}
+		}
+		current[key] = least
+		counts[least]++
+	}
+	return current, len(unassigned)
+}
+
+// Name returns the driver name
+func (d *Driver) Name() string {
+	return d.StorageDriver.Name()
+}
+
+// driversFor returns the drivers which may hold path, the one new files are
+// written to first. Blob paths below a digest prefix are held by the roots,
+// the root of the prefix first. The directories above them, e.g. blobs/ or
+// /, are merged from the primary driver and the roots. Other paths are held
+// by the primary driver alone.
+func (d *Driver) driversFor(p string) []driver.StorageDriver {
+	p = path.Clean(p)
+	if rel, ok := strings.CutPrefix(p, blobsRoot+"/"); ok {
+		// <algorithm>/<first two hex digits>/...
+		if parts := strings.SplitN(rel, "/", 3); len(parts) >= 2 {
+			if prefix, ok := parsePrefix(parts[1]); ok {
+				return d.withFirst(d.roots[d.lookup[prefix]].Driver)
+			}
+		}
+		return d.merged()
+	}
+	if p == blobsRoot || p == "/" || strings.HasPrefix(blobsRoot, p+"/") {
+		return d.merged()
+	}
+	return []driver.StorageDriver{d.StorageDriver}
+}
+
+// withFirst returns the drivers of the roots, first first
+func (d *Driver) withFirst(first driver.StorageDriver) []driver.StorageDriver {
+	drivers := []driver.StorageDriver{first}
+	for _, root := range d.roots {
+		if root.Driver != first {
+			drivers = append(drivers, root.Driver)
+		}
+	}
+	return drivers
+}
+
+// merged returns the primary driver and the drivers of the roots
+func (d *Driver) merged() []driver.StorageDriver {
+	return d.withFirst(d.StorageDriver)
+}
+
+// holder returns the driver holding the file or directory at path
+func (d *Driver) holder(ctx context.Context, path string) (driver.StorageDriver, error) {
+	drivers := d.driversFor(path)
+	if len(drivers) == 1 {
+		return drivers[0], nil
+	}
+	var firstErr error
+	for _, drv := range drivers {
+		_, err := drv.Stat(ctx, path)
+		if err == nil {
+			return drv, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// GetContent reads from the driver holding path
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	drv, err := d.holder(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return drv.GetContent(ctx, path)
+}
+
+// PutContent writes to the root of the digest prefix of blob paths, or to
+// the primary driver
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	return d.driversFor(path)[0].PutContent(ctx, path, content)
+}
+
+// Reader reads from the driver holding path
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	drv, err := d.holder(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return drv.Reader(ctx, path, offset)
+}
+
+// Writer writes new files to the root of the digest prefix of blob paths,
+// or to the primary driver, and appends to the driver holding path
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	if append {
+		if drv, err := d.holder(ctx, path); err == nil {
+			return drv.Writer(ctx, path, append)
+		}
+	}
+	return d.driversFor(path)[0].Writer(ctx, path, append)
+}
+
+// Stat stats on the driver holding path
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	var firstErr error
+	for _, drv := range d.driversFor(path) {
+		fi, err := drv.Stat(ctx, path)
+		if err == nil || !isNotFound(err) {
+			return fi, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// List merges the children of path on the drivers which may hold it
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	var children []string
+	var firstErr error
+	found := false
+	seen := make(map[string]bool)
+	for _, drv := range d.driversFor(path) {
+		list, err := drv.List(ctx, path)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, child := range list {
+			if !seen[child] {
+				seen[child] = true
+				children = append(children, child)
+			}
+		}
+	}
+	if !found {
+		return nil, firstErr
+	}
+	return children, nil
+}
+
+// Move moves within a driver, or copies between them, e.g. completed
+// uploads from the primary driver to the root of their digest prefix
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source, err := d.holder(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	dest := d.driversFor(destPath)[0]
+	if source == dest {
+		return source.Move(ctx, sourcePath, destPath)
+	}
+
+	// copy aside first, readers must not see a partial file
+	staging := path.Join(stagingDir, uuid.NewString())
+	if err := driverutil.CopyFile(ctx, source, dest, sourcePath, staging); err != nil {
+		dest.Delete(ctx, staging)
+		return err
+	}
+	if err := dest.Move(ctx, staging, destPath); err != nil {
+		dest.Delete(ctx, staging)
+		return err
+	}
+	// copies left on other roots by an earlier prefix assignment
+	for _, drv := range d.driversFor(destPath)[1:] {
+		if drv != source {
+			if err := drv.Delete(ctx, destPath); err != nil && !isNotFound(err) {
+				d.logger.Warnf("failed to delete stale copy of %s: %v", destPath, err)
+			}
+		}
+	}
+	return source.Delete(ctx, sourcePath)
+}
+
+// Delete deletes path from every driver which may hold it
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	var firstErr error
+	found := false
+	for _, drv := range d.driversFor(path) {
+		err := drv.Delete(ctx, path)
+		if err == nil {
+			found = true
+			continue
+		}
+		if !isNotFound(err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if !found {
+		return firstErr
+	}
+	return nil
+}
+
+// RedirectURL redirects to the driver holding path
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	drv, err := d.holder(r.Context(), path)
+	if err != nil {
+		return "", err
+	}
+	return drv.RedirectURL(r, path)
+}
+
+// Walk traverses the merged drivers. Paths held by the primary driver alone
+// are walked by it.
+func (d *Driver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	if drivers := d.driversFor(path); len(drivers) == 1 {
+		return drivers[0].Walk(ctx, path, f, options...)
+	}
+	return driver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// parsePrefix parses the two hex digit directory of the blobs of a prefix
+func parsePrefix(s string) (int, bool) {
+	if len(s) != 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 16, 8)
+	return int(n), err == nil
+}
+
+func prefixKey(i int) string {
+	return fmt.Sprintf("%02x", i)
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, new(driver.PathNotFoundError))
+}
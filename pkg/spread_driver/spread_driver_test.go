@@ -0,0 +1,143 @@
+package spread_driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func blobPath(dgst digest.Digest) string {
+	return fmt.Sprintf("%s/%s/%s/%s/data", blobsRoot, dgst.Algorithm(), dgst.Encoded()[:2], dgst.Encoded())
+}
+
+func put(t *testing.T, d driver.StorageDriver, path string, content []byte) {
+	t.Helper()
+	if err := d.PutContent(context.Background(), path, content); err != nil {
+		t.Fatalf("unexpected error writing %s: %v", path, err)
+	}
+}
+
+func TestBlobsSpread(t *testing.T) {
+	ctx := context.Background()
+	primary := inmemory.New()
+	disks := []driver.StorageDriver{inmemory.New(), inmemory.New()}
+	d, err := New(ctx, primary, []Root{{Name: "a", Driver: disks[0]}, {Name: "b", Driver: disks[1]}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	counts := make([]int, len(disks))
+	var blobs []string
+	for i := 0; i < 100; i++ {
+		p := blobPath(digest.FromString(fmt.Sprint(i)))
+		put(t, d, p, []byte("blob"))
+		blobs = append(blobs, p)
+		for j, disk := range disks {
+			if _, err := disk.Stat(ctx, p); err == nil {
+				counts[j]++
+			}
+		}
+	}
+	if counts[0]+counts[1] != 100 || counts[0] < 25 || counts[1] < 25 {
+		t.Errorf("unexpected spread of 100 blobs: %v", counts)
+	}
+	put(t, d, "/docker/registry/v2/repositories/foo/_layers/link", []byte("link"))
+	if _, err := primary.Stat(ctx, "/docker/registry/v2/repositories/foo/_layers/link"); err != nil {
+		t.Errorf("expected links on the primary driver: %v", err)
+	}
+
+	// the directories above the prefixes are merged
+	prefixDirs, err := d.List(ctx, blobsRoot+"/sha256")
+	if err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, p := range blobs {
+		seen[p[:len(blobsRoot+"/sha256/00")]] = true
+	}
+	if len(prefixDirs) != len(seen) {
+		t.Errorf("listed %d prefix directories, want %d", len(prefixDirs), len(seen))
+	}
+	var walked int
+	err = d.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() && fi.Path() != mapPath {
+			walked++
+		}
+		return nil
+	})
+	if err != nil || walked != 101 {
+		t.Errorf("walked %d files, want 101: %v", walked, err)
+	}
+
+	// blobs are found after a root is added and prefixes reassigned
+	disks = append(disks, inmemory.New())
+	d, err = New(ctx, primary, []Root{{Name: "a", Driver: disks[0]}, {Name: "b", Driver: disks[1]}, {Name: "c", Driver: disks[2]}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	for _, p := range blobs {
+		if content, err := d.GetContent(ctx, p); err != nil || string(content) != "blob" {
+			t.Fatalf("unexpected content of %s: %q, %v", p, content, err)
+		}
+	}
+	if err := d.Delete(ctx, blobs[0]); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if _, err := d.Stat(ctx, blobs[0]); !isNotFound(err) {
+		t.Errorf("expected deleted blob not found, got %v", err)
+	}
+}
+
+func TestMoveUploadToRoot(t *testing.T) {
+	ctx := context.Background()
+	primary := inmemory.New()
+	disk := inmemory.New()
+	d, err := New(ctx, primary, []Root{{Name: "primary", Driver: primary}, {Name: "disk", Driver: disk}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		upload := fmt.Sprintf("/docker/registry/v2/repositories/foo/_uploads/%d/data", i)
+		dest := blobPath(digest.FromString(fmt.Sprint(i)))
+		put(t, d, upload, []byte("layer"))
+		if err := d.Move(ctx, upload, dest); err != nil {
+			t.Fatalf("unexpected error moving: %v", err)
+		}
+		if _, err := d.Stat(ctx, upload); !isNotFound(err) {
+			t.Errorf("expected upload moved, got %v", err)
+		}
+		if content, err := d.GetContent(ctx, dest); err != nil || string(content) != "layer" {
+			t.Errorf("unexpected content of %s: %q, %v", dest, content, err)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	first, moved := assign(nil, []string{"a", "b"})
+	if moved != prefixes {
+		t.Errorf("assigned %d prefixes, want %d", moved, prefixes)
+	}
+	second, moved := assign(first, []string{"a", "b", "c"})
+	// a third of the prefixes move to the new root
+	if moved != 84 {
+		t.Errorf("reassigned %d prefixes, want 84", moved)
+	}
+	counts := make(map[string]int)
+	for key, name := range second {
+		counts[name]++
+		if name != "c" && first[key] != name {
+			t.Errorf("prefix %s moved from %s to %s", key, first[key], name)
+		}
+	}
+	if counts["a"] < 84 || counts["b"] < 84 || counts["c"] < 84 {
+		t.Errorf("unbalanced roots: %v", counts)
+	}
+	if _, moved := assign(second, []string{"a", "b", "c"}); moved != 0 {
+		t.Errorf("reassigned %d prefixes of unchanged roots", moved)
+	}
+}
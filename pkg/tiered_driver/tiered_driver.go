@@ -0,0 +1,386 @@
+package tiered_driver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+	"github.com/jc-lab/docker-cache-server/internal/driverutil"
+	"github.com/sirupsen/logrus"
+)
+
+// blobsRoot holds the blob data files moved between the tiers
+const blobsRoot = "/docker/registry/v2/blobs"
+
+// promoteDir holds promoted blobs on the hot tier until they are complete
+const promoteDir = "/docker-cache-server/promote"
+
+// Driver stores blob data on a small hot tier, e.g. a local SSD, and a large
+// cold tier, e.g. object storage. Everything else, such as links and upload
+// sessions, stays on the hot tier.
+//
+// Blobs are written to the hot tier. When it exceeds its maximum size the
+// least recently read blobs are demoted to the cold tier. Blobs read from
+// the cold tier are promoted back in the background; the cold copy is kept,
+// so demoting them again only removes the hot copy.
+type Driver struct {
+	driver.StorageDriver
+	cold    driver.StorageDriver
+	maxSize int64
+	logger  *logrus.Logger
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	promoting sync.Map
+	demoting  atomic.Bool
+}
+
+// hotBlob is a blob data file on the hot tier
+type hotBlob struct {
+	path string
+	size int64
+}
+
+// New creates a tiered storage driver keeping at most maxSize bytes of blob
+// data on hot. The blobs already on hot are scanned to restore their order,
+// oldest modification first.
+func New(ctx context.Context, hot, cold driver.StorageDriver, maxSize int64, logger *logrus.Logger) (*Driver, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	d := &Driver{
+		StorageDriver: hot,
+		cold:          cold,
+		maxSize:       maxSize,
+		logger:        logger,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+
+	var blobs []driver.FileInfo
+	err := hot.Walk(ctx, blobsRoot, func(fi driver.FileInfo) error {
+		if !fi.IsDir() && isBlobData(fi.Path()) {
+			blobs = append(blobs, fi)
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return nil, fmt.Errorf("scanning hot tier: %w", err)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+	for _, fi := range blobs {
+		d.track(fi.Path(), fi.Size())
+	}
+	logger.Infof("hot tier holds %d blobs, %d of %d bytes", len(blobs), d.size, maxSize)
+
+	return d, nil
+}
+
+// Name returns the driver name
+func (d *Driver) Name() string {
+	return "tiered"
+}
+
+// GetContent reads from the hot tier, falling back to the cold tier
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if !isBlobData(path) {
+		return content, err
+	}
+	if err == nil {
+		d.touch(path)
+		return content, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	content, err = d.cold.GetContent(ctx, path)
+	if err == nil {
+		d.promote(path)
+	}
+	return content, err
+}
+
+// PutContent writes to the hot tier
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	if isBlobData(path) {
+		d.track(path, int64(len(content)))
+		d.demote()
+	}
+	return nil
+}
+
+// Reader reads from the hot tier, falling back to the cold tier
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	reader, err := d.StorageDriver.Reader(ctx, path, offset)
+	if !isBlobData(path) {
+		return reader, err
+	}
+	if err == nil {
+		d.touch(path)
+		return reader, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	reader, err = d.cold.Reader(ctx, path, offset)
+	if err == nil {
+		d.promote(path)
+	}
+	return reader, err
+}
+
+// Stat stats on the hot tier, falling back to the cold tier
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err == nil || !isNotFound(err) {
+		return fi, err
+	}
+	return d.cold.Stat(ctx, path)
+}
+
+// List merges the children of path on both tiers
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	hot, hotErr := d.StorageDriver.List(ctx, path)
+	if hotErr != nil && !isNotFound(hotErr) {
+		return nil, hotErr
+	}
+	if !strings.HasPrefix(path, blobsRoot) {
+		return hot, hotErr
+	}
+	cold, coldErr := d.cold.List(ctx, path)
+	if coldErr != nil && !isNotFound(coldErr) {
+		return nil, coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return nil, hotErr
+	}
+
+	seen := make(map[string]bool, len(hot))
+	for _, child := range hot {
+		seen[child] = true
+	}
+	for _, child := range cold {
+		if !seen[child] {
+			hot = append(hot, child)
+		}
+	}
+	return hot, nil
+}
+
+// Move moves on the hot tier, or on the cold tier for paths only held there
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	err := d.StorageDriver.Move(ctx, sourcePath, destPath)
+	if err != nil && isNotFound(err) && strings.HasPrefix(sourcePath, blobsRoot) {
+		return d.cold.Move(ctx, sourcePath, destPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.untrack(sourcePath)
+	if isBlobData(destPath) {
+		if fi, err := d.StorageDriver.Stat(ctx, destPath); err == nil {
+			d.track(destPath, fi.Size())
+			d.demote()
+		}
+	}
+	return nil
+}
+
+// Delete deletes from both tiers
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	hotErr := d.StorageDriver.Delete(ctx, path)
+	if hotErr != nil && !isNotFound(hotErr) {
+		return hotErr
+	}
+	d.untrack(path)
+
+	if !strings.HasPrefix(path, blobsRoot) && !strings.HasPrefix(blobsRoot, path) {
+		return hotErr
+	}
+	coldErr := d.cold.Delete(ctx, path)
+	if coldErr != nil && !isNotFound(coldErr) {
+		return coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return hotErr
+	}
+	return nil
+}
+
+// RedirectURL redirects to the tier holding path
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if isBlobData(path) {
+		if _, err := d.StorageDriver.Stat(r.Context(), path); isNotFound(err) {
+			d.promote(path)
+			return d.cold.RedirectURL(r, path)
+		}
+	}
+	return d.StorageDriver.RedirectURL(r, path)
+}
+
+// Walk traverses the merged tiers
+func (d *Driver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	return driver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// track records a blob written to the hot tier as most recently used
+func (d *Driver) track(path string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, exists := d.entries[path]; exists {
+		blob := e.Value.(*hotBlob)
+		d.size += size - blob.size
+		blob.size = size
+		d.lru.MoveToFront(e)
+		return
+	}
+	d.entries[path] = d.lru.PushFront(&hotBlob{path: path, size: size})
+	d.size += size
+}
+
+// touch marks a blob on the hot tier as most recently used
+func (d *Driver) touch(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, exists := d.entries[path]; exists {
+		d.lru.MoveToFront(e)
+	}
+}
+
+// untrack forgets the blobs at or below path
+func (d *Driver) untrack(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for p, e := range d.entries {
+		if p == path || strings.HasPrefix(p, strings.TrimSuffix(path, "/")+"/") {
+			d.size -= e.Value.(*hotBlob).size
+			d.lru.Remove(e)
+			delete(d.entries, p)
+		}
+	}
+}
+
+// demote starts moving the least recently used blobs to the cold tier in the
+// background while the hot tier exceeds its maximum size
+func (d *Driver) demote() {
+	d.mu.Lock()
+	over := d.size > d.maxSize
+	d.mu.Unlock()
+	if !over || !d.demoting.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer d.demoting.Store(false)
+		ctx := context.Background()
+
+		for {
+			d.mu.Lock()
+			e := d.lru.Back()
+			if d.size <= d.maxSize || e == nil {
+				d.mu.Unlock()
+				return
+			}
+			blob := *e.Value.(*hotBlob)
+			d.mu.Unlock()
+
+			if err := d.demoteBlob(ctx, blob); err != nil {
+				d.logger.Errorf("failed to demote %s to cold tier: %v", blob.path, err)
+				return
+			}
+			d.untrack(blob.path)
+		}
+	}()
+}
+
+// demoteBlob copies a blob to the cold tier, unless it is already there, and
+// removes it from the hot tier
+func (d *Driver) demoteBlob(ctx context.Context, blob hotBlob) error {
+	fi, err := d.cold.Stat(ctx, blob.path)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err != nil || fi.Size() != blob.size {
+		if err := driverutil.CopyFile(ctx, d.StorageDriver, d.cold, blob.path, blob.path); err != nil {
+			return err
+		}
+	}
+	d.logger.Debugf("demoted %s to cold tier", blob.path)
+	return d.StorageDriver.Delete(ctx, blob.path)
+}
+
+// promote copies a blob read from the cold tier to the hot tier in the
+// background
+func (d *Driver) promote(blobPath string) {
+	if _, loaded := d.promoting.LoadOrStore(blobPath, true); loaded {
+		return
+	}
+
+	go func() {
+		defer d.promoting.Delete(blobPath)
+		ctx := context.Background()
+
+		fi, err := d.cold.Stat(ctx, blobPath)
+		if err != nil {
+			d.logger.Errorf("failed to promote %s to hot tier: %v", blobPath, err)
+			return
+		}
+		if fi.Size() > d.maxSize {
+			return
+		}
+
+		// copy aside first, readers must not see a partial blob
+		staging := path.Join(promoteDir, uuid.NewString())
+		if err := driverutil.CopyFile(ctx, d.cold, d.StorageDriver, blobPath, staging); err != nil {
+			d.logger.Errorf("failed to promote %s to hot tier: %v", blobPath, err)
+			d.StorageDriver.Delete(ctx, staging)
+			return
+		}
+		if err := d.StorageDriver.Move(ctx, staging, blobPath); err != nil {
+			d.logger.Errorf("failed to promote %s to hot tier: %v", blobPath, err)
+			d.StorageDriver.Delete(ctx, staging)
+			return
+		}
+		d.logger.Debugf("promoted %s to hot tier", blobPath)
+
+		d.track(blobPath, fi.Size())
+		d.demote()
+	}()
+}
+
+// isBlobData reports whether path is the data file of a blob, e.g.
+// /docker/registry/v2/blobs/sha256/ab/abc.../data
+func isBlobData(path string) bool {
+	parts := strings.Split(path, "/")
+	n := len(parts)
+	return n >= 5 && parts[n-1] == "data" && parts[n-5] == "blobs"
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, new(driver.PathNotFoundError))
+}
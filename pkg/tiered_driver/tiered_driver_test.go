@@ -0,0 +1,131 @@
+package tiered_driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func newTestDriver(t *testing.T, maxSize int64) (*Driver, *inmemory.Driver, *inmemory.Driver) {
+	t.Helper()
+	hot := inmemory.New()
+	cold := inmemory.New()
+	d, err := New(context.Background(), hot, cold, maxSize, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	return d, hot, cold
+}
+
+func blobPath(i int) string {
+	return fmt.Sprintf("%s/sha256/%02d/%02d/data", blobsRoot, i, i)
+}
+
+// exists reports whether path is held by d
+func exists(d driver.StorageDriver, path string) bool {
+	_, err := d.Stat(context.Background(), path)
+	return err == nil
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDemoteAndPromote(t *testing.T) {
+	ctx := context.Background()
+	d, hot, cold := newTestDriver(t, 250)
+	content := bytes.Repeat([]byte{1}, 100)
+
+	for i := 0; i < 3; i++ {
+		if err := d.PutContent(ctx, blobPath(i), content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "demotion of the oldest blob", func() bool {
+		return !exists(hot, blobPath(0)) && exists(cold, blobPath(0))
+	})
+	if !exists(hot, blobPath(1)) || !exists(hot, blobPath(2)) {
+		t.Fatal("expected recent blobs to stay on the hot tier")
+	}
+
+	fi, err := d.Stat(ctx, blobPath(0))
+	if err != nil {
+		t.Fatalf("unexpected error stating demoted blob: %v", err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), fi.Size())
+	}
+
+	got, err := d.GetContent(ctx, blobPath(0))
+	if err != nil {
+		t.Fatalf("unexpected error reading demoted blob: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("unexpected content")
+	}
+	waitFor(t, "promotion of the read blob", func() bool {
+		return exists(hot, blobPath(0)) && !exists(hot, blobPath(1))
+	})
+	if !exists(cold, blobPath(0)) {
+		t.Fatal("expected cold copy of promoted blob to be kept")
+	}
+}
+
+func TestNonBlobsStayOnHotTier(t *testing.T) {
+	ctx := context.Background()
+	d, hot, cold := newTestDriver(t, 10)
+
+	link := "/docker/registry/v2/repositories/foo/_layers/sha256/00/link"
+	if err := d.PutContent(ctx, link, bytes.Repeat([]byte{1}, 100)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !exists(hot, link) || exists(cold, link) {
+		t.Fatal("expected link to stay on the hot tier")
+	}
+}
+
+func TestDeleteRemovesBothTiers(t *testing.T) {
+	ctx := context.Background()
+	d, hot, cold := newTestDriver(t, 150)
+	content := bytes.Repeat([]byte{1}, 100)
+
+	for i := 0; i < 2; i++ {
+		if err := d.PutContent(ctx, blobPath(i), content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "demotion of the oldest blob", func() bool {
+		return !exists(hot, blobPath(0)) && exists(cold, blobPath(0))
+	})
+
+	children, err := d.List(ctx, blobsRoot+"/sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("expected blobs of both tiers to be listed, got %v", children)
+	}
+
+	if err := d.Delete(ctx, blobsRoot+"/sha256"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if exists(hot, blobPath(i)) || exists(cold, blobPath(i)) {
+			t.Fatalf("expected blob %d to be deleted from both tiers", i)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package upload_driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+	"github.com/jc-lab/docker-cache-server/internal/driverutil"
+)
+
+// stagingDir holds files moved between the volumes until they are complete
+const stagingDir = "/docker-cache-server/staging"
+
+// Driver keeps upload sessions, the _uploads directories of the
+// repositories, on a separate volume, e.g. a fast scratch disk, so large
+// pushes do not thrash the volume holding the blobs. Everything else is
+// stored on the embedded driver.
+//
+// Completed uploads are moved into the blob store by copying them to a
+// staging file next to their destination and renaming it, so a blob never
+// appears partially written.
+type Driver struct {
+	driver.StorageDriver
+	uploads driver.StorageDriver
+}
+
+// New creates a driver storing upload sessions on uploads and everything
+// else on base.
+func New(base, uploads driver.StorageDriver) *Driver {
+	return &Driver{
+		StorageDriver: base,
+		uploads:       uploads,
+	}
+}
+
+// Name returns the driver name
+func (d *Driver) Name() string {
+	return d.StorageDriver.Name()
+}
+
+// driverFor returns the driver holding path
+func (d *Driver) driverFor(path string) driver.StorageDriver {
+	if isUploadPath(path) {
+		return d.uploads
+	}
+	return d.StorageDriver
+}
+
+// GetContent reads from the driver holding path
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	return d.driverFor(path).GetContent(ctx, path)
+}
+
+// PutContent writes to the driver holding path
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	return d.driverFor(path).PutContent(ctx, path, content)
+}
+
+// Reader reads from the driver holding path
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return d.driverFor(path).Reader(ctx, path, offset)
+}
+
+// Writer writes to the driver holding path
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	return d.driverFor(path).Writer(ctx, path, append)
+}
+
+// Stat stats on the driver holding path. Directories only holding upload
+// sessions, such as a repository being pushed for the first time, are
+// found on the uploads volume.
+func (d *Driver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	if isUploadPath(path) {
+		return d.uploads.Stat(ctx, path)
+	}
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err == nil || !isNotFound(err) {
+		return fi, err
+	}
+	if fi, err := d.uploads.Stat(ctx, path); err == nil && fi.IsDir() {
+		return fi, nil
+	}
+	return nil, err
+}
+
+// List merges the children of path on both volumes
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	if isUploadPath(path) {
+		return d.uploads.List(ctx, path)
+	}
+	children, baseErr := d.StorageDriver.List(ctx, path)
+	if baseErr != nil && !isNotFound(baseErr) {
+		return nil, baseErr
+	}
+	uploads, uploadsErr := d.uploads.List(ctx, path)
+	if uploadsErr != nil && !isNotFound(uploadsErr) {
+		return nil, uploadsErr
+	}
+	if baseErr != nil && uploadsErr != nil {
+		return nil, baseErr
+	}
+
+	seen := make(map[string]bool, len(children))
+	for _, child := range children {
+		seen[child] = true
+	}
+	for _, child := range uploads {
+		if !seen[child] {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+// Move moves within a volume, or copies between them for completed uploads
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source := d.driverFor(sourcePath)
+	dest := d.driverFor(destPath)
+	if source == dest {
+		return source.Move(ctx, sourcePath, destPath)
+	}
+
+	// copy aside first, readers must not see a partial file
+	staging := path.Join(stagingDir, uuid.NewString())
+	if err := driverutil.CopyFile(ctx, source, dest, sourcePath, staging); err != nil {
+		dest.Delete(ctx, staging)
+		return err
+	}
+	if err := dest.Move(ctx, staging, destPath); err != nil {
+		dest.Delete(ctx, staging)
+		return err
+	}
+	return source.Delete(ctx, sourcePath)
+}
+
+// Delete deletes from the driver holding path, or from both volumes for
+// directories which may contain upload sessions
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	if isUploadPath(path) {
+		return d.uploads.Delete(ctx, path)
+	}
+	baseErr := d.StorageDriver.Delete(ctx, path)
+	if baseErr != nil && !isNotFound(baseErr) {
+		return baseErr
+	}
+	uploadsErr := d.uploads.Delete(ctx, path)
+	if uploadsErr != nil && !isNotFound(uploadsErr) {
+		return uploadsErr
+	}
+	if baseErr != nil && uploadsErr != nil {
+		return baseErr
+	}
+	return nil
+}
+
+// RedirectURL redirects to the driver holding path
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return d.driverFor(path).RedirectURL(r, path)
+}
+
+// Walk traverses the merged volumes. Paths without upload sessions are
+// walked by the base driver alone.
+func (d *Driver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	if isUploadPath(path) {
+		return d.uploads.Walk(ctx, path, f, options...)
+	}
+	if _, err := d.uploads.Stat(ctx, path); isNotFound(err) {
+		return d.StorageDriver.Walk(ctx, path, f, options...)
+	}
+	return driver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// isUploadPath reports whether path is at or below the upload sessions of a
+// repository, e.g. /docker/registry/v2/repositories/foo/_uploads/<uuid>/data
+func isUploadPath(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if part == "_uploads" {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, new(driver.PathNotFoundError))
+}
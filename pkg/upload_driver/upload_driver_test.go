@@ -0,0 +1,93 @@
+package upload_driver
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+const (
+	repoPath   = "/docker/registry/v2/repositories/foo"
+	uploadPath = repoPath + "/_uploads/1234/data"
+	blobPath   = "/docker/registry/v2/blobs/sha256/ab/abcdef/data"
+)
+
+func TestUploadsStoredSeparately(t *testing.T) {
+	ctx := context.Background()
+	base := inmemory.New()
+	uploads := inmemory.New()
+	d := New(base, uploads)
+	content := []byte("layer")
+
+	w, err := d.Writer(ctx, uploadPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.Stat(ctx, uploadPath); err == nil {
+		t.Fatal("expected upload not to be stored on the base driver")
+	}
+	if _, err := uploads.Stat(ctx, uploadPath); err != nil {
+		t.Fatalf("expected upload on the uploads driver: %v", err)
+	}
+
+	children, err := d.List(ctx, repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0] != repoPath+"/_uploads" {
+		t.Fatalf("expected uploads to be listed, got %v", children)
+	}
+
+	if err := d.Move(ctx, uploadPath, blobPath); err != nil {
+		t.Fatalf("unexpected error moving upload: %v", err)
+	}
+	got, err := base.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatalf("expected blob on the base driver: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("unexpected content")
+	}
+	if _, err := uploads.Stat(ctx, uploadPath); err == nil {
+		t.Fatal("expected upload to be removed")
+	}
+	if children, _ := base.List(ctx, stagingDir); len(children) > 0 {
+		t.Fatalf("expected no staging files left, got %v", children)
+	}
+}
+
+func TestDeleteRepository(t *testing.T) {
+	ctx := context.Background()
+	base := inmemory.New()
+	uploads := inmemory.New()
+	d := New(base, uploads)
+
+	link := repoPath + "/_layers/sha256/abcdef/link"
+	if err := d.PutContent(ctx, link, []byte("sha256:abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, uploadPath, []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Delete(ctx, repoPath); err != nil {
+		t.Fatalf("unexpected error deleting repository: %v", err)
+	}
+	if _, err := base.Stat(ctx, link); err == nil {
+		t.Fatal("expected link to be deleted")
+	}
+	if _, err := uploads.Stat(ctx, uploadPath); err == nil {
+		t.Fatal("expected upload to be deleted")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package usage
+
+import "io/fs"
+
+// diskUsage returns the size of a file, the allocated space being unknown
+func diskUsage(info fs.FileInfo) int64 {
+	return info.Size()
+}
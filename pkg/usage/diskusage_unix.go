@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package usage
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// diskUsage returns the space allocated to a file on disk
+func diskUsage(info fs.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,198 @@
+// Package usage periodically measures the storage actually used by the
+// cache, the space taken on disk or the objects of a bucket, independently
+// of the sizes tracked for LRU eviction, and reports it as metrics.
+package usage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+	"github.com/jc-lab/docker-cache-server/pkg/dcsmetrics"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	namespace = metrics.NewNamespace(dcsmetrics.NamespacePrefix, "storage", nil)
+
+	usedBytes      = namespace.NewGauge("usage", "Storage used by the cache, measured on disk or in the bucket", metrics.Bytes)
+	objects        = namespace.NewGauge("objects", "Files or bucket objects in the storage", "")
+	sampleDuration = namespace.NewGauge("usage_sample_duration", "Time the last storage usage measure took", metrics.Seconds)
+)
+
+func init() {
+	metrics.Register(namespace)
+}
+
+// Usage is a measure of the storage
+type Usage struct {
+	Bytes    int64         `json:"bytes"`
+	Objects  int64         `json:"objects"`
+	Sampled  time.Time     `json:"sampled"`
+	Duration time.Duration `json:"duration"`
+}
+
+// MeasureFunc measures the bytes and objects used in a storage.
+type MeasureFunc func(ctx context.Context) (bytes, objects int64, err error)
+
+// Directory measures the space taken on disk by the files below dirs, which
+// accounts for sparse files and filesystem blocks, unlike file sizes.
+func Directory(dirs ...string) MeasureFunc {
+	return func(ctx context.Context) (int64, int64, error) {
+		var bytes, objects int64
+		for _, dir := range dirs {
+			b, o, err := measureDirectory(ctx, dir)
+			bytes += b
+			objects += o
+			if err != nil {
+				return bytes, objects, err
+			}
+		}
+		return bytes, objects, nil
+	}
+}
+
+// measureDirectory measures the space taken on disk by the files below dir
+func measureDirectory(ctx context.Context, dir string) (int64, int64, error) {
+	var bytes, objects int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// removed while walking, e.g. by an eviction
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		bytes += diskUsage(info)
+		objects++
+		return nil
+	})
+	return bytes, objects, err
+}
+
+// Driver measures the size and number of the files of a storage driver, e.g.
+// the objects of a bucket.
+func Driver(driver storagedriver.StorageDriver) MeasureFunc {
+	return func(ctx context.Context) (int64, int64, error) {
+		var bytes, objects int64
+		err := driver.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				bytes += fi.Size()
+				objects++
+			}
+			return nil
+		})
+		if errors.As(err, new(storagedriver.PathNotFoundError)) {
+			// nothing stored yet
+			return 0, 0, nil
+		}
+		return bytes, objects, err
+	}
+}
+
+// Sampler measures the storage usage at a fixed interval and keeps the
+// latest measure.
+type Sampler struct {
+	interval time.Duration
+	measure  MeasureFunc
+	logger   *logrus.Logger
+
+	mu   sync.RWMutex
+	last Usage
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSampler creates a sampler running measure every interval.
+func NewSampler(interval time.Duration, measure MeasureFunc, logger *logrus.Logger) *Sampler {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Sampler{
+		interval: interval,
+		measure:  measure,
+		logger:   logger,
+	}
+}
+
+// Start measures the usage immediately and then every interval until ctx is
+// done or Stop is called.
+func (s *Sampler) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.sample(ctx)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.sample(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops sampling, interrupting a measure in progress, and waits for it
+// to return.
+func (s *Sampler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *Sampler) sample(ctx context.Context) {
+	start := time.Now()
+	bytes, n, err := s.measure(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.Errorf("error measuring storage usage: %v", err)
+		}
+		return
+	}
+	u := Usage{Bytes: bytes, Objects: n, Sampled: start, Duration: time.Since(start)}
+	usedBytes.Set(float64(u.Bytes))
+	objects.Set(float64(u.Objects))
+	sampleDuration.Set(u.Duration.Seconds())
+
+	s.mu.Lock()
+	s.last = u
+	s.mu.Unlock()
+	s.logger.Debugf("storage usage: %d bytes in %d objects, measured in %v", u.Bytes, u.Objects, u.Duration)
+}
+
+// Last returns the latest measure, and false until the first one completes.
+func (s *Sampler) Last() (Usage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last, !s.last.Sampled.IsZero()
+}
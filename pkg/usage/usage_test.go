@@ -0,0 +1,81 @@
+package usage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "a/two", "a/b/three"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("x", 10000)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bytes, objects, err := Directory(dir)(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 3 {
+		t.Errorf("objects = %d, want 3", objects)
+	}
+	// allocated in whole blocks
+	if bytes < 30000 {
+		t.Errorf("bytes = %d, want at least 30000", bytes)
+	}
+
+	if _, _, err := Directory(filepath.Join(dir, "missing"))(context.Background()); err != nil {
+		t.Errorf("measuring a missing directory: %v", err)
+	}
+}
+
+func TestDriver(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+
+	bytes, objects, err := Driver(driver)(ctx)
+	if err != nil || bytes != 0 || objects != 0 {
+		t.Fatalf("empty storage = %d bytes, %d objects, %v", bytes, objects, err)
+	}
+
+	driver.PutContent(ctx, "/docker/registry/v2/blobs/one", []byte("12345"))
+	driver.PutContent(ctx, "/docker/registry/v2/repositories/a/link", []byte("123"))
+	bytes, objects, err = Driver(driver)(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 8 || objects != 2 {
+		t.Errorf("got %d bytes in %d objects, want 8 bytes in 2 objects", bytes, objects)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	s := NewSampler(10*time.Millisecond, func(ctx context.Context) (int64, int64, error) {
+		calls <- struct{}{}
+		return 42, 2, nil
+	}, nil)
+	if _, ok := s.Last(); ok {
+		t.Fatal("measure reported before sampling")
+	}
+
+	s.Start(context.Background())
+	<-calls
+	<-calls
+	s.Stop()
+
+	u, ok := s.Last()
+	if !ok || u.Bytes != 42 || u.Objects != 2 {
+		t.Errorf("Last() = %+v, %v", u, ok)
+	}
+}